@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// WhatsApp sends separate offer, accept and terminate events for each call.
+// Calls are kept in memory from the offer until they end, so the
+// CallTerminate webhook can tell whether the call was missed and how long it
+// lasted. Calls still ringing when wuzapi restarts are reported as missed.
+//
+// Each user has a call policy applied to incoming calls: only notify (the
+// default), reject the call, or reject it and send a text reply to the
+// caller. Every call is recorded in the call log.
+
+const (
+	callPolicyNotify      = "notify"
+	callPolicyReject      = "reject"
+	callPolicyRejectReply = "reject_reply"
+
+	callActionNone     = "none"
+	callActionRejected = "rejected"
+	callActionReplied  = "replied"
+
+	callStateRinging  = "ringing"
+	callStateAnswered = "answered"
+	callStateMissed   = "missed"
+	callStateRejected = "rejected"
+
+	maxCallReplyLength = 4096
+)
+
+var (
+	callcache       = cache.New(time.Hour, 10*time.Minute)
+	callpolicycache = cache.New(5*time.Minute, 10*time.Minute)
+)
+
+type trackedCall struct {
+	Media      string
+	IsGroup    bool
+	Rejected   bool
+	OfferedAt  time.Time
+	AcceptedAt time.Time
+}
+
+type CallPolicy struct {
+	UserId    string `db:"user_id"`
+	Mode      string `db:"mode"`
+	ReplyText string `db:"reply_text"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+const callPolicyColumns = "user_id, mode, reply_text, updated_at"
+
+func (p CallPolicy) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"mode":       p.Mode,
+		"reply_text": p.ReplyText,
+		"updated_at": p.UpdatedAt,
+	}
+}
+
+func (p CallPolicy) validate() error {
+	switch p.Mode {
+	case callPolicyNotify, callPolicyReject:
+	case callPolicyRejectReply:
+		if p.ReplyText == "" {
+			return errors.New("reply_text is required with the reject_reply mode")
+		}
+	default:
+		return fmt.Errorf("invalid call policy mode: %s (allowed: notify, reject, reject_reply)", p.Mode)
+	}
+	if len(p.ReplyText) > maxCallReplyLength {
+		return fmt.Errorf("reply_text cannot be longer than %d bytes", maxCallReplyLength)
+	}
+	return nil
+}
+
+// One call as kept in the call log
+type CallLogEntry struct {
+	Id        string `db:"id" json:"id"`
+	UserId    string `db:"user_id" json:"-"`
+	CallId    string `db:"call_id" json:"call_id"`
+	Caller    string `db:"caller" json:"caller"`
+	Media     string `db:"media" json:"media"`
+	IsGroup   bool   `db:"is_group" json:"is_group"`
+	Action    string `db:"action" json:"action"`
+	State     string `db:"state" json:"state"`
+	Reason    string `db:"reason" json:"reason"`
+	Duration  int64  `db:"duration" json:"duration"`
+	Error     string `db:"error" json:"error"`
+	OfferedAt int64  `db:"offered_at" json:"offered_at"`
+	EndedAt   int64  `db:"ended_at" json:"ended_at"`
+}
+
+const callLogColumns = "id, user_id, call_id, caller, media, is_group, action, state, reason, duration, error, offered_at, ended_at"
+
+// Returns the call policy of a user, notify when none is set
+func getCallPolicy(db *sqlx.DB, userID string) CallPolicy {
+	if cached, found := callpolicycache.Get(userID); found {
+		return cached.(CallPolicy)
+	}
+	policy := CallPolicy{UserId: userID, Mode: callPolicyNotify}
+	err := db.Get(&policy, "SELECT "+callPolicyColumns+" FROM call_policies WHERE user_id=$1", userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load call policy")
+		return policy
+	}
+	callpolicycache.Set(userID, policy, cache.DefaultExpiration)
+	return policy
+}
+
+func deleteUserCalls(db sqlx.Ext, userID string) error {
+	if _, err := db.Exec("DELETE FROM call_policies WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM call_log WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	callpolicycache.Delete(userID)
+	return nil
+}
+
+func callCacheKey(userID string, callID string) string {
+	return userID + ":" + callID
+}
+
+// Returns the media of a call offer, audio unless the offer has a video
+// element, and whether it is a group call
+func callOfferDetails(data *waBinary.Node) (string, bool) {
+	if data == nil {
+		return "audio", false
+	}
+	media := "audio"
+	if _, ok := data.GetOptionalChildByTag("video"); ok {
+		media = "video"
+	}
+	_, isGroup := data.Attrs["group-jid"]
+	return media, isGroup
+}
+
+// Applies the call policy to an incoming call and records it in the call
+// log. Group calls are only recorded, they cannot be rejected for the other
+// participants. Returns the action taken.
+func (mycli *MyClient) handleCallOffer(meta types.BasicCallMeta, media string, isGroup bool) string {
+	call := &trackedCall{Media: media, IsGroup: isGroup, OfferedAt: callTime(meta)}
+	callcache.Set(callCacheKey(mycli.userID, meta.CallID), call, cache.DefaultExpiration)
+
+	action := callActionNone
+	state := callStateRinging
+	errText := ""
+	policy := getCallPolicy(mycli.db, mycli.userID)
+	if policy.Mode != callPolicyNotify && !isGroup {
+		if err := mycli.WAClient.RejectCall(meta.From, meta.CallID); err != nil {
+			log.Error().Err(err).Str("userid", mycli.userID).Str("callid", meta.CallID).Msg("Could not reject call")
+			errText = err.Error()
+		} else {
+			action = callActionRejected
+			state = callStateRejected
+			call.Rejected = true
+			if policy.Mode == callPolicyRejectReply {
+				action = callActionReplied
+				go mycli.sendCallReply(meta, policy.ReplyText)
+			}
+		}
+	}
+
+	id, err := GenerateRandomID()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not generate call log id")
+		return action
+	}
+	_, err = mycli.db.Exec("INSERT INTO call_log ("+callLogColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+		id, mycli.userID, meta.CallID, meta.From.ToNonAD().String(), media, boolToFlag(isGroup), action, state, "", 0, errText, call.OfferedAt.Unix(), 0)
+	if err != nil {
+		log.Error().Err(err).Str("userid", mycli.userID).Msg("Could not save call to call log")
+	}
+	return action
+}
+
+func (mycli *MyClient) sendCallReply(meta types.BasicCallMeta, text string) {
+	msg := &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{Text: proto.String(text)}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := mycli.WAClient.SendMessage(ctx, meta.From.ToNonAD(), msg, whatsmeow.SendRequestExtra{})
+	if err != nil {
+		log.Error().Err(err).Str("userid", mycli.userID).Str("callid", meta.CallID).Msg("Could not send call reply")
+		_, err = mycli.db.Exec("UPDATE call_log SET error=$1 WHERE user_id=$2 AND call_id=$3", "could not send reply: "+err.Error(), mycli.userID, meta.CallID)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not update call log")
+		}
+		return
+	}
+	log.Info().Str("userid", mycli.userID).Str("to", meta.From.ToNonAD().String()).Msg("Sent call reply")
+}
+
+func trackCallAccept(db *sqlx.DB, userID string, meta types.BasicCallMeta) {
+	if cached, found := callcache.Get(callCacheKey(userID, meta.CallID)); found {
+		cached.(*trackedCall).AcceptedAt = callTime(meta)
+	}
+	_, err := db.Exec("UPDATE call_log SET state=$1 WHERE user_id=$2 AND call_id=$3", callStateAnswered, userID, meta.CallID)
+	if err != nil {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not update call log")
+	}
+}
+
+// Forgets a call that ended and records how it ended in the call log.
+// Returns the state and duration, missed when the offer was not seen.
+func finishCall(db *sqlx.DB, userID string, meta types.BasicCallMeta, state string, reason string) (*trackedCall, string, int64) {
+	var duration int64
+	key := callCacheKey(userID, meta.CallID)
+	cached, found := callcache.Get(key)
+	var call *trackedCall
+	if found {
+		callcache.Delete(key)
+		call = cached.(*trackedCall)
+		switch {
+		case call.Rejected:
+			state = callStateRejected
+		case !call.AcceptedAt.IsZero():
+			state = callStateAnswered
+			duration = int64(callTime(meta).Sub(call.AcceptedAt).Seconds())
+		}
+	}
+
+	_, err := db.Exec("UPDATE call_log SET state=$1, reason=$2, duration=$3, ended_at=$4 WHERE user_id=$5 AND call_id=$6",
+		state, reason, duration, callTime(meta).Unix(), userID, meta.CallID)
+	if err != nil {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not update call log")
+	}
+	return call, state, duration
+}
+
+func callTime(meta types.BasicCallMeta) time.Time {
+	if meta.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return meta.Timestamp
+}
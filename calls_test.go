@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestCallOfferDetails(t *testing.T) {
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	tests := []struct {
+		name    string
+		data    *waBinary.Node
+		media   string
+		isGroup bool
+	}{
+		{"no data", nil, "audio", false},
+		{"audio", &waBinary.Node{Tag: "offer", Content: []waBinary.Node{{Tag: "audio"}}}, "audio", false},
+		{"video", &waBinary.Node{Tag: "offer", Content: []waBinary.Node{{Tag: "audio"}, {Tag: "video"}}}, "video", false},
+		{"group", &waBinary.Node{Tag: "offer", Attrs: waBinary.Attrs{"group-jid": group}, Content: []waBinary.Node{{Tag: "audio"}}}, "audio", true},
+	}
+	for _, tt := range tests {
+		media, isGroup := callOfferDetails(tt.data)
+		if media != tt.media || isGroup != tt.isGroup {
+			t.Errorf("%s: callOfferDetails = %s, %v, want %s, %v", tt.name, media, isGroup, tt.media, tt.isGroup)
+		}
+	}
+}
+
+func TestFinishCall(t *testing.T) {
+	db := newTestDB(t)
+	caller := types.NewJID("5491155554444", types.DefaultUserServer)
+	offered := time.Unix(1767225600, 0)
+	meta := func(callID string, ts time.Time) types.BasicCallMeta {
+		return types.BasicCallMeta{From: caller, CallID: callID, Timestamp: ts}
+	}
+	offer := func(userID string, callID string, call *trackedCall) {
+		callcache.Set(callCacheKey(userID, callID), call, 0)
+		_, err := db.Exec("INSERT INTO call_log ("+callLogColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+			userID+callID, userID, callID, caller.String(), call.Media, boolToFlag(call.IsGroup), callActionNone, callStateRinging, "", 0, "", offered.Unix(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logged := func(userID string, callID string) CallLogEntry {
+		var entry CallLogEntry
+		if err := db.Get(&entry, "SELECT "+callLogColumns+" FROM call_log WHERE user_id=$1 AND call_id=$2", userID, callID); err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+	defer callcache.Flush()
+
+	offer("u1", "answered", &trackedCall{Media: "video", OfferedAt: offered})
+	trackCallAccept(db, "u1", meta("answered", offered.Add(5*time.Second)))
+	if entry := logged("u1", "answered"); entry.State != callStateAnswered {
+		t.Errorf("accepted call is %s in the call log", entry.State)
+	}
+	call, state, duration := finishCall(db, "u1", meta("answered", offered.Add(65*time.Second)), callStateMissed, "")
+	if call == nil || call.Media != "video" || state != callStateAnswered || duration != 60 {
+		t.Fatalf("answered call = %+v, %s, %d", call, state, duration)
+	}
+	if entry := logged("u1", "answered"); entry.State != callStateAnswered || entry.Duration != 60 || entry.EndedAt != offered.Add(65*time.Second).Unix() {
+		t.Errorf("answered call log = %+v", entry)
+	}
+	if again, _, _ := finishCall(db, "u1", meta("answered", offered), callStateMissed, ""); again != nil {
+		t.Errorf("call is kept after it finished: %+v", again)
+	}
+
+	offer("u1", "missed", &trackedCall{Media: "audio", IsGroup: true, OfferedAt: offered})
+	call, state, duration = finishCall(db, "u1", meta("missed", offered.Add(time.Minute)), callStateMissed, "timeout")
+	if call == nil || !call.IsGroup || state != callStateMissed || duration != 0 {
+		t.Errorf("missed call = %+v, %s, %d", call, state, duration)
+	}
+	if entry := logged("u1", "missed"); entry.State != callStateMissed || entry.Reason != "timeout" {
+		t.Errorf("missed call log = %+v", entry)
+	}
+
+	offer("u1", "rejected", &trackedCall{Media: "audio", Rejected: true, OfferedAt: offered})
+	if _, state, _ := finishCall(db, "u1", meta("rejected", offered.Add(time.Second)), callStateMissed, ""); state != callStateRejected {
+		t.Errorf("rejected call state = %s", state)
+	}
+
+	// Calls are tracked per user, calls whose offer was not seen keep the
+	// state they ended with
+	offer("u1", "other", &trackedCall{Media: "audio", OfferedAt: offered})
+	if call, state, _ := finishCall(db, "u2", meta("other", offered), callStateMissed, ""); call != nil || state != callStateMissed {
+		t.Errorf("call of another user = %+v, %s", call, state)
+	}
+	if entry := logged("u1", "other"); entry.State != callStateRinging {
+		t.Errorf("call of another user was updated: %+v", entry)
+	}
+}
+
+func TestCallPolicyValidate(t *testing.T) {
+	valid := []CallPolicy{
+		{Mode: callPolicyNotify},
+		{Mode: callPolicyReject},
+		{Mode: callPolicyRejectReply, ReplyText: "I will call you back"},
+	}
+	for _, policy := range valid {
+		if err := policy.validate(); err != nil {
+			t.Errorf("validate(%+v) error = %v", policy, err)
+		}
+	}
+	invalid := []CallPolicy{
+		{Mode: ""},
+		{Mode: "block"},
+		{Mode: callPolicyRejectReply},
+		{Mode: callPolicyReject, ReplyText: string(make([]byte, maxCallReplyLength+1))},
+	}
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Errorf("validate(%s, %d bytes of reply) should fail", policy.Mode, len(policy.ReplyText))
+		}
+	}
+}
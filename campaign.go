@@ -0,0 +1,371 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// A campaign sends one message template to a list of recipients. Every
+// {{variable}} in the text fields of the template is replaced with the
+// value given for each recipient, and each recipient becomes a send job of
+// the campaign, so campaigns are sent by the send queue within its limits
+// and each message is reported with a SendJob event. The status of each
+// recipient is the status of its job, moved on to delivered, read and
+// played by the receipts of the message.
+//
+// Pausing a campaign holds its queued jobs in the queue, cancelling it
+// cancels them. A campaign is finished when none of its jobs are left.
+
+const (
+	campaignRunning   = "running"
+	campaignPaused    = "paused"
+	campaignFinished  = "finished"
+	campaignCancelled = "cancelled"
+
+	maxCampaignRecipients = 50000
+)
+
+var (
+	campaignVariablePattern = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+	campaignStatuses        = []string{campaignRunning, campaignPaused, campaignFinished, campaignCancelled}
+	// Status of a recipient, in the order they are reported
+	campaignRecipientStatuses = []string{sendJobQueued, sendJobSending, sendJobSent, messageStateDelivered, messageStateRead, messageStatePlayed, sendJobFailed, sendJobCancelled}
+)
+
+// Status of a recipient, from its job and the receipts of the message
+const campaignRecipientStatus = "CASE WHEN j.status='" + sendJobSent + "' AND sm.state IS NOT NULL THEN sm.state ELSE j.status END"
+
+type Campaign struct {
+	Id         string          `db:"id" json:"id"`
+	UserId     string          `db:"user_id" json:"-"`
+	Name       string          `db:"name" json:"name"`
+	Action     string          `db:"action" json:"action"`
+	Template   string          `db:"template" json:"-"`
+	Message    json.RawMessage `db:"-" json:"message"`
+	Status     string          `db:"status" json:"status"`
+	Total      int             `db:"total" json:"total"`
+	SendAt     int64           `db:"send_at" json:"send_at"`
+	CreatedAt  int64           `db:"created_at" json:"created_at"`
+	UpdatedAt  int64           `db:"updated_at" json:"updated_at"`
+	FinishedAt int64           `db:"finished_at" json:"finished_at"`
+	Progress   map[string]int  `db:"-" json:"progress"`
+}
+
+const campaignColumns = "id, user_id, name, action, template, status, total, send_at, created_at, updated_at, finished_at"
+
+// A recipient of a campaign with the values of the template variables
+type CampaignRecipient struct {
+	Phone     string            `json:"phone"`
+	Variables map[string]string `json:"variables"`
+}
+
+// Returns the names of the variables used in the strings of a template
+func campaignVariables(value interface{}, names map[string]bool) {
+	switch v := value.(type) {
+	case string:
+		for _, match := range campaignVariablePattern.FindAllStringSubmatch(v, -1) {
+			names[match[1]] = true
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			campaignVariables(item, names)
+		}
+	case []interface{}:
+		for _, item := range v {
+			campaignVariables(item, names)
+		}
+	}
+}
+
+// Returns a copy of a template with the variables replaced
+func renderCampaignTemplate(value interface{}, variables map[string]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return campaignVariablePattern.ReplaceAllStringFunc(v, func(match string) string {
+			return variables[campaignVariablePattern.FindStringSubmatch(match)[1]]
+		})
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			rendered[key] = renderCampaignTemplate(item, variables)
+		}
+		return rendered
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered[i] = renderCampaignTemplate(item, variables)
+		}
+		return rendered
+	}
+	return value
+}
+
+// Builds a campaign and the send jobs of its recipients. Recipients that
+// repeat an earlier one are left out. A zero sendAt sends it right away.
+func newCampaign(userID string, name string, msgtype string, message map[string]interface{}, recipients []CampaignRecipient, sendAt time.Time) (*Campaign, []*SendJob, error) {
+	msgtype = strings.ToLower(msgtype)
+	if msgtype == "" {
+		return nil, nil, errors.New("Missing type in Payload")
+	}
+	if !Find(scheduleTypes, msgtype) {
+		return nil, nil, fmt.Errorf("Invalid type: %s (allowed: %s)", msgtype, strings.Join(scheduleTypes, ", "))
+	}
+	if len(message) == 0 {
+		return nil, nil, errors.New("Missing message in Payload")
+	}
+	if len(recipients) == 0 {
+		return nil, nil, errors.New("Missing recipients in Payload")
+	}
+	if len(recipients) > maxCampaignRecipients {
+		return nil, nil, fmt.Errorf("A campaign can have up to %d recipients", maxCampaignRecipients)
+	}
+
+	// Each message gets its own id and recipient
+	for key := range message {
+		switch strings.ToLower(key) {
+		case "phone", "group", "id":
+			delete(message, key)
+		}
+	}
+	template, err := json.Marshal(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make(map[string]bool)
+	campaignVariables(message, names)
+
+	id, err := GenerateRandomID()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	campaign := &Campaign{
+		Id:        id,
+		UserId:    userID,
+		Name:      name,
+		Action:    "send_" + msgtype,
+		Template:  string(template),
+		Message:   json.RawMessage(template),
+		Status:    campaignRunning,
+		CreatedAt: now.Unix(),
+		UpdatedAt: now.Unix(),
+	}
+	seq := now.UnixNano()
+	if !sendAt.IsZero() {
+		campaign.SendAt = sendAt.Unix()
+		seq = sendAt.UnixNano()
+	}
+
+	jobs := []*SendJob{}
+	seen := make(map[string]bool)
+	for i, recipient := range recipients {
+		for variable := range names {
+			if _, ok := recipient.Variables[variable]; !ok {
+				return nil, nil, fmt.Errorf("Recipient %d (%s) has no value for {{%s}}", i+1, recipient.Phone, variable)
+			}
+		}
+		payload := renderCampaignTemplate(message, recipient.Variables).(map[string]interface{})
+		payload["Phone"] = recipient.Phone
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		job, err := newSendJob(userID, campaign.Action, body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Recipient %d (%s): %v", i+1, recipient.Phone, err)
+		}
+		if seen[job.Chat] {
+			continue
+		}
+		seen[job.Chat] = true
+		job.CampaignId = campaign.Id
+		job.SendAt = campaign.SendAt
+		job.Seq = seq + int64(len(jobs))
+		jobs = append(jobs, job)
+	}
+	campaign.Total = len(jobs)
+	return campaign, jobs, nil
+}
+
+// Stores a campaign with its jobs
+func createCampaign(db *sqlx.DB, campaign *Campaign, jobs []*SendJob) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO campaigns ("+campaignColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 0)",
+		campaign.Id, campaign.UserId, campaign.Name, campaign.Action, campaign.Template, campaign.Status, campaign.Total, campaign.SendAt, campaign.CreatedAt, campaign.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Preparex("INSERT INTO send_jobs (" + sendJobColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, 0, '', '', $8, $9, $10, $11, 0)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, job := range jobs {
+		_, err = stmt.Exec(job.Id, job.UserId, job.Action, job.Chat, job.MessageId, job.Payload, job.Status, job.Seq, job.SendAt, job.CampaignId, job.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Counts the recipients of a campaign in each status
+func (c *Campaign) loadProgress(db *sqlx.DB) error {
+	rows := []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}{}
+	err := db.Select(&rows, "SELECT "+campaignRecipientStatus+" AS status, COUNT(*) AS count FROM send_jobs j LEFT JOIN sent_messages sm ON sm.user_id = j.user_id AND sm.id = j.message_id WHERE j.campaign_id=$1 GROUP BY 1", c.Id)
+	if err != nil {
+		return err
+	}
+	c.Progress = make(map[string]int, len(campaignRecipientStatuses))
+	for _, status := range campaignRecipientStatuses {
+		c.Progress[status] = 0
+	}
+	for _, row := range rows {
+		c.Progress[row.Status] += row.Count
+	}
+	c.Message = json.RawMessage(c.Template)
+	return nil
+}
+
+// Returns a campaign with its progress, nil when there is none
+func getCampaign(db *sqlx.DB, userID string, id string) (*Campaign, error) {
+	var campaign Campaign
+	err := db.Get(&campaign, "SELECT "+campaignColumns+" FROM campaigns WHERE user_id=$1 AND id=$2", userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := campaign.loadProgress(db); err != nil {
+		return nil, err
+	}
+	return &campaign, nil
+}
+
+// Moves a campaign from one status to another, returns false when the
+// campaign is not in the from status
+func setCampaignStatus(db *sqlx.DB, userID string, id string, from string, to string) (bool, error) {
+	result, err := db.Exec("UPDATE campaigns SET status=$1, updated_at=$2 WHERE user_id=$3 AND id=$4 AND status=$5",
+		to, time.Now().Unix(), userID, id, from)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// Cancels a running or paused campaign and its queued jobs, returns false
+// when the campaign is not running or paused
+func cancelCampaign(db *sqlx.DB, userID string, id string) (bool, error) {
+	now := time.Now().Unix()
+	result, err := db.Exec("UPDATE campaigns SET status=$1, updated_at=$2, finished_at=$2 WHERE user_id=$3 AND id=$4 AND status IN ($5, $6)",
+		campaignCancelled, now, userID, id, campaignRunning, campaignPaused)
+	if err != nil {
+		return false, err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return false, err
+	}
+	_, err = db.Exec("UPDATE send_jobs SET status=$1, finished_at=$2 WHERE user_id=$3 AND campaign_id=$4 AND status=$5",
+		sendJobCancelled, now, userID, id, sendJobQueued)
+	return err == nil, err
+}
+
+// Marks a running campaign as finished when none of its jobs are left
+func finishCampaign(db *sqlx.DB, id string) {
+	now := time.Now().Unix()
+	_, err := db.Exec("UPDATE campaigns SET status=$1, updated_at=$2, finished_at=$2 WHERE id=$3 AND status=$4 AND NOT EXISTS (SELECT 1 FROM send_jobs WHERE campaign_id=$3 AND status IN ($5, $6))",
+		campaignFinished, now, id, campaignRunning, sendJobQueued, sendJobSending)
+	if err != nil {
+		log.Error().Err(err).Str("campaign", id).Msg("Could not update campaign")
+	}
+}
+
+func formatCSVTime(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(ts, 0).Format(time.RFC3339)
+}
+
+// Writes the status of each recipient of a campaign as CSV, times are in
+// the timezone set with TZ
+func writeCampaignCSV(db *sqlx.DB, userID string, id string, w io.Writer) error {
+	rows, err := db.Queryx("SELECT j.chat, j.message_id, "+campaignRecipientStatus+" AS status, j.error, j.finished_at, COALESCE(sm.delivered_at, 0), COALESCE(sm.read_at, 0), COALESCE(sm.played_at, 0) FROM send_jobs j LEFT JOIN sent_messages sm ON sm.user_id = j.user_id AND sm.id = j.message_id WHERE j.user_id=$1 AND j.campaign_id=$2 ORDER BY j.seq",
+		userID, id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"phone", "chat", "message_id", "status", "error", "sent_at", "delivered_at", "read_at", "played_at"})
+	for rows.Next() {
+		var chat, msgid, status, sendError string
+		var finishedAt, deliveredAt, readAt, playedAt int64
+		if err := rows.Scan(&chat, &msgid, &status, &sendError, &finishedAt, &deliveredAt, &readAt, &playedAt); err != nil {
+			return err
+		}
+		sentAt := int64(0)
+		if status != sendJobFailed && status != sendJobCancelled {
+			sentAt = finishedAt
+		}
+		phone := chat
+		if jid, err := types.ParseJID(chat); err == nil {
+			phone = jid.User
+		}
+		out.Write([]string{phone, chat, msgid, status, sendError, formatCSVTime(sentAt), formatCSVTime(deliveredAt), formatCSVTime(readAt), formatCSVTime(playedAt)})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func deleteUserCampaigns(db sqlx.Ext, userID string) error {
+	_, err := db.Exec("DELETE FROM campaigns WHERE user_id=$1", userID)
+	return err
+}
+
+// Removes the campaigns, and their jobs, that finished before
+// -statusretention
+func purgeCampaigns(db *sqlx.DB) {
+	if *statusRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-*statusRetention).Unix()
+	const finished = "SELECT id FROM campaigns WHERE status IN ($1, $2) AND finished_at < $3"
+	if _, err := db.Exec("DELETE FROM send_jobs WHERE campaign_id IN ("+finished+")", campaignFinished, campaignCancelled, cutoff); err != nil {
+		log.Error().Err(err).Msg("Failed to purge campaigns")
+		return
+	}
+	result, err := db.Exec("DELETE FROM campaigns WHERE id IN ("+finished+")", campaignFinished, campaignCancelled, cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge campaigns")
+		return
+	}
+	if purged, err := result.RowsAffected(); err == nil && purged > 0 {
+		log.Info().Int64("purged", purged).Msg("Purged old campaigns")
+	}
+}
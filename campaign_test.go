@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderCampaignTemplate(t *testing.T) {
+	template := map[string]interface{}{
+		"Body":    "Hi {{name}}, order {{ order }} ships {{date}}",
+		"Options": []interface{}{"{{name}}", "no variables", 3.0},
+		"ContextInfo": map[string]interface{}{
+			"Note":  "{{order}}",
+			"Count": 2.0,
+		},
+		"Flag": true,
+	}
+	variables := map[string]string{"name": "Ana", "order": "{{name}}-42", "date": "", "unused": "x"}
+
+	names := make(map[string]bool)
+	campaignVariables(template, names)
+	if want := map[string]bool{"name": true, "order": true, "date": true}; !reflect.DeepEqual(names, want) {
+		t.Errorf("campaignVariables = %v, want %v", names, want)
+	}
+
+	got := renderCampaignTemplate(template, variables)
+	want := map[string]interface{}{
+		// Values are not expanded again
+		"Body":    "Hi Ana, order {{name}}-42 ships ",
+		"Options": []interface{}{"Ana", "no variables", 3.0},
+		"ContextInfo": map[string]interface{}{
+			"Note":  "{{name}}-42",
+			"Count": 2.0,
+		},
+		"Flag": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("renderCampaignTemplate = %v, want %v", got, want)
+	}
+	if template["Body"] != "Hi {{name}}, order {{ order }} ships {{date}}" {
+		t.Errorf("the template was changed: %v", template["Body"])
+	}
+}
+
+func TestNewCampaign(t *testing.T) {
+	sendAt := time.Now().Add(time.Hour)
+	message := map[string]interface{}{"Body": "Hi {{name}}", "Phone": "ignored", "id": "ignored"}
+	recipients := []CampaignRecipient{
+		{Phone: "5491155550001", Variables: map[string]string{"name": "Ana"}},
+		{Phone: "5491155550002", Variables: map[string]string{"name": "Bob"}},
+		// The same chats again
+		{Phone: "5491155550001@s.whatsapp.net", Variables: map[string]string{"name": "Ana again"}},
+		{Phone: "5491155550002", Variables: map[string]string{"name": "Bob again"}},
+		{Phone: "+5491155550001", Variables: map[string]string{"name": "Ana once more"}},
+		{Phone: "120363000000000000@g.us", Variables: map[string]string{"name": "group"}},
+	}
+	campaign, jobs, err := newCampaign("u1", "launch", "Text", message, recipients, sendAt)
+	if err != nil {
+		t.Fatalf("newCampaign error = %v", err)
+	}
+	if campaign.Action != "send_text" || campaign.Status != campaignRunning || campaign.SendAt != sendAt.Unix() {
+		t.Errorf("campaign = %s %s at %d", campaign.Action, campaign.Status, campaign.SendAt)
+	}
+	if strings.Contains(campaign.Template, "ignored") {
+		t.Errorf("template %s keeps the recipient and id", campaign.Template)
+	}
+	if campaign.Total != 3 || len(jobs) != 3 {
+		t.Fatalf("campaign has %d recipients and %d jobs, want 3", campaign.Total, len(jobs))
+	}
+
+	wantChats := []string{"5491155550001@s.whatsapp.net", "5491155550002@s.whatsapp.net", "120363000000000000@g.us"}
+	wantBodies := []string{"Hi Ana", "Hi Bob", "Hi group"}
+	ids := make(map[string]bool)
+	for i, job := range jobs {
+		var payload map[string]string
+		if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+			t.Fatalf("job %d payload %s: %v", i, job.Payload, err)
+		}
+		if job.Chat != wantChats[i] || payload["Body"] != wantBodies[i] {
+			t.Errorf("job %d = %s %q, want %s %q", i, job.Chat, payload["Body"], wantChats[i], wantBodies[i])
+		}
+		if job.CampaignId != campaign.Id || job.SendAt != campaign.SendAt || job.Action != "send_text" {
+			t.Errorf("job %d = campaign %s at %d, action %s", i, job.CampaignId, job.SendAt, job.Action)
+		}
+		if job.Seq != sendAt.UnixNano()+int64(i) {
+			t.Errorf("job %d seq = %d, want %d", i, job.Seq, sendAt.UnixNano()+int64(i))
+		}
+		if ids[job.MessageId] || job.MessageId == "ignored" {
+			t.Errorf("job %d reuses message id %s", i, job.MessageId)
+		}
+		ids[job.MessageId] = true
+	}
+
+	now, jobs, err := newCampaign("u1", "now", "text", map[string]interface{}{"Body": "hi"}, recipients[:1], time.Time{})
+	if err != nil || now.SendAt != 0 || jobs[0].SendAt != 0 {
+		t.Errorf("campaign without send_at = %v, error %v", now, err)
+	}
+}
+
+func TestNewCampaignErrors(t *testing.T) {
+	one := []CampaignRecipient{{Phone: "5491155550001", Variables: map[string]string{"name": "Ana"}}}
+	tooMany := make([]CampaignRecipient, maxCampaignRecipients+1)
+	for i := range tooMany {
+		tooMany[i] = CampaignRecipient{Phone: "5491155550001"}
+	}
+
+	tests := []struct {
+		name       string
+		msgtype    string
+		message    map[string]interface{}
+		recipients []CampaignRecipient
+		err        string
+	}{
+		{"no type", "", map[string]interface{}{"Body": "hi"}, one, "Missing type"},
+		{"bad type", "fax", map[string]interface{}{"Body": "hi"}, one, "Invalid type: fax"},
+		{"no message", "text", nil, one, "Missing message"},
+		{"no recipients", "text", map[string]interface{}{"Body": "hi"}, nil, "Missing recipients"},
+		{"over the limit", "text", map[string]interface{}{"Body": "hi"}, tooMany, "up to 50000 recipients"},
+		{
+			"missing variable", "text", map[string]interface{}{"Body": "Hi {{name}}, {{code}}"},
+			[]CampaignRecipient{
+				{Phone: "5491155550001", Variables: map[string]string{"name": "Ana", "code": "1"}},
+				{Phone: "5491155550002", Variables: map[string]string{"name": "Bob"}},
+			},
+			"Recipient 2 (5491155550002) has no value for {{code}}",
+		},
+		{"no phone", "text", map[string]interface{}{"Body": "hi"}, []CampaignRecipient{{Phone: ""}}, "Recipient 1 (): Missing Phone"},
+		{"bad phone", "text", map[string]interface{}{"Body": "hi"}, []CampaignRecipient{{Phone: "@s.whatsapp.net"}}, "Could not parse Phone"},
+	}
+	for _, tt := range tests {
+		_, _, err := newCampaign("u1", tt.name, tt.msgtype, tt.message, tt.recipients, time.Time{})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: newCampaign error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	// The limit is on the list sent, before duplicates are removed
+	_, jobs, err := newCampaign("u1", "limit", "text", map[string]interface{}{"Body": "hi"}, tooMany[:maxCampaignRecipients], time.Time{})
+	if err != nil || len(jobs) != 1 {
+		t.Errorf("campaign at the limit = %d jobs, error %v", len(jobs), err)
+	}
+}
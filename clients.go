@@ -10,12 +10,14 @@ import (
 type ClientManager struct {
 	sync.RWMutex
 	whatsmeowClients map[string]*whatsmeow.Client
+	myClients        map[string]*MyClient
 	httpClients      map[string]*resty.Client
 }
 
 func NewClientManager() *ClientManager {
 	return &ClientManager{
 		whatsmeowClients: make(map[string]*whatsmeow.Client),
+		myClients:        make(map[string]*MyClient),
 		httpClients:      make(map[string]*resty.Client),
 	}
 }
@@ -36,6 +38,21 @@ func (cm *ClientManager) DeleteWhatsmeowClient(userID string) {
 	cm.Lock()
 	defer cm.Unlock()
 	delete(cm.whatsmeowClients, userID)
+	delete(cm.myClients, userID)
+}
+
+func (cm *ClientManager) SetMyClient(userID string, mycli *MyClient) {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.myClients[userID] = mycli
+}
+
+// Returns the event handler of the user's running client, used to emit
+// events that do not come from WhatsApp
+func (cm *ClientManager) GetMyClient(userID string) *MyClient {
+	cm.RLock()
+	defer cm.RUnlock()
+	return cm.myClients[userID]
 }
 
 func (cm *ClientManager) SetHTTPClient(userID string, client *resty.Client) {
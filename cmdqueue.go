@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Besides the REST API and the WebSocket, send commands can be consumed from
+// a Redis Stream or a NATS subject. Each user can configure one command
+// queue, which is consumed while the user's WhatsApp client is running.
+// Commands are the same {id, action, payload} objects used on the WebSocket
+// and are run one at a time through runDirectCommand, so a busy instance or
+// a session waiting for its send rate simply stops taking new commands.
+// Each result is published on the reply subject.
+//
+// Redis commands are read with a consumer group and acknowledged once the
+// reply is published, entries left pending by a crash are run again when
+// the consumer starts. NATS commands are read with a queue subscription, or
+// from a JetStream durable consumer when one is configured.
+
+const (
+	defaultNATSCommandSubject  = "wuzapi.{user}.commands"
+	defaultNATSReplySubject    = "wuzapi.{user}.replies"
+	defaultRedisCommandStream  = "wuzapi:{user}:commands"
+	defaultRedisReplyStream    = "wuzapi:{user}:replies"
+	commandQueueGroup          = "wuzapi"
+	commandQueueReadTimeout    = time.Second
+	commandQueueReconnectDelay = 5 * time.Second
+)
+
+var commandQueues = NewCommandQueues()
+
+type CommandQueueConfig struct {
+	UserId       string `db:"user_id"`
+	Type         string `db:"type"`
+	URL          string `db:"url"`
+	Subject      string `db:"subject"`
+	ReplySubject string `db:"reply_subject"`
+	Durable      string `db:"durable"`
+	Enabled      bool   `db:"enabled"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+const commandQueueColumns = "user_id, type, url, subject, reply_subject, durable, enabled, updated_at"
+
+func (cq CommandQueueConfig) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":          cq.Type,
+		"url":           redactURL(cq.URL),
+		"subject":       cq.Subject,
+		"reply_subject": cq.ReplySubject,
+		"durable":       cq.Durable,
+		"enabled":       cq.Enabled,
+		"updated_at":    cq.UpdatedAt,
+	}
+}
+
+// Checks the type and url of a command queue and fills in the default
+// subjects
+func (cq *CommandQueueConfig) validate() error {
+	switch cq.Type {
+	case sinkTypeNATS:
+		if cq.Subject == "" {
+			cq.Subject = defaultNATSCommandSubject
+		}
+		if cq.ReplySubject == "" {
+			cq.ReplySubject = defaultNATSReplySubject
+		}
+	case sinkTypeRedis:
+		if cq.Subject == "" {
+			cq.Subject = defaultRedisCommandStream
+		}
+		if cq.ReplySubject == "" {
+			cq.ReplySubject = defaultRedisReplyStream
+		}
+		if cq.Durable != "" {
+			return errors.New("durable is only used with nats")
+		}
+	default:
+		return fmt.Errorf("invalid command queue type: %s (allowed: nats, redis)", cq.Type)
+	}
+
+	if err := validateBrokerURL(cq.Type, cq.URL); err != nil {
+		return err
+	}
+	for _, value := range []string{cq.Subject, cq.ReplySubject, cq.Durable} {
+		if strings.ContainsAny(value, " \t\r\n") {
+			return errors.New("command queue subjects cannot contain whitespace")
+		}
+	}
+	if cq.Subject == cq.ReplySubject {
+		return errors.New("subject and reply_subject must be different")
+	}
+	return nil
+}
+
+// Returns the command queue of a user, nil when it has none
+func getCommandQueue(db *sqlx.DB, userID string) (*CommandQueueConfig, error) {
+	var cq CommandQueueConfig
+	err := db.Get(&cq, "SELECT "+commandQueueColumns+" FROM command_queues WHERE user_id=$1", userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &cq, nil
+}
+
+type commandConsumer struct {
+	config CommandQueueConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// CommandQueues keeps the running consumer of each user
+type CommandQueues struct {
+	sync.Mutex
+	consumers map[string]*commandConsumer
+}
+
+func NewCommandQueues() *CommandQueues {
+	return &CommandQueues{consumers: make(map[string]*commandConsumer)}
+}
+
+// Starts consuming the command queue of a user, replacing the running
+// consumer if there is one. Nothing is started when the user has no queue
+// or it is disabled.
+func (q *CommandQueues) Start(s *server, userID string, token string) {
+	q.Stop(userID)
+
+	cq, err := getCommandQueue(s.db, userID)
+	if err != nil {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load command queue")
+		return
+	}
+	if cq == nil || !cq.Enabled {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &commandConsumer{config: *cq, cancel: cancel, done: make(chan struct{})}
+	q.Lock()
+	q.consumers[userID] = consumer
+	q.Unlock()
+
+	go func() {
+		defer close(consumer.done)
+		consumer.run(ctx, s, token)
+	}()
+}
+
+// Stops the consumer of a user and waits for the command it is running
+func (q *CommandQueues) Stop(userID string) {
+	q.Lock()
+	consumer, ok := q.consumers[userID]
+	delete(q.consumers, userID)
+	q.Unlock()
+
+	if ok {
+		consumer.cancel()
+		<-consumer.done
+	}
+}
+
+// Checks if the command queue of a user is being consumed
+func (q *CommandQueues) Running(userID string) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.consumers[userID]
+	return ok
+}
+
+// Consumes commands until the context is cancelled, reconnecting to the
+// broker when the connection fails
+func (c *commandConsumer) run(ctx context.Context, s *server, token string) {
+	userID := c.config.UserId
+	subject := strings.ReplaceAll(c.config.Subject, "{user}", userID)
+	replySubject := strings.ReplaceAll(c.config.ReplySubject, "{user}", userID)
+	execute := func(data []byte) []byte {
+		return s.runQueuedCommand(userID, token, data)
+	}
+
+	for {
+		log.Info().Str("userid", userID).Str("type", c.config.Type).Str("subject", subject).Msg("Consuming command queue")
+		var err error
+		if c.config.Type == sinkTypeRedis {
+			err = consumeRedisCommands(ctx, c.config.URL, subject, replySubject, execute)
+		} else {
+			err = consumeNATSCommands(ctx, c.config.URL, subject, replySubject, c.config.Durable, execute)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Str("userid", userID).Msg("Command queue consumer stopped, reconnecting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(commandQueueReconnectDelay):
+		}
+	}
+}
+
+// Runs a command received from a queue and returns the encoded result
+func (s *server) runQueuedCommand(userID string, token string, data []byte) []byte {
+	var result CommandResult
+	var cmd Command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		result = commandError(cmd, http.StatusBadRequest, errors.New("could not decode command"))
+	} else {
+		userinfo := Values{map[string]string{"Id": userID, "Token": token}}
+		if cached, found := userinfocache.Get(token); found {
+			userinfo = cached.(Values)
+		}
+		// Commands that were already taken from the queue are finished
+		// even if the consumer is being stopped
+		result = s.runDirectCommand(context.Background(), userinfo, cmd, 0)
+	}
+	if !result.Success {
+		log.Warn().Str("userid", userID).Str("id", cmd.Id).Str("action", cmd.Action).Str("error", result.Error).Msg("Queued command failed")
+	}
+	reply, err := json.Marshal(result)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal command result")
+		return []byte(`{"type":"response","code":500,"success":false,"error":"could not encode result"}`)
+	}
+	return reply
+}
+
+// Reads commands from a Redis Stream with the wuzapi consumer group. The
+// entries are id, action and payload fields, the reply entries have the
+// command id and action and the result JSON in the data field.
+func consumeRedisCommands(ctx context.Context, rawURL string, stream string, replyStream string, execute func([]byte) []byte) error {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return err
+	}
+	client := redis.NewClient(options)
+	defer client.Close()
+
+	err = client.XGroupCreateMkStream(ctx, stream, commandQueueGroup, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	consumerName, _ := os.Hostname()
+	if consumerName == "" {
+		consumerName = "wuzapi"
+	}
+
+	// Entries delivered before but never acknowledged come first
+	start := "0"
+	for {
+		streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    commandQueueGroup,
+			Consumer: consumerName,
+			Streams:  []string{stream, start},
+			Count:    1,
+			Block:    commandQueueReadTimeout,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			start = ">"
+			continue
+		}
+
+		for _, entry := range streams[0].Messages {
+			cmd := map[string]interface{}{}
+			for _, field := range []string{"id", "action"} {
+				if value, ok := entry.Values[field].(string); ok {
+					cmd[field] = value
+				}
+			}
+			// A payload that is not valid JSON is passed as a string, so
+			// the handler rejects it like an invalid request body
+			if payload, ok := entry.Values["payload"].(string); ok && json.Valid([]byte(payload)) {
+				cmd["payload"] = json.RawMessage(payload)
+			} else if ok {
+				cmd["payload"] = payload
+			}
+			data, err := json.Marshal(cmd)
+			if err != nil {
+				return err
+			}
+
+			result := execute(data)
+			err = client.XAdd(context.Background(), &redis.XAddArgs{
+				Stream: replyStream,
+				MaxLen: redisSinkStreamMaxLen,
+				Approx: true,
+				Values: map[string]interface{}{
+					"id":     cmd["id"],
+					"action": cmd["action"],
+					"data":   string(result),
+				},
+			}).Err()
+			if err != nil {
+				return err
+			}
+			if err := client.XAck(context.Background(), stream, commandQueueGroup, entry.ID).Err(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Reads commands from a NATS subject. Replies go to the reply inbox of the
+// message when it has one (request/reply), otherwise to the reply subject.
+// With a durable name the commands are read from a JetStream consumer and
+// acknowledged after the reply is published.
+func consumeNATSCommands(ctx context.Context, rawURL string, subject string, replySubject string, durable string, execute func([]byte) []byte) error {
+	conn, err := nats.Connect(rawURL, nats.Name("wuzapi"), nats.Timeout(sinkPublishTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reply := func(msg *nats.Msg) error {
+		result := execute(msg.Data)
+		target := replySubject
+		if durable == "" && msg.Reply != "" {
+			target = msg.Reply
+		}
+		if err := conn.Publish(target, result); err != nil {
+			return err
+		}
+		return conn.Flush()
+	}
+
+	if durable != "" {
+		js, err := conn.JetStream()
+		if err != nil {
+			return err
+		}
+		sub, err := js.PullSubscribe(subject, durable, nats.ManualAck())
+		if err != nil {
+			return err
+		}
+		for {
+			fetchCtx, cancel := context.WithTimeout(ctx, commandQueueReadTimeout)
+			msgs, err := sub.Fetch(1, nats.Context(fetchCtx))
+			cancel()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, msg := range msgs {
+				if err := reply(msg); err != nil {
+					return err
+				}
+				if err := msg.Ack(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	sub, err := conn.QueueSubscribeSync(subject, commandQueueGroup)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		if err := reply(msg); err != nil {
+			return err
+		}
+	}
+}
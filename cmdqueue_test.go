@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandQueueConfigValidate(t *testing.T) {
+	nats := CommandQueueConfig{Type: "nats", URL: "nats://localhost:4222", Durable: "wuzapi"}
+	if err := nats.validate(); err != nil {
+		t.Fatalf("nats validate error = %v", err)
+	}
+	if nats.Subject != defaultNATSCommandSubject || nats.ReplySubject != defaultNATSReplySubject {
+		t.Errorf("nats subjects = %q %q", nats.Subject, nats.ReplySubject)
+	}
+
+	redis := CommandQueueConfig{Type: "redis", URL: "redis://localhost:6379/0", ReplySubject: "replies"}
+	if err := redis.validate(); err != nil {
+		t.Fatalf("redis validate error = %v", err)
+	}
+	if redis.Subject != defaultRedisCommandStream || redis.ReplySubject != "replies" {
+		t.Errorf("redis subjects = %q %q", redis.Subject, redis.ReplySubject)
+	}
+
+	invalid := []struct {
+		config CommandQueueConfig
+		err    string
+	}{
+		{CommandQueueConfig{Type: "amqp", URL: "amqp://rabbit"}, "invalid command queue type: amqp"},
+		{CommandQueueConfig{Type: "redis", URL: "redis://localhost", Durable: "x"}, "durable is only used with nats"},
+		{CommandQueueConfig{Type: "nats", URL: "redis://localhost"}, "nats url must use"},
+		{CommandQueueConfig{Type: "redis", URL: "localhost"}, "invalid broker url"},
+		{CommandQueueConfig{Type: "nats", URL: "nats://localhost", Subject: "in box"}, "cannot contain whitespace"},
+		{CommandQueueConfig{Type: "nats", URL: "nats://localhost", Durable: "a b"}, "cannot contain whitespace"},
+		{CommandQueueConfig{Type: "nats", URL: "nats://localhost", Subject: "x", ReplySubject: "x"}, "must be different"},
+	}
+	for _, tt := range invalid {
+		config := tt.config
+		err := config.validate()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("validate(%+v) error = %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Commands received outside of the REST API (WebSocket frames, queue
+// messages) are run through the same handlers, so validation and responses
+// are identical. The command payload is the JSON body of the REST endpoint.
+
+var commandHandlers = map[string]func(*server) http.HandlerFunc{
+	"send_text":     (*server).SendMessage,
+	"send_image":    (*server).SendImage,
+	"send_audio":    (*server).SendAudio,
+	"send_document": (*server).SendDocument,
+	"send_video":    (*server).SendVideo,
+	"send_sticker":  (*server).SendSticker,
+	"send_location": (*server).SendLocation,
+	"send_contact":  (*server).SendContact,
+	"send_poll":     (*server).SendPoll,
+	"send_buttons":  (*server).SendButtons,
+	"send_list":     (*server).SendList,
+	"send_reaction": (*server).React,
+	"mark_read":     (*server).MarkRead,
+	"presence":      (*server).SendPresence,
+	"chat_presence": (*server).ChatPresence,
+}
+
+type Command struct {
+	Id      string          `json:"id"`
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type CommandResult struct {
+	Type    string          `json:"type"`
+	Id      string          `json:"id"`
+	Action  string          `json:"action"`
+	Code    int             `json:"code"`
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Response of a handler run for a command
+type commandResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *commandResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *commandResponse) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *commandResponse) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
+
+func commandError(cmd Command, code int, err error) CommandResult {
+	return CommandResult{Type: "response", Id: cmd.Id, Action: cmd.Action, Code: code, Error: err.Error()}
+}
+
+// Runs a command for the user, as if its payload was posted to the matching
+// REST endpoint with the user's token
+func (s *server) runCommand(ctx context.Context, userinfo Values, cmd Command) CommandResult {
+	handler, ok := commandHandlers[cmd.Action]
+	if !ok {
+		return commandError(cmd, http.StatusBadRequest, fmt.Errorf("unknown action: %s", cmd.Action))
+	}
+	payload := cmd.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage("{}")
+	}
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, "userinfo", userinfo), http.MethodPost, "/", bytes.NewReader(payload))
+	if err != nil {
+		return commandError(cmd, http.StatusInternalServerError, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rec := &commandResponse{header: make(http.Header)}
+	handler(s).ServeHTTP(rec, req)
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+
+	var envelope struct {
+		Data  json.RawMessage `json:"data"`
+		Error string          `json:"error"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &envelope); err != nil {
+		return commandError(cmd, http.StatusInternalServerError, fmt.Errorf("invalid response: %w", err))
+	}
+	return CommandResult{
+		Type:    "response",
+		Id:      cmd.Id,
+		Action:  cmd.Action,
+		Code:    rec.code,
+		Success: rec.code >= 200 && rec.code <= 299,
+		Data:    envelope.Data,
+		Error:   envelope.Error,
+	}
+}
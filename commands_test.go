@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	s := &server{}
+	userinfo := Values{map[string]string{"Id": "cmdtest", "Jid": "", "Token": "t"}}
+
+	unknown := s.runCommand(context.Background(), userinfo, Command{Id: "1", Action: "send_fax"})
+	if unknown.Code != http.StatusBadRequest || unknown.Success || unknown.Error != "unknown action: send_fax" {
+		t.Errorf("unknown action = %+v", unknown)
+	}
+	if unknown.Type != "response" || unknown.Id != "1" || unknown.Action != "send_fax" {
+		t.Errorf("unknown action result does not echo the command: %+v", unknown)
+	}
+
+	// Run through the REST handler, which fails without a WhatsApp session
+	payload := json.RawMessage(`{"Phone":"5491155554444","Body":"hi"}`)
+	result := s.runCommand(context.Background(), userinfo, Command{Id: "2", Action: "send_text", Payload: payload})
+	if result.Success || result.Code != http.StatusInternalServerError || result.Error != "No session" {
+		t.Errorf("send without a session = %+v", result)
+	}
+	if result.Id != "2" || result.Action != "send_text" {
+		t.Errorf("result does not echo the command: %+v", result)
+	}
+
+	empty := s.runCommand(context.Background(), userinfo, Command{Id: "3", Action: "presence"})
+	if empty.Success || empty.Code == 0 || empty.Error == "" {
+		t.Errorf("command without payload = %+v", empty)
+	}
+}
+
+func TestRunCommandResponse(t *testing.T) {
+	handlers := map[string]func(*server) http.HandlerFunc{
+		"implicit_ok": func(s *server) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"data":{"user":"` + r.Context().Value("userinfo").(Values).Get("Id") + `"}}`))
+				w.WriteHeader(http.StatusTeapot)
+			}
+		},
+		"created": func(s *server) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"data":{}}`))
+			}
+		},
+		"not_json": func(s *server) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {}
+		},
+	}
+	for action, handler := range handlers {
+		commandHandlers[action] = handler
+		defer delete(commandHandlers, action)
+	}
+	s := &server{}
+	userinfo := Values{map[string]string{"Id": "cmdtest"}}
+
+	// The status can not change once the body is written
+	if res := s.runCommand(context.Background(), userinfo, Command{Action: "implicit_ok"}); res.Code != http.StatusOK || !res.Success || string(res.Data) != `{"user":"cmdtest"}` {
+		t.Errorf("implicit_ok = %+v", res)
+	}
+	if res := s.runCommand(context.Background(), userinfo, Command{Action: "created"}); res.Code != http.StatusCreated || !res.Success {
+		t.Errorf("created = %+v", res)
+	}
+	if res := s.runCommand(context.Background(), userinfo, Command{Action: "not_json"}); res.Code != http.StatusInternalServerError || res.Success {
+		t.Errorf("not_json = %+v", res)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Returns a new SQLite database with every migration applied
+func newTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := initializeSQLite(DatabaseConfig{Type: "sqlite", Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("could not open the test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := initializeSchema(db); err != nil {
+		t.Fatalf("could not initialize the test database: %v", err)
+	}
+	return db
+}
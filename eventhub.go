@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+)
+
+// Events built by myEventHandler are also published to an in-memory hub so
+// they can be streamed to connected clients. Each user keeps a bounded ring
+// buffer of recent events, used to resume a stream after a reconnection.
+
+const (
+	eventHistorySize     = 256
+	eventHistoryMaxBytes = 8 * 1024 * 1024
+	eventSubscriberQueue = 64
+)
+
+type HubEvent struct {
+	Id   uint64
+	Type string
+	Data []byte
+}
+
+type userEventStream struct {
+	lastId      uint64
+	history     []HubEvent
+	historySize int
+	subscribers map[chan HubEvent]struct{}
+}
+
+type EventHub struct {
+	sync.Mutex
+	streams map[string]*userEventStream
+}
+
+var eventHub = NewEventHub()
+
+func NewEventHub() *EventHub {
+	return &EventHub{streams: make(map[string]*userEventStream)}
+}
+
+func (h *EventHub) stream(userID string) *userEventStream {
+	stream, ok := h.streams[userID]
+	if !ok {
+		stream = &userEventStream{subscribers: make(map[chan HubEvent]struct{})}
+		h.streams[userID] = stream
+	}
+	return stream
+}
+
+// Publish adds an event to the user's history and hands it to every
+// subscriber. Subscribers that fall behind are disconnected, they can
+// resume from the history with the id of the last event they got.
+func (h *EventHub) Publish(userID string, eventType string, data []byte) {
+	h.Lock()
+	defer h.Unlock()
+
+	stream := h.stream(userID)
+	stream.lastId++
+	event := HubEvent{Id: stream.lastId, Type: eventType, Data: data}
+
+	stream.history = append(stream.history, event)
+	stream.historySize += len(data)
+	for len(stream.history) > 1 && (len(stream.history) > eventHistorySize || stream.historySize > eventHistoryMaxBytes) {
+		stream.historySize -= len(stream.history[0].Data)
+		stream.history[0] = HubEvent{}
+		stream.history = stream.history[1:]
+	}
+
+	for ch := range stream.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(stream.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the buffered events newer than lastID and a channel
+// receiving the following ones. The channel is closed when the subscriber
+// falls behind or the user is removed; cancel must be called when done.
+func (h *EventHub) Subscribe(userID string, lastID uint64) ([]HubEvent, <-chan HubEvent, func()) {
+	h.Lock()
+	defer h.Unlock()
+
+	stream := h.stream(userID)
+	var backlog []HubEvent
+	if lastID > 0 && lastID < stream.lastId {
+		for _, event := range stream.history {
+			if event.Id > lastID {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	ch := make(chan HubEvent, eventSubscriberQueue)
+	stream.subscribers[ch] = struct{}{}
+	cancel := func() {
+		h.Lock()
+		defer h.Unlock()
+		if _, ok := stream.subscribers[ch]; ok {
+			delete(stream.subscribers, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// Remove drops the history of a user and disconnects its subscribers
+func (h *EventHub) Remove(userID string) {
+	h.Lock()
+	defer h.Unlock()
+
+	stream, ok := h.streams[userID]
+	if !ok {
+		return
+	}
+	for ch := range stream.subscribers {
+		delete(stream.subscribers, ch)
+		close(ch)
+	}
+	delete(h.streams, userID)
+}
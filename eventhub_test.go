@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEventHubResume(t *testing.T) {
+	hub := NewEventHub()
+	hub.Publish("u1", "Message", []byte("one"))
+	hub.Publish("u1", "Message", []byte("two"))
+	hub.Publish("u2", "Message", []byte("other user"))
+
+	backlog, ch, cancel := hub.Subscribe("u1", 1)
+	defer cancel()
+	if len(backlog) != 1 || backlog[0].Id != 2 || string(backlog[0].Data) != "two" {
+		t.Errorf("backlog after id 1 = %v, want event 2", backlog)
+	}
+	if fresh, _, cancelFresh := hub.Subscribe("u1", 0); len(fresh) != 0 {
+		t.Errorf("new subscriber got a backlog of %d events", len(fresh))
+	} else {
+		cancelFresh()
+	}
+	if current, _, cancelCurrent := hub.Subscribe("u1", 2); len(current) != 0 {
+		t.Errorf("subscriber with the last id got a backlog of %d events", len(current))
+	} else {
+		cancelCurrent()
+	}
+
+	hub.Publish("u1", "ReadReceipt", []byte("three"))
+	if event := <-ch; event.Id != 3 || event.Type != "ReadReceipt" {
+		t.Errorf("live event = %v, want event 3", event)
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("channel is open after cancel")
+	}
+	// Calling cancel again or publishing afterwards is harmless
+	cancel()
+	hub.Publish("u1", "Message", []byte("four"))
+}
+
+func TestEventHubHistoryLimits(t *testing.T) {
+	hub := NewEventHub()
+	for i := 0; i < eventHistorySize+10; i++ {
+		hub.Publish("u1", "Message", []byte("x"))
+	}
+	backlog, _, cancel := hub.Subscribe("u1", 1)
+	cancel()
+	if len(backlog) != eventHistorySize || backlog[0].Id != 11 {
+		t.Errorf("backlog has %d events from id %d, want %d from 11", len(backlog), backlog[0].Id, eventHistorySize)
+	}
+
+	// The newest event is kept even when it is larger than the limit
+	big := []byte(strings.Repeat("x", eventHistoryMaxBytes/2+1))
+	hub.Publish("u2", "Message", big)
+	hub.Publish("u2", "Message", big)
+	backlog, _, cancel = hub.Subscribe("u2", 0)
+	cancel()
+	stream := hub.streams["u2"]
+	if len(stream.history) != 1 || stream.history[0].Id != 2 || stream.historySize != len(big) {
+		t.Errorf("history has %d events and %d bytes, want only the last one", len(stream.history), stream.historySize)
+	}
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	hub := NewEventHub()
+	_, slow, cancel := hub.Subscribe("u1", 0)
+	defer cancel()
+	for i := 0; i <= eventSubscriberQueue; i++ {
+		hub.Publish("u1", "Message", []byte("x"))
+	}
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != eventSubscriberQueue {
+		t.Errorf("slow subscriber got %d events before being dropped, want %d", received, eventSubscriberQueue)
+	}
+
+	_, removed, cancelRemoved := hub.Subscribe("u1", 0)
+	defer cancelRemoved()
+	hub.Remove("u1")
+	if _, ok := <-removed; ok {
+		t.Error("channel is open after the user was removed")
+	}
+	if _, ok := hub.streams["u1"]; ok {
+		t.Error("stream is kept after the user was removed")
+	}
+}
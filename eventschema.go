@@ -0,0 +1,698 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Webhooks are sent with the v1 schema by default, the whatsmeow event as is
+// in the "event" field, which changes whenever whatsmeow does. The v2 schema
+// is made of the types below, which only change in backwards compatible ways
+// (new optional fields). The JSON Schema served at /webhook/schema/v2 is
+// generated from these types, so the description and enum tags are part of
+// the documentation.
+
+const (
+	webhookSchemaV1 = "v1"
+	webhookSchemaV2 = "v2"
+)
+
+func validateWebhookSchema(schema string) (string, error) {
+	switch schema {
+	case "":
+		return webhookSchemaV1, nil
+	case webhookSchemaV1, webhookSchemaV2:
+		return schema, nil
+	}
+	return "", fmt.Errorf("invalid webhook schema: %s (allowed: v1, v2)", schema)
+}
+
+type EventV2 struct {
+	Version       int              `json:"version" description:"Schema version, always 2" enum:"2"`
+	Id            string           `json:"id" description:"Unique id of the event, the same for every webhook it is sent to"`
+	InstanceId    string           `json:"instance_id" description:"Id of the wuzapi user that received the event"`
+	InstanceName  string           `json:"instance_name" description:"Name of the wuzapi user that received the event"`
+	Type          string           `json:"type" description:"Event type, as used in webhook subscriptions"`
+	Timestamp     int64            `json:"timestamp" description:"Unix time in seconds when the event happened"`
+	Test          bool             `json:"test,omitempty" description:"True for sample events sent by /webhook/test"`
+	Chat          *ChatV2          `json:"chat,omitempty" description:"Chat the event belongs to"`
+	Sender        *SenderV2        `json:"sender,omitempty" description:"User that caused the event"`
+	Message       *MessageV2       `json:"message,omitempty" description:"Set for Message events"`
+	Receipt       *ReceiptV2       `json:"receipt,omitempty" description:"Set for ReadReceipt events"`
+	Presence      *PresenceV2      `json:"presence,omitempty" description:"Set for Presence events"`
+	ChatPresence  *ChatPresenceV2  `json:"chat_presence,omitempty" description:"Set for ChatPresence events"`
+	HistorySync   *HistorySyncV2   `json:"history_sync,omitempty" description:"Set for HistorySync events"`
+	Call          *CallV2          `json:"call,omitempty" description:"Set for CallOffer, CallOfferNotice, CallAccept, CallTerminate and CallReject events"`
+	Group         *GroupV2         `json:"group,omitempty" description:"Set for GroupInfo and JoinedGroup events"`
+	Picture       *PictureV2       `json:"picture,omitempty" description:"Set for Picture events"`
+	Undecryptable *UndecryptableV2 `json:"undecryptable,omitempty" description:"Set for UndecryptableMessage events"`
+	Identity      *IdentityV2      `json:"identity,omitempty" description:"Set for IdentityChange events"`
+	Blocklist     *BlocklistV2     `json:"blocklist,omitempty" description:"Set for Blocklist events"`
+	Newsletter    *NewsletterV2    `json:"newsletter,omitempty" description:"Set for NewsletterJoin, NewsletterLeave, NewsletterMuteChange and NewsletterLiveUpdate events"`
+	SendJob       *SendJobV2       `json:"send_job,omitempty" description:"Set for SendJob events"`
+	Raw           json.RawMessage  `json:"raw,omitempty" description:"The whatsmeow event, only for types without a v2 representation. Its fields are not stable."`
+}
+
+type ChatV2 struct {
+	JID     string `json:"jid" description:"JID of the chat, a user or a group"`
+	IsGroup bool   `json:"is_group"`
+}
+
+type SenderV2 struct {
+	JID      string `json:"jid"`
+	PushName string `json:"push_name,omitempty" description:"Name set by the sender in WhatsApp"`
+	IsFromMe bool   `json:"is_from_me" description:"True when the event was caused by this account, for example a message sent from the phone"`
+}
+
+type MessageV2 struct {
+	Id          string      `json:"id" description:"WhatsApp message id"`
+	Kind        string      `json:"kind" description:"Kind of message, tells which of the optional fields is set" enum:"text,image,audio,video,document,sticker,location,contact,reaction,poll,edit,revoke,other"`
+	Text        string      `json:"text,omitempty" description:"Text of the message or caption of the media"`
+	QuotedId    string      `json:"quoted_id,omitempty" description:"Id of the message this one replies to"`
+	IsViewOnce  bool        `json:"is_view_once,omitempty"`
+	IsEphemeral bool        `json:"is_ephemeral,omitempty"`
+	IsForwarded bool        `json:"is_forwarded,omitempty"`
+	Media       *MediaV2    `json:"media,omitempty" description:"Set for image, audio, video, document and sticker messages"`
+	Location    *LocationV2 `json:"location,omitempty"`
+	Contacts    []ContactV2 `json:"contacts,omitempty"`
+	Reaction    *ReactionV2 `json:"reaction,omitempty"`
+	Poll        *PollV2     `json:"poll,omitempty"`
+	Edit        *EditV2     `json:"edit,omitempty"`
+	Revoke      *RevokeV2   `json:"revoke,omitempty"`
+}
+
+type MediaV2 struct {
+	MimeType string     `json:"mime_type"`
+	FileName string     `json:"file_name,omitempty"`
+	Size     uint64     `json:"size,omitempty" description:"File size in bytes"`
+	Seconds  uint32     `json:"seconds,omitempty" description:"Duration of audio and video"`
+	Voice    bool       `json:"voice,omitempty" description:"True for voice notes"`
+	Base64   string     `json:"base64,omitempty" description:"File contents, when media is not stored in S3 and was downloaded"`
+	S3       *StorageV2 `json:"s3,omitempty" description:"Object the file was uploaded to, when S3 storage is configured"`
+}
+
+type StorageV2 struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	URL       string `json:"url" description:"Presigned download URL"`
+	ExpiresAt int64  `json:"expires_at" description:"Unix time when the URL expires"`
+	Size      int64  `json:"size"`
+}
+
+type LocationV2 struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	Live      bool    `json:"live,omitempty" description:"True for live location updates"`
+}
+
+type ContactV2 struct {
+	DisplayName string `json:"display_name"`
+	VCard       string `json:"vcard"`
+}
+
+type ReactionV2 struct {
+	MessageId string `json:"message_id" description:"Id of the message reacted to"`
+	Emoji     string `json:"emoji" description:"The reaction, empty when it was removed"`
+}
+
+type PollV2 struct {
+	Name    string   `json:"name,omitempty" description:"Question, for new polls"`
+	Options []string `json:"options,omitempty" description:"Options, for new polls"`
+	Vote    bool     `json:"vote,omitempty" description:"True for votes, which are encrypted and carry no options"`
+}
+
+type EditV2 struct {
+	MessageId string `json:"message_id" description:"Id of the edited message"`
+	Text      string `json:"text" description:"New text of the message"`
+}
+
+type RevokeV2 struct {
+	MessageId string `json:"message_id" description:"Id of the deleted message"`
+}
+
+type ReceiptV2 struct {
+	MessageIds []string `json:"message_ids"`
+	State      string   `json:"state" enum:"Delivered,Read,ReadSelf"`
+}
+
+type PresenceV2 struct {
+	State    string `json:"state" enum:"online,offline"`
+	LastSeen int64  `json:"last_seen,omitempty" description:"Unix time when the user was last online, if shared"`
+}
+
+type ChatPresenceV2 struct {
+	State string `json:"state" enum:"composing,paused"`
+	Media string `json:"media,omitempty" description:"audio when recording a voice note" enum:"audio"`
+}
+
+type HistorySyncV2 struct {
+	SyncType      string `json:"sync_type"`
+	ChunkOrder    uint32 `json:"chunk_order,omitempty"`
+	Progress      uint32 `json:"progress,omitempty" description:"Percentage of the history synced so far"`
+	Conversations int    `json:"conversations" description:"Number of conversations in this chunk, use the v1 schema to get their contents"`
+}
+
+type CallV2 struct {
+	Id       string `json:"id" description:"WhatsApp call id, the same in every event of the call"`
+	Creator  string `json:"creator,omitempty" description:"JID of the user who started the call"`
+	Media    string `json:"media,omitempty" enum:"audio,video"`
+	IsGroup  bool   `json:"is_group,omitempty"`
+	Platform string `json:"platform,omitempty" description:"Platform of the caller, for CallOffer and CallAccept"`
+	Version  string `json:"version,omitempty" description:"WhatsApp version of the caller, for CallOffer and CallAccept"`
+	Reason   string `json:"reason,omitempty" description:"Why the call ended, for CallTerminate"`
+	Action   string `json:"action,omitempty" description:"What the call policy did with the call, for CallOffer and CallOfferNotice" enum:"none,rejected,replied"`
+	State    string `json:"state,omitempty" description:"For CallTerminate, missed when the call was never accepted" enum:"missed,answered,rejected"`
+	Duration int64  `json:"duration,omitempty" description:"Seconds from accept to terminate, for answered calls"`
+}
+
+type GroupV2 struct {
+	JID              string   `json:"jid"`
+	Name             string   `json:"name,omitempty" description:"New name of the group, or its name for JoinedGroup"`
+	Topic            string   `json:"topic,omitempty" description:"New description of the group, or its description for JoinedGroup"`
+	Locked           *bool    `json:"locked,omitempty" description:"Only admins can edit the group info"`
+	Announce         *bool    `json:"announce,omitempty" description:"Only admins can send messages"`
+	EphemeralSeconds *uint32  `json:"ephemeral_seconds,omitempty" description:"Disappearing messages timer, 0 when turned off"`
+	Join             []string `json:"join,omitempty" description:"Users who joined or were added"`
+	Leave            []string `json:"leave,omitempty" description:"Users who left or were removed"`
+	Promote          []string `json:"promote,omitempty" description:"Users who were made admins"`
+	Demote           []string `json:"demote,omitempty" description:"Users who are no longer admins"`
+	InviteLink       string   `json:"invite_link,omitempty" description:"New invite link"`
+	Deleted          bool     `json:"deleted,omitempty"`
+	Reason           string   `json:"reason,omitempty" description:"invite when the user joined with an invite link"`
+	Participants     int      `json:"participants,omitempty" description:"Number of participants, for JoinedGroup"`
+}
+
+type PictureV2 struct {
+	JID       string `json:"jid" description:"User or group whose picture changed"`
+	Author    string `json:"author,omitempty" description:"User who changed the picture"`
+	PictureId string `json:"picture_id,omitempty"`
+	Removed   bool   `json:"removed,omitempty"`
+}
+
+type UndecryptableV2 struct {
+	MessageId       string `json:"message_id"`
+	Unavailable     bool   `json:"unavailable,omitempty" description:"True when the message was not sent to this device, for example view once messages"`
+	UnavailableType string `json:"unavailable_type,omitempty"`
+	Hidden          bool   `json:"hidden,omitempty" description:"True when WhatsApp does not show the failure to the user"`
+}
+
+type IdentityV2 struct {
+	JID      string `json:"jid" description:"User whose encryption keys changed, usually after reinstalling WhatsApp"`
+	Implicit bool   `json:"implicit,omitempty" description:"True when the change was noticed from a message instead of a notification"`
+}
+
+type BlocklistV2 struct {
+	Changes []BlocklistChangeV2 `json:"changes,omitempty"`
+	Reload  bool                `json:"reload,omitempty" description:"True when the changes are not known and the blocklist should be fetched again"`
+}
+
+type BlocklistChangeV2 struct {
+	JID    string `json:"jid"`
+	Action string `json:"action" enum:"block,unblock"`
+}
+
+type NewsletterV2 struct {
+	JID      string `json:"jid"`
+	Name     string `json:"name,omitempty" description:"For NewsletterJoin"`
+	Role     string `json:"role,omitempty"`
+	Mute     string `json:"mute,omitempty" description:"For NewsletterMuteChange" enum:"on,off"`
+	Messages int    `json:"messages,omitempty" description:"Number of messages, for NewsletterLiveUpdate"`
+}
+
+type SendJobV2 struct {
+	Id         string          `json:"id" description:"Id of the job returned when the message was queued"`
+	Action     string          `json:"action" description:"Command that sent the message, like send_text"`
+	MessageId  string          `json:"message_id"`
+	Status     string          `json:"status" enum:"sent,failed"`
+	Code       int             `json:"code" description:"HTTP status code of the send"`
+	Error      string          `json:"error,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty" description:"Response of the send endpoint"`
+	SendAt     int64           `json:"send_at,omitempty" description:"Time a scheduled message was due, unix seconds"`
+	CampaignId string          `json:"campaign_id,omitempty" description:"Campaign the message was sent for"`
+}
+
+// Builds the v2 representation of an event from the postmap built by
+// myEventHandler
+func buildEventV2(postmap map[string]interface{}, eventID string, instanceID string, instanceName string) EventV2 {
+	event := EventV2{
+		Version:      2,
+		Id:           eventID,
+		InstanceId:   instanceID,
+		InstanceName: instanceName,
+		Timestamp:    time.Now().Unix(),
+	}
+	event.Type, _ = postmap["type"].(string)
+	event.Test, _ = postmap["test"].(bool)
+
+	setSource := func(source types.MessageSource, pushName string) {
+		event.Chat = &ChatV2{JID: source.Chat.ToNonAD().String(), IsGroup: source.IsGroup}
+		event.Sender = &SenderV2{JID: source.Sender.ToNonAD().String(), PushName: pushName, IsFromMe: source.IsFromMe}
+	}
+	setTimestamp := func(t time.Time) {
+		if !t.IsZero() {
+			event.Timestamp = t.Unix()
+		}
+	}
+
+	setCall := func(meta types.BasicCallMeta) {
+		caller := meta.From.ToNonAD().String()
+		event.Chat = &ChatV2{JID: caller}
+		event.Sender = &SenderV2{JID: caller}
+		setTimestamp(meta.Timestamp)
+		event.Call = &CallV2{Id: meta.CallID}
+		if !meta.CallCreator.IsEmpty() {
+			event.Call.Creator = meta.CallCreator.ToNonAD().String()
+		}
+		event.Call.Media, _ = postmap["media"].(string)
+		event.Call.Action, _ = postmap["action"].(string)
+	}
+
+	switch evt := postmap["event"].(type) {
+	case *events.Message:
+		setSource(evt.Info.MessageSource, evt.Info.PushName)
+		setTimestamp(evt.Info.Timestamp)
+		event.Message = buildMessageV2(evt, postmap)
+	case *events.Receipt:
+		setSource(evt.MessageSource, "")
+		setTimestamp(evt.Timestamp)
+		state, _ := postmap["state"].(string)
+		event.Receipt = &ReceiptV2{MessageIds: evt.MessageIDs, State: state}
+	case *events.Presence:
+		jid := evt.From.ToNonAD().String()
+		event.Chat = &ChatV2{JID: jid}
+		event.Sender = &SenderV2{JID: jid}
+		event.Presence = &PresenceV2{State: "online"}
+		if evt.Unavailable {
+			event.Presence.State = "offline"
+		}
+		if !evt.LastSeen.IsZero() {
+			event.Presence.LastSeen = evt.LastSeen.Unix()
+		}
+	case *events.ChatPresence:
+		setSource(evt.MessageSource, "")
+		event.ChatPresence = &ChatPresenceV2{State: string(evt.State), Media: string(evt.Media)}
+	case *events.HistorySync:
+		event.HistorySync = &HistorySyncV2{
+			SyncType:      evt.Data.GetSyncType().String(),
+			ChunkOrder:    evt.Data.GetChunkOrder(),
+			Progress:      evt.Data.GetProgress(),
+			Conversations: len(evt.Data.GetConversations()),
+		}
+	case *events.CallOffer:
+		setCall(evt.BasicCallMeta)
+		event.Call.Platform = evt.RemotePlatform
+		event.Call.Version = evt.RemoteVersion
+		_, event.Call.IsGroup = callOfferDetails(evt.Data)
+	case *events.CallOfferNotice:
+		setCall(evt.BasicCallMeta)
+		event.Call.IsGroup = evt.Type == "group"
+	case *events.CallAccept:
+		setCall(evt.BasicCallMeta)
+		event.Call.Platform = evt.RemotePlatform
+		event.Call.Version = evt.RemoteVersion
+	case *events.CallTerminate:
+		setCall(evt.BasicCallMeta)
+		event.Call.Reason = evt.Reason
+		event.Call.State, _ = postmap["state"].(string)
+		event.Call.Duration, _ = postmap["duration"].(int64)
+	case *events.CallReject:
+		setCall(evt.BasicCallMeta)
+	case *events.GroupInfo:
+		event.Chat = &ChatV2{JID: evt.JID.String(), IsGroup: true}
+		if evt.Sender != nil {
+			event.Sender = &SenderV2{JID: evt.Sender.ToNonAD().String()}
+		}
+		setTimestamp(evt.Timestamp)
+		group := &GroupV2{
+			JID:     evt.JID.String(),
+			Join:    jidStrings(evt.Join),
+			Leave:   jidStrings(evt.Leave),
+			Promote: jidStrings(evt.Promote),
+			Demote:  jidStrings(evt.Demote),
+			Reason:  evt.JoinReason,
+		}
+		if evt.Name != nil {
+			group.Name = evt.Name.Name
+		}
+		if evt.Topic != nil {
+			group.Topic = evt.Topic.Topic
+		}
+		if evt.Locked != nil {
+			group.Locked = &evt.Locked.IsLocked
+		}
+		if evt.Announce != nil {
+			group.Announce = &evt.Announce.IsAnnounce
+		}
+		if evt.Ephemeral != nil {
+			group.EphemeralSeconds = &evt.Ephemeral.DisappearingTimer
+		}
+		if evt.NewInviteLink != nil {
+			group.InviteLink = *evt.NewInviteLink
+		}
+		if evt.Delete != nil {
+			group.Deleted = evt.Delete.Deleted
+		}
+		event.Group = group
+	case *events.JoinedGroup:
+		event.Chat = &ChatV2{JID: evt.JID.String(), IsGroup: true}
+		if evt.Sender != nil {
+			event.Sender = &SenderV2{JID: evt.Sender.ToNonAD().String()}
+		}
+		event.Group = &GroupV2{
+			JID:          evt.JID.String(),
+			Name:         evt.Name,
+			Topic:        evt.Topic,
+			Reason:       evt.Reason,
+			Participants: len(evt.Participants),
+		}
+	case *events.Picture:
+		jid := evt.JID.ToNonAD().String()
+		event.Chat = &ChatV2{JID: jid, IsGroup: evt.JID.Server == types.GroupServer}
+		if !evt.Author.IsEmpty() {
+			event.Sender = &SenderV2{JID: evt.Author.ToNonAD().String()}
+		}
+		setTimestamp(evt.Timestamp)
+		event.Picture = &PictureV2{JID: jid, PictureId: evt.PictureID, Removed: evt.Remove}
+		if event.Sender != nil {
+			event.Picture.Author = event.Sender.JID
+		}
+	case *events.UndecryptableMessage:
+		setSource(evt.Info.MessageSource, evt.Info.PushName)
+		setTimestamp(evt.Info.Timestamp)
+		event.Undecryptable = &UndecryptableV2{
+			MessageId:       evt.Info.ID,
+			Unavailable:     evt.IsUnavailable,
+			UnavailableType: string(evt.UnavailableType),
+			Hidden:          evt.DecryptFailMode == events.DecryptFailHide,
+		}
+	case *events.IdentityChange:
+		jid := evt.JID.ToNonAD().String()
+		event.Chat = &ChatV2{JID: jid}
+		event.Sender = &SenderV2{JID: jid}
+		setTimestamp(evt.Timestamp)
+		event.Identity = &IdentityV2{JID: jid, Implicit: evt.Implicit}
+	case *events.Blocklist:
+		event.Blocklist = &BlocklistV2{Reload: evt.Action == events.BlocklistActionModify}
+		for _, change := range evt.Changes {
+			event.Blocklist.Changes = append(event.Blocklist.Changes, BlocklistChangeV2{JID: change.JID.ToNonAD().String(), Action: string(change.Action)})
+		}
+	case *events.NewsletterJoin:
+		event.Chat = &ChatV2{JID: evt.ID.String()}
+		event.Newsletter = &NewsletterV2{JID: evt.ID.String(), Name: evt.ThreadMeta.Name.Text}
+		if evt.ViewerMeta != nil {
+			event.Newsletter.Role = string(evt.ViewerMeta.Role)
+			event.Newsletter.Mute = string(evt.ViewerMeta.Mute)
+		}
+	case *events.NewsletterLeave:
+		event.Chat = &ChatV2{JID: evt.ID.String()}
+		event.Newsletter = &NewsletterV2{JID: evt.ID.String(), Role: string(evt.Role)}
+	case *events.NewsletterMuteChange:
+		event.Chat = &ChatV2{JID: evt.ID.String()}
+		event.Newsletter = &NewsletterV2{JID: evt.ID.String(), Mute: string(evt.Mute)}
+	case *events.NewsletterLiveUpdate:
+		event.Chat = &ChatV2{JID: evt.JID.String()}
+		setTimestamp(evt.Time)
+		event.Newsletter = &NewsletterV2{JID: evt.JID.String(), Messages: len(evt.Messages)}
+	case *SendJob:
+		event.Chat = &ChatV2{JID: evt.Chat, IsGroup: strings.HasSuffix(evt.Chat, "@"+types.GroupServer)}
+		if evt.FinishedAt > 0 {
+			event.Timestamp = evt.FinishedAt
+		}
+		event.SendJob = &SendJobV2{
+			Id:         evt.Id,
+			Action:     evt.Action,
+			MessageId:  evt.MessageId,
+			Status:     evt.Status,
+			Code:       evt.Code,
+			Error:      evt.Error,
+			Data:       evt.Data,
+			SendAt:     evt.SendAt,
+			CampaignId: evt.CampaignId,
+		}
+	default:
+		raw, err := json.Marshal(postmap["event"])
+		if err == nil && string(raw) != "null" {
+			event.Raw = raw
+		}
+	}
+	return event
+}
+
+func buildMessageV2(evt *events.Message, postmap map[string]interface{}) *MessageV2 {
+	msg := evt.Message
+	message := &MessageV2{
+		Id:          evt.Info.ID,
+		Kind:        messageKind(msg),
+		Text:        messageText(msg),
+		IsViewOnce:  evt.IsViewOnce,
+		IsEphemeral: evt.IsEphemeral,
+	}
+	if contextInfo := messageContextInfo(msg); contextInfo != nil {
+		message.QuotedId = contextInfo.GetStanzaID()
+		message.IsForwarded = contextInfo.GetIsForwarded()
+	}
+
+	media := func(mimeType string, fileName string, size uint64) *MediaV2 {
+		m := &MediaV2{MimeType: mimeType, FileName: fileName, Size: size}
+		// Added by attachMedia when the file was downloaded
+		if object, ok := postmap["s3"].(map[string]interface{}); ok {
+			m.S3 = &StorageV2{}
+			m.S3.Bucket, _ = object["bucket"].(string)
+			m.S3.Key, _ = object["key"].(string)
+			m.S3.URL, _ = object["url"].(string)
+			m.S3.ExpiresAt, _ = object["expiresAt"].(int64)
+			m.S3.Size, _ = object["size"].(int64)
+		} else {
+			m.Base64, _ = postmap["base64"].(string)
+		}
+		if m.FileName == "" {
+			m.FileName, _ = postmap["fileName"].(string)
+		}
+		return m
+	}
+
+	switch {
+	case msg.GetImageMessage() != nil:
+		img := msg.GetImageMessage()
+		message.Media = media(img.GetMimetype(), "", img.GetFileLength())
+	case msg.GetAudioMessage() != nil:
+		audio := msg.GetAudioMessage()
+		message.Media = media(audio.GetMimetype(), "", audio.GetFileLength())
+		message.Media.Seconds = audio.GetSeconds()
+		message.Media.Voice = audio.GetPTT()
+	case msg.GetVideoMessage() != nil:
+		video := msg.GetVideoMessage()
+		message.Media = media(video.GetMimetype(), "", video.GetFileLength())
+		message.Media.Seconds = video.GetSeconds()
+	case msg.GetDocumentMessage() != nil:
+		document := msg.GetDocumentMessage()
+		message.Media = media(document.GetMimetype(), document.GetFileName(), document.GetFileLength())
+	case msg.GetDocumentWithCaptionMessage() != nil:
+		document := msg.GetDocumentWithCaptionMessage().GetMessage().GetDocumentMessage()
+		message.Media = media(document.GetMimetype(), document.GetFileName(), document.GetFileLength())
+	case msg.GetStickerMessage() != nil:
+		sticker := msg.GetStickerMessage()
+		message.Media = media(sticker.GetMimetype(), "", sticker.GetFileLength())
+	case msg.GetLocationMessage() != nil:
+		location := msg.GetLocationMessage()
+		message.Location = &LocationV2{
+			Latitude:  location.GetDegreesLatitude(),
+			Longitude: location.GetDegreesLongitude(),
+			Name:      location.GetName(),
+			Address:   location.GetAddress(),
+		}
+	case msg.GetLiveLocationMessage() != nil:
+		location := msg.GetLiveLocationMessage()
+		message.Location = &LocationV2{
+			Latitude:  location.GetDegreesLatitude(),
+			Longitude: location.GetDegreesLongitude(),
+			Live:      true,
+		}
+		message.Text = location.GetCaption()
+	case msg.GetContactMessage() != nil:
+		contact := msg.GetContactMessage()
+		message.Contacts = []ContactV2{{DisplayName: contact.GetDisplayName(), VCard: contact.GetVcard()}}
+	case msg.GetContactsArrayMessage() != nil:
+		for _, contact := range msg.GetContactsArrayMessage().GetContacts() {
+			message.Contacts = append(message.Contacts, ContactV2{DisplayName: contact.GetDisplayName(), VCard: contact.GetVcard()})
+		}
+	case msg.GetReactionMessage() != nil:
+		reaction := msg.GetReactionMessage()
+		message.Reaction = &ReactionV2{MessageId: reaction.GetKey().GetID(), Emoji: reaction.GetText()}
+	case msg.GetPollCreationMessage() != nil || msg.GetPollCreationMessageV3() != nil:
+		poll := msg.GetPollCreationMessage()
+		if poll == nil {
+			poll = msg.GetPollCreationMessageV3()
+		}
+		message.Poll = &PollV2{Name: poll.GetName()}
+		for _, option := range poll.GetOptions() {
+			message.Poll.Options = append(message.Poll.Options, option.GetOptionName())
+		}
+	case msg.GetPollUpdateMessage() != nil:
+		message.Poll = &PollV2{Vote: true}
+	case msg.GetProtocolMessage() != nil:
+		protocol := msg.GetProtocolMessage()
+		switch protocol.GetType() {
+		case waE2E.ProtocolMessage_REVOKE:
+			message.Kind = "revoke"
+			message.Revoke = &RevokeV2{MessageId: protocol.GetKey().GetID()}
+		case waE2E.ProtocolMessage_MESSAGE_EDIT:
+			message.Kind = "edit"
+			message.Edit = &EditV2{MessageId: protocol.GetKey().GetID(), Text: messageText(protocol.GetEditedMessage())}
+		}
+	}
+	return message
+}
+
+func jidStrings(jids []types.JID) []string {
+	var result []string
+	for _, jid := range jids {
+		result = append(result, jid.ToNonAD().String())
+	}
+	return result
+}
+
+// Returns the context info (reply and forward details) of the message
+func messageContextInfo(msg *waE2E.Message) *waE2E.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
+	case msg.GetLocationMessage() != nil:
+		return msg.GetLocationMessage().GetContextInfo()
+	case msg.GetContactMessage() != nil:
+		return msg.GetContactMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// Encodes an event once for each schema used by its subscribers
+type eventEncoder struct {
+	postmap      map[string]interface{}
+	eventID      string
+	instanceID   string
+	instanceName string
+	encoded      map[string][]byte
+}
+
+func newEventEncoder(postmap map[string]interface{}, eventID string, instanceID string, instanceName string) *eventEncoder {
+	return &eventEncoder{postmap: postmap, eventID: eventID, instanceID: instanceID, instanceName: instanceName, encoded: map[string][]byte{}}
+}
+
+func (e *eventEncoder) Encode(schema string) ([]byte, error) {
+	if schema != webhookSchemaV2 {
+		schema = webhookSchemaV1
+	}
+	if data, ok := e.encoded[schema]; ok {
+		return data, nil
+	}
+	var data []byte
+	var err error
+	if schema == webhookSchemaV2 {
+		data, err = json.Marshal(buildEventV2(e.postmap, e.eventID, e.instanceID, e.instanceName))
+	} else {
+		data, err = json.Marshal(e.postmap)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.encoded[schema] = data
+	return data, nil
+}
+
+// Generates the JSON Schema of the v2 events from the Go types
+func eventSchemaV2() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	schema := jsonSchemaOfStruct(reflect.TypeOf(EventV2{}), definitions)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "wuzapi webhook event v2"
+	schema["$defs"] = definitions
+	return schema
+}
+
+func jsonSchemaOf(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaOf(t.Elem(), definitions)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		if t == reflect.TypeOf(json.RawMessage{}) {
+			return map[string]interface{}{}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchemaOf(t.Elem(), definitions)}
+	case reflect.Struct:
+		if _, ok := definitions[t.Name()]; !ok {
+			definitions[t.Name()] = jsonSchemaOfStruct(t, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func jsonSchemaOfStruct(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		property := jsonSchemaOf(field.Type, definitions)
+		if description := field.Tag.Get("description"); description != "" {
+			if _, ok := property["$ref"]; ok {
+				property = map[string]interface{}{"allOf": []interface{}{property}}
+			}
+			property["description"] = description
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			values := []interface{}{}
+			for _, value := range strings.Split(enum, ",") {
+				if property["type"] == "integer" {
+					var n int
+					fmt.Sscan(value, &n)
+					values = append(values, n)
+				} else {
+					values = append(values, value)
+				}
+			}
+			property["enum"] = values
+		}
+		properties[name] = property
+		if options != "omitempty" {
+			required = append(required, name)
+		}
+	}
+	// Additional properties are allowed, new optional fields can be added
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBuildEventV2Message(t *testing.T) {
+	chat := types.NewJID("120363000000000000", types.GroupServer)
+	sender := types.JID{User: "5491155554444", Device: 3, Server: types.DefaultUserServer}
+	sent := time.Unix(1767225600, 0)
+	evt := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsGroup: true},
+			ID:            "MSG1",
+			PushName:      "Ana",
+			Timestamp:     sent,
+		},
+		Message: &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+			Mimetype:    proto.String("image/jpeg"),
+			Caption:     proto.String("Invoice"),
+			FileLength:  proto.Uint64(2048),
+			ContextInfo: &waE2E.ContextInfo{StanzaID: proto.String("MSG0"), IsForwarded: proto.Bool(true)},
+		}},
+	}
+	postmap := map[string]interface{}{"type": "Message", "event": evt, "base64": "AAAA", "fileName": "MSG1.jpg"}
+
+	event := buildEventV2(postmap, "evt1", "u1", "Shop")
+	if event.Version != 2 || event.Id != "evt1" || event.InstanceId != "u1" || event.InstanceName != "Shop" || event.Type != "Message" {
+		t.Errorf("envelope = %+v", event)
+	}
+	if event.Timestamp != sent.Unix() {
+		t.Errorf("timestamp = %d, want the message time %d", event.Timestamp, sent.Unix())
+	}
+	// Device suffixes are dropped
+	if event.Chat == nil || event.Chat.JID != chat.String() || !event.Chat.IsGroup {
+		t.Errorf("chat = %+v", event.Chat)
+	}
+	if event.Sender == nil || event.Sender.JID != "5491155554444@s.whatsapp.net" || event.Sender.PushName != "Ana" || event.Sender.IsFromMe {
+		t.Errorf("sender = %+v", event.Sender)
+	}
+	msg := event.Message
+	if msg == nil || msg.Id != "MSG1" || msg.Kind != "image" || msg.Text != "Invoice" || msg.QuotedId != "MSG0" || !msg.IsForwarded {
+		t.Fatalf("message = %+v", msg)
+	}
+	if msg.Media == nil || msg.Media.MimeType != "image/jpeg" || msg.Media.Size != 2048 || msg.Media.Base64 != "AAAA" || msg.Media.FileName != "MSG1.jpg" || msg.Media.S3 != nil {
+		t.Errorf("media = %+v", msg.Media)
+	}
+	if event.Raw != nil || event.Receipt != nil {
+		t.Errorf("message event has other fields set: %+v", event)
+	}
+
+	// Media uploaded to S3 is not sent base64 encoded
+	postmap["s3"] = map[string]interface{}{"bucket": "media", "key": "wuzapi/u1/MSG1.jpg", "url": "https://s3/x", "expiresAt": int64(10), "size": int64(2048)}
+	media := buildEventV2(postmap, "evt1", "u1", "Shop").Message.Media
+	if media.Base64 != "" || media.S3 == nil || *media.S3 != (StorageV2{Bucket: "media", Key: "wuzapi/u1/MSG1.jpg", URL: "https://s3/x", ExpiresAt: 10, Size: 2048}) {
+		t.Errorf("media in S3 = %+v %+v", media, media.S3)
+	}
+}
+
+func TestBuildEventV2MessageKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *waE2E.Message
+		check   func(*MessageV2) bool
+	}{
+		{"text", &waE2E.Message{Conversation: proto.String("hi")}, func(m *MessageV2) bool {
+			return m.Kind == "text" && m.Text == "hi" && m.Media == nil
+		}},
+		{"voice note", &waE2E.Message{AudioMessage: &waE2E.AudioMessage{Mimetype: proto.String("audio/ogg"), Seconds: proto.Uint32(7), PTT: proto.Bool(true)}}, func(m *MessageV2) bool {
+			return m.Kind == "audio" && m.Media.Seconds == 7 && m.Media.Voice
+		}},
+		{"document", &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{Mimetype: proto.String("application/pdf"), FileName: proto.String("a.pdf")}}, func(m *MessageV2) bool {
+			return m.Kind == "document" && m.Media.FileName == "a.pdf"
+		}},
+		{"location", &waE2E.Message{LocationMessage: &waE2E.LocationMessage{DegreesLatitude: proto.Float64(-34.6), DegreesLongitude: proto.Float64(-58.4)}}, func(m *MessageV2) bool {
+			return m.Kind == "location" && m.Location.Latitude == -34.6 && !m.Location.Live
+		}},
+		{"reaction", &waE2E.Message{ReactionMessage: &waE2E.ReactionMessage{Key: &waCommon.MessageKey{ID: proto.String("MSG0")}, Text: proto.String("👍")}}, func(m *MessageV2) bool {
+			return m.Kind == "reaction" && m.Reaction.MessageId == "MSG0" && m.Reaction.Emoji == "👍"
+		}},
+		{"revoke", &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{Type: waE2E.ProtocolMessage_REVOKE.Enum(), Key: &waCommon.MessageKey{ID: proto.String("MSG0")}}}, func(m *MessageV2) bool {
+			return m.Kind == "revoke" && m.Revoke.MessageId == "MSG0"
+		}},
+		{"edit", &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+			Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+			Key:           &waCommon.MessageKey{ID: proto.String("MSG0")},
+			EditedMessage: &waE2E.Message{Conversation: proto.String("fixed")},
+		}}, func(m *MessageV2) bool {
+			return m.Kind == "edit" && m.Edit.MessageId == "MSG0" && m.Edit.Text == "fixed"
+		}},
+	}
+	for _, tt := range tests {
+		postmap := map[string]interface{}{"type": "Message", "event": &events.Message{Info: types.MessageInfo{ID: "MSG1"}, Message: tt.message}}
+		message := buildEventV2(postmap, "evt1", "u1", "").Message
+		if message == nil || !tt.check(message) {
+			data, _ := json.Marshal(message)
+			t.Errorf("%s: message = %s", tt.name, data)
+		}
+	}
+}
+
+func TestBuildEventV2OtherEvents(t *testing.T) {
+	contact := types.NewJID("5491155554444", types.DefaultUserServer)
+	receipt := buildEventV2(map[string]interface{}{
+		"type":  "ReadReceipt",
+		"state": "Read",
+		"event": &events.Receipt{
+			MessageSource: types.MessageSource{Chat: contact, Sender: contact},
+			MessageIDs:    []types.MessageID{"MSG1", "MSG2"},
+			Type:          types.ReceiptTypeRead,
+		},
+	}, "evt1", "u1", "")
+	if receipt.Receipt == nil || receipt.Receipt.State != "Read" || len(receipt.Receipt.MessageIds) != 2 || receipt.Chat.JID != contact.String() {
+		t.Errorf("receipt = %+v %+v", receipt, receipt.Receipt)
+	}
+
+	lastSeen := time.Unix(1767225600, 0)
+	presence := buildEventV2(map[string]interface{}{"type": "Presence", "event": &events.Presence{From: contact, Unavailable: true, LastSeen: lastSeen}}, "evt2", "u1", "")
+	if presence.Presence == nil || presence.Presence.State != "offline" || presence.Presence.LastSeen != lastSeen.Unix() || presence.Sender.JID != contact.String() {
+		t.Errorf("presence = %+v %+v", presence, presence.Presence)
+	}
+
+	// Types without a v2 representation carry the whatsmeow event
+	before := time.Now().Unix()
+	other := buildEventV2(map[string]interface{}{"type": "Connected", "event": &events.Connected{}}, "evt3", "u1", "")
+	if string(other.Raw) != "{}" || other.Timestamp < before {
+		t.Errorf("other event = raw %s at %d", other.Raw, other.Timestamp)
+	}
+	if empty := buildEventV2(map[string]interface{}{"type": "Test"}, "evt4", "u1", ""); empty.Raw != nil {
+		t.Errorf("event without data has raw %s", empty.Raw)
+	}
+}
+
+func TestValidateWebhookSchema(t *testing.T) {
+	for value, want := range map[string]string{"": webhookSchemaV1, "v1": webhookSchemaV1, "v2": webhookSchemaV2} {
+		if got, err := validateWebhookSchema(value); err != nil || got != want {
+			t.Errorf("validateWebhookSchema(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := validateWebhookSchema("v3"); err == nil {
+		t.Error("validateWebhookSchema(v3) should fail")
+	}
+}
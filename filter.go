@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Subscriptions (the main webhook, endpoints and the firehose) can have a
+// filter that further restricts the events they get. Filters are stored as
+// JSON and compiled once, the compiled filters are cached by their JSON.
+//
+// Rules about chats only apply to events that have a chat, and the message
+// kinds only apply to Message events. The expression is evaluated over the
+// fields returned by eventFilterFields, for example:
+//
+//	is_group && (kind == "image" || text contains "invoice")
+
+type EventFilter struct {
+	Chats         string   `json:"chats,omitempty"`
+	ExcludeFromMe bool     `json:"exclude_from_me,omitempty"`
+	AllowChats    []string `json:"allow_chats,omitempty"`
+	DenyChats     []string `json:"deny_chats,omitempty"`
+	MessageKinds  []string `json:"message_kinds,omitempty"`
+	Expression    string   `json:"expression,omitempty"`
+
+	expr filterExpr
+}
+
+var messageKinds = []string{"text", "image", "audio", "video", "document", "sticker", "location", "contact", "reaction", "poll", "other"}
+
+// Fields that can be used in filter expressions
+var filterFields = []string{"type", "chat", "sender", "is_group", "is_from_me", "kind", "text", "push_name", "state"}
+
+const (
+	maxFilterExpressionLength = 1024
+	// Nesting of parentheses and negations in an expression
+	maxFilterExpressionDepth = 32
+	maxCachedEventFilters    = 10000
+)
+
+// Compiled filters by their JSON. Filters not used for an hour are dropped,
+// and past maxCachedEventFilters new ones are compiled on every use.
+var eventFilters = cache.New(time.Hour, 10*time.Minute)
+
+// Parses and validates a filter sent through the API and returns it as
+// stored in the database, an empty string when there is no filter
+func normalizeEventFilter(raw json.RawMessage) (string, error) {
+	trimmed := strings.TrimSpace(string(raw))
+	if trimmed == "" || trimmed == "null" || trimmed == "{}" {
+		return "", nil
+	}
+	filter, err := compileEventFilter(trimmed)
+	if err != nil {
+		return "", err
+	}
+	normalized, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+func compileEventFilter(raw string) (*EventFilter, error) {
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var filter EventFilter
+	if err := decoder.Decode(&filter); err != nil {
+		return nil, fmt.Errorf("invalid filter: %w", err)
+	}
+	if filter.Chats != "" && filter.Chats != "groups" && filter.Chats != "direct" {
+		return nil, fmt.Errorf("invalid filter chats: %s (allowed: groups, direct)", filter.Chats)
+	}
+	for _, kind := range filter.MessageKinds {
+		if !Find(messageKinds, kind) {
+			return nil, fmt.Errorf("invalid filter message kind: %s (allowed: %s)", kind, strings.Join(messageKinds, ", "))
+		}
+	}
+	if len(filter.Expression) > maxFilterExpressionLength {
+		return nil, fmt.Errorf("invalid filter expression: longer than %d characters", maxFilterExpressionLength)
+	}
+	if filter.Expression != "" {
+		expr, err := parseFilterExpression(filter.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter expression: %w", err)
+		}
+		filter.expr = expr
+	}
+	return &filter, nil
+}
+
+// Returns the compiled filter stored as raw, nil when there is none
+func getEventFilter(raw string) *EventFilter {
+	if raw == "" {
+		return nil
+	}
+	if cached, ok := eventFilters.Get(raw); ok {
+		return cached.(*EventFilter)
+	}
+	filter, err := compileEventFilter(raw)
+	if err != nil {
+		// Filters are validated when saved, this only happens if the rules change
+		log.Error().Err(err).Str("filter", raw).Msg("Ignoring invalid event filter")
+		return nil
+	}
+	if eventFilters.ItemCount() < maxCachedEventFilters {
+		eventFilters.SetDefault(raw, filter)
+	}
+	return filter
+}
+
+// Returns the stored filter for API responses
+func eventFilterJSON(raw string) json.RawMessage {
+	if raw == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(raw)
+}
+
+// Match reports whether an event with the given fields passes the filter
+func (f *EventFilter) Match(fields map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	if chat, ok := fields["chat"].(string); ok {
+		isGroup, _ := fields["is_group"].(bool)
+		if f.Chats == "groups" && !isGroup || f.Chats == "direct" && isGroup {
+			return false
+		}
+		if len(f.AllowChats) > 0 && !matchChat(f.AllowChats, chat) {
+			return false
+		}
+		if matchChat(f.DenyChats, chat) {
+			return false
+		}
+	}
+	if f.ExcludeFromMe && fields["is_from_me"] == true {
+		return false
+	}
+	if len(f.MessageKinds) > 0 && fields["type"] == "Message" {
+		kind, _ := fields["kind"].(string)
+		if !Find(f.MessageKinds, kind) {
+			return false
+		}
+	}
+	if f.expr != nil && !f.expr.eval(fields) {
+		return false
+	}
+	return true
+}
+
+// Chats can be given as full JIDs or as the user part only (phone number or
+// group id)
+func matchChat(list []string, chat string) bool {
+	user := chat
+	if i := strings.IndexByte(chat, '@'); i >= 0 {
+		user = chat[:i]
+	}
+	for _, entry := range list {
+		if entry == chat || entry == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Extracts the fields filters work on from the postmap built by myEventHandler
+func eventFilterFields(postmap map[string]interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for _, key := range []string{"type", "state"} {
+		if value, ok := postmap[key].(string); ok {
+			fields[key] = value
+		}
+	}
+
+	// Events about a contact belong to the direct chat with them
+	setContact := func(jid types.JID) {
+		fields["chat"] = jid.ToNonAD().String()
+		fields["sender"] = jid.ToNonAD().String()
+		fields["is_group"] = false
+	}
+
+	setNewsletter := func(jid types.JID) {
+		fields["chat"] = jid.String()
+		fields["is_group"] = false
+	}
+
+	var source *types.MessageSource
+	switch evt := postmap["event"].(type) {
+	case *events.Message:
+		source = &evt.Info.MessageSource
+		fields["kind"] = messageKind(evt.Message)
+		fields["text"] = messageText(evt.Message)
+		fields["push_name"] = evt.Info.PushName
+	case *events.Receipt:
+		source = &evt.MessageSource
+	case *events.ChatPresence:
+		source = &evt.MessageSource
+	case *events.UndecryptableMessage:
+		source = &evt.Info.MessageSource
+	case *events.Presence:
+		setContact(evt.From)
+	case *events.IdentityChange:
+		setContact(evt.JID)
+	case *events.CallOffer:
+		setContact(evt.From)
+	case *events.CallOfferNotice:
+		setContact(evt.From)
+	case *events.CallAccept:
+		setContact(evt.From)
+	case *events.CallTerminate:
+		setContact(evt.From)
+	case *events.CallReject:
+		setContact(evt.From)
+	case *events.GroupInfo:
+		fields["chat"] = evt.JID.String()
+		fields["is_group"] = true
+		if evt.Sender != nil {
+			fields["sender"] = evt.Sender.ToNonAD().String()
+		}
+	case *events.JoinedGroup:
+		fields["chat"] = evt.JID.String()
+		fields["is_group"] = true
+		if evt.Sender != nil {
+			fields["sender"] = evt.Sender.ToNonAD().String()
+		}
+	case *events.Picture:
+		fields["chat"] = evt.JID.ToNonAD().String()
+		fields["is_group"] = evt.JID.Server == types.GroupServer
+		if !evt.Author.IsEmpty() {
+			fields["sender"] = evt.Author.ToNonAD().String()
+		}
+	case *events.NewsletterJoin:
+		setNewsletter(evt.ID)
+	case *events.NewsletterLeave:
+		setNewsletter(evt.ID)
+	case *events.NewsletterMuteChange:
+		setNewsletter(evt.ID)
+	case *events.NewsletterLiveUpdate:
+		setNewsletter(evt.JID)
+	case *SendJob:
+		fields["chat"] = evt.Chat
+		fields["is_group"] = strings.HasSuffix(evt.Chat, "@"+types.GroupServer)
+		fields["is_from_me"] = true
+	}
+	if source != nil {
+		fields["chat"] = source.Chat.ToNonAD().String()
+		fields["sender"] = source.Sender.ToNonAD().String()
+		fields["is_group"] = source.IsGroup
+		fields["is_from_me"] = source.IsFromMe
+	}
+	return fields
+}
+
+func messageKind(msg *waE2E.Message) string {
+	switch {
+	case msg == nil:
+		return "other"
+	case msg.GetConversation() != "" || msg.GetExtendedTextMessage() != nil:
+		return "text"
+	case msg.GetImageMessage() != nil:
+		return "image"
+	case msg.GetAudioMessage() != nil:
+		return "audio"
+	case msg.GetVideoMessage() != nil:
+		return "video"
+	case msg.GetDocumentMessage() != nil || msg.GetDocumentWithCaptionMessage() != nil:
+		return "document"
+	case msg.GetStickerMessage() != nil:
+		return "sticker"
+	case msg.GetLocationMessage() != nil || msg.GetLiveLocationMessage() != nil:
+		return "location"
+	case msg.GetContactMessage() != nil || msg.GetContactsArrayMessage() != nil:
+		return "contact"
+	case msg.GetReactionMessage() != nil:
+		return "reaction"
+	case msg.GetPollCreationMessage() != nil || msg.GetPollCreationMessageV3() != nil || msg.GetPollUpdateMessage() != nil:
+		return "poll"
+	}
+	return "other"
+}
+
+// Returns the text or caption of a message
+func messageText(msg *waE2E.Message) string {
+	switch {
+	case msg == nil:
+		return ""
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetCaption()
+	case msg.GetDocumentWithCaptionMessage() != nil:
+		return msg.GetDocumentWithCaptionMessage().GetMessage().GetDocumentMessage().GetCaption()
+	}
+	return ""
+}
+
+// Filter expressions:
+//
+//	expr    = or
+//	or      = and { ("||" | "or") and }
+//	and     = unary { ("&&" | "and") unary }
+//	unary   = ("!" | "not") unary | primary
+//	primary = "(" expr ")" | field [ op literal ]
+//	op      = "==" | "!=" | "contains" | "startswith"
+//	literal = string | number | "true" | "false"
+//
+// A field alone tests that it is true (or a non-empty string). Comparisons
+// with == and != are exact, contains and startswith ignore case. A field the
+// event does not have is different from any value. "!" negates the whole
+// comparison that follows it.
+
+type filterExpr interface {
+	eval(fields map[string]interface{}) bool
+}
+
+type filterAnd struct{ left, right filterExpr }
+type filterOr struct{ left, right filterExpr }
+type filterNot struct{ expr filterExpr }
+type filterField struct{ name string }
+type filterCompare struct {
+	field string
+	op    string
+	value string
+}
+
+func (e filterAnd) eval(fields map[string]interface{}) bool {
+	return e.left.eval(fields) && e.right.eval(fields)
+}
+
+func (e filterOr) eval(fields map[string]interface{}) bool {
+	return e.left.eval(fields) || e.right.eval(fields)
+}
+
+func (e filterNot) eval(fields map[string]interface{}) bool {
+	return !e.expr.eval(fields)
+}
+
+func (e filterField) eval(fields map[string]interface{}) bool {
+	switch value := fields[e.name].(type) {
+	case bool:
+		return value
+	case string:
+		return value != ""
+	}
+	return false
+}
+
+func (e filterCompare) eval(fields map[string]interface{}) bool {
+	raw, ok := fields[e.field]
+	if !ok {
+		return e.op == "!="
+	}
+	value := fmt.Sprint(raw)
+	switch e.op {
+	case "==":
+		return value == e.value
+	case "!=":
+		return value != e.value
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(e.value))
+	case "startswith":
+		return strings.HasPrefix(strings.ToLower(value), strings.ToLower(e.value))
+	}
+	return false
+}
+
+type filterToken struct {
+	kind  string // "ident", "string", "number", "op" or "eof"
+	value string
+}
+
+func tokenizeFilter(input string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, filterToken{"op", string(r)})
+			i++
+		case r == '!' || r == '=' || r == '&' || r == '|':
+			if i+1 < len(runes) && (runes[i+1] == '=' && (r == '!' || r == '=') || runes[i+1] == r && (r == '&' || r == '|')) {
+				tokens = append(tokens, filterToken{"op", string(runes[i : i+2])})
+				i += 2
+			} else if r == '!' {
+				tokens = append(tokens, filterToken{"op", "!"})
+				i++
+			} else {
+				return nil, fmt.Errorf("unexpected %q at position %d", r, i+1)
+			}
+		case r == '"' || r == '\'':
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				value.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			tokens = append(tokens, filterToken{"string", value.String()})
+			i = j + 1
+		case unicode.IsDigit(r) || r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, filterToken{"number", string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			word := string(runes[i:j])
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, filterToken{"op", "&&"})
+			case "or":
+				tokens = append(tokens, filterToken{"op", "||"})
+			case "not":
+				tokens = append(tokens, filterToken{"op", "!"})
+			case "contains", "startswith":
+				tokens = append(tokens, filterToken{"op", strings.ToLower(word)})
+			default:
+				tokens = append(tokens, filterToken{"ident", word})
+			}
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", r, i+1)
+		}
+	}
+	return append(tokens, filterToken{"eof", ""}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	depth  int
+}
+
+func parseFilterExpression(input string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q", p.peek().value)
+	}
+	return expr, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.tokens[p.pos]
+	if token.kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+func (p *filterParser) isOp(value string) bool {
+	token := p.peek()
+	return token.kind == "op" && token.value == value
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.isOp("||") {
+		p.next()
+		var right filterExpr
+		right, err = p.parseAnd()
+		left = filterOr{left, right}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.isOp("&&") {
+		p.next()
+		var right filterExpr
+		right, err = p.parseUnary()
+		left = filterAnd{left, right}
+	}
+	return left, err
+}
+
+// Parentheses and negations recurse, their nesting is limited so an
+// expression can not exhaust the stack
+func (p *filterParser) enter() error {
+	p.depth++
+	if p.depth > maxFilterExpressionDepth {
+		return fmt.Errorf("expression nested more than %d levels", maxFilterExpressionDepth)
+	}
+	return nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if p.isOp("!") {
+		p.next()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseUnary()
+		p.depth--
+		return filterNot{expr}, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterExpr, error) {
+	if p.isOp("(") {
+		p.next()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseOr()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.next()
+		return expr, nil
+	}
+
+	token := p.next()
+	if token.kind != "ident" {
+		if token.kind == "eof" {
+			return nil, errors.New("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("expected a field name, got %q", token.value)
+	}
+	if !Find(filterFields, token.value) {
+		return nil, fmt.Errorf("unknown field %s (allowed: %s)", token.value, strings.Join(filterFields, ", "))
+	}
+
+	op := p.peek()
+	if op.kind != "op" || (op.value != "==" && op.value != "!=" && op.value != "contains" && op.value != "startswith") {
+		return filterField{token.value}, nil
+	}
+	p.next()
+	literal := p.next()
+	switch {
+	case literal.kind == "string" || literal.kind == "number":
+	case literal.kind == "ident" && (literal.value == "true" || literal.value == "false"):
+	default:
+		return nil, fmt.Errorf("expected a value after %s", op.value)
+	}
+	return filterCompare{field: token.value, op: op.value, value: literal.value}, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenizeFilter(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []filterToken
+		err   string
+	}{
+		{
+			input: `kind == "image"`,
+			want:  []filterToken{{"ident", "kind"}, {"op", "=="}, {"string", "image"}, {"eof", ""}},
+		},
+		{
+			input: `text contains 'it\'s' and not is_group OR x != -12.5`,
+			want: []filterToken{
+				{"ident", "text"}, {"op", "contains"}, {"string", "it's"}, {"op", "&&"}, {"op", "!"},
+				{"ident", "is_group"}, {"op", "||"}, {"ident", "x"}, {"op", "!="}, {"number", "-12.5"}, {"eof", ""},
+			},
+		},
+		{
+			input: `!(a&&b)||c`,
+			want:  []filterToken{{"op", "!"}, {"op", "("}, {"ident", "a"}, {"op", "&&"}, {"ident", "b"}, {"op", ")"}, {"op", "||"}, {"ident", "c"}, {"eof", ""}},
+		},
+		{input: `kind = "image"`, err: "unexpected '='"},
+		{input: `a & b`, err: "unexpected '&'"},
+		{input: `text == "open`, err: "unterminated string"},
+		{input: `kind == -`, err: "unexpected '-'"},
+		{input: `kind == - 1`, err: "unexpected '-'"},
+		{input: `kind ~ "x"`, err: "unexpected '~'"},
+	}
+	for _, tt := range tests {
+		got, err := tokenizeFilter(tt.input)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("tokenizeFilter(%q) error = %v, want %q", tt.input, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tokenizeFilter(%q) error = %v", tt.input, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("tokenizeFilter(%q) = %v, want %v", tt.input, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("tokenizeFilter(%q) token %d = %v, want %v", tt.input, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseFilterExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"", "unexpected end of expression"},
+		{"kind ==", "expected a value after =="},
+		{"kind == is_group", "expected a value after =="},
+		{"(kind == \"image\"", "missing closing parenthesis"},
+		{"kind == \"image\")", `unexpected ")"`},
+		{"is_group is_from_me", `unexpected "is_from_me"`},
+		{"body contains \"x\"", "unknown field body"},
+		{"is_group &&", "unexpected end of expression"},
+		{"|| is_group", `expected a field name, got "||"`},
+		{"\"image\" == kind", `expected a field name, got "image"`},
+		{"!", "unexpected end of expression"},
+		{strings.Repeat("(", maxFilterExpressionDepth+1) + "is_group" + strings.Repeat(")", maxFilterExpressionDepth+1), "nested more than 32 levels"},
+		{strings.Repeat("!", maxFilterExpressionDepth+1) + "is_group", "nested more than 32 levels"},
+		{strings.Repeat("!(", 100000), "nested more than 32 levels"},
+	}
+	for _, tt := range tests {
+		_, err := parseFilterExpression(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseFilterExpression(%.40q) error = %v, want %q", tt.input, err, tt.err)
+		}
+	}
+
+	// Nesting up to the limit is fine, also one after the other
+	nested := strings.Repeat("(", maxFilterExpressionDepth) + "is_group" + strings.Repeat(")", maxFilterExpressionDepth)
+	if _, err := parseFilterExpression(nested + " && " + nested + " || !" + strings.Repeat("!", maxFilterExpressionDepth-1) + "is_group"); err != nil {
+		t.Errorf("expression nested %d levels error = %v", maxFilterExpressionDepth, err)
+	}
+}
+
+func TestFilterExpressionEval(t *testing.T) {
+	groupImage := map[string]interface{}{
+		"type":       "Message",
+		"chat":       "120363000000000000@g.us",
+		"sender":     "5491155554444@s.whatsapp.net",
+		"is_group":   true,
+		"is_from_me": false,
+		"kind":       "image",
+		"text":       "Invoice #42 attached",
+		"push_name":  "",
+	}
+	receipt := map[string]interface{}{
+		"type":     "ReadReceipt",
+		"chat":     "5491155554444@s.whatsapp.net",
+		"is_group": false,
+		"state":    "Read",
+	}
+
+	tests := []struct {
+		expr   string
+		fields map[string]interface{}
+		want   bool
+	}{
+		{`is_group`, groupImage, true},
+		{`is_from_me`, groupImage, false},
+		{`text`, groupImage, true},
+		{`push_name`, groupImage, false},
+		{`kind == "image"`, groupImage, true},
+		{`kind == "IMAGE"`, groupImage, false},
+		{`kind != "image"`, groupImage, false},
+		{`is_group == true`, groupImage, true},
+		{`is_group == false`, receipt, true},
+		{`text contains "INVOICE"`, groupImage, true},
+		{`text startswith "invoice"`, groupImage, true},
+		{`text startswith "42"`, groupImage, false},
+		{`chat startswith 549`, receipt, true},
+
+		// A field the event does not have differs from any value
+		{`kind == "image"`, receipt, false},
+		{`kind != "image"`, receipt, true},
+		{`kind contains ""`, receipt, false},
+		{`kind`, receipt, false},
+
+		// ! negates the whole comparison, not the field
+		{`!text contains "invoice"`, groupImage, false},
+		{`not kind == "video"`, groupImage, true},
+		{`!!is_group`, groupImage, true},
+
+		// && binds tighter than ||
+		{`is_from_me && kind == "image" || is_group`, groupImage, true},
+		{`is_group || is_from_me && kind == "video"`, groupImage, true},
+		{`(is_group || is_from_me) && kind == "video"`, groupImage, false},
+		{`!is_group || kind == "image" && text contains "invoice"`, groupImage, true},
+		{`!(is_group && kind == "image")`, groupImage, false},
+		{`type == "ReadReceipt" and state == "Read" or kind == "text"`, receipt, true},
+	}
+	for _, tt := range tests {
+		expr, err := parseFilterExpression(tt.expr)
+		if err != nil {
+			t.Errorf("parseFilterExpression(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if got := expr.eval(tt.fields); got != tt.want {
+			t.Errorf("eval(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompileEventFilterErrors(t *testing.T) {
+	tests := []struct {
+		raw string
+		err string
+	}{
+		{`{"chats":"everyone"}`, "invalid filter chats"},
+		{`{"message_kinds":["gif"]}`, "invalid filter message kind"},
+		{`{"expression":"kind =="}`, "invalid filter expression"},
+		{`{"unknown":true}`, "invalid filter"},
+		{`[]`, "invalid filter"},
+		{`{"expression":"` + strings.Repeat("is_group || ", 100) + `is_group"}`, "longer than 1024 characters"},
+	}
+	for _, tt := range tests {
+		_, err := compileEventFilter(tt.raw)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("compileEventFilter(%s) error = %v, want %q", tt.raw, err, tt.err)
+		}
+	}
+}
+
+func TestEventFilterMatch(t *testing.T) {
+	direct := map[string]interface{}{
+		"type":       "Message",
+		"chat":       "5491155554444@s.whatsapp.net",
+		"is_group":   false,
+		"is_from_me": false,
+		"kind":       "text",
+		"text":       "hello",
+	}
+	group := map[string]interface{}{
+		"type":       "Message",
+		"chat":       "120363000000000000@g.us",
+		"is_group":   true,
+		"is_from_me": true,
+		"kind":       "image",
+	}
+	receipt := map[string]interface{}{
+		"type":     "ReadReceipt",
+		"chat":     "5491155554444@s.whatsapp.net",
+		"is_group": false,
+	}
+	connected := map[string]interface{}{"type": "Connected"}
+
+	tests := []struct {
+		name   string
+		filter string
+		fields map[string]interface{}
+		want   bool
+	}{
+		{"groups only, group", `{"chats":"groups"}`, group, true},
+		{"groups only, direct", `{"chats":"groups"}`, direct, false},
+		{"direct only, direct", `{"chats":"direct"}`, direct, true},
+		{"direct only, group", `{"chats":"direct"}`, group, false},
+		{"chat rules skip events without chat", `{"chats":"groups","allow_chats":["1"]}`, connected, true},
+		{"allow by phone", `{"allow_chats":["5491155554444"]}`, direct, true},
+		{"allow by jid", `{"allow_chats":["5491155554444@s.whatsapp.net"]}`, receipt, true},
+		{"allow other chat", `{"allow_chats":["5491100000000"]}`, direct, false},
+		{"deny by group id", `{"deny_chats":["120363000000000000"]}`, group, false},
+		{"deny other chat", `{"deny_chats":["120363000000000000"]}`, direct, true},
+		{"deny wins over allow", `{"allow_chats":["5491155554444"],"deny_chats":["5491155554444"]}`, direct, false},
+		{"exclude from me", `{"exclude_from_me":true}`, group, false},
+		{"exclude from me, incoming", `{"exclude_from_me":true}`, direct, true},
+		{"kinds, listed", `{"message_kinds":["text","audio"]}`, direct, true},
+		{"kinds, not listed", `{"message_kinds":["text","audio"]}`, group, false},
+		{"kinds skip other events", `{"message_kinds":["text"]}`, receipt, true},
+		{"expression", `{"expression":"text contains \"HELLO\""}`, direct, true},
+		{"expression fails", `{"expression":"is_group"}`, direct, false},
+		{"rules and expression", `{"chats":"groups","expression":"kind == \"image\""}`, group, true},
+	}
+	for _, tt := range tests {
+		filter, err := compileEventFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: compileEventFilter error = %v", tt.name, err)
+			continue
+		}
+		if got := filter.Match(tt.fields); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var none *EventFilter
+	if !none.Match(group) {
+		t.Error("nil filter should match every event")
+	}
+}
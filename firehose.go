@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// The firehose is a global webhook configured by the admin that receives the
+// events of every session, tagged with the user id and name, regardless of
+// the user's own subscriptions. Its deliveries go through the outbox like
+// any other webhook, with firehoseWebhookID as webhook id, and are hidden
+// from the users' delivery log and failed list.
+
+const firehoseWebhookID = "firehose"
+
+var firehosecache = cache.New(5*time.Minute, 10*time.Minute)
+
+type Firehose struct {
+	URL       string `db:"url"`
+	Events    string `db:"events"`
+	Secret    string `db:"secret"`
+	Format    string `db:"format"`
+	Enabled   bool   `db:"enabled"`
+	UpdatedAt int64  `db:"updated_at"`
+	Filter    string `db:"filter"`
+	Schema    string `db:"schema"`
+}
+
+const firehoseColumns = "url, events, secret, format, enabled, updated_at, filter, schema"
+
+// Checks if the firehose is active and subscribed to the given event type
+func (f Firehose) Subscribed(eventType string) bool {
+	if !f.Enabled || f.URL == "" {
+		return false
+	}
+	events := strings.Split(f.Events, ",")
+	return Find(events, eventType) || Find(events, "All")
+}
+
+func (f Firehose) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"url":        f.URL,
+		"events":     strings.Split(f.Events, ","),
+		"secret":     f.Secret,
+		"format":     f.Format,
+		"enabled":    f.Enabled,
+		"updated_at": f.UpdatedAt,
+		"filter":     eventFilterJSON(f.Filter),
+		"schema":     f.Schema,
+	}
+}
+
+// Returns the firehose configuration, empty when it was never set
+func getFirehose(db *sqlx.DB) Firehose {
+	if cached, found := firehosecache.Get(firehoseWebhookID); found {
+		return cached.(Firehose)
+	}
+	firehose := Firehose{Events: "All", Format: webhookFormatForm, Schema: webhookSchemaV1}
+	err := db.Get(&firehose, "SELECT "+firehoseColumns+" FROM firehose WHERE id=$1", firehoseWebhookID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Msg("Could not load firehose settings")
+		return firehose
+	}
+	firehosecache.Set(firehoseWebhookID, firehose, cache.DefaultExpiration)
+	return firehose
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestFirehoseSubscribed(t *testing.T) {
+	tests := []struct {
+		name     string
+		firehose Firehose
+		event    string
+		want     bool
+	}{
+		{"all events", Firehose{URL: "https://example.com", Events: "All", Enabled: true}, "Message", true},
+		{"listed", Firehose{URL: "https://example.com", Events: "Message,ReadReceipt", Enabled: true}, "ReadReceipt", true},
+		{"not listed", Firehose{URL: "https://example.com", Events: "Message", Enabled: true}, "Presence", false},
+		{"disabled", Firehose{URL: "https://example.com", Events: "All"}, "Message", false},
+		{"no url", Firehose{Events: "All", Enabled: true}, "Message", false},
+	}
+	for _, tt := range tests {
+		if got := tt.firehose.Subscribed(tt.event); got != tt.want {
+			t.Errorf("%s: Subscribed(%s) = %v, want %v", tt.name, tt.event, got, tt.want)
+		}
+	}
+}
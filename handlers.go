@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -18,6 +19,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 	"github.com/nfnt/resize"
 	"github.com/patrickmn/go-cache"
 	"github.com/rs/zerolog/log"
@@ -39,7 +41,14 @@ func (v Values) Get(key string) string {
 	return v.m[key]
 }
 
-var messageTypes = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
+var messageTypes = []string{
+	"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence",
+	"CallOffer", "CallOfferNotice", "CallAccept", "CallTerminate", "CallReject",
+	"GroupInfo", "JoinedGroup", "Picture", "UndecryptableMessage", "IdentityChange", "Blocklist",
+	"NewsletterJoin", "NewsletterLeave", "NewsletterMuteChange", "NewsletterLiveUpdate",
+	"SendJob",
+	"All",
+}
 
 func (s *server) authadmin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +72,9 @@ func (s *server) authalice(next http.Handler) http.Handler {
 		events := ""
 		proxy_url := ""
 		qrcode := ""
+		includeToken := ""
+		webhookFilter := ""
+		webhookSchema := ""
 
 		// Get token from headers or uri parameters
 		token := r.Header.Get("token")
@@ -74,27 +86,30 @@ func (s *server) authalice(next http.Handler) http.Handler {
 		if !found {
 			log.Info().Msg("Looking for user information in DB")
 			// Checks DB from matching user and store user values in context
-			rows, err := s.db.Query("SELECT id,name,webhook,jid,events,proxy_url,qrcode FROM users WHERE token=$1 LIMIT 1", token)
+			rows, err := s.db.Query("SELECT id,name,webhook,jid,events,proxy_url,qrcode,webhook_include_token,webhook_filter,webhook_schema FROM users WHERE token=$1 LIMIT 1", token)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
 			}
 			defer rows.Close()
 			for rows.Next() {
-				err = rows.Scan(&txtid, &name, &webhook, &jid, &events, &proxy_url, &qrcode)
+				err = rows.Scan(&txtid, &name, &webhook, &jid, &events, &proxy_url, &qrcode, &includeToken, &webhookFilter, &webhookSchema)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, err)
 					return
 				}
 				v := Values{map[string]string{
-					"Id":      txtid,
-					"Name":    name,
-					"Jid":     jid,
-					"Webhook": webhook,
-					"Token":   token,
-					"Proxy":   proxy_url,
-					"Events":  events,
-					"Qrcode":  qrcode,
+					"Id":            txtid,
+					"Name":          name,
+					"Jid":           jid,
+					"Webhook":       webhook,
+					"Token":         token,
+					"Proxy":         proxy_url,
+					"Events":        events,
+					"Qrcode":        qrcode,
+					"IncludeToken":  includeToken,
+					"WebhookFilter": webhookFilter,
+					"WebhookSchema": webhookSchema,
 				}}
 
 				userinfocache.Set(token, v, cache.NoExpiration)
@@ -256,16 +271,21 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		webhook := ""
 		events := ""
+		secret := ""
+		includeToken := true
+		format := ""
+		filter := ""
+		schema := ""
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 
-		rows, err := s.db.Query("SELECT webhook,events FROM users WHERE id=$1 LIMIT 1", txtid)
+		rows, err := s.db.Query("SELECT webhook,events,webhook_secret,webhook_include_token,webhook_format,webhook_filter,webhook_schema FROM users WHERE id=$1 LIMIT 1", txtid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %v", err)))
 			return
 		}
 		defer rows.Close()
 		for rows.Next() {
-			err = rows.Scan(&webhook, &events)
+			err = rows.Scan(&webhook, &events, &secret, &includeToken, &format, &filter, &schema)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %s", fmt.Sprintf("%s", err))))
 				return
@@ -279,7 +299,7 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		eventarray := strings.Split(events, ",")
 
-		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray}
+		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray, "secret": secret, "include_token": includeToken, "format": format, "filter": eventFilterJSON(filter), "schema": schema}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -321,9 +341,15 @@ func (s *server) DeleteWebhook() http.HandlerFunc {
 // UpdateWebhook updates the webhook URL and events for a user
 func (s *server) UpdateWebhook() http.HandlerFunc {
 	type updateWebhookStruct struct {
-		WebhookURL string   `json:"webhook"`
-		Events     []string `json:"events,omitempty"`
-		Active     bool     `json:"active"`
+		WebhookURL     string          `json:"webhook"`
+		Events         []string        `json:"events,omitempty"`
+		Active         bool            `json:"active"`
+		Secret         *string         `json:"secret,omitempty"`
+		GenerateSecret bool            `json:"generate_secret,omitempty"`
+		IncludeToken   *bool           `json:"include_token,omitempty"`
+		Format         *string         `json:"format,omitempty"`
+		Filter         json.RawMessage `json:"filter,omitempty"`
+		Schema         *string         `json:"schema,omitempty"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
@@ -337,6 +363,28 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 			return
 		}
 
+		if t.Format != nil {
+			if _, err := validateWebhookFormat(*t.Format); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if t.Schema != nil {
+			if _, err := validateWebhookSchema(*t.Schema); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		var filter *string
+		if t.Filter != nil {
+			normalized, err := normalizeEventFilter(t.Filter)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			filter = &normalized
+		}
+
 		webhook := t.WebhookURL
 
 		var eventstring string
@@ -370,11 +418,30 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 			return
 		}
 
+		secret, err := s.updateWebhookSettings(txtid, t.Secret, t.GenerateSecret, t.IncludeToken, t.Format, filter, t.Schema)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update webhook: %v", err)))
+			return
+		}
+
 		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
 		v = updateUserInfo(v, "Events", eventstring)
+		if t.IncludeToken != nil {
+			v = updateUserInfo(v, "IncludeToken", boolToFlag(*t.IncludeToken))
+		}
+		if filter != nil {
+			v = updateUserInfo(v, "WebhookFilter", *filter)
+		}
+		if t.Schema != nil {
+			schema, _ := validateWebhookSchema(*t.Schema)
+			v = updateUserInfo(v, "WebhookSchema", schema)
+		}
 		userinfocache.Set(token, v, cache.NoExpiration)
 
 		response := map[string]interface{}{"webhook": webhook, "events": t.Events, "active": t.Active}
+		if secret != "" {
+			response["secret"] = secret
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -387,8 +454,14 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 // SetWebhook sets the webhook URL and events for a user
 func (s *server) SetWebhook() http.HandlerFunc {
 	type webhookStruct struct {
-		WebhookURL string   `json:"webhookurl"`
-		Events     []string `json:"events,omitempty"`
+		WebhookURL     string          `json:"webhookurl"`
+		Events         []string        `json:"events,omitempty"`
+		Secret         *string         `json:"secret,omitempty"`
+		GenerateSecret bool            `json:"generate_secret,omitempty"`
+		IncludeToken   *bool           `json:"include_token,omitempty"`
+		Format         *string         `json:"format,omitempty"`
+		Filter         json.RawMessage `json:"filter,omitempty"`
+		Schema         *string         `json:"schema,omitempty"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
@@ -402,6 +475,28 @@ func (s *server) SetWebhook() http.HandlerFunc {
 			return
 		}
 
+		if t.Format != nil {
+			if _, err := validateWebhookFormat(*t.Format); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if t.Schema != nil {
+			if _, err := validateWebhookSchema(*t.Schema); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		var filter *string
+		if t.Filter != nil {
+			normalized, err := normalizeEventFilter(t.Filter)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			filter = &normalized
+		}
+
 		webhook := t.WebhookURL
 
 		// If events are provided, validate them
@@ -432,11 +527,30 @@ func (s *server) SetWebhook() http.HandlerFunc {
 			return
 		}
 
+		secret, err := s.updateWebhookSettings(txtid, t.Secret, t.GenerateSecret, t.IncludeToken, t.Format, filter, t.Schema)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set webhook: %v", err)))
+			return
+		}
+
 		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
 		v = updateUserInfo(v, "Events", eventstring)
+		if t.IncludeToken != nil {
+			v = updateUserInfo(v, "IncludeToken", boolToFlag(*t.IncludeToken))
+		}
+		if filter != nil {
+			v = updateUserInfo(v, "WebhookFilter", *filter)
+		}
+		if t.Schema != nil {
+			schema, _ := validateWebhookSchema(*t.Schema)
+			v = updateUserInfo(v, "WebhookSchema", schema)
+		}
 		userinfocache.Set(token, v, cache.NoExpiration)
 
 		response := map[string]interface{}{"webhook": webhook}
+		if secret != "" {
+			response["secret"] = secret
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -446,610 +560,780 @@ func (s *server) SetWebhook() http.HandlerFunc {
 	}
 }
 
-// Gets QR code encoded in Base64
-func (s *server) GetQR() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// Updates the webhook signing secret, whether the user token is included in
+// webhook payloads, the body format, the event filter and the event schema.
+// Returns the secret when it was set or generated.
+func (s *server) updateWebhookSettings(txtid string, secret *string, generate bool, includeToken *bool, format *string, filter *string, schema *string) (string, error) {
+	newSecret := ""
+	if generate {
+		var err error
+		newSecret, err = generateWebhookSecret()
+		if err != nil {
+			return "", err
+		}
+		secret = &newSecret
+	} else if secret != nil {
+		newSecret = *secret
+	}
+
+	if secret != nil {
+		if _, err := s.db.Exec("UPDATE users SET webhook_secret=$1 WHERE id=$2", *secret, txtid); err != nil {
+			return "", err
+		}
+	}
+	if includeToken != nil {
+		if _, err := s.db.Exec("UPDATE users SET webhook_include_token=$1 WHERE id=$2", boolToFlag(*includeToken), txtid); err != nil {
+			return "", err
+		}
+	}
+	if format != nil {
+		validFormat, err := validateWebhookFormat(*format)
+		if err != nil {
+			return "", err
+		}
+		if _, err := s.db.Exec("UPDATE users SET webhook_format=$1 WHERE id=$2", validFormat, txtid); err != nil {
+			return "", err
+		}
+	}
+	if filter != nil {
+		if _, err := s.db.Exec("UPDATE users SET webhook_filter=$1 WHERE id=$2", *filter, txtid); err != nil {
+			return "", err
+		}
+	}
+	if schema != nil {
+		validSchema, err := validateWebhookSchema(*schema)
+		if err != nil {
+			return "", err
+		}
+		if _, err := s.db.Exec("UPDATE users SET webhook_schema=$1 WHERE id=$2", validSchema, txtid); err != nil {
+			return "", err
+		}
+	}
+	return newSecret, nil
+}
 
+// Lists the additional webhook endpoints of a user
+func (s *server) ListWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		code := ""
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		var webhooks []Webhook
+		err := s.db.Select(&webhooks, "SELECT "+webhookColumns+" FROM webhooks WHERE user_id=$1 ORDER BY created_at", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhooks: %v", err)))
 			return
-		} else {
-			if clientManager.GetWhatsmeowClient(txtid).IsConnected() == false {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
-				return
-			}
-			rows, err := s.db.Query("SELECT qrcode AS code FROM users WHERE id=$1 LIMIT 1", txtid)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&code)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-			}
-			err = rows.Err()
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			if clientManager.GetWhatsmeowClient(txtid).IsLoggedIn() == true {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
-				return
-			}
 		}
 
-		log.Info().Str("instance", txtid).Str("qrcode", code).Msg("Get QR successful")
-		response := map[string]interface{}{"QRCode": fmt.Sprintf("%s", code)}
+		response := []map[string]interface{}{}
+		for _, wh := range webhooks {
+			response = append(response, wh.toMap())
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Logs out device from Whatsapp (requires to scan QR next time)
-func (s *server) Logout() http.HandlerFunc {
+// Gets one additional webhook endpoint
+func (s *server) GetWebhookEndpoint() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		jid := r.Context().Value("userinfo").(Values).Get("Jid")
+		id := mux.Vars(r)["id"]
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		} else {
-			if clientManager.GetWhatsmeowClient(txtid).IsLoggedIn() == true &&
-				clientManager.GetWhatsmeowClient(txtid).IsConnected() == true {
-				err := clientManager.GetWhatsmeowClient(txtid).Logout()
-				if err != nil {
-					log.Error().Str("jid", jid).Msg("Could not perform logout")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
-					return
-				} else {
-					log.Info().Str("jid", jid).Msg("Logged out")
-					clientManager.DeleteWhatsmeowClient(txtid)
-					killchannel[txtid] <- true
-				}
-			} else {
-				if clientManager.GetWhatsmeowClient(txtid).IsConnected() == true {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not logout as it was not logged in"))
-					return
-				} else {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not connected"))
-					return
-				}
+		var wh Webhook
+		err := s.db.Get(&wh, "SELECT "+webhookColumns+" FROM webhooks WHERE id=$1 AND user_id=$2", id, txtid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Webhook not found"))
+				return
 			}
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %v", err)))
+			return
 		}
 
-		response := map[string]interface{}{"Details": "Logged out"}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(wh.toMap())
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Pair by Phone. Retrieves the code to pair by phone number instead of QR
-func (s *server) PairPhone() http.HandlerFunc {
-
-	type pairStruct struct {
-		Phone string
+// Adds a webhook endpoint with its own subscribed events
+func (s *server) AddWebhookEndpoint() http.HandlerFunc {
+	type webhookEndpointStruct struct {
+		URL         string          `json:"url"`
+		Events      []string        `json:"events,omitempty"`
+		Enabled     *bool           `json:"enabled,omitempty"`
+		Description string          `json:"description,omitempty"`
+		Format      string          `json:"format,omitempty"`
+		Filter      json.RawMessage `json:"filter,omitempty"`
+		Schema      string          `json:"schema,omitempty"`
 	}
-
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t pairStruct
+		var t webhookEndpointStruct
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if err := validateWebhookURL(t.URL); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		isLoggedIn := clientManager.GetWhatsmeowClient(txtid).IsLoggedIn()
-		if isLoggedIn {
-			log.Error().Msg(fmt.Sprintf("%s", "Already paired"))
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Already paired"))
+		eventstring, err := validateWebhookEvents(t.Events)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		linkingCode, err := clientManager.GetWhatsmeowClient(txtid).PairPhone(t.Phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+		format, err := validateWebhookFormat(t.Format)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		filter, err := normalizeEventFilter(t.Filter)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		schema, err := validateWebhookSchema(t.Schema)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		response := map[string]interface{}{"LinkingCode": linkingCode}
-		responseJson, err := json.Marshal(response)
+		id, err := GenerateRandomID()
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			return
 		}
-		return
-	}
-}
-
-// Gets Connected and LoggedIn Status
-func (s *server) GetStatus() http.HandlerFunc {
-
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		userInfo := r.Context().Value("userinfo").(Values)
-
-		// Log all userinfo values
-		log.Info().
-			Str("Id", userInfo.Get("Id")).
-			Str("Jid", userInfo.Get("Jid")).
-			Str("Name", userInfo.Get("Name")).
-			Str("Webhook", userInfo.Get("Webhook")).
-			Str("Token", userInfo.Get("Token")).
-			Str("Events", userInfo.Get("Events")).
-			Str("Proxy", userInfo.Get("Proxy")).
-			Msg("User info values")
-
-		log.Info().Str("Name", userInfo.Get("Name")).Msg("User name")
-
-		txtid := userInfo.Get("Id")
-
-		/*
-			if clientManager.GetWhatsmeowClient(txtid) == nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-				return
-			}
-		*/
-
-		isConnected := clientManager.GetWhatsmeowClient(txtid).IsConnected()
-		isLoggedIn := clientManager.GetWhatsmeowClient(txtid).IsLoggedIn()
-
-		response := map[string]interface{}{
-			"id":        txtid,
-			"name":      userInfo.Get("Name"),
-			"connected": isConnected,
-			"loggedIn":  isLoggedIn,
-			"token":     userInfo.Get("Token"),
-			"jid":       userInfo.Get("Jid"),
-			"webhook":   userInfo.Get("Webhook"),
-			"events":    userInfo.Get("Events"),
-			"proxy_url": userInfo.Get("Proxy"),
-			"qrcode":    userInfo.Get("Qrcode"),
+		wh := Webhook{
+			Id:          id,
+			UserId:      txtid,
+			URL:         t.URL,
+			Events:      eventstring,
+			Enabled:     t.Enabled == nil || *t.Enabled,
+			Description: t.Description,
+			Format:      format,
+			CreatedAt:   time.Now().Unix(),
+			Filter:      filter,
+			Schema:      schema,
 		}
-		responseJson, err := json.Marshal(response)
+		_, err = s.db.Exec("INSERT INTO webhooks ("+webhookColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+			wh.Id, wh.UserId, wh.URL, wh.Events, boolToFlag(wh.Enabled), wh.Description, wh.Format, wh.CreatedAt, wh.Filter, wh.Schema)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not add webhook: %v", err)))
+			return
+		}
+		webhookcache.Delete(txtid)
+
+		responseJson, err := json.Marshal(wh.toMap())
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			s.Respond(w, r, http.StatusCreated, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends a document/attachment message
-func (s *server) SendDocument() http.HandlerFunc {
-
-	type documentStruct struct {
-		Caption     string
-		Phone       string
-		Document    string
-		FileName    string
-		Id          string
-		MimeType    string
-		ContextInfo waE2E.ContextInfo
+// Updates a webhook endpoint, only the fields present in the payload are changed
+func (s *server) UpdateWebhookEndpoint() http.HandlerFunc {
+	type webhookEndpointStruct struct {
+		URL         *string         `json:"url,omitempty"`
+		Events      []string        `json:"events,omitempty"`
+		Enabled     *bool           `json:"enabled,omitempty"`
+		Description *string         `json:"description,omitempty"`
+		Format      *string         `json:"format,omitempty"`
+		Filter      json.RawMessage `json:"filter,omitempty"`
+		Schema      *string         `json:"schema,omitempty"`
 	}
-
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		msgid := ""
-		var resp whatsmeow.SendResponse
+		id := mux.Vars(r)["id"]
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		decoder := json.NewDecoder(r.Body)
+		var t webhookEndpointStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t documentStruct
-		var err error
-		err = decoder.Decode(&t)
+		var wh Webhook
+		err = s.db.Get(&wh, "SELECT "+webhookColumns+" FROM webhooks WHERE id=$1 AND user_id=$2", id, txtid)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Webhook not found"))
+				return
+			}
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %v", err)))
 			return
 		}
 
-		if t.Document == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Document in Payload"))
-			return
+		if t.URL != nil {
+			if err := validateWebhookURL(*t.URL); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			wh.URL = *t.URL
 		}
-
-		if t.FileName == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing FileName in Payload"))
-			return
+		if t.Events != nil {
+			wh.Events, err = validateWebhookEvents(t.Events)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
 		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
+		if t.Enabled != nil {
+			wh.Enabled = *t.Enabled
 		}
-
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		if t.Description != nil {
+			wh.Description = *t.Description
 		}
-
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Document[0:29] == "data:application/octet-stream" {
-			var dataURL, err = dataurl.DecodeString(t.Document)
+		if t.Format != nil {
+			wh.Format, err = validateWebhookFormat(*t.Format)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusBadRequest, err)
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaDocument)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Document data should start with \"data:application/octet-stream;base64,\""))
-			return
 		}
-
-		msg := &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
-			URL:        proto.String(uploaded.URL),
-			FileName:   &t.FileName,
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			Mimetype: proto.String(func() string {
-				if t.MimeType != "" {
-					return t.MimeType
-				}
-				return http.DetectContentType(filedata)
-			}()),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			Caption:       proto.String(t.Caption),
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+		if t.Filter != nil {
+			wh.Filter, err = normalizeEventFilter(t.Filter)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
 			}
 		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
+		if t.Schema != nil {
+			wh.Schema, err = validateWebhookSchema(*t.Schema)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		_, err = s.db.Exec("UPDATE webhooks SET url=$1, events=$2, enabled=$3, description=$4, format=$5, filter=$6, schema=$7 WHERE id=$8 AND user_id=$9",
+			wh.URL, wh.Events, boolToFlag(wh.Enabled), wh.Description, wh.Format, wh.Filter, wh.Schema, wh.Id, txtid)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update webhook: %v", err)))
 			return
 		}
+		webhookcache.Delete(txtid)
 
-		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(wh.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Removes a webhook endpoint
+func (s *server) DeleteWebhookEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		result, err := s.db.Exec("DELETE FROM webhooks WHERE id=$1 AND user_id=$2", id, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete webhook: %v", err)))
+			return
+		}
+		if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Webhook not found"))
+			return
+		}
+		webhookcache.Delete(txtid)
+
+		response := map[string]interface{}{"Details": "Webhook deleted successfully", "id": id}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends an audio message
-func (s *server) SendAudio() http.HandlerFunc {
+// Parses an optional unix timestamp query parameter
+func queryUnix(r *http.Request, name string) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	ts, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, fmt.Errorf("invalid %s, must be a unix timestamp", name)
+	}
+	return ts, nil
+}
 
-	type audioStruct struct {
-		Phone       string
-		Audio       string
-		Caption     string
-		Id          string
-		ContextInfo waE2E.ContextInfo
+// Parses the optional limit query parameter of list endpoints
+func queryLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return 100, nil
 	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > 1000 {
+		return 0, errors.New("invalid limit, must be between 1 and 1000")
+	}
+	return limit, nil
+}
 
+// Lists webhook deliveries that exhausted their retries
+func (s *server) ListFailedWebhooks() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		from, err := queryUnix(r, "from")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t audioStruct
-		err := decoder.Decode(&t)
+		to, err := queryUnix(r, "to")
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		if t.Audio == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Audio in Payload"))
-			return
+		if to == 0 {
+			to = time.Now().Unix()
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		failed := []FailedWebhook{}
+		err = s.db.Select(&failed, "SELECT "+failedWebhookColumns+" FROM webhook_failed WHERE user_id=$1 AND webhook_id <> $2 AND failed_at >= $3 AND failed_at <= $4 ORDER BY failed_at DESC LIMIT $5",
+			txtid, firehoseWebhookID, from, to, limit)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get failed webhooks: %v", err)))
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		responseJson, err := json.Marshal(failed)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
+// Queues one failed webhook delivery again
+func (s *server) ReplayFailedWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
 
-		if t.Audio[0:14] == "data:audio/ogg" {
-			var dataURL, err = dataurl.DecodeString(t.Audio)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaAudio)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Audio data should start with \"data:audio/ogg;base64,\""))
+		replayed, err := outbox.Replay(txtid, id, 0, 0)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not replay webhook: %v", err)))
+			return
+		}
+		if replayed == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Failed webhook not found"))
 			return
 		}
 
-		ptt := true
-		mime := "audio/ogg; codecs=opus"
+		response := map[string]interface{}{"Details": "Webhook queued for delivery", "id": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
 
-		msg := &waE2E.Message{AudioMessage: &waE2E.AudioMessage{
-			URL:        proto.String(uploaded.URL),
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			//Mimetype:      proto.String(http.DetectContentType(filedata)),
-			Mimetype:      &mime,
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			PTT:           &ptt,
-		}}
+// Queues again all failed webhook deliveries in a time range
+func (s *server) ReplayFailedWebhooks() http.HandlerFunc {
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+	type replayStruct struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t replayStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
 			}
 		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		if t.From < 0 || t.To < 0 || (t.To > 0 && t.From > t.To) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("invalid time range"))
+			return
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		replayed, err := outbox.Replay(txtid, "", t.From, t.To)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not replay webhooks: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Details": "Webhooks queued for delivery", "replayed": replayed}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends an Image message
-func (s *server) SendImage() http.HandlerFunc {
-
-	type imageStruct struct {
-		Phone       string
-		Image       string
-		Caption     string
-		Id          string
-		MimeType    string
-		ContextInfo waE2E.ContextInfo
-	}
-
+// Lists logged webhook delivery attempts
+func (s *server) ListWebhookDeliveries() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		from, err := queryUnix(r, "from")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
-		err := decoder.Decode(&t)
+		to, err := queryUnix(r, "to")
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if to == 0 {
+			to = time.Now().Unix()
+		}
 
-		if t.Image == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
-			return
+		query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE user_id=$1 AND webhook_id <> $2 AND created_at >= $3 AND created_at <= $4"
+		args := []interface{}{txtid, firehoseWebhookID, from, to}
+		if eventType := r.URL.Query().Get("event_type"); eventType != "" {
+			args = append(args, eventType)
+			query += fmt.Sprintf(" AND event_type=$%d", len(args))
+		}
+		if webhookID, ok := r.URL.Query()["webhook_id"]; ok {
+			args = append(args, strings.Join(webhookID, ""))
+			query += fmt.Sprintf(" AND webhook_id=$%d", len(args))
+		}
+		if r.URL.Query().Get("failed") == "true" {
+			query += " AND error <> ''"
 		}
+		args = append(args, limit)
+		query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d", len(args))
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		deliveries := []WebhookDelivery{}
+		err = s.db.Select(&deliveries, query, args...)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook deliveries: %v", err)))
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		responseJson, err := json.Marshal(deliveries)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-		var thumbnailBytes []byte
+// Sends a sample event to the main webhook or to one of the endpoints and
+// reports the result right away, without going through the outbox
+func (s *server) TestWebhook() http.HandlerFunc {
 
-		if t.Image[0:10] == "data:image" {
-			var dataURL, err = dataurl.DecodeString(t.Image)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+	type testStruct struct {
+		Type      string `json:"type"`
+		WebhookId string `json:"webhook_id"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		userinfo := r.Context().Value("userinfo").(Values)
+		txtid := userinfo.Get("Id")
+
+		var t testStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
 			}
+		}
+		if t.Type == "" {
+			t.Type = "Message"
+		}
+		if !Find(messageTypes, t.Type) || t.Type == "All" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("invalid event type: %s", t.Type)))
+			return
+		}
 
-			// decode jpeg into image.Image
-			reader := bytes.NewReader(filedata)
-			img, _, err := image.Decode(reader)
+		webhookurl := userinfo.Get("Webhook")
+		schema := userinfo.Get("WebhookSchema")
+		if t.WebhookId != "" {
+			err := s.db.QueryRow("SELECT url, schema FROM webhooks WHERE id=$1 AND user_id=$2", t.WebhookId, txtid).Scan(&webhookurl, &schema)
 			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not decode image for thumbnail preparation: %v", err)))
+				if errors.Is(err, sql.ErrNoRows) {
+					s.Respond(w, r, http.StatusNotFound, errors.New("Webhook not found"))
+					return
+				}
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %v", err)))
 				return
 			}
+		} else if webhookurl == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("No webhook set"))
+			return
+		}
 
-			// resize to width 72 using Lanczos resampling and preserve aspect ratio
-			m := resize.Thumbnail(72, 72, img, resize.Lanczos3)
+		postmap, err := sampleWebhookEvent(t.Type)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		eventID, err := GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		jsonData, err := newEventEncoder(postmap, eventID, txtid, userinfo.Get("Name")).Encode(schema)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		data := map[string]string{"jsonData": string(jsonData)}
+		if userinfo.Get("IncludeToken") != "0" {
+			data["token"] = userinfo.Get("Token")
+		}
+
+		target := getWebhookTarget(s.db, txtid, t.WebhookId)
+		start := time.Now()
+		status, err := sendWebhook(webhookurl, data, txtid, "", target)
+		latency := time.Since(start).Milliseconds()
+		recordWebhookDelivery(s.db, WebhookDelivery{
+			UserId:     txtid,
+			WebhookId:  t.WebhookId,
+			URL:        webhookurl,
+			EventType:  t.Type,
+			Attempt:    1,
+			StatusCode: status,
+			LatencyMs:  latency,
+			Error:      errorString(err),
+			Test:       true,
+		})
 
-			tmpFile, err := os.CreateTemp("", "resized-*.jpg")
+		response := map[string]interface{}{
+			"url":         webhookurl,
+			"webhook_id":  t.WebhookId,
+			"type":        t.Type,
+			"delivered":   err == nil,
+			"status_code": status,
+			"latency_ms":  latency,
+			"error":       errorString(err),
+		}
+		var statusErr *webhookStatusError
+		if errors.As(err, &statusErr) {
+			response["response_body"] = statusErr.Body
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Returns the JSON Schema of the v2 webhook events
+func (s *server) GetWebhookSchema() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/schema+json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(eventSchemaV2()); err != nil {
+			log.Error().Err(err).Msg("Failed to encode webhook schema")
+		}
+	}
+}
+
+// Streams the session events as Server-Sent Events. Clients reconnecting with
+// the Last-Event-ID header (or the lastEventId query parameter) get the
+// buffered events they missed first.
+func (s *server) StreamEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("lastEventId")
+		}
+		var lastID uint64
+		if lastEventID != "" {
+			var err error
+			lastID, err = strconv.ParseUint(lastEventID, 10, 64)
 			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create temp file for thumbnail: %v", err)))
+				s.Respond(w, r, http.StatusBadRequest, errors.New("invalid Last-Event-ID"))
 				return
 			}
-			defer tmpFile.Close()
+		}
 
-			// write new image to file
-			if err := jpeg.Encode(tmpFile, m, nil); err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to encode jpeg: %v", err)))
-				return
-			}
+		// The stream stays open, so the server write timeout must not apply
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Warn().Err(err).Msg("Could not disable write deadline for event stream")
+		}
 
-			thumbnailBytes, err = os.ReadFile(tmpFile.Name())
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to read %s: %v", tmpFile.Name(), err)))
+		backlog, events, cancel := eventHub.Subscribe(txtid, lastID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		writeEvent := func(event HubEvent) error {
+			_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, event.Data)
+			return err
+		}
+
+		fmt.Fprint(w, "retry: 3000\n\n")
+		for _, event := range backlog {
+			if err := writeEvent(event); err != nil {
 				return
 			}
-
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/png;base64,\""))
+		}
+		if err := rc.Flush(); err != nil {
+			log.Error().Err(err).Msg("Event stream not supported by response writer")
 			return
 		}
 
-		msg := &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
-			Caption:    proto.String(t.Caption),
-			URL:        proto.String(uploaded.URL),
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			Mimetype: proto.String(func() string {
-				if t.MimeType != "" {
-					return t.MimeType
+		keepalive := time.NewTicker(25 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
 				}
-				return http.DetectContentType(filedata)
-			}()),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: thumbnailBytes,
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			if msg.ImageMessage.ContextInfo == nil {
-				msg.ImageMessage.ContextInfo = &waE2E.ContextInfo{
-					StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-					Participant:   proto.String(*t.ContextInfo.Participant),
-					QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+			case event, ok := <-events:
+				if !ok {
+					// Fell behind or user removed, the client reconnects and resumes
+					return
+				}
+				if err := writeEvent(event); err != nil {
+					return
 				}
 			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
 		}
+	}
+}
 
-		if t.ContextInfo.MentionedJID != nil {
-			msg.ImageMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+// Gets QR code encoded in Base64
+func (s *server) GetQR() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		code := ""
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		} else {
+			if clientManager.GetWhatsmeowClient(txtid).IsConnected() == false {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
+				return
+			}
+			rows, err := s.db.Query("SELECT qrcode AS code FROM users WHERE id=$1 LIMIT 1", txtid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				err = rows.Scan(&code)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, err)
+					return
+				}
+			}
+			err = rows.Err()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if clientManager.GetWhatsmeowClient(txtid).IsLoggedIn() == true {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
+				return
+			}
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		log.Info().Str("instance", txtid).Str("qrcode", code).Msg("Get QR successful")
+		response := map[string]interface{}{"QRCode": fmt.Sprintf("%s", code)}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Logs out device from Whatsapp (requires to scan QR next time)
+func (s *server) Logout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		jid := r.Context().Value("userinfo").(Values).Get("Jid")
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
+		} else {
+			if clientManager.GetWhatsmeowClient(txtid).IsLoggedIn() == true &&
+				clientManager.GetWhatsmeowClient(txtid).IsConnected() == true {
+				err := clientManager.GetWhatsmeowClient(txtid).Logout()
+				if err != nil {
+					log.Error().Str("jid", jid).Msg("Could not perform logout")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
+					return
+				} else {
+					log.Info().Str("jid", jid).Msg("Logged out")
+					clientManager.DeleteWhatsmeowClient(txtid)
+					killchannel[txtid] <- true
+				}
+			} else {
+				if clientManager.GetWhatsmeowClient(txtid).IsConnected() == true {
+					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not logout as it was not logged in"))
+					return
+				} else {
+					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not connected"))
+					return
+				}
+			}
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Details": "Logged out"}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1060,23 +1344,16 @@ func (s *server) SendImage() http.HandlerFunc {
 	}
 }
 
-// Sends Sticker message
-func (s *server) SendSticker() http.HandlerFunc {
+// Pair by Phone. Retrieves the code to pair by phone number instead of QR
+func (s *server) PairPhone() http.HandlerFunc {
 
-	type stickerStruct struct {
-		Phone        string
-		Sticker      string
-		Id           string
-		PngThumbnail []byte
-		MimeType     string
-		ContextInfo  waE2E.ContextInfo
+	type pairStruct struct {
+		Phone string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		if clientManager.GetWhatsmeowClient(txtid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
@@ -1084,7 +1361,7 @@ func (s *server) SendSticker() http.HandlerFunc {
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t stickerStruct
+		var t pairStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
@@ -1096,83 +1373,75 @@ func (s *server) SendSticker() http.HandlerFunc {
 			return
 		}
 
-		if t.Sticker == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Sticker in Payload"))
+		isLoggedIn := clientManager.GetWhatsmeowClient(txtid).IsLoggedIn()
+		if isLoggedIn {
+			log.Error().Msg(fmt.Sprintf("%s", "Already paired"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Already paired"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		linkingCode, err := clientManager.GetWhatsmeowClient(txtid).PairPhone(t.Phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
 		if err != nil {
 			log.Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		response := map[string]interface{}{"LinkingCode": linkingCode}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
+// Gets Connected and LoggedIn Status
+func (s *server) GetStatus() http.HandlerFunc {
 
-		if t.Sticker[0:4] == "data" {
-			var dataURL, err = dataurl.DecodeString(t.Sticker)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
-			return
-		}
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		msg := &waE2E.Message{StickerMessage: &waE2E.StickerMessage{
-			URL:        proto.String(uploaded.URL),
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			Mimetype: proto.String(func() string {
-				if t.MimeType != "" {
-					return t.MimeType
-				}
-				return http.DetectContentType(filedata)
-			}()),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			PngThumbnail:  t.PngThumbnail,
-		}}
+		userInfo := r.Context().Value("userinfo").(Values)
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
+		// Log all userinfo values
+		log.Info().
+			Str("Id", userInfo.Get("Id")).
+			Str("Jid", userInfo.Get("Jid")).
+			Str("Name", userInfo.Get("Name")).
+			Str("Webhook", userInfo.Get("Webhook")).
+			Str("Token", userInfo.Get("Token")).
+			Str("Events", userInfo.Get("Events")).
+			Str("Proxy", userInfo.Get("Proxy")).
+			Msg("User info values")
+
+		log.Info().Str("Name", userInfo.Get("Name")).Msg("User name")
+
+		txtid := userInfo.Get("Id")
+
+		/*
+			if clientManager.GetWhatsmeowClient(txtid) == nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		*/
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
+		isConnected := clientManager.GetWhatsmeowClient(txtid).IsConnected()
+		isLoggedIn := clientManager.GetWhatsmeowClient(txtid).IsLoggedIn()
 
-		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{
+			"id":        txtid,
+			"name":      userInfo.Get("Name"),
+			"connected": isConnected,
+			"loggedIn":  isLoggedIn,
+			"token":     userInfo.Get("Token"),
+			"jid":       userInfo.Get("Jid"),
+			"webhook":   userInfo.Get("Webhook"),
+			"events":    userInfo.Get("Events"),
+			"proxy_url": userInfo.Get("Proxy"),
+			"qrcode":    userInfo.Get("Qrcode"),
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1183,17 +1452,17 @@ func (s *server) SendSticker() http.HandlerFunc {
 	}
 }
 
-// Sends Video message
-func (s *server) SendVideo() http.HandlerFunc {
+// Sends a document/attachment message
+func (s *server) SendDocument() http.HandlerFunc {
 
-	type imageStruct struct {
-		Phone         string
-		Video         string
-		Caption       string
-		Id            string
-		JPEGThumbnail []byte
-		MimeType      string
-		ContextInfo   waE2E.ContextInfo
+	type documentStruct struct {
+		Caption     string
+		Phone       string
+		Document    string
+		FileName    string
+		Id          string
+		MimeType    string
+		ContextInfo waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1207,21 +1476,31 @@ func (s *server) SendVideo() http.HandlerFunc {
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
-		err := decoder.Decode(&t)
+		var t documentStruct
+		upload, err := decodeMediaRequest(r, "Document", &t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if upload != nil {
+			defer upload.Close()
+		}
 
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
 
-		if t.Video == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Video in Payload"))
+		if t.Document == "" && upload == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Document in Payload"))
+			return
+		}
+
+		if t.FileName == "" && upload != nil {
+			t.FileName = upload.FileName
+		}
+		if t.FileName == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing FileName in Payload"))
 			return
 		}
 
@@ -1241,27 +1520,41 @@ func (s *server) SendVideo() http.HandlerFunc {
 		var uploaded whatsmeow.UploadResponse
 		var filedata []byte
 
-		if t.Video[0:4] == "data" {
-			var dataURL, err = dataurl.DecodeString(t.Video)
+		if upload != nil {
+			filedata = upload.Head
+			if t.MimeType == "" {
+				t.MimeType = upload.ContentType
+			}
+		} else if isRemoteMedia(t.Document) {
+			var mimetype string
+			filedata, mimetype, err = fetchRemoteMedia(r.Context(), t.Document)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Could not download Document: %v", err)))
+				return
+			}
+			if t.MimeType == "" {
+				t.MimeType = mimetype
+			}
+		} else if strings.HasPrefix(t.Document, "data:application/octet-stream") {
+			var dataURL, err = dataurl.DecodeString(t.Document)
 			if err != nil {
 				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientManager.GetWhatsmeowClient(txtid).Upload(context.Background(), filedata, whatsmeow.MediaVideo)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
 			}
+			filedata = dataURL.Data
 		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Document data should start with \"data:application/octet-stream;base64,\" or be an http(s) URL"))
+			return
+		}
+		uploaded, err = uploadMedia(context.Background(), clientManager.GetWhatsmeowClient(txtid), filedata, upload, whatsmeow.MediaDocument)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 			return
 		}
 
-		msg := &waE2E.Message{VideoMessage: &waE2E.VideoMessage{
-			Caption:    proto.String(t.Caption),
+		msg := &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{
 			URL:        proto.String(uploaded.URL),
+			FileName:   &t.FileName,
 			DirectPath: proto.String(uploaded.DirectPath),
 			MediaKey:   uploaded.MediaKey,
 			Mimetype: proto.String(func() string {
@@ -1272,8 +1565,8 @@ func (s *server) SendVideo() http.HandlerFunc {
 			}()),
 			FileEncSHA256: uploaded.FileEncSHA256,
 			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: t.JPEGThumbnail,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			Caption:       proto.String(t.Caption),
 		}}
 
 		if t.ContextInfo.StanzaID != nil {
@@ -1295,6 +1588,8 @@ func (s *server) SendVideo() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
@@ -1308,46 +1603,45 @@ func (s *server) SendVideo() http.HandlerFunc {
 	}
 }
 
-// Sends Contact
-func (s *server) SendContact() http.HandlerFunc {
+// Sends an audio message
+func (s *server) SendAudio() http.HandlerFunc {
 
-	type contactStruct struct {
+	type audioStruct struct {
 		Phone       string
+		Audio       string
+		Caption     string
 		Id          string
-		Name        string
-		Vcard       string
 		ContextInfo waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
 		if clientManager.GetWhatsmeowClient(txtid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t contactStruct
-		err := decoder.Decode(&t)
+		var t audioStruct
+		upload, err := decodeMediaRequest(r, "Audio", &t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if upload != nil {
+			defer upload.Close()
+		}
+
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
-			return
-		}
-		if t.Vcard == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Vcard in Payload"))
+
+		if t.Audio == "" && upload == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Audio in Payload"))
 			return
 		}
 
@@ -1364,9 +1658,51 @@ func (s *server) SendContact() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		msg := &waE2E.Message{ContactMessage: &waE2E.ContactMessage{
-			DisplayName: &t.Name,
-			Vcard:       &t.Vcard,
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+
+		if upload != nil {
+			if !strings.HasPrefix(upload.ContentType, "audio/ogg") && !strings.HasPrefix(upload.ContentType, "application/ogg") {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Audio should be audio/ogg, got %s", upload.ContentType)))
+				return
+			}
+			filedata = upload.Head
+		} else if isRemoteMedia(t.Audio) {
+			filedata, _, err = fetchRemoteMedia(r.Context(), t.Audio, "audio/ogg", "application/ogg")
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Could not download Audio: %v", err)))
+				return
+			}
+		} else if strings.HasPrefix(t.Audio, "data:audio/ogg") {
+			var dataURL, err = dataurl.DecodeString(t.Audio)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			}
+			filedata = dataURL.Data
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Audio data should start with \"data:audio/ogg;base64,\" or be an http(s) URL"))
+			return
+		}
+		uploaded, err = uploadMedia(context.Background(), clientManager.GetWhatsmeowClient(txtid), filedata, upload, whatsmeow.MediaAudio)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+			return
+		}
+
+		ptt := true
+		mime := "audio/ogg; codecs=opus"
+
+		msg := &waE2E.Message{AudioMessage: &waE2E.AudioMessage{
+			URL:        proto.String(uploaded.URL),
+			DirectPath: proto.String(uploaded.DirectPath),
+			MediaKey:   uploaded.MediaKey,
+			//Mimetype:      proto.String(http.DetectContentType(filedata)),
+			Mimetype:      &mime,
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			PTT:           &ptt,
 		}}
 
 		if t.ContextInfo.StanzaID != nil {
@@ -1388,6 +1724,8 @@ func (s *server) SendContact() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
@@ -1401,47 +1739,46 @@ func (s *server) SendContact() http.HandlerFunc {
 	}
 }
 
-// Sends location
-func (s *server) SendLocation() http.HandlerFunc {
+// Sends an Image message
+func (s *server) SendImage() http.HandlerFunc {
 
-	type locationStruct struct {
+	type imageStruct struct {
 		Phone       string
+		Image       string
+		Caption     string
 		Id          string
-		Name        string
-		Latitude    float64
-		Longitude   float64
+		MimeType    string
 		ContextInfo waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
 		if clientManager.GetWhatsmeowClient(txtid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t locationStruct
-		err := decoder.Decode(&t)
+		var t imageStruct
+		upload, err := decodeMediaRequest(r, "Image", &t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if upload != nil {
+			defer upload.Close()
+		}
+
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-		if t.Latitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Latitude in Payload"))
-			return
-		}
-		if t.Longitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Longitude in Payload"))
+
+		if t.Image == "" && upload == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
 			return
 		}
 
@@ -1458,34 +1795,123 @@ func (s *server) SendLocation() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		msg := &waE2E.Message{LocationMessage: &waE2E.LocationMessage{
-			DegreesLatitude:  &t.Latitude,
-			DegreesLongitude: &t.Longitude,
-			Name:             &t.Name,
-		}}
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+		var thumbnailBytes []byte
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+		if upload != nil || isRemoteMedia(t.Image) || strings.HasPrefix(t.Image, "data:image") {
+			if upload != nil {
+				if !strings.HasPrefix(upload.ContentType, "image/") {
+					s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Image should be an image, got %s", upload.ContentType)))
+					return
+				}
+				filedata = upload.Head
+				if t.MimeType == "" {
+					t.MimeType = upload.ContentType
+				}
+			} else if isRemoteMedia(t.Image) {
+				var mimetype string
+				filedata, mimetype, err = fetchRemoteMedia(r.Context(), t.Image, "image/")
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Could not download Image: %v", err)))
+					return
+				}
+				if t.MimeType == "" {
+					t.MimeType = mimetype
+				}
+			} else {
+				var dataURL, err = dataurl.DecodeString(t.Image)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+					return
+				}
+				filedata = dataURL.Data
 			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
+			uploaded, err = uploadMedia(context.Background(), clientManager.GetWhatsmeowClient(txtid), filedata, upload, whatsmeow.MediaImage)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+			// decode jpeg into image.Image
+			var reader io.Reader = bytes.NewReader(filedata)
+			if upload != nil {
+				reader = upload.File
+			}
+			img, _, err := image.Decode(reader)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not decode image for thumbnail preparation: %v", err)))
+				return
+			}
+
+			// resize to width 72 using Lanczos resampling and preserve aspect ratio
+			m := resize.Thumbnail(72, 72, img, resize.Lanczos3)
+
+			tmpFile, err := os.CreateTemp("", "resized-*.jpg")
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create temp file for thumbnail: %v", err)))
+				return
+			}
+			defer tmpFile.Close()
+
+			// write new image to file
+			if err := jpeg.Encode(tmpFile, m, nil); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to encode jpeg: %v", err)))
+				return
+			}
+
+			thumbnailBytes, err = os.ReadFile(tmpFile.Name())
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to read %s: %v", tmpFile.Name(), err)))
+				return
+			}
+
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/png;base64,\" or be an http(s) URL"))
+			return
+		}
+
+		msg := &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+			Caption:    proto.String(t.Caption),
+			URL:        proto.String(uploaded.URL),
+			DirectPath: proto.String(uploaded.DirectPath),
+			MediaKey:   uploaded.MediaKey,
+			Mimetype: proto.String(func() string {
+				if t.MimeType != "" {
+					return t.MimeType
+				}
+				return http.DetectContentType(filedata)
+			}()),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			JPEGThumbnail: thumbnailBytes,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			if msg.ImageMessage.ContextInfo == nil {
+				msg.ImageMessage.ContextInfo = &waE2E.ContextInfo{
+					StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+					Participant:   proto.String(*t.ContextInfo.Participant),
+					QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+				}
+			}
+		}
+
+		if t.ContextInfo.MentionedJID != nil {
+			msg.ImageMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1496,63 +1922,53 @@ func (s *server) SendLocation() http.HandlerFunc {
 	}
 }
 
-// Sends Buttons (not implemented, does not work)
-
-func (s *server) SendButtons() http.HandlerFunc {
+// Sends Sticker message
+func (s *server) SendSticker() http.HandlerFunc {
 
-	type buttonStruct struct {
-		ButtonId   string
-		ButtonText string
-	}
-	type textStruct struct {
-		Phone   string
-		Title   string
-		Buttons []buttonStruct
-		Id      string
+	type stickerStruct struct {
+		Phone        string
+		Sticker      string
+		Id           string
+		PngThumbnail []byte
+		MimeType     string
+		ContextInfo  waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
 		if clientManager.GetWhatsmeowClient(txtid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t textStruct
-		err := decoder.Decode(&t)
+		var t stickerStruct
+		upload, err := decodeMediaRequest(r, "Sticker", &t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if upload != nil {
+			defer upload.Close()
+		}
 
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
 
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Title in Payload"))
-			return
-		}
-
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
-			return
-		}
-		if len(t.Buttons) > 3 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+		if t.Sticker == "" && upload == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Sticker in Payload"))
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
@@ -1562,32 +1978,82 @@ func (s *server) SendButtons() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		var buttons []*waE2E.ButtonsMessage_Button
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
 
-		for _, item := range t.Buttons {
-			buttons = append(buttons, &waE2E.ButtonsMessage_Button{
-				ButtonID:       proto.String(item.ButtonId),
-				ButtonText:     &waE2E.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
-				Type:           waE2E.ButtonsMessage_Button_RESPONSE.Enum(),
-				NativeFlowInfo: &waE2E.ButtonsMessage_Button_NativeFlowInfo{},
-			})
+		if upload != nil {
+			if !strings.HasPrefix(upload.ContentType, "image/") {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Sticker should be an image, got %s", upload.ContentType)))
+				return
+			}
+			filedata = upload.Head
+			if t.MimeType == "" {
+				t.MimeType = upload.ContentType
+			}
+		} else if isRemoteMedia(t.Sticker) {
+			var mimetype string
+			filedata, mimetype, err = fetchRemoteMedia(r.Context(), t.Sticker, "image/")
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Could not download Sticker: %v", err)))
+				return
+			}
+			if t.MimeType == "" {
+				t.MimeType = mimetype
+			}
+		} else if strings.HasPrefix(t.Sticker, "data") {
+			var dataURL, err = dataurl.DecodeString(t.Sticker)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			}
+			filedata = dataURL.Data
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\" or be an http(s) URL"))
+			return
+		}
+		uploaded, err = uploadMedia(context.Background(), clientManager.GetWhatsmeowClient(txtid), filedata, upload, whatsmeow.MediaImage)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+			return
 		}
 
-		msg2 := &waE2E.ButtonsMessage{
-			ContentText: proto.String(t.Title),
-			HeaderType:  waE2E.ButtonsMessage_EMPTY.Enum(),
-			Buttons:     buttons,
+		msg := &waE2E.Message{StickerMessage: &waE2E.StickerMessage{
+			URL:        proto.String(uploaded.URL),
+			DirectPath: proto.String(uploaded.DirectPath),
+			MediaKey:   uploaded.MediaKey,
+			Mimetype: proto.String(func() string {
+				if t.MimeType != "" {
+					return t.MimeType
+				}
+				return http.DetectContentType(filedata)
+			}()),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			PngThumbnail:  t.PngThumbnail,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
-			Message: &waE2E.Message{
-				ButtonsMessage: msg2,
-			},
-		}}, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
@@ -1601,133 +2067,140 @@ func (s *server) SendButtons() http.HandlerFunc {
 	}
 }
 
-// SendList
-// https://github.com/tulir/whatsmeow/issues/305
-func (s *server) SendList() http.HandlerFunc {
-
-	type rowsStruct struct {
-		RowId       string
-		Title       string
-		Description string
-	}
-
-	type sectionsStruct struct {
-		Title string
-		Rows  []rowsStruct
-	}
+// Sends Video message
+func (s *server) SendVideo() http.HandlerFunc {
 
-	type listStruct struct {
-		Phone       string
-		Title       string
-		Description string
-		ButtonText  string
-		FooterText  string
-		Sections    []sectionsStruct
-		Id          string
+	type imageStruct struct {
+		Phone         string
+		Video         string
+		Caption       string
+		Id            string
+		JPEGThumbnail []byte
+		MimeType      string
+		ContextInfo   waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
 		if clientManager.GetWhatsmeowClient(txtid) == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t listStruct
-		err := decoder.Decode(&t)
-		marshal, _ := json.Marshal(t)
-		fmt.Println(string(marshal))
+		var t imageStruct
+		upload, err := decodeMediaRequest(r, "Video", &t)
 		if err != nil {
-			fmt.Println(err)
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		if upload != nil {
+			defer upload.Close()
+		}
 
 		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
 
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+		if t.Video == "" && upload == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Video in Payload"))
 			return
 		}
 
-		if t.Description == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Description in Payload"))
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.ButtonText == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonText in Payload"))
-			return
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
 		}
 
-		if len(t.Sections) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sections in Payload"))
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+
+		if upload != nil {
+			if !strings.HasPrefix(upload.ContentType, "video/") {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Video should be a video, got %s", upload.ContentType)))
+				return
+			}
+			filedata = upload.Head
+			if t.MimeType == "" {
+				t.MimeType = upload.ContentType
+			}
+		} else if isRemoteMedia(t.Video) {
+			var mimetype string
+			filedata, mimetype, err = fetchRemoteMedia(r.Context(), t.Video, "video/")
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Could not download Video: %v", err)))
+				return
+			}
+			if t.MimeType == "" {
+				t.MimeType = mimetype
+			}
+		} else if strings.HasPrefix(t.Video, "data") {
+			var dataURL, err = dataurl.DecodeString(t.Video)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			}
+			filedata = dataURL.Data
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\" or be an http(s) URL"))
 			return
 		}
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+		uploaded, err = uploadMedia(context.Background(), clientManager.GetWhatsmeowClient(txtid), filedata, upload, whatsmeow.MediaVideo)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		var sections []*waE2E.ListMessage_Section
-
-		for _, item := range t.Sections {
-			var rows []*waE2E.ListMessage_Row
-			id := 1
-			for _, row := range item.Rows {
-				var idtext string
-				if row.RowId == "" {
-					idtext = strconv.Itoa(id)
-				} else {
-					idtext = row.RowId
+		msg := &waE2E.Message{VideoMessage: &waE2E.VideoMessage{
+			Caption:    proto.String(t.Caption),
+			URL:        proto.String(uploaded.URL),
+			DirectPath: proto.String(uploaded.DirectPath),
+			MediaKey:   uploaded.MediaKey,
+			Mimetype: proto.String(func() string {
+				if t.MimeType != "" {
+					return t.MimeType
 				}
-				rows = append(rows, &waE2E.ListMessage_Row{
-					RowID:       proto.String(idtext),
-					Title:       proto.String(row.Title),
-					Description: proto.String(row.Description),
-				})
-			}
+				return http.DetectContentType(filedata)
+			}()),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			JPEGThumbnail: t.JPEGThumbnail,
+		}}
 
-			sections = append(sections, &waE2E.ListMessage_Section{
-				Title: proto.String(item.Title),
-				Rows:  rows,
-			})
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+			}
 		}
-		msg1 := &waE2E.ListMessage{
-			Title:       proto.String(t.Title),
-			Description: proto.String(t.Description),
-			ButtonText:  proto.String(t.ButtonText),
-			ListType:    waE2E.ListMessage_SINGLE_SELECT.Enum(),
-			Sections:    sections,
-			FooterText:  proto.String(t.FooterText),
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, &waE2E.Message{
-			ViewOnceMessage: &waE2E.FutureProofMessage{
-				Message: &waE2E.Message{
-					ListMessage: msg1,
-				},
-			}}, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
@@ -1741,13 +2214,14 @@ func (s *server) SendList() http.HandlerFunc {
 	}
 }
 
-// Sends a regular text message
-func (s *server) SendMessage() http.HandlerFunc {
+// Sends Contact
+func (s *server) SendContact() http.HandlerFunc {
 
-	type textStruct struct {
+	type contactStruct struct {
 		Phone       string
-		Body        string
 		Id          string
+		Name        string
+		Vcard       string
 		ContextInfo waE2E.ContextInfo
 	}
 
@@ -1764,20 +2238,22 @@ func (s *server) SendMessage() http.HandlerFunc {
 		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t contactStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
-
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+		if t.Vcard == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Vcard in Payload"))
 			return
 		}
 
@@ -1789,16 +2265,15 @@ func (s *server) SendMessage() http.HandlerFunc {
 		}
 
 		if t.Id == "" {
-			msgid = clientManager.GetWhatsmeowClient(txtid).GenerateMessageID()
+			msgid = whatsmeow.GenerateMessageID()
 		} else {
 			msgid = t.Id
 		}
 
-		msg := &waE2E.Message{
-			ExtendedTextMessage: &waE2E.ExtendedTextMessage{
-				Text: &t.Body,
-			},
-		}
+		msg := &waE2E.Message{ContactMessage: &waE2E.ContactMessage{
+			DisplayName: &t.Name,
+			Vcard:       &t.Vcard,
+		}}
 
 		if t.ContextInfo.StanzaID != nil {
 			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
@@ -1819,6 +2294,8 @@ func (s *server) SendMessage() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
 
 		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
@@ -1828,20 +2305,24 @@ func (s *server) SendMessage() http.HandlerFunc {
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
 		return
 	}
 }
 
-func (s *server) SendPoll() http.HandlerFunc {
-	type pollRequest struct {
-		Group   string   `json:"group"`   // The recipient's group id (120363313346913103@g.us)
-		Header  string   `json:"header"`  // The poll's headline text
-		Options []string `json:"options"` // The list of poll options
-		Id      string
+// Sends location
+func (s *server) SendLocation() http.HandlerFunc {
+
+	type locationStruct struct {
+		Phone       string
+		Id          string
+		Name        string
+		Latitude    float64
+		Longitude   float64
+		ContextInfo waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 
 		if clientManager.GetWhatsmeowClient(txtid) == nil {
@@ -1853,65 +2334,91 @@ func (s *server) SendPoll() http.HandlerFunc {
 		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
-		var req pollRequest
-		err := decoder.Decode(&req)
+		var t locationStruct
+		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
-
-		if req.Group == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Grouop in payload"))
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-
-		if req.Header == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Header in payload"))
+		if t.Latitude == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Latitude in Payload"))
+			return
+		}
+		if t.Longitude == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Longitude in Payload"))
 			return
 		}
 
-		if len(req.Options) < 2 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("At least 2 options are required"))
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if req.Id == "" {
-			msgid = clientManager.GetWhatsmeowClient(txtid).GenerateMessageID()
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
 		} else {
-			msgid = req.Id
+			msgid = t.Id
 		}
 
-		recipient, err := validateMessageFields(req.Group, nil, nil)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
+		msg := &waE2E.Message{LocationMessage: &waE2E.LocationMessage{
+			DegreesLatitude:  &t.Latitude,
+			DegreesLongitude: &t.Longitude,
+			Name:             &t.Name,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		pollMessage := clientManager.GetWhatsmeowClient(txtid).BuildPollCreation(req.Header, req.Options, 1)
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, pollMessage, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to send poll: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
 
-		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Poll sent")
-
-		response := map[string]interface{}{"Details": "Poll sent successfully", "Id": msgid}
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
 	}
 }
 
-// Delete message
-func (s *server) DeleteMessage() http.HandlerFunc {
+// Sends Buttons (not implemented, does not work)
+
+func (s *server) SendButtons() http.HandlerFunc {
 
+	type buttonStruct struct {
+		ButtonId   string
+		ButtonText string
+	}
 	type textStruct struct {
-		Phone string
-		Id    string
+		Phone   string
+		Title   string
+		Buttons []buttonStruct
+		Id      string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1939,12 +2446,19 @@ func (s *server) DeleteMessage() http.HandlerFunc {
 			return
 		}
 
-		if t.Id == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+		if t.Title == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Title in Payload"))
 			return
 		}
 
-		msgid = t.Id
+		if len(t.Buttons) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
+			return
+		}
+		if len(t.Buttons) > 3 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+			return
+		}
 
 		recipient, ok := parseJID(t.Phone)
 		if !ok {
@@ -1952,33 +2466,201 @@ func (s *server) DeleteMessage() http.HandlerFunc {
 			return
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, clientManager.GetWhatsmeowClient(txtid).BuildRevoke(recipient, types.EmptyJID, msgid))
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message deleted")
-		response := map[string]interface{}{"Details": "Deleted", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
 		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			msgid = t.Id
 		}
 
-		return
-	}
-}
-
-// Sends a edit text message
-func (s *server) SendEditMessage() http.HandlerFunc {
+		var buttons []*waE2E.ButtonsMessage_Button
 
-	type editStruct struct {
-		Phone       string
-		Body        string
-		Id          string
-		ContextInfo waE2E.ContextInfo
+		for _, item := range t.Buttons {
+			buttons = append(buttons, &waE2E.ButtonsMessage_Button{
+				ButtonID:       proto.String(item.ButtonId),
+				ButtonText:     &waE2E.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
+				Type:           waE2E.ButtonsMessage_Button_RESPONSE.Enum(),
+				NativeFlowInfo: &waE2E.ButtonsMessage_Button_NativeFlowInfo{},
+			})
+		}
+
+		msg2 := &waE2E.ButtonsMessage{
+			ContentText: proto.String(t.Title),
+			HeaderType:  waE2E.ButtonsMessage_EMPTY.Enum(),
+			Buttons:     buttons,
+		}
+
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
+			Message: &waE2E.Message{
+				ButtonsMessage: msg2,
+			},
+		}}, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// SendList
+// https://github.com/tulir/whatsmeow/issues/305
+func (s *server) SendList() http.HandlerFunc {
+
+	type rowsStruct struct {
+		RowId       string
+		Title       string
+		Description string
+	}
+
+	type sectionsStruct struct {
+		Title string
+		Rows  []rowsStruct
+	}
+
+	type listStruct struct {
+		Phone       string
+		Title       string
+		Description string
+		ButtonText  string
+		FooterText  string
+		Sections    []sectionsStruct
+		Id          string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t listStruct
+		err := decoder.Decode(&t)
+		marshal, _ := json.Marshal(t)
+		fmt.Println(string(marshal))
+		if err != nil {
+			fmt.Println(err)
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+
+		if t.Title == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+			return
+		}
+
+		if t.Description == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Description in Payload"))
+			return
+		}
+
+		if t.ButtonText == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonText in Payload"))
+			return
+		}
+
+		if len(t.Sections) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sections in Payload"))
+			return
+		}
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var sections []*waE2E.ListMessage_Section
+
+		for _, item := range t.Sections {
+			var rows []*waE2E.ListMessage_Row
+			id := 1
+			for _, row := range item.Rows {
+				var idtext string
+				if row.RowId == "" {
+					idtext = strconv.Itoa(id)
+				} else {
+					idtext = row.RowId
+				}
+				rows = append(rows, &waE2E.ListMessage_Row{
+					RowID:       proto.String(idtext),
+					Title:       proto.String(row.Title),
+					Description: proto.String(row.Description),
+				})
+			}
+
+			sections = append(sections, &waE2E.ListMessage_Section{
+				Title: proto.String(item.Title),
+				Rows:  rows,
+			})
+		}
+		msg1 := &waE2E.ListMessage{
+			Title:       proto.String(t.Title),
+			Description: proto.String(t.Description),
+			ButtonText:  proto.String(t.ButtonText),
+			ListType:    waE2E.ListMessage_SINGLE_SELECT.Enum(),
+			Sections:    sections,
+			FooterText:  proto.String(t.FooterText),
+		}
+
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, &waE2E.Message{
+			ViewOnceMessage: &waE2E.FutureProofMessage{
+				Message: &waE2E.Message{
+					ListMessage: msg1,
+				},
+			}}, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends a regular text message
+func (s *server) SendMessage() http.HandlerFunc {
+
+	type textStruct struct {
+		Phone       string
+		Body        string
+		Id          string
+		ContextInfo waE2E.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1994,7 +2676,7 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
-		var t editStruct
+		var t textStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
@@ -2019,8 +2701,7 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 		}
 
 		if t.Id == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
-			return
+			msgid = clientManager.GetWhatsmeowClient(txtid).GenerateMessageID()
 		} else {
 			msgid = t.Id
 		}
@@ -2045,13 +2726,15 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, clientManager.GetWhatsmeowClient(txtid).BuildEdit(recipient, msgid, msg))
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending edit message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
+		storeSentMessage(s.db, txtid, recipient, msgid, msg, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message edit sent")
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -2064,78 +2747,315 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 	}
 }
 
-/*
-// Sends a Template message
-func (s *server) SendTemplate() http.HandlerFunc {
-
-	type buttonStruct struct {
-		DisplayText string
-		Id          string
-		Url         string
-		PhoneNumber string
-		Type        string
-	}
-
-	type templateStruct struct {
-		Phone   string
-		Content string
-		Footer  string
+func (s *server) SendPoll() http.HandlerFunc {
+	type pollRequest struct {
+		Group   string   `json:"group"`   // The recipient's group id (120363313346913103@g.us)
+		Header  string   `json:"header"`  // The poll's headline text
+		Options []string `json:"options"` // The list of poll options
 		Id      string
-		Buttons []buttonStruct
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
 
-		if clientManager.GetWhatsmeowClient(userid) == nil {
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		msgid := ""
 		var resp whatsmeow.SendResponse
-//var ts time.Time
 
 		decoder := json.NewDecoder(r.Body)
-		var t templateStruct
-		err := decoder.Decode(&t)
+		var req pollRequest
+		err := decoder.Decode(&req)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if req.Group == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Grouop in payload"))
 			return
 		}
 
-		if t.Content == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+		if req.Header == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Header in payload"))
 			return
 		}
 
-		if t.Footer == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+		if len(req.Options) < 2 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("At least 2 options are required"))
 			return
 		}
 
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
-			return
+		if req.Id == "" {
+			msgid = clientManager.GetWhatsmeowClient(txtid).GenerateMessageID()
+		} else {
+			msgid = req.Id
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		recipient, err := validateMessageFields(req.Group, nil, nil)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		pollMessage := clientManager.GetWhatsmeowClient(txtid).BuildPollCreation(req.Header, req.Options, 1)
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, pollMessage, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to send poll: %v", err)))
+			return
+		}
+		storeSentMessage(s.db, txtid, recipient, msgid, pollMessage, resp.Timestamp)
+		trackSentMessage(s.db, txtid, recipient, msgid, resp.Timestamp)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Poll sent")
+
+		response := map[string]interface{}{"Details": "Poll sent successfully", "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Delete message
+func (s *server) DeleteMessage() http.HandlerFunc {
+
+	type textStruct struct {
+		Phone string
+		Id    string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		}
+
+		msgid = t.Id
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		revoke := clientManager.GetWhatsmeowClient(txtid).BuildRevoke(recipient, types.EmptyJID, msgid)
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, revoke)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+		storeSentMessage(s.db, txtid, recipient, resp.ID, revoke, resp.Timestamp)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message deleted")
+		response := map[string]interface{}{"Details": "Deleted", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Sends a edit text message
+func (s *server) SendEditMessage() http.HandlerFunc {
+
+	type editStruct struct {
+		Phone       string
+		Body        string
+		Id          string
+		ContextInfo waE2E.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		if clientManager.GetWhatsmeowClient(txtid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t editStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		} else {
+			msgid = t.Id
+		}
+
+		msg := &waE2E.Message{
+			ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+				Text: &t.Body,
+			},
+		}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		edit := clientManager.GetWhatsmeowClient(txtid).BuildEdit(recipient, msgid, msg)
+		resp, err = clientManager.GetWhatsmeowClient(txtid).SendMessage(context.Background(), recipient, edit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending edit message: %v", err)))
+			return
+		}
+		storeSentMessage(s.db, txtid, recipient, resp.ID, edit, resp.Timestamp)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%v", resp.Timestamp)).Str("id", msgid).Msg("Message edit sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+/*
+// Sends a Template message
+func (s *server) SendTemplate() http.HandlerFunc {
+
+	type buttonStruct struct {
+		DisplayText string
+		Id          string
+		Url         string
+		PhoneNumber string
+		Type        string
+	}
+
+	type templateStruct struct {
+		Phone   string
+		Content string
+		Footer  string
+		Id      string
+		Buttons []buttonStruct
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if clientManager.GetWhatsmeowClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+//var ts time.Time
+
+		decoder := json.NewDecoder(r.Body)
+		var t templateStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Content == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+			return
+		}
+
+		if t.Footer == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+			return
+		}
+
+		if len(t.Buttons) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
 		}
 
 		var buttons []*waE2E.HydratedTemplateButton
@@ -3939,16 +4859,80 @@ func (s *server) AddUser() http.HandlerFunc {
 	}
 }
 
-func (s *server) DeleteUser() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// Deletes the data of a user from every table in a single transaction,
+// returns whether the user existed and the webhook files left to remove
+func deleteUserData(tx *sqlx.Tx, userID string) (bool, []string, error) {
+	result, err := tx.Exec("DELETE FROM users WHERE id=$1", userID)
+	if err != nil {
+		return false, nil, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, nil, err
+	}
+	files, err := deleteUserWebhooks(tx, userID)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, table := range []string{"webhooks", "s3_config", "command_queues"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id=$1", userID); err != nil {
+			return false, nil, err
+		}
+	}
+	for _, deleteData := range []func(sqlx.Ext, string) error{
+		deleteUserSinks,
+		deleteUserCalls,
+		deleteUserMessages,
+		deleteUserMessageStatus,
+		deleteUserSendJobs,
+		deleteUserCampaigns,
+	} {
+		if err := deleteData(tx, userID); err != nil {
+			return false, nil, err
+		}
+	}
+	return deleted > 0, files, nil
+}
+
+// Deletes a user with deleteUserData, then its webhook files and the state
+// kept in memory. Returns whether the user existed.
+func (s *server) deleteUser(userID string) (bool, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	found, files, err := deleteUserData(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("file", file).Msg("Could not remove webhook file")
+		}
+	}
+	webhookcache.Delete(userID)
+	eventHub.Remove(userID)
+	storagecache.Delete(userID)
+	commandQueues.Stop(userID)
+	return found, nil
+}
+
+func (s *server) DeleteUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
 		// Get the user ID from the request URL
 		vars := mux.Vars(r)
 		userID := vars["id"]
 
 		// Delete the user from the database
-		result, err := s.db.Exec("DELETE FROM users WHERE id=$1", userID)
+		found, err := s.deleteUser(userID)
 		if err != nil {
+			log.Error().Err(err).Str("id", userID).Msg("Failed to delete user")
 			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"code":    http.StatusInternalServerError,
 				"error":   "Database error",
@@ -3956,18 +4940,7 @@ func (s *server) DeleteUser() http.HandlerFunc {
 			})
 			return
 		}
-
-		// Check if the user was deleted
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"code":    http.StatusInternalServerError,
-				"error":   "Failed to verify deletion",
-				"success": false,
-			})
-			return
-		}
-		if rowsAffected == 0 {
+		if !found {
 			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
 				"code":    http.StatusNotFound,
 				"error":   "User not found",
@@ -4043,8 +5016,8 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 		}
 
 		// 2. Remove from DB
-		_, err = s.db.Exec("DELETE FROM users WHERE id = $1", id)
-		if err != nil {
+		if _, err = s.deleteUser(id); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to delete user")
 			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
 				"code":    http.StatusInternalServerError,
 				"error":   "Database error",
@@ -4085,6 +5058,256 @@ func (s *server) DeleteUserComplete() http.HandlerFunc {
 	}
 }
 
+// Gets the firehose webhook settings
+func (s *server) GetFirehose() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		firehosecache.Delete(firehoseWebhookID)
+		firehose := getFirehose(s.db)
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    firehose.toMap(),
+			"success": true,
+		})
+	}
+}
+
+// Sets the firehose webhook, only the fields sent are changed
+func (s *server) SetFirehose() http.HandlerFunc {
+
+	type firehoseStruct struct {
+		URL            *string         `json:"url"`
+		Events         *[]string       `json:"events"`
+		Secret         *string         `json:"secret"`
+		GenerateSecret bool            `json:"generate_secret"`
+		Format         *string         `json:"format"`
+		Enabled        *bool           `json:"enabled"`
+		Filter         json.RawMessage `json:"filter"`
+		Schema         *string         `json:"schema"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t firehoseStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "Invalid request payload",
+				"success": false,
+			})
+			return
+		}
+
+		firehosecache.Delete(firehoseWebhookID)
+		firehose := getFirehose(s.db)
+		var err error
+		if t.URL != nil {
+			firehose.URL = *t.URL
+		}
+		if firehose.URL == "" {
+			err = errors.New("url is required")
+		} else {
+			err = validateWebhookURL(firehose.URL)
+		}
+		if err == nil && t.Events != nil {
+			firehose.Events, err = validateWebhookEvents(*t.Events)
+		}
+		if err == nil && t.Format != nil {
+			firehose.Format, err = validateWebhookFormat(*t.Format)
+		}
+		if err == nil && t.Filter != nil {
+			firehose.Filter, err = normalizeEventFilter(t.Filter)
+		}
+		if err == nil && t.Schema != nil {
+			firehose.Schema, err = validateWebhookSchema(*t.Schema)
+		}
+		if err == nil && t.GenerateSecret {
+			firehose.Secret, err = generateWebhookSecret()
+		} else if t.Secret != nil {
+			firehose.Secret = *t.Secret
+		}
+		if err != nil {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   err.Error(),
+				"success": false,
+			})
+			return
+		}
+		if t.Enabled != nil {
+			firehose.Enabled = *t.Enabled
+		} else if firehose.UpdatedAt == 0 {
+			firehose.Enabled = true
+		}
+		firehose.UpdatedAt = time.Now().Unix()
+
+		_, err = s.db.Exec(`INSERT INTO firehose (id, url, events, secret, format, enabled, updated_at, filter, schema) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (id) DO UPDATE SET url=excluded.url, events=excluded.events, secret=excluded.secret, format=excluded.format, enabled=excluded.enabled,
+			updated_at=excluded.updated_at, filter=excluded.filter, schema=excluded.schema`,
+			firehoseWebhookID, firehose.URL, firehose.Events, firehose.Secret, firehose.Format, boolToFlag(firehose.Enabled), firehose.UpdatedAt, firehose.Filter, firehose.Schema)
+		if err != nil {
+			log.Error().Err(err).Msg("Admin DB Error")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "Database error",
+				"success": false,
+			})
+			return
+		}
+		firehosecache.Delete(firehoseWebhookID)
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    firehose.toMap(),
+			"success": true,
+		})
+	}
+}
+
+// Removes the firehose webhook
+func (s *server) DeleteFirehose() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := s.db.Exec("DELETE FROM firehose WHERE id=$1", firehoseWebhookID)
+		if err != nil {
+			log.Error().Err(err).Msg("Admin DB Error")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "Database error",
+				"success": false,
+			})
+			return
+		}
+		firehosecache.Delete(firehoseWebhookID)
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    map[string]interface{}{"Details": "Firehose removed successfully"},
+			"success": true,
+		})
+	}
+}
+
+// Lists firehose deliveries that exhausted their retries, for all users
+func (s *server) ListFailedFirehose() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		badRequest := func(err error) {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   err.Error(),
+				"success": false,
+			})
+		}
+		from, err := queryUnix(r, "from")
+		if err != nil {
+			badRequest(err)
+			return
+		}
+		to, err := queryUnix(r, "to")
+		if err != nil {
+			badRequest(err)
+			return
+		}
+		limit, err := queryLimit(r)
+		if err != nil {
+			badRequest(err)
+			return
+		}
+		if to == 0 {
+			to = time.Now().Unix()
+		}
+
+		var failed []FailedWebhook
+		err = s.db.Select(&failed, "SELECT "+failedWebhookColumns+" FROM webhook_failed WHERE webhook_id=$1 AND failed_at >= $2 AND failed_at <= $3 ORDER BY failed_at DESC LIMIT $4",
+			firehoseWebhookID, from, to, limit)
+		if err != nil {
+			log.Error().Err(err).Msg("Admin DB Error")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "Database error",
+				"success": false,
+			})
+			return
+		}
+
+		response := []map[string]interface{}{}
+		for _, f := range failed {
+			response = append(response, map[string]interface{}{
+				"id":            f.Id,
+				"user_id":       f.UserId,
+				"url":           f.URL,
+				"event_type":    f.EventType,
+				"attempts":      f.Attempts,
+				"status_code":   f.StatusCode,
+				"response_body": f.ResponseBody,
+				"last_error":    f.LastError,
+				"created_at":    f.CreatedAt,
+				"failed_at":     f.FailedAt,
+			})
+		}
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    response,
+			"success": true,
+		})
+	}
+}
+
+// Queues again failed firehose deliveries, one by id or all in a time range
+func (s *server) ReplayFailedFirehose() http.HandlerFunc {
+
+	type replayStruct struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var t replayStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"code":    http.StatusBadRequest,
+					"error":   "Invalid request payload",
+					"success": false,
+				})
+				return
+			}
+		}
+		if t.From < 0 || t.To < 0 || (t.To > 0 && t.From > t.To) {
+			s.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"error":   "invalid time range",
+				"success": false,
+			})
+			return
+		}
+
+		replayed, err := outbox.ReplayFirehose(id, t.From, t.To)
+		if err != nil {
+			log.Error().Err(err).Msg("Admin DB Error")
+			s.respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"code":    http.StatusInternalServerError,
+				"error":   "Database error",
+				"success": false,
+			})
+			return
+		}
+		if id != "" && replayed == 0 {
+			s.respondWithJSON(w, http.StatusNotFound, map[string]interface{}{
+				"code":    http.StatusNotFound,
+				"error":   "Failed webhook not found",
+				"success": false,
+			})
+			return
+		}
+
+		s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"code":    http.StatusOK,
+			"data":    map[string]interface{}{"Details": "Webhooks queued for delivery", "replayed": replayed},
+			"success": true,
+		})
+	}
+}
+
 func (s *server) Respond(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -4216,3 +5439,1549 @@ func (s *server) SetProxy() http.HandlerFunc {
 		}
 	}
 }
+
+// Gets the S3 storage used for incoming media
+func (s *server) GetS3Config() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		response := map[string]interface{}{"source": "none"}
+		var config S3Config
+		err := s.db.Get(&config, "SELECT "+s3ConfigColumns+" FROM s3_config WHERE user_id=$1", txtid)
+		if err == nil {
+			response["source"] = "user"
+			response["config"] = config.toMap()
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get S3 settings: %v", err)))
+			return
+		} else if globalStorage != nil {
+			response["source"] = "global"
+			response["config"] = map[string]interface{}{
+				"bucket":         globalStorage.config.Bucket,
+				"prefix":         globalStorage.config.Prefix,
+				"retention_days": globalStorage.config.RetentionDays,
+				"url_expiry":     globalStorage.config.URLExpiry,
+			}
+		}
+
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets the S3 storage used for incoming media, only the fields sent are changed
+func (s *server) SetS3Config() http.HandlerFunc {
+	type s3ConfigStruct struct {
+		Enabled       *bool   `json:"enabled"`
+		Endpoint      *string `json:"endpoint"`
+		Region        *string `json:"region"`
+		Bucket        *string `json:"bucket"`
+		AccessKey     *string `json:"access_key"`
+		SecretKey     *string `json:"secret_key"`
+		UseSSL        *bool   `json:"use_ssl"`
+		PathStyle     *bool   `json:"path_style"`
+		Prefix        *string `json:"prefix"`
+		RetentionDays *int    `json:"retention_days"`
+		URLExpiry     *int    `json:"url_expiry"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t s3ConfigStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+
+		config := S3Config{Enabled: true, UseSSL: true, Prefix: defaultS3Prefix, URLExpiry: defaultS3URLExpiry}
+		err := s.db.Get(&config, "SELECT "+s3ConfigColumns+" FROM s3_config WHERE user_id=$1", txtid)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get S3 settings: %v", err)))
+			return
+		}
+		if t.Enabled != nil {
+			config.Enabled = *t.Enabled
+		}
+		if t.Endpoint != nil {
+			config.Endpoint = *t.Endpoint
+		}
+		if t.Region != nil {
+			config.Region = *t.Region
+		}
+		if t.Bucket != nil {
+			config.Bucket = *t.Bucket
+		}
+		if t.AccessKey != nil {
+			config.AccessKey = *t.AccessKey
+		}
+		if t.SecretKey != nil {
+			config.SecretKey = *t.SecretKey
+		}
+		if t.UseSSL != nil {
+			config.UseSSL = *t.UseSSL
+		}
+		if t.PathStyle != nil {
+			config.PathStyle = *t.PathStyle
+		}
+		if t.Prefix != nil {
+			config.Prefix = *t.Prefix
+		}
+		if t.RetentionDays != nil {
+			config.RetentionDays = *t.RetentionDays
+		}
+		if t.URLExpiry != nil {
+			config.URLExpiry = *t.URLExpiry
+		}
+
+		response := map[string]interface{}{}
+		if config.Enabled {
+			if err := config.validate(); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			storage, err := newMediaStorage(config, userStorageScope(config, txtid))
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid S3 settings: %v", err)))
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+			defer cancel()
+			if err := storage.Check(ctx); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Could not access bucket: %v", err)))
+				return
+			}
+			if err := storage.ApplyLifecycle(ctx); err != nil {
+				log.Warn().Err(err).Str("userid", txtid).Msg("Could not set S3 lifecycle rule")
+				response["warning"] = fmt.Sprintf("could not set the lifecycle rule, media will not expire: %v", err)
+			}
+		}
+		config.UpdatedAt = time.Now().Unix()
+
+		_, err = s.db.Exec(`INSERT INTO s3_config (user_id, enabled, endpoint, region, bucket, access_key, secret_key, use_ssl, path_style, prefix, retention_days, url_expiry, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			ON CONFLICT (user_id) DO UPDATE SET enabled=excluded.enabled, endpoint=excluded.endpoint, region=excluded.region, bucket=excluded.bucket,
+			access_key=excluded.access_key, secret_key=excluded.secret_key, use_ssl=excluded.use_ssl, path_style=excluded.path_style, prefix=excluded.prefix,
+			retention_days=excluded.retention_days, url_expiry=excluded.url_expiry, updated_at=excluded.updated_at`,
+			txtid, boolToFlag(config.Enabled), config.Endpoint, config.Region, config.Bucket, config.AccessKey, config.SecretKey,
+			boolToFlag(config.UseSSL), boolToFlag(config.PathStyle), config.Prefix, config.RetentionDays, config.URLExpiry, config.UpdatedAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not save S3 settings: %v", err)))
+			return
+		}
+		storagecache.Delete(txtid)
+
+		response["config"] = config.toMap()
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Removes the user's S3 storage, media goes to the global storage if set
+func (s *server) DeleteS3Config() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		_, err := s.db.Exec("DELETE FROM s3_config WHERE user_id=$1", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete S3 settings: %v", err)))
+			return
+		}
+		storagecache.Delete(txtid)
+
+		response := map[string]interface{}{"Details": "S3 settings removed successfully"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Checks that the S3 storage used for incoming media is reachable and writable
+func (s *server) TestS3Config() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		storage := getMediaStorage(s.db, txtid)
+		if storage == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("No S3 storage configured"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		if err := storage.Check(ctx); err != nil {
+			s.Respond(w, r, http.StatusBadGateway, errors.New(fmt.Sprintf("Could not access bucket: %v", err)))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "S3 storage is reachable", "bucket": storage.config.Bucket}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the event sinks of a user
+func (s *server) ListSinks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var sinks []SinkConfig
+		err := s.db.Select(&sinks, "SELECT "+sinkColumns+" FROM event_sinks WHERE user_id=$1 ORDER BY created_at", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get sinks: %v", err)))
+			return
+		}
+
+		response := []map[string]interface{}{}
+		for _, sc := range sinks {
+			response = append(response, sc.toMap())
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets one event sink
+func (s *server) GetSink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		var sc SinkConfig
+		err := s.db.Get(&sc, "SELECT "+sinkColumns+" FROM event_sinks WHERE id=$1 AND user_id=$2", id, txtid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Sink not found"))
+				return
+			}
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get sink: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(sc.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Adds an event sink publishing to NATS, a Redis Stream or an AMQP exchange
+func (s *server) AddSink() http.HandlerFunc {
+	type sinkStruct struct {
+		Type        string          `json:"type"`
+		URL         string          `json:"url"`
+		Subject     string          `json:"subject,omitempty"`
+		Exchange    string          `json:"exchange,omitempty"`
+		Events      []string        `json:"events,omitempty"`
+		Enabled     *bool           `json:"enabled,omitempty"`
+		Description string          `json:"description,omitempty"`
+		Schema      string          `json:"schema,omitempty"`
+		Filter      json.RawMessage `json:"filter,omitempty"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		decoder := json.NewDecoder(r.Body)
+		var t sinkStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+
+		sc := SinkConfig{
+			UserId:      txtid,
+			Type:        strings.ToLower(t.Type),
+			URL:         t.URL,
+			Subject:     t.Subject,
+			Exchange:    t.Exchange,
+			Enabled:     t.Enabled == nil || *t.Enabled,
+			Description: t.Description,
+			CreatedAt:   time.Now().Unix(),
+		}
+		if err := sc.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		sc.Events, err = validateWebhookEvents(t.Events)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		sc.Schema, err = validateWebhookSchema(t.Schema)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		sc.Filter, err = normalizeEventFilter(t.Filter)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		sc.Id, err = GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		_, err = s.db.Exec("INSERT INTO event_sinks ("+sinkColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+			sc.Id, sc.UserId, sc.Type, sc.URL, sc.Subject, sc.Exchange, sc.Events, boolToFlag(sc.Enabled), sc.Description, sc.Schema, sc.Filter, sc.CreatedAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not add sink: %v", err)))
+			return
+		}
+		sinkcache.Delete(txtid)
+
+		responseJson, err := json.Marshal(sc.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusCreated, string(responseJson))
+		}
+	}
+}
+
+// Updates an event sink, only the fields present in the payload are changed
+func (s *server) UpdateSink() http.HandlerFunc {
+	type sinkStruct struct {
+		URL         *string         `json:"url,omitempty"`
+		Subject     *string         `json:"subject,omitempty"`
+		Exchange    *string         `json:"exchange,omitempty"`
+		Events      []string        `json:"events,omitempty"`
+		Enabled     *bool           `json:"enabled,omitempty"`
+		Description *string         `json:"description,omitempty"`
+		Schema      *string         `json:"schema,omitempty"`
+		Filter      json.RawMessage `json:"filter,omitempty"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		decoder := json.NewDecoder(r.Body)
+		var t sinkStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+
+		var sc SinkConfig
+		err = s.db.Get(&sc, "SELECT "+sinkColumns+" FROM event_sinks WHERE id=$1 AND user_id=$2", id, txtid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Sink not found"))
+				return
+			}
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get sink: %v", err)))
+			return
+		}
+
+		if t.URL != nil {
+			sc.URL = *t.URL
+		}
+		if t.Subject != nil {
+			sc.Subject = *t.Subject
+		}
+		if t.Exchange != nil {
+			sc.Exchange = *t.Exchange
+		}
+		if err := sc.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if t.Events != nil {
+			sc.Events, err = validateWebhookEvents(t.Events)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if t.Enabled != nil {
+			sc.Enabled = *t.Enabled
+		}
+		if t.Description != nil {
+			sc.Description = *t.Description
+		}
+		if t.Schema != nil {
+			sc.Schema, err = validateWebhookSchema(*t.Schema)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if t.Filter != nil {
+			sc.Filter, err = normalizeEventFilter(t.Filter)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		_, err = s.db.Exec("UPDATE event_sinks SET url=$1, subject=$2, exchange=$3, events=$4, enabled=$5, description=$6, schema=$7, filter=$8 WHERE id=$9 AND user_id=$10",
+			sc.URL, sc.Subject, sc.Exchange, sc.Events, boolToFlag(sc.Enabled), sc.Description, sc.Schema, sc.Filter, sc.Id, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update sink: %v", err)))
+			return
+		}
+		sinkcache.Delete(txtid)
+		if !sc.Enabled {
+			sinkDispatcher.Remove(sc.Id)
+		}
+
+		responseJson, err := json.Marshal(sc.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Removes an event sink
+func (s *server) DeleteSink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		result, err := s.db.Exec("DELETE FROM event_sinks WHERE id=$1 AND user_id=$2", id, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete sink: %v", err)))
+			return
+		}
+		if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Sink not found"))
+			return
+		}
+		sinkcache.Delete(txtid)
+		sinkDispatcher.Remove(id)
+
+		response := map[string]interface{}{"Details": "Sink deleted successfully", "id": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Publishes a sample event to a sink and waits for the broker to take it,
+// bypassing the queue so connection errors are reported back
+func (s *server) TestSink() http.HandlerFunc {
+	type testStruct struct {
+		Type string `json:"type"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		userinfo := r.Context().Value("userinfo").(Values)
+		txtid := userinfo.Get("Id")
+		id := mux.Vars(r)["id"]
+
+		var t testStruct
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+				return
+			}
+		}
+		if t.Type == "" {
+			t.Type = "Message"
+		}
+		if !Find(messageTypes, t.Type) || t.Type == "All" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("invalid event type: %s", t.Type)))
+			return
+		}
+
+		var sc SinkConfig
+		err := s.db.Get(&sc, "SELECT "+sinkColumns+" FROM event_sinks WHERE id=$1 AND user_id=$2", id, txtid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Sink not found"))
+				return
+			}
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get sink: %v", err)))
+			return
+		}
+
+		postmap, err := sampleWebhookEvent(t.Type)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		eventID, err := GenerateRandomID()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		data, err := newEventEncoder(postmap, eventID, txtid, userinfo.Get("Name")).Encode(sc.Schema)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		subject := sc.SubjectFor(txtid, t.Type)
+		ctx, cancel := context.WithTimeout(r.Context(), sinkPublishTimeout)
+		defer cancel()
+		start := time.Now()
+		sink, err := newEventSink(ctx, sc)
+		if err == nil {
+			err = sink.Publish(ctx, subject, SinkMessage{
+				EventID:      eventID,
+				EventType:    t.Type,
+				InstanceID:   txtid,
+				InstanceName: userinfo.Get("Name"),
+				Data:         data,
+			})
+			sink.Close()
+		}
+
+		response := map[string]interface{}{
+			"id":         sc.Id,
+			"sink_type":  sc.Type,
+			"subject":    subject,
+			"type":       t.Type,
+			"event_id":   eventID,
+			"published":  err == nil,
+			"latency_ms": time.Since(start).Milliseconds(),
+			"error":      errorString(err),
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the command queue of the user and whether it is being consumed
+func (s *server) GetCommandQueue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		cq, err := getCommandQueue(s.db, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get command queue: %v", err)))
+			return
+		}
+		if cq == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No command queue configured"))
+			return
+		}
+
+		response := cq.toMap()
+		response["running"] = commandQueues.Running(txtid)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets the command queue of the user, only the fields sent are changed. The
+// consumer is restarted if the session is running.
+func (s *server) SetCommandQueue() http.HandlerFunc {
+	type commandQueueStruct struct {
+		Type         *string `json:"type"`
+		URL          *string `json:"url"`
+		Subject      *string `json:"subject"`
+		ReplySubject *string `json:"reply_subject"`
+		Durable      *string `json:"durable"`
+		Enabled      *bool   `json:"enabled"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		userinfo := r.Context().Value("userinfo").(Values)
+		txtid := userinfo.Get("Id")
+
+		var t commandQueueStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+
+		cq, err := getCommandQueue(s.db, txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get command queue: %v", err)))
+			return
+		}
+		if cq == nil {
+			cq = &CommandQueueConfig{UserId: txtid, Enabled: true}
+		}
+		// Subjects that are not sent go back to the defaults of the new type
+		if t.Type != nil && strings.ToLower(*t.Type) != cq.Type {
+			cq.Type = strings.ToLower(*t.Type)
+			cq.Subject = ""
+			cq.ReplySubject = ""
+			cq.Durable = ""
+		}
+		if t.URL != nil {
+			cq.URL = *t.URL
+		}
+		if t.Subject != nil {
+			cq.Subject = *t.Subject
+		}
+		if t.ReplySubject != nil {
+			cq.ReplySubject = *t.ReplySubject
+		}
+		if t.Durable != nil {
+			cq.Durable = *t.Durable
+		}
+		if t.Enabled != nil {
+			cq.Enabled = *t.Enabled
+		}
+		if err := cq.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		cq.UpdatedAt = time.Now().Unix()
+
+		_, err = s.db.Exec(`INSERT INTO command_queues (`+commandQueueColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (user_id) DO UPDATE SET type=excluded.type, url=excluded.url, subject=excluded.subject,
+			reply_subject=excluded.reply_subject, durable=excluded.durable, enabled=excluded.enabled, updated_at=excluded.updated_at`,
+			cq.UserId, cq.Type, cq.URL, cq.Subject, cq.ReplySubject, cq.Durable, boolToFlag(cq.Enabled), cq.UpdatedAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not save command queue: %v", err)))
+			return
+		}
+
+		if clientManager.GetWhatsmeowClient(txtid) != nil {
+			commandQueues.Start(s, txtid, userinfo.Get("Token"))
+		} else {
+			commandQueues.Stop(txtid)
+		}
+
+		response := cq.toMap()
+		response["running"] = commandQueues.Running(txtid)
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Removes the command queue of the user and stops consuming it
+func (s *server) DeleteCommandQueue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		_, err := s.db.Exec("DELETE FROM command_queues WHERE user_id=$1", txtid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete command queue: %v", err)))
+			return
+		}
+		commandQueues.Stop(txtid)
+
+		response := map[string]interface{}{"Details": "Command queue removed successfully"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the policy applied to incoming calls
+func (s *server) GetCallPolicy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		policy := getCallPolicy(s.db, txtid)
+		responseJson, err := json.Marshal(policy.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets the policy applied to incoming calls, only the fields sent are changed
+func (s *server) SetCallPolicy() http.HandlerFunc {
+	type callPolicyStruct struct {
+		Mode      *string `json:"mode"`
+		ReplyText *string `json:"reply_text"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t callPolicyStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+
+		policy := CallPolicy{UserId: txtid, Mode: callPolicyNotify}
+		err := s.db.Get(&policy, "SELECT "+callPolicyColumns+" FROM call_policies WHERE user_id=$1", txtid)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get call policy: %v", err)))
+			return
+		}
+		if t.Mode != nil {
+			policy.Mode = strings.ToLower(*t.Mode)
+		}
+		if t.ReplyText != nil {
+			policy.ReplyText = *t.ReplyText
+		}
+		if err := policy.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		policy.UpdatedAt = time.Now().Unix()
+
+		_, err = s.db.Exec(`INSERT INTO call_policies (`+callPolicyColumns+`) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id) DO UPDATE SET mode=excluded.mode, reply_text=excluded.reply_text, updated_at=excluded.updated_at`,
+			policy.UserId, policy.Mode, policy.ReplyText, policy.UpdatedAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not save call policy: %v", err)))
+			return
+		}
+		callpolicycache.Delete(txtid)
+
+		responseJson, err := json.Marshal(policy.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the calls received, newest first
+func (s *server) ListCallLog() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		from, err := queryUnix(r, "from")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		to, err := queryUnix(r, "to")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if to == 0 {
+			to = time.Now().Unix()
+		}
+
+		query := "SELECT " + callLogColumns + " FROM call_log WHERE user_id=$1 AND offered_at >= $2 AND offered_at <= $3"
+		args := []interface{}{txtid, from, to}
+		if state := r.URL.Query().Get("state"); state != "" {
+			query += " AND state=$4"
+			args = append(args, state)
+		}
+		query += fmt.Sprintf(" ORDER BY offered_at DESC LIMIT %d", limit)
+
+		calls := []CallLogEntry{}
+		if err := s.db.Select(&calls, query, args...); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get call log: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(calls)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the message store settings
+func (s *server) GetMessageStore() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		config := getMessageStoreConfig(s.db, txtid)
+		responseJson, err := json.Marshal(config.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Enables or disables the message store, only the fields sent are changed
+func (s *server) SetMessageStore() http.HandlerFunc {
+	type messageStoreStruct struct {
+		Enabled       *bool `json:"enabled"`
+		RetentionDays *int  `json:"retention_days"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t messageStoreStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+
+		config := MessageStoreConfig{UserId: txtid, RetentionDays: defaultMessageRetentionDays}
+		err := s.db.Get(&config, "SELECT "+messageStoreConfigColumns+" FROM message_store_config WHERE user_id=$1", txtid)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get message store settings: %v", err)))
+			return
+		}
+		if t.Enabled != nil {
+			config.Enabled = *t.Enabled
+		}
+		if t.RetentionDays != nil {
+			config.RetentionDays = *t.RetentionDays
+		}
+		if err := config.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		config.UpdatedAt = time.Now().Unix()
+
+		_, err = s.db.Exec(`INSERT INTO message_store_config (`+messageStoreConfigColumns+`) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id) DO UPDATE SET enabled=excluded.enabled, retention_days=excluded.retention_days, updated_at=excluded.updated_at`,
+			config.UserId, boolToFlag(config.Enabled), config.RetentionDays, config.UpdatedAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not save message store settings: %v", err)))
+			return
+		}
+		messagestorecache.Delete(txtid)
+
+		responseJson, err := json.Marshal(config.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the stored chats, the most recently active first
+func (s *server) ListChats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		chats := []StoredChat{}
+		err = s.db.Select(&chats, "SELECT "+storedChatColumns+" FROM chats WHERE user_id=$1 ORDER BY last_message_at DESC LIMIT $2", txtid, limit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get chats: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(chats)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the stored messages of a chat, newest first. Older pages are fetched
+// with before set to the timestamp of the last message received.
+func (s *server) GetChatHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		chatParam := r.URL.Query().Get("chat")
+		if chatParam == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing chat in query"))
+			return
+		}
+		chat, ok := parseJID(chatParam)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse chat"))
+			return
+		}
+		before, err := queryUnix(r, "before")
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if before == 0 {
+			before = time.Now().Unix() + 1
+		}
+
+		messages := []StoredMessage{}
+		err = s.db.Select(&messages, "SELECT "+storedMessageColumns+" FROM messages WHERE user_id=$1 AND chat=$2 AND sent_at < $3 ORDER BY sent_at DESC LIMIT $4",
+			txtid, chat.ToNonAD().String(), before, limit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get chat history: %v", err)))
+			return
+		}
+		for i := range messages {
+			messages[i].decodePayload()
+		}
+
+		responseJson, err := json.Marshal(messages)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Searches the stored messages, with optional chat, sender, kind and date
+// filters. The cursor of the response gets the next page.
+func (s *server) SearchMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		params := r.URL.Query()
+
+		search := MessageSearch{Query: params.Get("q"), Kind: params.Get("kind")}
+		if len(searchTerms(search.Query)) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing q in query"))
+			return
+		}
+		if search.Kind != "" && !Find(messageKinds, search.Kind) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid kind: %s (allowed: %s)", search.Kind, strings.Join(messageKinds, ", "))))
+			return
+		}
+		if chatParam := params.Get("chat"); chatParam != "" {
+			chat, ok := parseJID(chatParam)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse chat"))
+				return
+			}
+			search.Chat = chat.ToNonAD().String()
+		}
+		if senderParam := params.Get("sender"); senderParam != "" {
+			sender, ok := parseJID(senderParam)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse sender"))
+				return
+			}
+			search.Sender = sender.ToNonAD().String()
+		}
+		var err error
+		if search.From, err = queryUnix(r, "from"); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if search.To, err = queryUnix(r, "to"); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if search.Limit, err = queryLimit(r); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if cursorParam := params.Get("cursor"); cursorParam != "" {
+			if search.Cursor, err = decodeSearchCursor(cursorParam); err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		results, next, err := searchMessages(s.db, txtid, search)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not search messages: %v", err)))
+			return
+		}
+
+		response := map[string]interface{}{"results": results, "next_cursor": next}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a stored message by id, the optional chat query parameter picks the
+// chat when the id is not unique
+func (s *server) GetStoredMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		query := "SELECT " + storedMessageColumns + " FROM messages WHERE user_id=$1 AND id=$2"
+		args := []interface{}{txtid, id}
+		if chatParam := r.URL.Query().Get("chat"); chatParam != "" {
+			chat, ok := parseJID(chatParam)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse chat"))
+				return
+			}
+			query += " AND chat=$3"
+			args = append(args, chat.ToNonAD().String())
+		}
+		query += " ORDER BY sent_at DESC LIMIT 1"
+
+		var message StoredMessage
+		err := s.db.Get(&message, query, args...)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get message: %v", err)))
+			return
+		}
+		message.decodePayload()
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the delivery status of a message sent through the API, with the
+// state of each participant in groups
+func (s *server) GetMessageStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		message, err := getMessageStatus(s.db, txtid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get message status: %v", err)))
+			return
+		}
+		if message == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(message)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets the send queue settings
+func (s *server) GetSendQueueConfig() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		config := getSendQueueConfig(s.db, txtid)
+		responseJson, err := json.Marshal(config.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Sets the rate of the send queue, only the fields sent are changed
+func (s *server) SetSendQueueConfig() http.HandlerFunc {
+	type sendQueueStruct struct {
+		MessagesPerMinute *int `json:"messages_per_minute"`
+		RecipientInterval *int `json:"recipient_interval"`
+		Jitter            *int `json:"jitter"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t sendQueueStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+
+		sendqueueconfcache.Delete(txtid)
+		config := getSendQueueConfig(s.db, txtid)
+		if t.MessagesPerMinute != nil {
+			config.MessagesPerMinute = *t.MessagesPerMinute
+		}
+		if t.RecipientInterval != nil {
+			config.RecipientInterval = *t.RecipientInterval
+		}
+		if t.Jitter != nil {
+			config.Jitter = *t.Jitter
+		}
+		if err := config.validate(); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		config.UpdatedAt = time.Now().Unix()
+
+		_, err := s.db.Exec(`INSERT INTO send_queue_config (`+sendQueueConfigColumns+`) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id) DO UPDATE SET messages_per_minute=excluded.messages_per_minute, recipient_interval=excluded.recipient_interval, jitter=excluded.jitter, updated_at=excluded.updated_at`,
+			config.UserId, config.MessagesPerMinute, config.RecipientInterval, config.Jitter, config.UpdatedAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not save send queue settings: %v", err)))
+			return
+		}
+		sendqueueconfcache.Delete(txtid)
+
+		responseJson, err := json.Marshal(config.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists the send jobs, newest first, optionally only those with a status
+func (s *server) ListSendJobs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		query := "SELECT " + sendJobColumns + " FROM send_jobs WHERE user_id=$1"
+		args := []interface{}{txtid}
+		if status := r.URL.Query().Get("status"); status != "" {
+			if !Find(sendJobStatuses, status) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid status: %s (allowed: %s)", status, strings.Join(sendJobStatuses, ", "))))
+				return
+			}
+			query += " AND status=$2"
+			args = append(args, status)
+		}
+		query += fmt.Sprintf(" ORDER BY seq DESC LIMIT %d", limit)
+
+		jobs := []SendJob{}
+		if err := s.db.Select(&jobs, query, args...); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get send jobs: %v", err)))
+			return
+		}
+		for i := range jobs {
+			jobs[i].decodeResponse()
+		}
+
+		responseJson, err := json.Marshal(jobs)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a send job by id
+func (s *server) GetSendJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		var job SendJob
+		err := s.db.Get(&job, "SELECT "+sendJobColumns+" FROM send_jobs WHERE user_id=$1 AND id=$2", txtid, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Send job not found"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get send job: %v", err)))
+			return
+		}
+		job.decodeResponse()
+
+		responseJson, err := json.Marshal(job)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Cancels a send job that is still queued
+func (s *server) CancelSendJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		cancelled, err := cancelSendJob(s.db, txtid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not cancel send job: %v", err)))
+			return
+		}
+		if !cancelled {
+			s.Respond(w, r, http.StatusConflict, errors.New("Send job not found or no longer queued"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Cancelled", "JobId": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Schedules a message to be sent at a given time
+func (s *server) ScheduleMessage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not read Payload"))
+			return
+		}
+		job, err := newScheduledJob(txtid, body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := sendQueue.Enqueue(s, job); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not schedule message: %v", err)))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Str("job", job.Id).Str("id", job.MessageId).Int64("send_at", job.SendAt).Msg("Message scheduled")
+		response := map[string]interface{}{"Details": "Scheduled", "JobId": job.Id, "Id": job.MessageId, "SendAt": job.SendAt}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists scheduled messages, the queued ones by the time they are due and the
+// others newest first
+func (s *server) ListScheduledMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		query := "SELECT " + sendJobColumns + " FROM send_jobs WHERE user_id=$1 AND send_at > 0"
+		args := []interface{}{txtid}
+		order := "DESC"
+		if status := r.URL.Query().Get("status"); status != "" {
+			if !Find(sendJobStatuses, status) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid status: %s (allowed: %s)", status, strings.Join(sendJobStatuses, ", "))))
+				return
+			}
+			query += " AND status=$2"
+			args = append(args, status)
+			if status == sendJobQueued {
+				order = "ASC"
+			}
+		}
+		query += fmt.Sprintf(" ORDER BY send_at %s, seq %s LIMIT %d", order, order, limit)
+
+		jobs := []SendJob{}
+		if err := s.db.Select(&jobs, query, args...); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get scheduled messages: %v", err)))
+			return
+		}
+		for i := range jobs {
+			jobs[i].decodeResponse()
+		}
+
+		responseJson, err := json.Marshal(jobs)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Moves a scheduled message that was not sent yet to a new time
+func (s *server) RescheduleMessage() http.HandlerFunc {
+
+	type rescheduleStruct struct {
+		SendAt json.RawMessage `json:"send_at"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		var t rescheduleStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.SendAt == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing send_at in Payload"))
+			return
+		}
+		sendAt, err := parseSendAt(t.SendAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := validateSendAt(sendAt); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		updated, err := rescheduleSendJob(s.db, txtid, id, sendAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not reschedule message: %v", err)))
+			return
+		}
+		if !updated {
+			s.Respond(w, r, http.StatusConflict, errors.New("Scheduled message not found or no longer queued"))
+			return
+		}
+		sendQueue.wake(s, txtid)
+
+		response := map[string]interface{}{"Details": "Rescheduled", "JobId": id, "SendAt": sendAt.Unix()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Creates a campaign that sends a message template to a list of recipients
+func (s *server) CreateCampaign() http.HandlerFunc {
+
+	type campaignStruct struct {
+		Name       string
+		Type       string
+		Message    map[string]interface{}
+		Recipients []CampaignRecipient
+		SendAt     json.RawMessage `json:"send_at"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		var t campaignStruct
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		var sendAt time.Time
+		if t.SendAt != nil {
+			var err error
+			sendAt, err = parseSendAt(t.SendAt)
+			if err == nil {
+				err = validateSendAt(sendAt)
+			}
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		campaign, jobs, err := newCampaign(txtid, t.Name, t.Type, t.Message, t.Recipients, sendAt)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := createCampaign(s.db, campaign, jobs); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create campaign: %v", err)))
+			return
+		}
+		sendQueue.wake(s, txtid)
+
+		log.Info().Str("userid", txtid).Str("campaign", campaign.Id).Int("recipients", campaign.Total).Msg("Campaign created")
+		if err := campaign.loadProgress(s.db); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get campaign: %v", err)))
+			return
+		}
+		responseJson, err := json.Marshal(campaign)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Lists campaigns with their progress, newest first
+func (s *server) ListCampaigns() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+		limit, err := queryLimit(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		query := "SELECT " + campaignColumns + " FROM campaigns WHERE user_id=$1"
+		args := []interface{}{txtid}
+		if status := r.URL.Query().Get("status"); status != "" {
+			if !Find(campaignStatuses, status) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid status: %s (allowed: %s)", status, strings.Join(campaignStatuses, ", "))))
+				return
+			}
+			query += " AND status=$2"
+			args = append(args, status)
+		}
+		query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT %d", limit)
+
+		campaigns := []Campaign{}
+		if err := s.db.Select(&campaigns, query, args...); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get campaigns: %v", err)))
+			return
+		}
+		for i := range campaigns {
+			if err := campaigns[i].loadProgress(s.db); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get campaigns: %v", err)))
+				return
+			}
+		}
+
+		responseJson, err := json.Marshal(campaigns)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Gets a campaign with its progress
+func (s *server) GetCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		campaign, err := getCampaign(s.db, txtid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get campaign: %v", err)))
+			return
+		}
+		if campaign == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Campaign not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(campaign)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Pauses, resumes or cancels a campaign
+func (s *server) UpdateCampaignStatus(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		var updated bool
+		var err error
+		var details string
+		switch action {
+		case "pause":
+			updated, err = setCampaignStatus(s.db, txtid, id, campaignRunning, campaignPaused)
+			details = "Campaign not found or not running"
+		case "resume":
+			updated, err = setCampaignStatus(s.db, txtid, id, campaignPaused, campaignRunning)
+			details = "Campaign not found or not paused"
+			if updated && err == nil {
+				finishCampaign(s.db, id)
+				sendQueue.wake(s, txtid)
+			}
+		case "cancel":
+			updated, err = cancelCampaign(s.db, txtid, id)
+			details = "Campaign not found or already finished"
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update campaign: %v", err)))
+			return
+		}
+		if !updated {
+			s.Respond(w, r, http.StatusConflict, errors.New(details))
+			return
+		}
+		log.Info().Str("userid", txtid).Str("campaign", id).Str("action", action).Msg("Campaign updated")
+
+		campaign, err := getCampaign(s.db, txtid, id)
+		if err != nil || campaign == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get campaign: %v", err)))
+			return
+		}
+		responseJson, err := json.Marshal(campaign)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+	}
+}
+
+// Exports the status of each recipient of a campaign as CSV
+func (s *server) ExportCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		id := mux.Vars(r)["id"]
+
+		campaign, err := getCampaign(s.db, txtid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get campaign: %v", err)))
+			return
+		}
+		if campaign == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Campaign not found"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"campaign-%s.csv\"", id))
+		if err := writeCampaignCSV(s.db, txtid, id, w); err != nil {
+			log.Error().Err(err).Str("userid", txtid).Str("campaign", id).Msg("Could not export campaign")
+		}
+	}
+}
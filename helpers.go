@@ -1,10 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"github.com/rs/zerolog/log"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
 )
 
 func Find(slice []string, val string) bool {
@@ -16,6 +32,14 @@ func Find(slice []string, val string) bool {
 	return false
 }
 
+// Converts a boolean to the 1/0 flag stored in INTEGER columns
+func boolToFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
 // Update entry in User map
 func updateUserInfo(values interface{}, field string, value string) interface{} {
 	log.Debug().Str("field", field).Str("value", value).Msg("User info updated")
@@ -23,8 +47,69 @@ func updateUserInfo(values interface{}, field string, value string) interface{}
 	return values
 }
 
+// Returns the HTTP client used to call webhooks for a user, falling back to
+// a shared client when the user has no active session (e.g. on retries
+// after a restart)
+func getWebhookClient(id string) *resty.Client {
+	if client := clientManager.GetHTTPClient(id); client != nil {
+		return client
+	}
+	return defaultWebhookClient
+}
+
+// Generates a random secret used to sign webhook payloads
+func generateWebhookSecret() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Signs the request body with HMAC-SHA256 over "<timestamp>.<body>". The
+// timestamp is sent along so receivers can reject replayed requests.
+func signWebhook(req *resty.Request, secret string, body []byte) {
+	if secret == "" {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	req.SetHeader("X-Wuzapi-Timestamp", timestamp)
+	req.SetHeader("X-Wuzapi-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Maximum length of a receiver response kept for failed deliveries
+const webhookResponseExcerpt = 1024
+
+// Returned when the webhook receiver answers with a non-2xx status
+type webhookStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook returned status %d", e.StatusCode)
+}
+
+// Checks the receiver answered with a 2xx status, otherwise returns a
+// webhookStatusError with an excerpt of the response body
+func checkWebhookResponse(resp *resty.Response) error {
+	if resp.StatusCode() >= 200 && resp.StatusCode() <= 299 {
+		return nil
+	}
+	body := resp.Body()
+	if len(body) > webhookResponseExcerpt {
+		body = body[:webhookResponseExcerpt]
+	}
+	// Stored as TEXT, which must be valid UTF-8 without NUL bytes on PostgreSQL
+	excerpt := strings.ReplaceAll(strings.ToValidUTF8(string(body), ""), "\x00", "")
+	return &webhookStatusError{StatusCode: resp.StatusCode(), Body: excerpt}
+}
+
 // webhook for regular messages
-func callHook(myurl string, payload map[string]string, id string) {
+func callHook(myurl string, payload map[string]string, id string, secret string) (int, error) {
 	log.Info().Str("url", myurl).Msg("Sending POST to client " + id)
 
 	// Log the payload map
@@ -33,19 +118,61 @@ func callHook(myurl string, payload map[string]string, id string) {
 		log.Debug().Str(key, value).Msg("")
 	}
 
-	client := clientManager.GetHTTPClient(id)
+	client := getWebhookClient(id)
+
+	form := url.Values{}
+	for key, value := range payload {
+		form.Set(key, value)
+	}
+	body := []byte(form.Encode())
 
-	_, err := client.R().SetFormData(payload).Post(myurl)
+	req := client.R().
+		SetHeader("Content-Type", "application/x-www-form-urlencoded").
+		SetBody(body)
+	signWebhook(req, secret, body)
+
+	resp, err := req.Post(myurl)
 	if err != nil {
-		log.Debug().Str("error", err.Error())
+		return 0, fmt.Errorf("failed to send POST request: %w", err)
+	}
+	return resp.StatusCode(), checkWebhookResponse(resp)
+}
+
+// Sets the headers used by the JSON format to carry what the form format
+// sends as fields
+func setWebhookJSONHeaders(req *resty.Request, payload map[string]string, id string) {
+	req.SetHeader("X-Wuzapi-Instance", id)
+	if token, ok := payload["token"]; ok {
+		req.SetHeader("X-Wuzapi-Token", token)
 	}
 }
 
-// webhook for messages with file attachments
-func callHookFile(myurl string, payload map[string]string, id string, file string) error {
+// webhook for regular messages, posting the event as a JSON body
+func callHookJSON(myurl string, payload map[string]string, id string, secret string) (int, error) {
+	log.Info().Str("url", myurl).Msg("Sending JSON POST to client " + id)
+
+	client := getWebhookClient(id)
+
+	body := []byte(payload["jsonData"])
+	req := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body)
+	setWebhookJSONHeaders(req, payload, id)
+	signWebhook(req, secret, body)
+
+	resp, err := req.Post(myurl)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send POST request: %w", err)
+	}
+	return resp.StatusCode(), checkWebhookResponse(resp)
+}
+
+// webhook for messages with file attachments. In the JSON format the event
+// is sent as an application/json "metadata" part instead of form fields.
+func callHookFile(myurl string, payload map[string]string, id string, file string, secret string, format string) (int, error) {
 	log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST")
 
-	client := clientManager.GetHTTPClient(id)
+	client := getWebhookClient(id)
 
 	// Create final payload map
 	finalPayload := make(map[string]string)
@@ -57,22 +184,64 @@ func callHookFile(myurl string, payload map[string]string, id string, file strin
 
 	log.Debug().Interface("finalPayload", finalPayload).Msg("Final payload to be sent")
 
-	resp, err := client.R().
-		SetFiles(map[string]string{
-			"file": file,
-		}).
-		SetFormData(finalPayload).
-		Post(myurl)
+	// The multipart body is built here instead of by resty so the exact
+	// bytes sent can be signed
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if format == webhookFormatJSON {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="metadata"`)
+		header.Set("Content-Type", "application/json")
+		part, err := writer.CreatePart(header)
+		if err == nil {
+			_, err = part.Write([]byte(payload["jsonData"]))
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to build multipart body: %w", err)
+		}
+	} else {
+		for k, v := range finalPayload {
+			if err := writer.WriteField(k, v); err != nil {
+				return 0, fmt.Errorf("failed to build multipart body: %w", err)
+			}
+		}
+	}
+	part, err := writer.CreateFormFile("file", filepath.Base(file))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build multipart body: %w", err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	_, err = io.Copy(part, f)
+	f.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf("failed to build multipart body: %w", err)
+	}
+
+	req := client.R().
+		SetHeader("Content-Type", writer.FormDataContentType()).
+		SetBody(body.Bytes())
+	if format == webhookFormatJSON {
+		setWebhookJSONHeaders(req, payload, id)
+	}
+	signWebhook(req, secret, body.Bytes())
+
+	resp, err := req.Post(myurl)
 
 	if err != nil {
 		log.Error().Err(err).Str("url", myurl).Msg("Failed to send POST request")
-		return fmt.Errorf("failed to send POST request: %w", err)
+		return 0, fmt.Errorf("failed to send POST request: %w", err)
 	}
 
 	log.Debug().Interface("payload", finalPayload).Msg("Payload sent to webhook")
 	log.Info().Int("status", resp.StatusCode()).Str("body", string(resp.Body())).Msg("POST request completed")
 
-	return nil
+	return resp.StatusCode(), checkWebhookResponse(resp)
 }
 
 func (s *server) respondWithJSON(w http.ResponseWriter, statusCode int, payload interface{}) {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"type":"Message"}`)
+	req := resty.New().R()
+	before := time.Now().Unix()
+	signWebhook(req, "s3cret", body)
+
+	timestamp := req.Header.Get("X-Wuzapi-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || ts < before || ts > time.Now().Unix() {
+		t.Fatalf("timestamp = %q, want the current unix time", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get("X-Wuzapi-Signature"); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+
+	// The signature covers the body and depends on the secret
+	other := resty.New().R()
+	signWebhook(other, "other", body)
+	if other.Header.Get("X-Wuzapi-Signature") == want {
+		t.Error("signatures with different secrets are equal")
+	}
+
+	unsigned := resty.New().R()
+	signWebhook(unsigned, "", body)
+	if unsigned.Header.Get("X-Wuzapi-Signature") != "" || unsigned.Header.Get("X-Wuzapi-Timestamp") != "" {
+		t.Errorf("request without a secret has headers %v", unsigned.Header)
+	}
+}
+
+func TestGenerateWebhookSecret(t *testing.T) {
+	first, err := generateWebhookSecret()
+	if err != nil {
+		t.Fatalf("generateWebhookSecret error = %v", err)
+	}
+	if _, err := hex.DecodeString(first); err != nil || len(first) != 64 {
+		t.Errorf("secret %q is not 32 bytes in hex", first)
+	}
+	second, _ := generateWebhookSecret()
+	if first == second {
+		t.Error("two secrets are equal")
+	}
+}
+
+func TestCheckWebhookResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusNoContent)
+		case "/long":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(strings.Repeat("x", webhookResponseExcerpt+100)))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("bad\x00 \xffgateway"))
+		}
+	}))
+	defer srv.Close()
+
+	client := resty.New()
+	resp, err := client.R().Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWebhookResponse(resp); err != nil {
+		t.Errorf("2xx response error = %v", err)
+	}
+
+	resp, _ = client.R().Get(srv.URL + "/fail")
+	var statusErr *webhookStatusError
+	if err := checkWebhookResponse(resp); !errors.As(err, &statusErr) {
+		t.Fatalf("5xx response error = %v, want a webhookStatusError", err)
+	}
+	// Kept as TEXT, without NUL bytes or invalid UTF-8
+	if statusErr.StatusCode != http.StatusInternalServerError || statusErr.Body != "bad gateway" {
+		t.Errorf("error = %d %q, want 500 \"bad gateway\"", statusErr.StatusCode, statusErr.Body)
+	}
+
+	resp, _ = client.R().Get(srv.URL + "/long")
+	if err := checkWebhookResponse(resp); !errors.As(err, &statusErr) || len(statusErr.Body) != webhookResponseExcerpt {
+		t.Errorf("long response error = %v with %d bytes, want %d", err, len(statusErr.Body), webhookResponseExcerpt)
+	}
+}
+
+func TestCallHookJSON(t *testing.T) {
+	var got *http.Request
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got, body = r, string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	payload := map[string]string{"jsonData": `{"type":"Message"}`, "token": "usertoken"}
+	status, err := callHookJSON(srv.URL, payload, "user1", "s3cret")
+	if err != nil || status != http.StatusAccepted {
+		t.Fatalf("callHookJSON = %d, %v", status, err)
+	}
+	if body != payload["jsonData"] || got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("posted %q as %s", body, got.Header.Get("Content-Type"))
+	}
+	if got.Header.Get("X-Wuzapi-Instance") != "user1" || got.Header.Get("X-Wuzapi-Token") != "usertoken" {
+		t.Errorf("headers = %v", got.Header)
+	}
+	if !strings.HasPrefix(got.Header.Get("X-Wuzapi-Signature"), "sha256=") {
+		t.Errorf("request is not signed: %v", got.Header)
+	}
+
+	status, err = callHookJSON(srv.URL+"/gone", map[string]string{"jsonData": "{}"}, "user1", "")
+	if err != nil || got.Header.Get("X-Wuzapi-Token") != "" || got.Header.Get("X-Wuzapi-Signature") != "" {
+		t.Errorf("request without token or secret = %d, %v, headers %v", status, err, got.Header)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// Send requests with an Idempotency-Key header, or with the Id of the
+// message to send, are run once: the response is kept for -idempotencyttl
+// and a retry of the same request gets it back instead of sending the
+// message again. Reusing a key for a different request, or while the first
+// request is still running, fails with 409. Responses with a 5xx status
+// are not kept, so those requests can be retried. Media uploaded as
+// multipart/form-data is only run once with the header.
+
+const maxIdempotencyKeyLength = 255
+
+var idempotencycache = cache.New(cache.NoExpiration, 10*time.Minute)
+
+// Outcome of a request made with an idempotency key, pending until the
+// request is done
+type idempotentResponse struct {
+	Hash        string
+	Done        bool
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Captures the response of a request while it is written
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(data []byte) (int, error) {
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+// Returns the Id field of a JSON request body, empty when there is none
+func requestMessageId(body []byte) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return ""
+	}
+	for key, value := range fields {
+		var id string
+		if strings.ToLower(key) == "id" && json.Unmarshal(value, &id) == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// Hashes the parts of a multipart body kept in a file, leaving the file at
+// its start. The boundary changes on every request and is left out.
+func hashMultipart(hash io.Writer, r *http.Request, file *os.File) error {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	reader := multipart.NewReader(file, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%q %q\n", part.FormName(), part.FileName())
+		if _, err := io.Copy(hash, part); err != nil {
+			return err
+		}
+		hash.Write([]byte("\n"))
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
+// Makes a send endpoint idempotent. With useMessageId the Id in the body is
+// the key of requests without an Idempotency-Key header, for endpoints where
+// it is the id of the message being sent.
+func (s *server) idempotent(useMessageId bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if (key == "" && !useMessageId) || *idempotencyTTL <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Idempotency-Key is too long"))
+				return
+			}
+			txtid := r.Context().Value("userinfo").(Values).Get("Id")
+
+			hash := sha256.New()
+			hash.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n"))
+			if isMultipartRequest(r) {
+				// Uploads are kept on disk and hashed part by part, their
+				// Id is not looked for
+				if key == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+				file, err := spoolRequestBody(r.Body, nil)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New("Could not read Payload"))
+					return
+				}
+				defer os.Remove(file.Name())
+				defer file.Close()
+				if err := hashMultipart(hash, r, file); err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Could not read form: %v", err)))
+					return
+				}
+				r.Body = file
+			} else {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New("Could not read Payload"))
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				if key == "" {
+					if id := requestMessageId(body); id != "" {
+						key = "Id:" + id
+					}
+				}
+				if key == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+				hash.Write(body)
+			}
+			entry := &idempotentResponse{Hash: hex.EncodeToString(hash.Sum(nil))}
+			cacheKey := txtid + "\x00" + key
+
+			if err := idempotencycache.Add(cacheKey, entry, *idempotencyTTL); err != nil {
+				cached, found := idempotencycache.Get(cacheKey)
+				if !found {
+					// Expired since, run the request again
+					idempotencycache.Set(cacheKey, entry, *idempotencyTTL)
+				} else {
+					previous := cached.(*idempotentResponse)
+					if previous.Hash != entry.Hash {
+						s.Respond(w, r, http.StatusConflict, errors.New("Idempotency key was already used for a different request"))
+						return
+					}
+					if !previous.Done {
+						s.Respond(w, r, http.StatusConflict, errors.New("A request with this idempotency key is still in progress"))
+						return
+					}
+					log.Info().Str("userid", txtid).Str("key", key).Msg("Replaying response of idempotent request")
+					w.Header().Set("Content-Type", previous.ContentType)
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(previous.Status)
+					w.Write(previous.Body)
+					return
+				}
+			}
+
+			rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+			completed := false
+			defer func() {
+				// A handler that panicked leaves no response, so the
+				// request can be retried instead of staying in progress
+				if !completed {
+					idempotencycache.Delete(cacheKey)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+			completed = true
+			if rec.status >= 500 {
+				idempotencycache.Delete(cacheKey)
+				return
+			}
+			idempotencycache.Set(cacheKey, &idempotentResponse{
+				Hash:        entry.Hash,
+				Done:        true,
+				Status:      rec.status,
+				ContentType: w.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			}, *idempotencyTTL)
+		})
+	}
+}
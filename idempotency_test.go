@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A send handler that counts its calls and answers with the status and
+// body set by the test
+type idempotencyHandler struct {
+	sync.Mutex
+	calls  int
+	status int
+	block  chan struct{}
+	panics bool
+}
+
+func (h *idempotencyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	h.calls++
+	calls := h.calls
+	status := h.status
+	block := h.block
+	panics := h.panics
+	h.Unlock()
+	if block != nil {
+		<-block
+	}
+	if panics {
+		panic("handler failed")
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(`{"call":` + strconv.Itoa(calls) + `}`))
+}
+
+func (h *idempotencyHandler) callCount() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.calls
+}
+
+func idempotencyRequest(userID string, key string, body string) *http.Request {
+	return idempotencyRequestBody(userID, key, strings.NewReader(body), "application/json")
+}
+
+func idempotencyRequestBody(userID string, key string, body io.Reader, contentType string) *http.Request {
+	r := httptest.NewRequest("POST", "/chat/send/text", body)
+	r.Header.Set("Content-Type", contentType)
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	return r.WithContext(context.WithValue(r.Context(), "userinfo", Values{map[string]string{"Id": userID}}))
+}
+
+func serveIdempotent(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	idempotencycache.Flush()
+	s := &server{}
+	h := &idempotencyHandler{}
+	handler := s.idempotent(true)(h)
+
+	first := serveIdempotent(handler, idempotencyRequest("u1", "k1", `{"Phone":"1","Body":"hi"}`))
+	if first.Code != http.StatusOK || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request = %d %q", first.Code, first.Header().Get("Idempotent-Replayed"))
+	}
+	retry := serveIdempotent(handler, idempotencyRequest("u1", "k1", `{"Phone":"1","Body":"hi"}`))
+	if retry.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry = %d %q, want a replay", retry.Code, retry.Header().Get("Idempotent-Replayed"))
+	}
+	if retry.Body.String() != first.Body.String() || retry.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("replayed %q %q, want %q", retry.Header().Get("Content-Type"), retry.Body.String(), first.Body.String())
+	}
+	if h.callCount() != 1 {
+		t.Errorf("handler called %d times, want 1", h.callCount())
+	}
+
+	// Keys are per user
+	other := serveIdempotent(handler, idempotencyRequest("u2", "k1", `{"Phone":"1","Body":"hi"}`))
+	if other.Code != http.StatusOK || other.Header().Get("Idempotent-Replayed") != "" || h.callCount() != 2 {
+		t.Errorf("same key of another user = %d %q after %d calls", other.Code, other.Header().Get("Idempotent-Replayed"), h.callCount())
+	}
+
+	// Client errors are kept like successes
+	h.status = http.StatusBadRequest
+	serveIdempotent(handler, idempotencyRequest("u1", "k2", `{}`))
+	replay := serveIdempotent(handler, idempotencyRequest("u1", "k2", `{}`))
+	if replay.Code != http.StatusBadRequest || replay.Header().Get("Idempotent-Replayed") != "true" || h.callCount() != 3 {
+		t.Errorf("retry of a 400 = %d %q after %d calls", replay.Code, replay.Header().Get("Idempotent-Replayed"), h.callCount())
+	}
+}
+
+func TestIdempotentConflicts(t *testing.T) {
+	idempotencycache.Flush()
+	s := &server{}
+	h := &idempotencyHandler{}
+	handler := s.idempotent(true)(h)
+
+	serveIdempotent(handler, idempotencyRequest("u1", "k1", `{"Phone":"1","Body":"hi"}`))
+	different := serveIdempotent(handler, idempotencyRequest("u1", "k1", `{"Phone":"1","Body":"bye"}`))
+	if different.Code != http.StatusConflict || !strings.Contains(different.Body.String(), "different request") {
+		t.Errorf("same key, different body = %d %s", different.Code, different.Body.String())
+	}
+	otherPath := idempotencyRequest("u1", "k1", `{"Phone":"1","Body":"hi"}`)
+	otherPath.URL.Path = "/chat/send/image"
+	if w := serveIdempotent(handler, otherPath); w.Code != http.StatusConflict {
+		t.Errorf("same key, different endpoint = %d", w.Code)
+	}
+
+	// A retry while the first request is still running
+	h.block = make(chan struct{})
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveIdempotent(handler, idempotencyRequest("u1", "k2", `{"Body":"slow"}`))
+	}()
+	for h.callCount() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	running := serveIdempotent(handler, idempotencyRequest("u1", "k2", `{"Body":"slow"}`))
+	if running.Code != http.StatusConflict || !strings.Contains(running.Body.String(), "still in progress") {
+		t.Errorf("retry while running = %d %s", running.Code, running.Body.String())
+	}
+	close(h.block)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("first request = %d", w.Code)
+	}
+	h.block = nil
+	if w := serveIdempotent(handler, idempotencyRequest("u1", "k2", `{"Body":"slow"}`)); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry once finished = %d, want a replay", w.Code)
+	}
+
+	tooLong := serveIdempotent(handler, idempotencyRequest("u1", strings.Repeat("k", maxIdempotencyKeyLength+1), `{}`))
+	if tooLong.Code != http.StatusBadRequest {
+		t.Errorf("key too long = %d", tooLong.Code)
+	}
+}
+
+func TestIdempotentNotKept(t *testing.T) {
+	idempotencycache.Flush()
+	s := &server{}
+	h := &idempotencyHandler{status: http.StatusInternalServerError}
+	handler := s.idempotent(true)(h)
+
+	for i := 1; i <= 2; i++ {
+		w := serveIdempotent(handler, idempotencyRequest("u1", "k1", `{"Body":"hi"}`))
+		if w.Code != http.StatusInternalServerError || w.Header().Get("Idempotent-Replayed") != "" || h.callCount() != i {
+			t.Errorf("5xx attempt %d = %d %q after %d calls", i, w.Code, w.Header().Get("Idempotent-Replayed"), h.callCount())
+		}
+	}
+
+	// A handler that panics does not leave the key in progress
+	h.panics = true
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic should reach the server")
+			}
+		}()
+		serveIdempotent(handler, idempotencyRequest("u1", "k2", `{"Body":"hi"}`))
+	}()
+	h.panics = false
+	h.status = http.StatusOK
+	if w := serveIdempotent(handler, idempotencyRequest("u1", "k2", `{"Body":"hi"}`)); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a panic = %d %s", w.Code, w.Body.String())
+	}
+
+	// Without a key or an Id requests always run
+	calls := h.callCount()
+	serveIdempotent(handler, idempotencyRequest("u1", "", `{"Body":"hi"}`))
+	serveIdempotent(handler, idempotencyRequest("u1", "", `{"Body":"hi"}`))
+	if h.callCount() != calls+2 {
+		t.Errorf("requests without a key ran %d times, want 2", h.callCount()-calls)
+	}
+
+	ttl := *idempotencyTTL
+	*idempotencyTTL = 0
+	defer func() { *idempotencyTTL = ttl }()
+	calls = h.callCount()
+	serveIdempotent(handler, idempotencyRequest("u1", "k3", `{"Body":"hi"}`))
+	serveIdempotent(handler, idempotencyRequest("u1", "k3", `{"Body":"hi"}`))
+	if h.callCount() != calls+2 {
+		t.Errorf("with -idempotencyttl=0 requests ran %d times, want 2", h.callCount()-calls)
+	}
+}
+
+func TestIdempotentMessageId(t *testing.T) {
+	idempotencycache.Flush()
+	s := &server{}
+	h := &idempotencyHandler{}
+
+	send := s.idempotent(true)(h)
+	serveIdempotent(send, idempotencyRequest("u1", "", `{"Phone":"1","id":"MSG1"}`))
+	if w := serveIdempotent(send, idempotencyRequest("u1", "", `{"Phone":"1","id":"MSG1"}`)); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry with the same Id = %d, want a replay", w.Code)
+	}
+	if w := serveIdempotent(send, idempotencyRequest("u1", "", `{"Phone":"2","Id":"MSG1"}`)); w.Code != http.StatusConflict {
+		t.Errorf("same Id, different message = %d, want 409", w.Code)
+	}
+
+	// Endpoints where the Id names an existing message only use the header
+	keyed := s.idempotent(false)(h)
+	calls := h.callCount()
+	serveIdempotent(keyed, idempotencyRequest("u1", "", `{"Phone":"1","Id":"MSG2"}`))
+	serveIdempotent(keyed, idempotencyRequest("u1", "", `{"Phone":"1","Id":"MSG2"}`))
+	if h.callCount() != calls+2 {
+		t.Errorf("keyed endpoint without header ran %d times, want 2", h.callCount()-calls)
+	}
+}
+
+func TestIdempotentMultipart(t *testing.T) {
+	idempotencycache.Flush()
+	s := &server{}
+	h := &idempotencyHandler{}
+	handler := s.idempotent(true)(h)
+
+	upload := func(key string, boundary string, file string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.SetBoundary(boundary)
+		mw.WriteField("Phone", "1")
+		mw.WriteField("Id", "MSG1")
+		part, _ := mw.CreateFormFile("Document", "a.txt")
+		part.Write([]byte(file))
+		mw.Close()
+		return serveIdempotent(handler, idempotencyRequestBody("u1", key, &body, mw.FormDataContentType()))
+	}
+
+	// The Id of an upload is not a key
+	upload("", "boundary1", "hello")
+	upload("", "boundary1", "hello")
+	if h.callCount() != 2 {
+		t.Errorf("uploads without a key ran %d times, want 2", h.callCount())
+	}
+
+	// Retries are recognized even with a new boundary
+	upload("k1", "boundary1", "hello")
+	if w := upload("k1", "boundary2", "hello"); w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry with a new boundary = %d, want a replay", w.Code)
+	}
+	if w := upload("k1", "boundary3", "other file"); w.Code != http.StatusConflict {
+		t.Errorf("same key, different file = %d, want 409", w.Code)
+	}
+	if h.callCount() != 3 {
+		t.Errorf("handler called %d times, want 3", h.callCount())
+	}
+}
@@ -46,15 +46,26 @@ var (
 	adminToken  = flag.String("admintoken", "", "Security Token to authorize admin actions (list/create/remove users)")
 	versionFlag = flag.Bool("version", false, "Display version information and exit")
 
+	webhookMaxAge       = flag.Duration("webhookmaxage", 24*time.Hour, "Maximum age of a webhook event before delivery retries are abandoned")
+	webhookLogRetention = flag.Duration("webhooklogretention", 7*24*time.Hour, "How long webhook delivery attempts are kept in the delivery log (0 disables the log)")
+	statusRetention     = flag.Duration("statusretention", 30*24*time.Hour, "How long the delivery status of sent messages and finished send jobs are kept (0 keeps them forever)")
+	idempotencyTTL      = flag.Duration("idempotencyttl", 24*time.Hour, "How long the responses of send requests with an idempotency key are kept (0 disables idempotency keys)")
+	remoteMediaMaxSize  = flag.Int("remotemediamaxsize", 64, "Maximum size in MB of media sent from an http(s) URL")
+	remoteMediaTimeout  = flag.Duration("remotemediatimeout", 60*time.Second, "Timeout to download media sent from an http(s) URL")
+	remoteMediaAllow    = flag.String("remotemediaallow", "", "Comma separated private networks or addresses media may be downloaded from, like 10.0.0.0/8")
+	uploadMaxSize       = flag.Int("uploadmaxsize", 100, "Maximum size in MB of media uploaded as multipart/form-data")
+	uploadTimeout       = flag.Duration("uploadtimeout", 10*time.Minute, "Time allowed to read the body of a multipart/form-data media upload")
+
 	container     *sqlstore.Container
 	clientManager = NewClientManager()
 	killchannel   = make(map[string](chan bool))
 	userinfocache = cache.New(5*time.Minute, 10*time.Minute)
+	outbox        *WebhookOutbox
 )
 
 const version = "1.0.0"
 
-func init() {
+func main() {
 	err := godotenv.Load()
 	if err != nil {
 		log.Warn().Err(err).Msg("It was not possible to load the .env file (it may not exist).")
@@ -130,9 +141,7 @@ func init() {
 			log.Warn().Str("admin_token", *adminToken).Msg("No admin token provided, generated a random one")
 		}
 	}
-}
 
-func main() {
 	ex, err := os.Executable()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to get executable path")
@@ -193,6 +202,36 @@ func main() {
 	}
 	s.routes()
 
+	outbox = NewWebhookOutbox(db)
+	go outbox.Run()
+	go runMessageStorePurge(db)
+	sendQueue.Resume(s)
+
+	globalStorage, err = loadGlobalStorage()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid S3 storage configuration")
+		os.Exit(1)
+	}
+	if globalStorage != nil {
+		log.Info().Str("endpoint", globalStorage.config.Endpoint).Str("bucket", globalStorage.config.Bucket).Msg("Storing incoming media in S3")
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := globalStorage.ApplyLifecycle(ctx); err != nil {
+				log.Warn().Err(err).Msg("Could not set the S3 lifecycle rule, media will not expire")
+			}
+		}()
+	}
+
+	globalSinks, err = loadGlobalSinks()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid event sink configuration")
+		os.Exit(1)
+	}
+	for _, sc := range globalSinks {
+		log.Info().Str("sink", sc.Type).Str("url", redactURL(sc.URL)).Str("subject", sc.Subject).Msg("Publishing the events of all users to a message bus")
+	}
+
 	s.connectOnStartup()
 
 	srv := &http.Server{
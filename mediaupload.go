@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+)
+
+// The media send endpoints take multipart/form-data as well as JSON. The
+// file is the part named like the JSON field (Image, Audio, Document, Video
+// or Sticker) and the other fields are form fields, ContextInfo as JSON.
+// The file is streamed to a temporary file and uploaded from there, so it
+// is never held in memory, and the read deadline of these requests is
+// extended to -uploadtimeout.
+
+const (
+	maxMultipartFieldSize = 1 << 20
+	// Time to send the media to WhatsApp and respond once it is read
+	uploadWriteGrace = 2 * time.Minute
+)
+
+// A file sent as a multipart part, kept in a temporary file
+type mediaUpload struct {
+	File        *os.File
+	FileName    string
+	ContentType string
+	Size        int64
+	// Start of the file, enough to detect its type
+	Head []byte
+}
+
+func (u *mediaUpload) Close() {
+	u.File.Close()
+	os.Remove(u.File.Name())
+}
+
+func isMultipartRequest(r *http.Request) bool {
+	mediatype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediatype == "multipart/form-data"
+}
+
+func uploadMaxBytes() int64 {
+	return int64(*uploadMaxSize) * 1024 * 1024
+}
+
+// Gives multipart requests -uploadtimeout to be read instead of the server
+// timeouts, and limits their size
+func multipartUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMultipartRequest(r) {
+			rc := http.NewResponseController(w)
+			if err := rc.SetReadDeadline(time.Now().Add(*uploadTimeout)); err != nil {
+				log.Warn().Err(err).Msg("Could not extend the read deadline of upload")
+			}
+			if err := rc.SetWriteDeadline(time.Now().Add(*uploadTimeout + uploadWriteGrace)); err != nil {
+				log.Warn().Err(err).Msg("Could not extend the write deadline of upload")
+			}
+			// Room for the form fields on top of the file
+			r.Body = http.MaxBytesReader(w, r.Body, uploadMaxBytes()+maxMultipartFieldSize*8)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Copies a request body to a temporary file, also writing it to extra
+// when set, and returns the file at its start
+func spoolRequestBody(body io.Reader, extra io.Writer) (*os.File, error) {
+	file, err := os.CreateTemp("", "wuzapi-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	var dst io.Writer = file
+	if extra != nil {
+		dst = io.MultiWriter(file, extra)
+	}
+	if _, err = io.Copy(dst, body); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// Decodes the body of a media send request into v. JSON requests return a
+// nil upload. Multipart requests return the file sent in the part named
+// field, which must be closed, and fill v from the form fields.
+func decodeMediaRequest(r *http.Request, field string, v interface{}) (*mediaUpload, error) {
+	if !isMultipartRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			return nil, errors.New("Could not decode Payload")
+		}
+		return nil, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("Could not decode Payload")
+	}
+	fields := make(map[string]json.RawMessage)
+	var upload *mediaUpload
+	fail := func(err error) (*mediaUpload, error) {
+		if upload != nil {
+			upload.Close()
+		}
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Errorf("Could not read form: %v", err))
+		}
+		name := part.FormName()
+
+		if strings.EqualFold(name, field) {
+			if upload != nil {
+				return fail(fmt.Errorf("Only one %s can be sent", field))
+			}
+			file, err := spoolRequestBody(io.LimitReader(part, uploadMaxBytes()+1), nil)
+			if err != nil {
+				return fail(fmt.Errorf("Could not read %s: %v", field, err))
+			}
+			upload = &mediaUpload{File: file, FileName: part.FileName()}
+			if info, err := file.Stat(); err == nil {
+				upload.Size = info.Size()
+			}
+			if upload.Size > uploadMaxBytes() {
+				return fail(fmt.Errorf("%s is larger than %d MB", field, *uploadMaxSize))
+			}
+			if upload.Size == 0 {
+				return fail(fmt.Errorf("%s is empty", field))
+			}
+			head := make([]byte, 512)
+			n, _ := file.ReadAt(head, 0)
+			upload.Head = head[:n]
+			upload.ContentType = http.DetectContentType(upload.Head)
+			if strings.HasPrefix(upload.ContentType, "application/octet-stream") {
+				if header, _, err := mime.ParseMediaType(part.Header.Get("Content-Type")); err == nil && header != "" {
+					upload.ContentType = header
+				}
+			}
+			continue
+		}
+		if part.FileName() != "" {
+			return fail(fmt.Errorf("Unexpected file %s, the file must be sent as %s", name, field))
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxMultipartFieldSize+1))
+		if err != nil {
+			return fail(fmt.Errorf("Could not read form: %v", err))
+		}
+		if len(value) > maxMultipartFieldSize {
+			return fail(fmt.Errorf("Field %s is too large", name))
+		}
+		// Objects like ContextInfo are sent as JSON, everything else is text
+		if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+			fields[name] = json.RawMessage(trimmed)
+		} else {
+			fields[name], _ = json.Marshal(string(value))
+		}
+	}
+	if upload == nil {
+		return nil, fmt.Errorf("Missing %s in form", field)
+	}
+
+	data, err := json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fail(errors.New("Could not decode Payload"))
+	}
+	return upload, nil
+}
+
+// The uploads of whatsmeow.Client used by uploadMedia
+type mediaUploader interface {
+	Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+	UploadReader(ctx context.Context, plaintext io.Reader, tempFile io.ReadWriteSeeker, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+}
+
+// Uploads media to WhatsApp, from the multipart file when there is one,
+// which is left at its start to be read again
+func uploadMedia(ctx context.Context, cli mediaUploader, filedata []byte, upload *mediaUpload, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	if upload == nil {
+		return cli.Upload(ctx, filedata, appInfo)
+	}
+	resp, err := cli.UploadReader(ctx, upload.File, nil, appInfo)
+	if err == nil {
+		_, err = upload.File.Seek(0, io.SeekStart)
+	}
+	return resp, err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+)
+
+// A part of a multipart test request, a file when fileName is set
+type formPart struct {
+	name        string
+	fileName    string
+	contentType string
+	value       string
+}
+
+func newMultipartRequest(t *testing.T, parts ...formPart) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		if p.fileName != "" {
+			header.Set("Content-Disposition", `form-data; name="`+p.name+`"; filename="`+p.fileName+`"`)
+		} else {
+			header.Set("Content-Disposition", `form-data; name="`+p.name+`"`)
+		}
+		if p.contentType != "" {
+			header.Set("Content-Type", p.contentType)
+		}
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(p.value))
+	}
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+type mediaTestRequest struct {
+	Phone       string
+	Caption     string
+	Id          string
+	ContextInfo *waE2E.ContextInfo
+}
+
+// Points the temporary files to a directory of the test and sets the
+// upload limit, so leftovers and sizes can be checked
+func setUploadTestEnv(t *testing.T, maxSize int) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	size := *uploadMaxSize
+	*uploadMaxSize = maxSize
+	t.Cleanup(func() { *uploadMaxSize = size })
+	return dir
+}
+
+func tempFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestDecodeMediaRequest(t *testing.T) {
+	dir := setUploadTestEnv(t, 1)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+	tooLarge := strings.Repeat("x", 1024*1024+1)
+
+	tests := []struct {
+		name    string
+		parts   []formPart
+		wantErr string
+	}{
+		{"image", []formPart{
+			{name: "Phone", value: "5491155554444"},
+			{name: "Image", fileName: "a.png", value: png},
+		}, ""},
+		{"field name in another case", []formPart{
+			{name: "image", fileName: "a.png", value: png},
+		}, ""},
+		{"size limit", []formPart{
+			{name: "Image", fileName: "a.png", value: strings.Repeat("x", 1024*1024)},
+		}, ""},
+		{"larger than the limit", []formPart{
+			{name: "Image", fileName: "a.png", value: tooLarge},
+		}, "Image is larger than 1 MB"},
+		{"empty file", []formPart{
+			{name: "Image", fileName: "a.png"},
+		}, "Image is empty"},
+		{"duplicate file", []formPart{
+			{name: "Image", fileName: "a.png", value: png},
+			{name: "Image", fileName: "b.png", value: png},
+		}, "Only one Image can be sent"},
+		{"stray file", []formPart{
+			{name: "Image", fileName: "a.png", value: png},
+			{name: "Document", fileName: "a.pdf", value: "%PDF"},
+		}, "Unexpected file Document, the file must be sent as Image"},
+		{"stray file before the media", []formPart{
+			{name: "Document", fileName: "a.pdf", value: "%PDF"},
+			{name: "Image", fileName: "a.png", value: png},
+		}, "Unexpected file Document"},
+		{"missing file", []formPart{
+			{name: "Phone", value: "5491155554444"},
+		}, "Missing Image in form"},
+		{"field too large", []formPart{
+			{name: "Image", fileName: "a.png", value: png},
+			{name: "Caption", value: strings.Repeat("x", maxMultipartFieldSize+1)},
+		}, "Field Caption is too large"},
+		{"invalid field type", []formPart{
+			{name: "Image", fileName: "a.png", value: png},
+			{name: "ContextInfo", value: "not json"},
+		}, "Could not decode Payload"},
+	}
+	for _, tt := range tests {
+		body, contentType := newMultipartRequest(t, tt.parts...)
+		r := httptest.NewRequest("POST", "/chat/send/image", body)
+		r.Header.Set("Content-Type", contentType)
+		var req mediaTestRequest
+		upload, err := decodeMediaRequest(r, "Image", &req)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || upload != nil {
+				t.Errorf("%s: decodeMediaRequest = %v, %v, want error %q", tt.name, upload, err, tt.wantErr)
+			}
+		} else if err != nil || upload == nil {
+			t.Errorf("%s: decodeMediaRequest error = %v", tt.name, err)
+		} else {
+			upload.Close()
+		}
+		// Temporary files are removed on errors and on Close
+		if n := tempFiles(t, dir); n != 0 {
+			t.Errorf("%s: %d temporary files left", tt.name, n)
+		}
+	}
+}
+
+func TestDecodeMediaRequestFields(t *testing.T) {
+	dir := setUploadTestEnv(t, 1)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+	body, contentType := newMultipartRequest(t,
+		formPart{name: "Phone", value: "5491155554444"},
+		formPart{name: "Caption", value: " {not json "},
+		formPart{name: "ContextInfo", value: ` {"StanzaID":"MSG0","Participant":"5491155550001@s.whatsapp.net","MentionedJID":["5491155550002@s.whatsapp.net"]}`},
+		formPart{name: "Image", fileName: "photo.png", contentType: "image/jpeg", value: png},
+	)
+	r := httptest.NewRequest("POST", "/chat/send/image", body)
+	r.Header.Set("Content-Type", contentType)
+	var req mediaTestRequest
+	upload, err := decodeMediaRequest(r, "Image", &req)
+	if err != nil {
+		t.Fatalf("decodeMediaRequest error = %v", err)
+	}
+	defer upload.Close()
+
+	// ContextInfo is JSON, other fields are kept as text
+	if req.Phone != "5491155554444" || req.Caption != " {not json " {
+		t.Errorf("request = %q %q", req.Phone, req.Caption)
+	}
+	if ci := req.ContextInfo; ci.GetStanzaID() != "MSG0" || ci.GetParticipant() != "5491155550001@s.whatsapp.net" || len(ci.MentionedJID) != 1 {
+		t.Errorf("ContextInfo = %v", ci)
+	}
+	// The detected type wins over the header of the part
+	if upload.FileName != "photo.png" || upload.ContentType != "image/png" || upload.Size != int64(len(png)) || string(upload.Head) != png {
+		t.Errorf("upload = %s %s %d", upload.FileName, upload.ContentType, upload.Size)
+	}
+	if n := tempFiles(t, dir); n != 1 {
+		t.Errorf("%d temporary files while the upload is open, want 1", n)
+	}
+
+	// Unknown content uses the header of the part
+	body, contentType = newMultipartRequest(t, formPart{name: "Document", fileName: "a.bin", contentType: "application/x-custom; v=1", value: "\x00\x01\x02"})
+	r = httptest.NewRequest("POST", "/chat/send/document", body)
+	r.Header.Set("Content-Type", contentType)
+	document, err := decodeMediaRequest(r, "Document", &req)
+	if err != nil {
+		t.Fatalf("decodeMediaRequest of a document error = %v", err)
+	}
+	defer document.Close()
+	if document.ContentType != "application/x-custom" {
+		t.Errorf("content type = %s", document.ContentType)
+	}
+
+	// JSON requests have no upload
+	r = httptest.NewRequest("POST", "/chat/send/image", strings.NewReader(`{"Phone":"1","Image":"data:image/png;base64,AA=="}`))
+	r.Header.Set("Content-Type", "application/json")
+	if upload, err := decodeMediaRequest(r, "Image", &req); upload != nil || err != nil || req.Phone != "1" {
+		t.Errorf("JSON request = %v, %v", upload, err)
+	}
+}
+
+// Reads the whole file like whatsmeow does, checking it gets the upload
+type uploaderStub struct {
+	data []byte
+	err  error
+}
+
+func (u *uploaderStub) Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	u.data = plaintext
+	return whatsmeow.UploadResponse{FileLength: uint64(len(plaintext))}, u.err
+}
+
+func (u *uploaderStub) UploadReader(ctx context.Context, plaintext io.Reader, tempFile io.ReadWriteSeeker, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	data, err := io.ReadAll(plaintext)
+	if err != nil {
+		return whatsmeow.UploadResponse{}, err
+	}
+	u.data = data
+	return whatsmeow.UploadResponse{FileLength: uint64(len(data))}, u.err
+}
+
+func TestUploadMedia(t *testing.T) {
+	setUploadTestEnv(t, 1)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+	body, contentType := newMultipartRequest(t, formPart{name: "Image", fileName: "a.png", value: png})
+	r := httptest.NewRequest("POST", "/chat/send/image", body)
+	r.Header.Set("Content-Type", contentType)
+	var req mediaTestRequest
+	upload, err := decodeMediaRequest(r, "Image", &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.Close()
+
+	uploader := &uploaderStub{}
+	resp, err := uploadMedia(context.Background(), uploader, nil, upload, whatsmeow.MediaImage)
+	if err != nil || string(uploader.data) != png || resp.FileLength != uint64(len(png)) {
+		t.Fatalf("uploadMedia = %d bytes, %v", len(uploader.data), err)
+	}
+	// The file is read again for the thumbnail and the message store
+	data, err := io.ReadAll(upload.File)
+	if err != nil || string(data) != png {
+		t.Errorf("file after the upload = %d bytes, %v", len(data), err)
+	}
+
+	uploader = &uploaderStub{}
+	if _, err := uploadMedia(context.Background(), uploader, []byte("inline"), nil, whatsmeow.MediaImage); err != nil || string(uploader.data) != "inline" {
+		t.Errorf("uploadMedia of JSON media = %q, %v", uploader.data, err)
+	}
+}
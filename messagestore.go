@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Messages are not kept by default, they are only sent to the webhooks. When
+// the message store is enabled for a user, incoming messages, history syncs
+// and messages sent through the API are saved in the messages and chats
+// tables and served by /chat/history, /chat/message/{id} and /chat/search.
+// Edits and deletes update the stored message. Messages older than the
+// retention of the user are purged every hour.
+
+const (
+	defaultMessageRetentionDays = 30
+	maxMessageRetentionDays     = 3650
+	messageStorePurgeEvery      = time.Hour
+
+	messageSourceLive    = "live"
+	messageSourceHistory = "history"
+	messageSourceSent    = "sent"
+)
+
+var messagestorecache = cache.New(5*time.Minute, 10*time.Minute)
+
+type MessageStoreConfig struct {
+	UserId        string `db:"user_id"`
+	Enabled       bool   `db:"enabled"`
+	RetentionDays int    `db:"retention_days"`
+	UpdatedAt     int64  `db:"updated_at"`
+}
+
+const messageStoreConfigColumns = "user_id, enabled, retention_days, updated_at"
+
+func (c MessageStoreConfig) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":        c.Enabled,
+		"retention_days": c.RetentionDays,
+		"updated_at":     c.UpdatedAt,
+	}
+}
+
+func (c MessageStoreConfig) validate() error {
+	if c.RetentionDays < 0 || c.RetentionDays > maxMessageRetentionDays {
+		return fmt.Errorf("retention_days must be between 0 and %d", maxMessageRetentionDays)
+	}
+	return nil
+}
+
+// One message as kept in the message store
+type StoredMessage struct {
+	UserId   string          `db:"user_id" json:"-"`
+	Chat     string          `db:"chat" json:"chat"`
+	Id       string          `db:"id" json:"id"`
+	Sender   string          `db:"sender" json:"sender"`
+	PushName string          `db:"push_name" json:"push_name"`
+	IsFromMe bool            `db:"is_from_me" json:"is_from_me"`
+	Kind     string          `db:"kind" json:"kind"`
+	Text     string          `db:"text" json:"text"`
+	QuotedId string          `db:"quoted_id" json:"quoted_id"`
+	Source   string          `db:"source" json:"source"`
+	Edited   bool            `db:"edited" json:"edited"`
+	Revoked  bool            `db:"revoked" json:"revoked"`
+	FileName string          `db:"file_name" json:"file_name"`
+	SentAt   int64           `db:"sent_at" json:"timestamp"`
+	Payload  string          `db:"payload" json:"-"`
+	Message  json.RawMessage `db:"-" json:"message,omitempty"`
+}
+
+const storedMessageColumns = "user_id, chat, id, sender, push_name, is_from_me, kind, text, quoted_id, source, edited, revoked, file_name, sent_at, payload"
+
+// Fills in the message field of the API responses from the stored payload
+func (m *StoredMessage) decodePayload() {
+	if m.Payload != "" && json.Valid([]byte(m.Payload)) {
+		m.Message = json.RawMessage(m.Payload)
+	}
+}
+
+type StoredChat struct {
+	UserId        string `db:"user_id" json:"-"`
+	JID           string `db:"jid" json:"jid"`
+	Name          string `db:"name" json:"name"`
+	IsGroup       bool   `db:"is_group" json:"is_group"`
+	LastMessageId string `db:"last_message_id" json:"last_message_id"`
+	LastMessageAt int64  `db:"last_message_at" json:"last_message_at"`
+}
+
+const storedChatColumns = "user_id, jid, name, is_group, last_message_id, last_message_at"
+
+// Returns the message store settings of a user, disabled when none are set
+func getMessageStoreConfig(db *sqlx.DB, userID string) MessageStoreConfig {
+	if cached, found := messagestorecache.Get(userID); found {
+		return cached.(MessageStoreConfig)
+	}
+	config := MessageStoreConfig{UserId: userID, RetentionDays: defaultMessageRetentionDays}
+	err := db.Get(&config, "SELECT "+messageStoreConfigColumns+" FROM message_store_config WHERE user_id=$1", userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load message store settings")
+		return config
+	}
+	messagestorecache.Set(userID, config, cache.DefaultExpiration)
+	return config
+}
+
+func deleteUserMessages(db sqlx.Ext, userID string) error {
+	for _, table := range []string{"messages", "chats", "message_store_config"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE user_id=$1", userID); err != nil {
+			return err
+		}
+	}
+	messagestorecache.Delete(userID)
+	return nil
+}
+
+// Saves a message in the message store if it is enabled for the user
+func storeMessage(db *sqlx.DB, userID string, evt *events.Message, source string) {
+	if !getMessageStoreConfig(db, userID).Enabled {
+		return
+	}
+	if err := saveMessage(db, userID, evt, source, ""); err != nil {
+		log.Error().Err(err).Str("userid", userID).Str("id", evt.Info.ID).Msg("Could not store message")
+	}
+}
+
+// Saves a message sent through the API, the sender is the user's own JID
+func storeSentMessage(db *sqlx.DB, userID string, recipient types.JID, id string, msg *waE2E.Message, timestamp time.Time) {
+	if !getMessageStoreConfig(db, userID).Enabled {
+		return
+	}
+	sender := types.EmptyJID
+	if client := clientManager.GetWhatsmeowClient(userID); client != nil && client.Store.ID != nil {
+		sender = client.Store.ID.ToNonAD()
+	}
+	evt := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:     recipient,
+				Sender:   sender,
+				IsFromMe: true,
+				IsGroup:  recipient.Server == types.GroupServer,
+			},
+			ID:        id,
+			Timestamp: timestamp,
+		},
+		RawMessage: msg,
+	}
+	// Edits and view once messages are wrapped like the received ones
+	evt.UnwrapRaw()
+	if err := saveMessage(db, userID, evt, messageSourceSent, ""); err != nil {
+		log.Error().Err(err).Str("userid", userID).Str("id", id).Msg("Could not store sent message")
+	}
+}
+
+// Saves the conversations of a history sync in one transaction
+func storeHistorySync(mycli *MyClient, evt *events.HistorySync) {
+	if !getMessageStoreConfig(mycli.db, mycli.userID).Enabled {
+		return
+	}
+	tx, err := mycli.db.Beginx()
+	if err != nil {
+		log.Error().Err(err).Str("userid", mycli.userID).Msg("Could not store history sync")
+		return
+	}
+	stored := 0
+	for _, conv := range evt.Data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			continue
+		}
+		name := conv.GetName()
+		if name == "" {
+			name = conv.GetDisplayName()
+		}
+		for _, historyMsg := range conv.GetMessages() {
+			msgEvt, err := mycli.WAClient.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil {
+				continue
+			}
+			if err := saveMessage(tx, mycli.userID, msgEvt, messageSourceHistory, name); err != nil {
+				log.Error().Err(err).Str("userid", mycli.userID).Msg("Could not store history sync")
+				tx.Rollback()
+				return
+			}
+			stored++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error().Err(err).Str("userid", mycli.userID).Msg("Could not store history sync")
+		return
+	}
+	log.Info().Str("userid", mycli.userID).Int("messages", stored).Msg("Stored history sync messages")
+}
+
+// Saves a message and updates its chat. Edits and deletes change the
+// message they refer to, other protocol messages are not stored.
+func saveMessage(db sqlx.Execer, userID string, evt *events.Message, source string, chatName string) error {
+	msg := evt.Message
+	if msg == nil {
+		return nil
+	}
+	chat := evt.Info.Chat.ToNonAD().String()
+
+	if protocol := msg.GetProtocolMessage(); protocol != nil {
+		switch protocol.GetType() {
+		case waE2E.ProtocolMessage_MESSAGE_EDIT:
+			// Only the sender can edit a message
+			edited := protocol.GetEditedMessage()
+			payload, err := json.Marshal(edited)
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec("UPDATE messages SET text=$1, payload=$2, edited=1 WHERE user_id=$3 AND chat=$4 AND id=$5 AND sender=$6",
+				messageText(edited), string(payload), userID, chat, protocol.GetKey().GetID(), evt.Info.Sender.ToNonAD().String())
+			return err
+		case waE2E.ProtocolMessage_REVOKE:
+			// Messages are deleted by their sender, or by a group admin, who
+			// names the sender of the message in the key
+			sender := evt.Info.Sender.ToNonAD()
+			if participant := protocol.GetKey().GetParticipant(); participant != "" && evt.Info.IsGroup {
+				original, err := types.ParseJID(participant)
+				if err != nil {
+					return nil
+				}
+				if original.ToNonAD() != sender {
+					if !isGroupAdmin(userID, evt.Info.Chat, sender) {
+						log.Warn().Str("userid", userID).Str("id", protocol.GetKey().GetID()).Str("sender", sender.String()).Msg("Ignoring delete of a message of another sender")
+						return nil
+					}
+					sender = original.ToNonAD()
+				}
+			}
+			_, err := db.Exec("UPDATE messages SET text='', file_name='', payload='', revoked=1 WHERE user_id=$1 AND chat=$2 AND id=$3 AND sender=$4",
+				userID, chat, protocol.GetKey().GetID(), sender.String())
+			return err
+		}
+		return nil
+	}
+	if isEmptyMessage(msg) {
+		return nil
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	quotedID := ""
+	if contextInfo := messageContextInfo(msg); contextInfo != nil {
+		quotedID = contextInfo.GetStanzaID()
+	}
+	sentAt := evt.Info.Timestamp.Unix()
+	if evt.Info.Timestamp.IsZero() {
+		sentAt = time.Now().Unix()
+	}
+
+	_, err = db.Exec(`INSERT INTO messages (`+storedMessageColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 0, 0, $11, $12, $13)
+		ON CONFLICT (user_id, chat, id) DO NOTHING`,
+		userID, chat, evt.Info.ID, evt.Info.Sender.ToNonAD().String(), evt.Info.PushName, boolToFlag(evt.Info.IsFromMe),
+		messageKind(msg), messageText(msg), quotedID, source, messageFileName(msg), sentAt, string(payload))
+	if err != nil {
+		return err
+	}
+
+	// Direct chats are named after the contact, groups only get a name from
+	// history syncs
+	if chatName == "" && !evt.Info.IsGroup && !evt.Info.IsFromMe {
+		chatName = evt.Info.PushName
+	}
+	_, err = db.Exec(`INSERT INTO chats (`+storedChatColumns+`) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, jid) DO UPDATE SET
+		name=CASE WHEN excluded.name <> '' THEN excluded.name ELSE chats.name END,
+		last_message_id=CASE WHEN excluded.last_message_at >= chats.last_message_at THEN excluded.last_message_id ELSE chats.last_message_id END,
+		last_message_at=CASE WHEN excluded.last_message_at >= chats.last_message_at THEN excluded.last_message_at ELSE chats.last_message_at END`,
+		userID, chat, chatName, boolToFlag(evt.Info.Chat.Server == types.GroupServer), evt.Info.ID, sentAt)
+	return err
+}
+
+// Reports whether a participant is an admin of a group, as seen by the
+// session of the user
+func isGroupAdmin(userID string, group types.JID, participant types.JID) bool {
+	client := clientManager.GetWhatsmeowClient(userID)
+	if client == nil {
+		return false
+	}
+	info, err := client.GetGroupInfo(group)
+	if err != nil {
+		log.Warn().Err(err).Str("userid", userID).Str("group", group.String()).Msg("Could not get group info")
+		return false
+	}
+	for _, p := range info.Participants {
+		if p.JID.ToNonAD() == participant || p.PhoneNumber.ToNonAD() == participant || p.LID.ToNonAD() == participant {
+			return p.IsAdmin || p.IsSuperAdmin
+		}
+	}
+	return false
+}
+
+// Returns the file name of document messages
+func messageFileName(msg *waE2E.Message) string {
+	if document := msg.GetDocumentMessage(); document != nil {
+		return document.GetFileName()
+	}
+	return msg.GetDocumentWithCaptionMessage().GetMessage().GetDocumentMessage().GetFileName()
+}
+
+// Messages that only carry encryption keys for the group have no content
+func isEmptyMessage(msg *waE2E.Message) bool {
+	content := proto.Clone(msg).(*waE2E.Message)
+	content.SenderKeyDistributionMessage = nil
+	content.MessageContextInfo = nil
+	return proto.Size(content) == 0
+}
+
+// Removes the messages older than the retention of each user, and the old
+// status of sent messages, send jobs and campaigns, never returns
+func runMessageStorePurge(db *sqlx.DB) {
+	ticker := time.NewTicker(messageStorePurgeEvery)
+	defer ticker.Stop()
+	for {
+		purgeStoredMessages(db)
+		purgeMessageStatus(db)
+		purgeSendJobs(db)
+		purgeCampaigns(db)
+		<-ticker.C
+	}
+}
+
+func purgeStoredMessages(db *sqlx.DB) {
+	configs := []MessageStoreConfig{}
+	err := db.Select(&configs, "SELECT "+messageStoreConfigColumns+" FROM message_store_config WHERE retention_days > 0")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge message store")
+		return
+	}
+	for _, config := range configs {
+		cutoff := time.Now().AddDate(0, 0, -config.RetentionDays).Unix()
+		result, err := db.Exec("DELETE FROM messages WHERE user_id=$1 AND sent_at < $2", config.UserId, cutoff)
+		if err != nil {
+			log.Error().Err(err).Str("userid", config.UserId).Msg("Failed to purge message store")
+			continue
+		}
+		if _, err := db.Exec("DELETE FROM chats WHERE user_id=$1 AND last_message_at < $2", config.UserId, cutoff); err != nil {
+			log.Error().Err(err).Str("userid", config.UserId).Msg("Failed to purge message store")
+		}
+		if purged, err := result.RowsAffected(); err == nil && purged > 0 {
+			log.Info().Str("userid", config.UserId).Int64("purged", purged).Msg("Purged old stored messages")
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func storeTestMessage(chat types.JID, sender types.JID, id string, sentAt time.Time, msg *waE2E.Message) *events.Message {
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsGroup: chat.Server == types.GroupServer},
+			ID:            id,
+			PushName:      "Ana",
+			Timestamp:     sentAt,
+		},
+		Message: msg,
+	}
+}
+
+func TestSaveMessage(t *testing.T) {
+	db := newTestDB(t)
+	contact := types.NewJID("5491155554444", types.DefaultUserServer)
+	sentAt := time.Unix(1767225600, 0)
+	stored := func(id string) StoredMessage {
+		var m StoredMessage
+		if err := db.Get(&m, "SELECT "+storedMessageColumns+" FROM messages WHERE user_id=$1 AND id=$2", "u1", id); err != nil {
+			t.Fatalf("message %s: %v", id, err)
+		}
+		return m
+	}
+
+	reply := &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+		Text:        proto.String("hello"),
+		ContextInfo: &waE2E.ContextInfo{StanzaID: proto.String("MSG0")},
+	}}
+	if err := saveMessage(db, "u1", storeTestMessage(contact, contact, "MSG1", sentAt, reply), messageSourceLive, ""); err != nil {
+		t.Fatalf("saveMessage error = %v", err)
+	}
+	m := stored("MSG1")
+	if m.Chat != contact.String() || m.Sender != contact.String() || m.Kind != "text" || m.Text != "hello" || m.QuotedId != "MSG0" || m.SentAt != sentAt.Unix() || m.Source != messageSourceLive {
+		t.Errorf("stored message = %+v", m)
+	}
+	var chat StoredChat
+	if err := db.Get(&chat, "SELECT "+storedChatColumns+" FROM chats WHERE user_id=$1 AND jid=$2", "u1", contact.String()); err != nil {
+		t.Fatal(err)
+	}
+	if chat.Name != "Ana" || chat.LastMessageId != "MSG1" || chat.LastMessageAt != sentAt.Unix() {
+		t.Errorf("chat = %+v", chat)
+	}
+
+	// Messages already stored are kept as they are
+	again := &waE2E.Message{Conversation: proto.String("changed")}
+	if err := saveMessage(db, "u1", storeTestMessage(contact, contact, "MSG1", sentAt, again), messageSourceHistory, ""); err != nil || stored("MSG1").Text != "hello" {
+		t.Errorf("second save of MSG1 = %q, %v", stored("MSG1").Text, err)
+	}
+
+	edit := &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+		Key:           &waCommon.MessageKey{ID: proto.String("MSG1")},
+		EditedMessage: &waE2E.Message{Conversation: proto.String("hello, edited")},
+	}}
+	// Only the sender can edit or delete a message
+	other := types.NewJID("5491155550009", types.DefaultUserServer)
+	if err := saveMessage(db, "u1", storeTestMessage(contact, other, "EDIT0", sentAt.Add(time.Minute), edit), messageSourceLive, ""); err != nil || stored("MSG1").Edited {
+		t.Errorf("edit by another sender = %q, %v", stored("MSG1").Text, err)
+	}
+	if err := saveMessage(db, "u1", storeTestMessage(contact, contact, "EDIT1", sentAt.Add(time.Minute), edit), messageSourceLive, ""); err != nil {
+		t.Fatalf("saveMessage of an edit error = %v", err)
+	}
+	if m := stored("MSG1"); m.Text != "hello, edited" || !m.Edited {
+		t.Errorf("edited message = %q, edited %v", m.Text, m.Edited)
+	}
+
+	revoke := &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+		Type: waE2E.ProtocolMessage_REVOKE.Enum(),
+		Key:  &waCommon.MessageKey{ID: proto.String("MSG1")},
+	}}
+	if err := saveMessage(db, "u1", storeTestMessage(contact, other, "REVOKE0", sentAt.Add(2*time.Minute), revoke), messageSourceLive, ""); err != nil || stored("MSG1").Revoked {
+		t.Errorf("revoke by another sender = %v, %v", stored("MSG1").Revoked, err)
+	}
+	if err := saveMessage(db, "u1", storeTestMessage(contact, contact, "REVOKE1", sentAt.Add(2*time.Minute), revoke), messageSourceLive, ""); err != nil {
+		t.Fatalf("saveMessage of a revoke error = %v", err)
+	}
+	if m := stored("MSG1"); m.Text != "" || m.Payload != "" || !m.Revoked {
+		t.Errorf("revoked message = %+v", m)
+	}
+
+	// In groups the key names the sender, anyone else must be an admin
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	groupMsg := &waE2E.Message{Conversation: proto.String("in the group")}
+	if err := saveMessage(db, "u1", storeTestMessage(group, contact, "MSG2", sentAt, groupMsg), messageSourceLive, ""); err != nil {
+		t.Fatal(err)
+	}
+	groupRevoke := func(participant types.JID) *waE2E.Message {
+		return &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+			Type: waE2E.ProtocolMessage_REVOKE.Enum(),
+			Key:  &waCommon.MessageKey{ID: proto.String("MSG2"), Participant: proto.String(participant.String())},
+		}}
+	}
+	groupStored := func() StoredMessage {
+		var m StoredMessage
+		db.Get(&m, "SELECT "+storedMessageColumns+" FROM messages WHERE user_id=$1 AND chat=$2 AND id=$3", "u1", group.String(), "MSG2")
+		return m
+	}
+	// Without a session the admins are not known
+	saveMessage(db, "u1", storeTestMessage(group, other, "REVOKE2", sentAt.Add(time.Minute), groupRevoke(contact)), messageSourceLive, "")
+	if groupStored().Revoked {
+		t.Error("revoke by a participant that is not an admin was applied")
+	}
+	saveMessage(db, "u1", storeTestMessage(group, other, "REVOKE3", sentAt.Add(time.Minute), groupRevoke(other)), messageSourceLive, "")
+	if groupStored().Revoked {
+		t.Error("revoke naming the wrong sender was applied")
+	}
+	saveMessage(db, "u1", storeTestMessage(group, contact, "REVOKE4", sentAt.Add(time.Minute), groupRevoke(contact)), messageSourceLive, "")
+	if m := groupStored(); !m.Revoked || m.Text != "" {
+		t.Errorf("revoke by the sender in a group = %+v", m)
+	}
+
+	// Protocol messages and group key distributions are not stored
+	keys := &waE2E.Message{SenderKeyDistributionMessage: &waE2E.SenderKeyDistributionMessage{GroupID: proto.String("g")}}
+	for id, msg := range map[string]*waE2E.Message{"EDIT1": edit, "KEYS1": keys} {
+		saveMessage(db, "u1", storeTestMessage(contact, contact, id, sentAt, msg), messageSourceLive, "")
+		var count int
+		db.Get(&count, "SELECT COUNT(*) FROM messages WHERE id=$1", id)
+		if count != 0 {
+			t.Errorf("message %s was stored", id)
+		}
+	}
+}
+
+func TestMessageStoreConfigValidate(t *testing.T) {
+	for _, days := range []int{0, 1, defaultMessageRetentionDays, maxMessageRetentionDays} {
+		if err := (MessageStoreConfig{RetentionDays: days}).validate(); err != nil {
+			t.Errorf("retention of %d days error = %v", days, err)
+		}
+	}
+	for _, days := range []int{-1, maxMessageRetentionDays + 1} {
+		if err := (MessageStoreConfig{RetentionDays: days}).validate(); err == nil {
+			t.Errorf("retention of %d days should fail", days)
+		}
+	}
+}
@@ -45,8 +45,524 @@ var migrations = []Migration{
 		Name:  "change_id_to_string",
 		UpSQL: changeIDToStringSQL,
 	},
+	{
+		ID:    4,
+		Name:  "add_webhook_outbox",
+		UpSQL: addWebhookOutboxSQL,
+	},
+	{
+		ID:    5,
+		Name:  "add_webhook_signing",
+		UpSQL: addWebhookSigningSQL,
+	},
+	{
+		ID:    6,
+		Name:  "add_webhooks",
+		UpSQL: addWebhooksSQL,
+	},
+	{
+		ID:    7,
+		Name:  "add_webhook_format",
+		UpSQL: addWebhookFormatSQL,
+	},
+	{
+		ID:    8,
+		Name:  "add_webhook_failed",
+		UpSQL: addWebhookFailedSQL,
+	},
+	{
+		ID:    9,
+		Name:  "add_webhook_deliveries",
+		UpSQL: addWebhookDeliveriesSQL,
+	},
+	{
+		ID:    10,
+		Name:  "add_firehose",
+		UpSQL: addFirehoseSQL,
+	},
+	{
+		ID:    11,
+		Name:  "add_event_filters",
+		UpSQL: addEventFiltersSQL,
+	},
+	{
+		ID:    12,
+		Name:  "add_s3_config",
+		UpSQL: addS3ConfigSQL,
+	},
+	{
+		ID:    13,
+		Name:  "add_webhook_schema",
+		UpSQL: addWebhookSchemaSQL,
+	},
+	{
+		ID:    14,
+		Name:  "add_event_sinks",
+		UpSQL: addEventSinksSQL,
+	},
+	{
+		ID:    15,
+		Name:  "add_command_queues",
+		UpSQL: addCommandQueuesSQL,
+	},
+	{
+		ID:    16,
+		Name:  "add_call_log",
+		UpSQL: addCallLogSQL,
+	},
+	{
+		ID:    17,
+		Name:  "add_message_store",
+		UpSQL: addMessageStoreSQL,
+	},
+	{
+		ID:    18,
+		Name:  "add_message_search",
+		UpSQL: addMessageSearchSQL,
+	},
+	{
+		ID:    19,
+		Name:  "add_message_status",
+		UpSQL: addMessageStatusSQL,
+	},
+	{
+		ID:    20,
+		Name:  "add_send_queue",
+		UpSQL: addSendQueueSQL,
+	},
+	{
+		ID:    21,
+		Name:  "add_scheduled_messages",
+		UpSQL: addScheduledMessagesSQL,
+	},
+	{
+		ID:    22,
+		Name:  "add_campaigns",
+		UpSQL: addCampaignsSQL,
+	},
 }
 
+const addCampaignsSQL = createCampaignsSQL + `
+ALTER TABLE send_jobs ADD COLUMN IF NOT EXISTS campaign_id TEXT NOT NULL DEFAULT '';
+` + sendJobsCampaignIndexSQL
+
+const createCampaignsSQL = `
+CREATE TABLE IF NOT EXISTS campaigns (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    template TEXT NOT NULL,
+    status TEXT NOT NULL,
+    total INTEGER NOT NULL,
+    send_at BIGINT NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL,
+    updated_at BIGINT NOT NULL,
+    finished_at BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_campaigns_user ON campaigns (user_id, created_at);
+`
+
+const sendJobsCampaignIndexSQL = `
+CREATE INDEX IF NOT EXISTS idx_send_jobs_campaign ON send_jobs (campaign_id, seq);
+`
+
+const addScheduledMessagesSQL = `
+ALTER TABLE send_jobs ADD COLUMN IF NOT EXISTS send_at BIGINT NOT NULL DEFAULT 0;
+`
+
+const addSendQueueSQL = `
+CREATE TABLE IF NOT EXISTS send_queue_config (
+    user_id TEXT PRIMARY KEY,
+    messages_per_minute INTEGER NOT NULL,
+    recipient_interval INTEGER NOT NULL,
+    jitter INTEGER NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS send_jobs (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    chat TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    code INTEGER NOT NULL DEFAULT 0,
+    response TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    seq BIGINT NOT NULL,
+    created_at BIGINT NOT NULL,
+    finished_at BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_send_jobs_user_status ON send_jobs (user_id, status, seq);
+CREATE INDEX IF NOT EXISTS idx_send_jobs_finished ON send_jobs (status, finished_at);
+`
+
+const addMessageStatusSQL = `
+CREATE TABLE IF NOT EXISTS sent_messages (
+    user_id TEXT NOT NULL,
+    id TEXT NOT NULL,
+    chat TEXT NOT NULL,
+    is_group INTEGER NOT NULL DEFAULT 0,
+    sent_at BIGINT NOT NULL,
+    state TEXT NOT NULL,
+    delivered_at BIGINT NOT NULL DEFAULT 0,
+    read_at BIGINT NOT NULL DEFAULT 0,
+    played_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, id)
+);
+CREATE INDEX IF NOT EXISTS idx_sent_messages_sent_at ON sent_messages (sent_at);
+
+CREATE TABLE IF NOT EXISTS message_receipts (
+    user_id TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    participant TEXT NOT NULL,
+    state TEXT NOT NULL,
+    delivered_at BIGINT NOT NULL DEFAULT 0,
+    read_at BIGINT NOT NULL DEFAULT 0,
+    played_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, message_id, participant)
+);
+`
+
+const addMessageSearchSQL = `
+-- PostgreSQL version
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS file_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', text || ' ' || file_name)) STORED;
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search_vector);
+
+-- SQLite version (handled in code)
+`
+
+// FTS5 index kept in sync with the messages table by triggers
+const addMessageSearchSQLite = `
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+    text, file_name,
+    content='messages', content_rowid='rowid', tokenize='unicode61 remove_diacritics 2'
+);
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+    INSERT INTO messages_fts (rowid, text, file_name) VALUES (new.rowid, new.text, new.file_name);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+    INSERT INTO messages_fts (messages_fts, rowid, text, file_name) VALUES ('delete', old.rowid, old.text, old.file_name);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF text, file_name ON messages BEGIN
+    INSERT INTO messages_fts (messages_fts, rowid, text, file_name) VALUES ('delete', old.rowid, old.text, old.file_name);
+    INSERT INTO messages_fts (rowid, text, file_name) VALUES (new.rowid, new.text, new.file_name);
+END;
+INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');
+`
+
+const addMessageStoreSQL = `
+-- Message store, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS message_store_config (
+    user_id TEXT PRIMARY KEY,
+    enabled INTEGER NOT NULL DEFAULT 0,
+    retention_days INTEGER NOT NULL DEFAULT 30,
+    updated_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS chats (
+    user_id TEXT NOT NULL,
+    jid TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    is_group INTEGER NOT NULL DEFAULT 0,
+    last_message_id TEXT NOT NULL DEFAULT '',
+    last_message_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, jid)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    user_id TEXT NOT NULL,
+    chat TEXT NOT NULL,
+    id TEXT NOT NULL,
+    sender TEXT NOT NULL DEFAULT '',
+    push_name TEXT NOT NULL DEFAULT '',
+    is_from_me INTEGER NOT NULL DEFAULT 0,
+    kind TEXT NOT NULL DEFAULT '',
+    text TEXT NOT NULL DEFAULT '',
+    quoted_id TEXT NOT NULL DEFAULT '',
+    source TEXT NOT NULL DEFAULT '',
+    edited INTEGER NOT NULL DEFAULT 0,
+    revoked INTEGER NOT NULL DEFAULT 0,
+    sent_at BIGINT NOT NULL DEFAULT 0,
+    payload TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (user_id, chat, id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_user_chat_sent ON messages (user_id, chat, sent_at);
+CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_chats_user_last ON chats (user_id, last_message_at);
+`
+
+const addCallLogSQL = `
+-- Call policies and call log, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS call_policies (
+    user_id TEXT PRIMARY KEY,
+    mode TEXT NOT NULL DEFAULT 'notify',
+    reply_text TEXT NOT NULL DEFAULT '',
+    updated_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS call_log (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    call_id TEXT NOT NULL,
+    caller TEXT NOT NULL,
+    media TEXT NOT NULL DEFAULT '',
+    is_group INTEGER NOT NULL DEFAULT 0,
+    action TEXT NOT NULL DEFAULT '',
+    state TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    duration BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    offered_at BIGINT NOT NULL DEFAULT 0,
+    ended_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_call_log_user_offered ON call_log (user_id, offered_at);
+CREATE INDEX IF NOT EXISTS idx_call_log_user_call ON call_log (user_id, call_id);
+`
+
+const addCommandQueuesSQL = `
+-- Message bus command queues, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS command_queues (
+    user_id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    url TEXT NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    reply_subject TEXT NOT NULL DEFAULT '',
+    durable TEXT NOT NULL DEFAULT '',
+    enabled INTEGER NOT NULL DEFAULT 1,
+    updated_at BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const addEventSinksSQL = `
+-- Message bus event sinks, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS event_sinks (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    url TEXT NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    exchange TEXT NOT NULL DEFAULT '',
+    events TEXT NOT NULL DEFAULT 'All',
+    enabled INTEGER NOT NULL DEFAULT 1,
+    description TEXT NOT NULL DEFAULT '',
+    schema TEXT NOT NULL DEFAULT 'v1',
+    filter TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_event_sinks_user_id ON event_sinks (user_id);
+`
+
+const addWebhookSchemaSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'users' AND column_name = 'webhook_schema'
+    ) THEN
+        ALTER TABLE users ADD COLUMN webhook_schema TEXT NOT NULL DEFAULT 'v1';
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'webhooks' AND column_name = 'schema'
+    ) THEN
+        ALTER TABLE webhooks ADD COLUMN schema TEXT NOT NULL DEFAULT 'v1';
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'firehose' AND column_name = 'schema'
+    ) THEN
+        ALTER TABLE firehose ADD COLUMN schema TEXT NOT NULL DEFAULT 'v1';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3ConfigSQL = `
+-- Per user S3 storage for incoming media, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS s3_config (
+    user_id TEXT PRIMARY KEY,
+    enabled INTEGER NOT NULL DEFAULT 1,
+    endpoint TEXT NOT NULL DEFAULT '',
+    region TEXT NOT NULL DEFAULT '',
+    bucket TEXT NOT NULL DEFAULT '',
+    access_key TEXT NOT NULL DEFAULT '',
+    secret_key TEXT NOT NULL DEFAULT '',
+    use_ssl INTEGER NOT NULL DEFAULT 1,
+    path_style INTEGER NOT NULL DEFAULT 0,
+    prefix TEXT NOT NULL DEFAULT 'wuzapi',
+    retention_days INTEGER NOT NULL DEFAULT 0,
+    url_expiry INTEGER NOT NULL DEFAULT 86400,
+    updated_at BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const addEventFiltersSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'users' AND column_name = 'webhook_filter'
+    ) THEN
+        ALTER TABLE users ADD COLUMN webhook_filter TEXT NOT NULL DEFAULT '';
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'webhooks' AND column_name = 'filter'
+    ) THEN
+        ALTER TABLE webhooks ADD COLUMN filter TEXT NOT NULL DEFAULT '';
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'firehose' AND column_name = 'filter'
+    ) THEN
+        ALTER TABLE firehose ADD COLUMN filter TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addFirehoseSQL = `
+-- Admin configured webhook receiving the events of all users, stored as a
+-- single row with id 'firehose', valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS firehose (
+    id TEXT PRIMARY KEY,
+    url TEXT NOT NULL DEFAULT '',
+    events TEXT NOT NULL DEFAULT 'All',
+    secret TEXT NOT NULL DEFAULT '',
+    format TEXT NOT NULL DEFAULT 'form',
+    enabled INTEGER NOT NULL DEFAULT 1,
+    updated_at BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const addWebhookDeliveriesSQL = `
+-- Log of webhook delivery attempts, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    webhook_id TEXT NOT NULL DEFAULT '',
+    event_id TEXT NOT NULL DEFAULT '',
+    url TEXT NOT NULL,
+    event_type TEXT NOT NULL DEFAULT '',
+    attempt INTEGER NOT NULL DEFAULT 1,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    latency_ms BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    test INTEGER NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_user_created_at ON webhook_deliveries (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_created_at ON webhook_deliveries (created_at);
+`
+
+const addWebhookFailedSQL = `
+-- Dead-letter store for webhook deliveries that exhausted their retries,
+-- valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS webhook_failed (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    webhook_id TEXT NOT NULL DEFAULT '',
+    url TEXT NOT NULL,
+    event_type TEXT NOT NULL DEFAULT '',
+    payload TEXT NOT NULL,
+    file_path TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    response_body TEXT NOT NULL DEFAULT '',
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL,
+    failed_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_failed_user_failed_at ON webhook_failed (user_id, failed_at);
+ALTER TABLE webhook_outbox ADD COLUMN last_status INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE webhook_outbox ADD COLUMN last_response TEXT NOT NULL DEFAULT '';
+`
+
+const addWebhookFormatSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'users' AND column_name = 'webhook_format'
+    ) THEN
+        ALTER TABLE users ADD COLUMN webhook_format TEXT NOT NULL DEFAULT 'form';
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'webhooks' AND column_name = 'format'
+    ) THEN
+        ALTER TABLE webhooks ADD COLUMN format TEXT NOT NULL DEFAULT 'form';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhooksSQL = `
+-- Additional webhook endpoints per user, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS webhooks (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT 'All',
+    enabled INTEGER NOT NULL DEFAULT 1,
+    description TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks (user_id);
+ALTER TABLE webhook_outbox ADD COLUMN webhook_id TEXT NOT NULL DEFAULT '';
+`
+
+const addWebhookSigningSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'users' AND column_name = 'webhook_secret'
+    ) THEN
+        ALTER TABLE users ADD COLUMN webhook_secret TEXT NOT NULL DEFAULT '';
+    END IF;
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'users' AND column_name = 'webhook_include_token'
+    ) THEN
+        ALTER TABLE users ADD COLUMN webhook_include_token INTEGER NOT NULL DEFAULT 1;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookOutboxSQL = `
+-- Pending webhook deliveries, valid for both PostgreSQL and SQLite
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    url TEXT NOT NULL,
+    event_type TEXT NOT NULL DEFAULT '',
+    payload TEXT NOT NULL,
+    file_path TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL,
+    next_attempt_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_outbox_next_attempt ON webhook_outbox (next_attempt_at);
+`
+
 const changeIDToStringSQL = `
 -- Migration to change ID from integer to random string
 DO $$
@@ -228,6 +744,75 @@ func applyMigration(db *sqlx.DB, migration Migration) error {
 		} else {
 			_, err = tx.Exec(migration.UpSQL)
 		}
+	} else if migration.ID == 5 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_secret", "TEXT NOT NULL DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "webhook_include_token", "INTEGER NOT NULL DEFAULT 1")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 7 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_format", "TEXT NOT NULL DEFAULT 'form'")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhooks", "format", "TEXT NOT NULL DEFAULT 'form'")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 11 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_filter", "TEXT NOT NULL DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhooks", "filter", "TEXT NOT NULL DEFAULT ''")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "firehose", "filter", "TEXT NOT NULL DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 13 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_schema", "TEXT NOT NULL DEFAULT 'v1'")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "webhooks", "schema", "TEXT NOT NULL DEFAULT 'v1'")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "firehose", "schema", "TEXT NOT NULL DEFAULT 'v1'")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 21 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "send_jobs", "send_at", "BIGINT NOT NULL DEFAULT 0")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 22 {
+		if db.DriverName() == "sqlite" {
+			_, err = tx.Exec(createCampaignsSQL)
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "send_jobs", "campaign_id", "TEXT NOT NULL DEFAULT ''")
+			}
+			if err == nil {
+				_, err = tx.Exec(sendJobsCampaignIndexSQL)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 18 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "messages", "file_name", "TEXT NOT NULL DEFAULT ''")
+			if err == nil {
+				_, err = tx.Exec(addMessageSearchSQLite)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
 	} else {
 		_, err = tx.Exec(migration.UpSQL)
 	}
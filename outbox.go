@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// Webhook events are written to the webhook_outbox table before delivery, so
+// they survive receiver outages and server restarts. A background worker
+// sends due entries and reschedules failures with exponential backoff and
+// jitter until the entry is older than -webhookmaxage. Entries that exhaust
+// their retries are moved to the webhook_failed dead-letter table, from where
+// they can be listed and replayed through the API. Every attempt is recorded
+// in the webhook_deliveries log, which is purged after -webhooklogretention.
+
+const (
+	outboxPollInterval = 1 * time.Second
+	outboxBatchSize    = 100
+	outboxWorkers      = 16
+	outboxBaseBackoff  = 5 * time.Second
+	outboxMaxBackoff   = 10 * time.Minute
+	outboxLease        = 2 * time.Minute
+	outboxPurgeEvery   = 1 * time.Hour
+)
+
+// Used to call webhooks for users without an active session
+var defaultWebhookClient = resty.New().
+	SetRedirectPolicy(resty.FlexibleRedirectPolicy(15)).
+	SetTimeout(30 * time.Second).
+	SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+
+type outboxEntry struct {
+	Id            string `db:"id"`
+	UserId        string `db:"user_id"`
+	WebhookId     string `db:"webhook_id"`
+	URL           string `db:"url"`
+	EventType     string `db:"event_type"`
+	Payload       string `db:"payload"`
+	FilePath      string `db:"file_path"`
+	Attempts      int    `db:"attempts"`
+	LastError     string `db:"last_error"`
+	LastStatus    int    `db:"last_status"`
+	LastResponse  string `db:"last_response"`
+	CreatedAt     int64  `db:"created_at"`
+	NextAttemptAt int64  `db:"next_attempt_at"`
+}
+
+// A delivery that exhausted its retries
+type FailedWebhook struct {
+	Id           string `db:"id" json:"id"`
+	UserId       string `db:"user_id" json:"-"`
+	WebhookId    string `db:"webhook_id" json:"webhook_id"`
+	URL          string `db:"url" json:"url"`
+	EventType    string `db:"event_type" json:"event_type"`
+	Payload      string `db:"payload" json:"-"`
+	FilePath     string `db:"file_path" json:"file_path"`
+	Attempts     int    `db:"attempts" json:"attempts"`
+	StatusCode   int    `db:"status_code" json:"status_code"`
+	ResponseBody string `db:"response_body" json:"response_body"`
+	LastError    string `db:"last_error" json:"last_error"`
+	CreatedAt    int64  `db:"created_at" json:"created_at"`
+	FailedAt     int64  `db:"failed_at" json:"failed_at"`
+}
+
+// One delivery attempt as kept in the delivery log
+type WebhookDelivery struct {
+	Id         string `db:"id" json:"id"`
+	UserId     string `db:"user_id" json:"-"`
+	WebhookId  string `db:"webhook_id" json:"webhook_id"`
+	EventId    string `db:"event_id" json:"event_id"`
+	URL        string `db:"url" json:"url"`
+	EventType  string `db:"event_type" json:"event_type"`
+	Attempt    int    `db:"attempt" json:"attempt"`
+	StatusCode int    `db:"status_code" json:"status_code"`
+	LatencyMs  int64  `db:"latency_ms" json:"latency_ms"`
+	Error      string `db:"error" json:"error"`
+	Test       bool   `db:"test" json:"test"`
+	CreatedAt  int64  `db:"created_at" json:"created_at"`
+}
+
+const webhookDeliveryColumns = "id, user_id, webhook_id, event_id, url, event_type, attempt, status_code, latency_ms, error, test, created_at"
+
+const failedWebhookColumns = "id, user_id, webhook_id, url, event_type, payload, file_path, attempts, status_code, response_body, last_error, created_at, failed_at"
+
+type WebhookOutbox struct {
+	db      *sqlx.DB
+	wake    chan struct{}
+	workers chan struct{}
+}
+
+func NewWebhookOutbox(db *sqlx.DB) *WebhookOutbox {
+	return &WebhookOutbox{
+		db:      db,
+		wake:    make(chan struct{}, 1),
+		workers: make(chan struct{}, outboxWorkers),
+	}
+}
+
+// Enqueue stores a webhook call so it is delivered (and retried) by the worker.
+// webhookID is empty for the user's main webhook (users.webhook column).
+func (o *WebhookOutbox) Enqueue(userID string, webhookID string, url string, eventType string, payload map[string]string, filePath string) error {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+	now := time.Now().Unix()
+	_, err = o.db.Exec(`INSERT INTO webhook_outbox (id, user_id, webhook_id, url, event_type, payload, file_path, attempts, last_error, created_at, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, 0, '', $8, $9)`, id, userID, webhookID, url, eventType, string(data), filePath, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook: %w", err)
+	}
+	o.notify()
+	return nil
+}
+
+func (o *WebhookOutbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls the outbox for due entries and delivers them, never returns
+func (o *WebhookOutbox) Run() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(outboxPurgeEvery)
+	defer purge.Stop()
+	o.purgeDeliveries()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		case <-purge.C:
+			o.purgeDeliveries()
+			continue
+		}
+		o.processDue()
+	}
+}
+
+func (o *WebhookOutbox) processDue() {
+	var entries []outboxEntry
+	err := o.db.Select(&entries, `SELECT id, user_id, webhook_id, url, event_type, payload, file_path, attempts, last_error, last_status, last_response, created_at, next_attempt_at
+		FROM webhook_outbox WHERE next_attempt_at <= $1 ORDER BY next_attempt_at, created_at LIMIT $2`, time.Now().Unix(), outboxBatchSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read webhook outbox")
+		return
+	}
+
+	for _, entry := range entries {
+		if !o.claim(entry) {
+			continue
+		}
+		o.workers <- struct{}{}
+		go func(entry outboxEntry) {
+			defer func() { <-o.workers }()
+			o.deliver(entry)
+		}(entry)
+	}
+}
+
+// Claims an entry by pushing its next attempt past the delivery timeout, so
+// it is not picked up again while being sent. If the server stops during the
+// delivery the entry becomes due again once the lease expires.
+func (o *WebhookOutbox) claim(entry outboxEntry) bool {
+	result, err := o.db.Exec("UPDATE webhook_outbox SET next_attempt_at=$1 WHERE id=$2 AND next_attempt_at=$3",
+		time.Now().Add(outboxLease).Unix(), entry.Id, entry.NextAttemptAt)
+	if err != nil {
+		log.Error().Err(err).Str("id", entry.Id).Msg("Failed to claim webhook")
+		return false
+	}
+	rowsAffected, err := result.RowsAffected()
+	return err == nil && rowsAffected == 1
+}
+
+func (o *WebhookOutbox) deliver(entry outboxEntry) {
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(entry.Payload), &payload); err != nil {
+		log.Error().Err(err).Str("id", entry.Id).Msg("Dropping webhook with invalid payload")
+		o.remove(entry.Id)
+		return
+	}
+
+	target := getWebhookTarget(o.db, entry.UserId, entry.WebhookId)
+	entry.Attempts++
+
+	start := time.Now()
+	status, err := sendWebhook(entry.URL, payload, entry.UserId, entry.FilePath, target)
+	recordWebhookDelivery(o.db, WebhookDelivery{
+		UserId:     entry.UserId,
+		WebhookId:  entry.WebhookId,
+		EventId:    entry.Id,
+		URL:        entry.URL,
+		EventType:  entry.EventType,
+		Attempt:    entry.Attempts,
+		StatusCode: status,
+		LatencyMs:  time.Since(start).Milliseconds(),
+		Error:      errorString(err),
+	})
+	if err == nil {
+		o.remove(entry.Id)
+		return
+	}
+
+	entry.LastError = err.Error()
+	entry.LastStatus = status
+	entry.LastResponse = ""
+	var statusErr *webhookStatusError
+	if errors.As(err, &statusErr) {
+		entry.LastResponse = statusErr.Body
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(entry.CreatedAt, 0)) >= *webhookMaxAge {
+		log.Error().Err(err).Str("userid", entry.UserId).Str("url", entry.URL).Str("type", entry.EventType).Int("attempts", entry.Attempts).Msg("Giving up on webhook delivery")
+		o.deadLetter(entry)
+		return
+	}
+
+	next := now.Add(outboxBackoff(entry.Attempts))
+	log.Warn().Err(err).Str("userid", entry.UserId).Str("url", entry.URL).Int("attempts", entry.Attempts).Time("retry_at", next).Msg("Webhook delivery failed, will retry")
+	_, dbErr := o.db.Exec("UPDATE webhook_outbox SET attempts=$1, last_error=$2, last_status=$3, last_response=$4, next_attempt_at=$5 WHERE id=$6",
+		entry.Attempts, entry.LastError, entry.LastStatus, entry.LastResponse, next.Unix(), entry.Id)
+	if dbErr != nil {
+		log.Error().Err(dbErr).Str("id", entry.Id).Msg("Failed to reschedule webhook")
+	}
+}
+
+// Moves an entry that exhausted its retries to the dead-letter table
+func (o *WebhookOutbox) deadLetter(entry outboxEntry) {
+	tx, err := o.db.Beginx()
+	if err != nil {
+		log.Error().Err(err).Str("id", entry.Id).Msg("Failed to move webhook to dead-letter table")
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO webhook_failed (id, user_id, webhook_id, url, event_type, payload, file_path, attempts, status_code, response_body, last_error, created_at, failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		entry.Id, entry.UserId, entry.WebhookId, entry.URL, entry.EventType, entry.Payload, entry.FilePath,
+		entry.Attempts, entry.LastStatus, entry.LastResponse, entry.LastError, entry.CreatedAt, time.Now().Unix())
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM webhook_outbox WHERE id=$1", entry.Id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Error().Err(err).Str("id", entry.Id).Msg("Failed to move webhook to dead-letter table")
+	}
+}
+
+// Replay moves failed deliveries of a user back to the outbox. Only the
+// entry with the given id is replayed when id is not empty, otherwise all
+// entries that failed between from and to (unix seconds, 0 for no bound).
+// Replayed entries start over with a fresh retry window.
+func (o *WebhookOutbox) Replay(userID string, id string, from int64, to int64) (int64, error) {
+	return o.replay("user_id=$1 AND webhook_id <> $2", []interface{}{userID, firehoseWebhookID}, id, from, to)
+}
+
+// ReplayFirehose is like Replay for the failed firehose deliveries of all users
+func (o *WebhookOutbox) ReplayFirehose(id string, from int64, to int64) (int64, error) {
+	return o.replay("webhook_id=$1", []interface{}{firehoseWebhookID}, id, from, to)
+}
+
+func (o *WebhookOutbox) replay(where string, args []interface{}, id string, from int64, to int64) (int64, error) {
+	if id != "" {
+		args = append(args, id)
+		where += fmt.Sprintf(" AND id=$%d", len(args))
+	}
+	if from > 0 {
+		args = append(args, from)
+		where += fmt.Sprintf(" AND failed_at >= $%d", len(args))
+	}
+	if to > 0 {
+		args = append(args, to)
+		where += fmt.Sprintf(" AND failed_at <= $%d", len(args))
+	}
+
+	tx, err := o.db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	args = append(args, now)
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO webhook_outbox (id, user_id, webhook_id, url, event_type, payload, file_path, attempts, last_error, created_at, next_attempt_at)
+		SELECT id, user_id, webhook_id, url, event_type, payload, file_path, 0, '', $%d, $%d FROM webhook_failed WHERE %s`, len(args), len(args), where), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue webhooks: %w", err)
+	}
+	result, err := tx.Exec("DELETE FROM webhook_failed WHERE "+where, args[:len(args)-1]...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove failed webhooks: %w", err)
+	}
+	replayed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	if replayed > 0 {
+		o.notify()
+	}
+	return replayed, nil
+}
+
+// Removes the pending, failed and logged webhooks of a user, returns the
+// files of the pending and failed ones to be removed once this is committed
+func deleteUserWebhooks(db sqlx.Ext, userID string) ([]string, error) {
+	var files []string
+	err := sqlx.Select(db, &files, `SELECT file_path FROM webhook_outbox WHERE user_id=$1 AND file_path != ''
+		UNION SELECT file_path FROM webhook_failed WHERE user_id=$1 AND file_path != ''`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"webhook_outbox", "webhook_failed", "webhook_deliveries"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE user_id=$1", userID); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Sends a webhook with the body format of the target, returns the HTTP status
+// of the response (0 when no response was received)
+func sendWebhook(url string, payload map[string]string, userID string, filePath string, target webhookTarget) (int, error) {
+	if filePath != "" {
+		return callHookFile(url, payload, userID, filePath, target.Secret, target.Format)
+	}
+	if target.Format == webhookFormatJSON {
+		return callHookJSON(url, payload, userID, target.Secret)
+	}
+	return callHook(url, payload, userID, target.Secret)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Adds an attempt to the delivery log, unless the log is disabled
+func recordWebhookDelivery(db *sqlx.DB, delivery WebhookDelivery) {
+	if *webhookLogRetention <= 0 {
+		return
+	}
+	id, err := GenerateRandomID()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to record webhook delivery")
+		return
+	}
+	_, err = db.Exec(`INSERT INTO webhook_deliveries (id, user_id, webhook_id, event_id, url, event_type, attempt, status_code, latency_ms, error, test, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		id, delivery.UserId, delivery.WebhookId, delivery.EventId, delivery.URL, delivery.EventType, delivery.Attempt,
+		delivery.StatusCode, delivery.LatencyMs, delivery.Error, boolToFlag(delivery.Test), time.Now().Unix())
+	if err != nil {
+		log.Error().Err(err).Str("userid", delivery.UserId).Msg("Failed to record webhook delivery")
+	}
+}
+
+// Removes delivery log entries older than -webhooklogretention
+func (o *WebhookOutbox) purgeDeliveries() {
+	cutoff := time.Now().Add(-*webhookLogRetention).Unix()
+	if *webhookLogRetention <= 0 {
+		cutoff = time.Now().Unix()
+	}
+	result, err := o.db.Exec("DELETE FROM webhook_deliveries WHERE created_at < $1", cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge webhook delivery log")
+		return
+	}
+	if purged, err := result.RowsAffected(); err == nil && purged > 0 {
+		log.Info().Int64("purged", purged).Msg("Purged old webhook deliveries")
+	}
+}
+
+func (o *WebhookOutbox) remove(id string) {
+	if _, err := o.db.Exec("DELETE FROM webhook_outbox WHERE id=$1", id); err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Failed to remove webhook from outbox")
+	}
+}
+
+// Exponential backoff capped at outboxMaxBackoff, randomized between half
+// and the full delay so receivers coming back up are not hit all at once
+func outboxBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := outboxMaxBackoff
+	if attempts < 20 {
+		delay = outboxBaseBackoff << (attempts - 1)
+		if delay > outboxMaxBackoff {
+			delay = outboxMaxBackoff
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
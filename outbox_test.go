@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{4, 40 * time.Second},
+		{7, 320 * time.Second},
+		// 640s is over the cap
+		{8, outboxMaxBackoff},
+		{19, outboxMaxBackoff},
+		{20, outboxMaxBackoff},
+		{64, outboxMaxBackoff},
+		{1000, outboxMaxBackoff},
+	}
+	for _, tt := range tests {
+		min, max := tt.delay, time.Duration(0)
+		for i := 0; i < 500; i++ {
+			got := outboxBackoff(tt.attempts)
+			if got < tt.delay/2 || got > tt.delay {
+				t.Fatalf("outboxBackoff(%d) = %v, want between %v and %v", tt.attempts, got, tt.delay/2, tt.delay)
+			}
+			if got < min {
+				min = got
+			}
+			if got > max {
+				max = got
+			}
+		}
+		// The jitter spreads the retries over the whole range
+		if max-min < tt.delay/4 {
+			t.Errorf("outboxBackoff(%d) ranged over %v to %v, want jitter up to %v", tt.attempts, min, max, tt.delay/2)
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	db := newTestDB(t)
+	s := &server{db: db}
+	pending := filepath.Join(t.TempDir(), "pending.jpg")
+	failed := filepath.Join(t.TempDir(), "failed.jpg")
+	for _, file := range []string{pending, failed} {
+		if err := os.WriteFile(file, []byte("media"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, query := range []string{
+		"INSERT INTO users (id, name, token) VALUES ('u1', 'ana', 't1'), ('u2', 'bob', 't2')",
+		"INSERT INTO webhooks (id, user_id, url, created_at) VALUES ('w1', 'u1', 'http://a', 1), ('w2', 'u2', 'http://b', 1)",
+		"INSERT INTO webhook_outbox (id, user_id, url, event_type, payload, file_path, created_at, next_attempt_at) VALUES ('o1', 'u1', 'http://a', 'Message', '{}', '" + pending + "', 1, 1), ('o2', 'u2', 'http://b', 'Message', '{}', '', 1, 1)",
+		"INSERT INTO webhook_failed (id, user_id, url, event_type, payload, file_path, created_at, failed_at) VALUES ('f1', 'u1', 'http://a', 'Message', '{}', '" + failed + "', 1, 1)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := s.deleteUser("u1")
+	if err != nil || !found {
+		t.Fatalf("deleteUser = %v, %v", found, err)
+	}
+	for table, column := range map[string]string{"users": "id", "webhooks": "user_id", "webhook_outbox": "user_id", "webhook_failed": "user_id"} {
+		var mine, others int
+		db.Get(&mine, "SELECT COUNT(*) FROM "+table+" WHERE "+column+"='u1'")
+		db.Get(&others, "SELECT COUNT(*) FROM "+table)
+		if mine != 0 || (others == 0 && table != "webhook_failed") {
+			t.Errorf("%s has %d rows of the user and %d in total", table, mine, others)
+		}
+	}
+	// The files of the pending webhooks go with them
+	for _, file := range []string{pending, failed} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", filepath.Base(file), err)
+		}
+	}
+
+	if found, err := s.deleteUser("u1"); found || err != nil {
+		t.Errorf("second deleteUser = %v, %v", found, err)
+	}
+}
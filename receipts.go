@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Messages sent through the send endpoints are recorded with their id and
+// recipient, and receipts move them through the sent (acknowledged by the
+// server), delivered, read and played states. States never go back, a late
+// delivery receipt does not undo a read. In groups every participant has its
+// own state and the message has the most advanced one. The status of sent
+// messages is kept for -statusretention.
+
+const (
+	messageStateSent      = "sent"
+	messageStateDelivered = "delivered"
+	messageStateRead      = "read"
+	messageStatePlayed    = "played"
+)
+
+var messageStateRank = map[string]int{
+	messageStateSent:      1,
+	messageStateDelivered: 2,
+	messageStateRead:      3,
+	messageStatePlayed:    4,
+}
+
+// Delivery status of a message or of one group participant
+type MessageStatus struct {
+	State       string `db:"state" json:"state"`
+	DeliveredAt int64  `db:"delivered_at" json:"delivered_at"`
+	ReadAt      int64  `db:"read_at" json:"read_at"`
+	PlayedAt    int64  `db:"played_at" json:"played_at"`
+}
+
+type SentMessage struct {
+	UserId  string `db:"user_id" json:"-"`
+	Id      string `db:"id" json:"id"`
+	Chat    string `db:"chat" json:"chat"`
+	IsGroup bool   `db:"is_group" json:"is_group"`
+	SentAt  int64  `db:"sent_at" json:"sent_at"`
+	MessageStatus
+	Participants []MessageReceipt `db:"-" json:"participants"`
+}
+
+const sentMessageColumns = "user_id, id, chat, is_group, sent_at, state, delivered_at, read_at, played_at"
+
+type MessageReceipt struct {
+	Participant string `db:"participant" json:"participant"`
+	MessageStatus
+}
+
+const messageReceiptColumns = "participant, state, delivered_at, read_at, played_at"
+
+// Moves a status to a new state, filling in the time of the states it
+// skipped. Returns false when the status was already there or beyond.
+func (st *MessageStatus) advance(state string, ts int64) bool {
+	if messageStateRank[state] <= messageStateRank[st.State] {
+		return false
+	}
+	st.State = state
+	if st.DeliveredAt == 0 {
+		st.DeliveredAt = ts
+	}
+	if state != messageStateDelivered && st.ReadAt == 0 {
+		st.ReadAt = ts
+	}
+	if state == messageStatePlayed && st.PlayedAt == 0 {
+		st.PlayedAt = ts
+	}
+	return true
+}
+
+// Returns the state a receipt type moves messages to, empty for receipts
+// that do not change the status of sent messages
+func receiptState(receiptType types.ReceiptType) string {
+	switch receiptType {
+	case types.ReceiptTypeDelivered:
+		return messageStateDelivered
+	case types.ReceiptTypeRead:
+		return messageStateRead
+	case types.ReceiptTypePlayed:
+		return messageStatePlayed
+	}
+	return ""
+}
+
+// Records a message sent through the API, acknowledged by the server
+func trackSentMessage(db *sqlx.DB, userID string, recipient types.JID, id string, timestamp time.Time) {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	_, err := db.Exec("INSERT INTO sent_messages ("+sentMessageColumns+") VALUES ($1, $2, $3, $4, $5, $6, 0, 0, 0) ON CONFLICT (user_id, id) DO NOTHING",
+		userID, id, recipient.ToNonAD().String(), boolToFlag(recipient.Server == types.GroupServer), timestamp.Unix(), messageStateSent)
+	if err != nil {
+		log.Error().Err(err).Str("userid", userID).Str("id", id).Msg("Could not record sent message")
+	}
+}
+
+// Updates the status of the sent messages a receipt refers to. Receipts
+// from the user's own devices and for messages not sent through the API are
+// ignored.
+func trackReceipt(db *sqlx.DB, userID string, evt *events.Receipt) {
+	state := receiptState(evt.Type)
+	if state == "" || evt.IsFromMe {
+		return
+	}
+	ts := evt.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	participant := evt.Sender.ToNonAD().String()
+	for _, id := range evt.MessageIDs {
+		if err := updateMessageStatus(db, userID, id, participant, state, ts.Unix()); err != nil {
+			log.Error().Err(err).Str("userid", userID).Str("id", id).Msg("Could not update message status")
+		}
+	}
+}
+
+func updateMessageStatus(db *sqlx.DB, userID string, id string, participant string, state string, ts int64) error {
+	var message SentMessage
+	err := db.Get(&message, "SELECT "+sentMessageColumns+" FROM sent_messages WHERE user_id=$1 AND id=$2", userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	receipt := MessageReceipt{Participant: participant}
+	err = db.Get(&receipt, "SELECT "+messageReceiptColumns+" FROM message_receipts WHERE user_id=$1 AND message_id=$2 AND participant=$3", userID, id, participant)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if receipt.advance(state, ts) {
+		_, err = db.Exec(`INSERT INTO message_receipts (user_id, message_id, participant, state, delivered_at, read_at, played_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (user_id, message_id, participant) DO UPDATE SET state=excluded.state, delivered_at=excluded.delivered_at, read_at=excluded.read_at, played_at=excluded.played_at`,
+			userID, id, participant, receipt.State, receipt.DeliveredAt, receipt.ReadAt, receipt.PlayedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if message.advance(state, ts) {
+		_, err = db.Exec("UPDATE sent_messages SET state=$1, delivered_at=$2, read_at=$3, played_at=$4 WHERE user_id=$5 AND id=$6",
+			message.State, message.DeliveredAt, message.ReadAt, message.PlayedAt, userID, id)
+	}
+	return err
+}
+
+// Returns a sent message with the status of each participant, nil when the
+// message is unknown
+func getMessageStatus(db *sqlx.DB, userID string, id string) (*SentMessage, error) {
+	var message SentMessage
+	err := db.Get(&message, "SELECT "+sentMessageColumns+" FROM sent_messages WHERE user_id=$1 AND id=$2", userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	message.Participants = []MessageReceipt{}
+	err = db.Select(&message.Participants, "SELECT "+messageReceiptColumns+" FROM message_receipts WHERE user_id=$1 AND message_id=$2 ORDER BY participant", userID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func deleteUserMessageStatus(db sqlx.Ext, userID string) error {
+	if _, err := db.Exec("DELETE FROM message_receipts WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM sent_messages WHERE user_id=$1", userID)
+	return err
+}
+
+// Removes the status of messages sent before -statusretention, 0 keeps it
+// forever
+func purgeMessageStatus(db *sqlx.DB) {
+	if *statusRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-*statusRetention).Unix()
+	_, err := db.Exec("DELETE FROM message_receipts WHERE message_id IN (SELECT id FROM sent_messages WHERE sent_at < $1 AND sent_messages.user_id = message_receipts.user_id)", cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge message status")
+		return
+	}
+	result, err := db.Exec("DELETE FROM sent_messages WHERE sent_at < $1", cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge message status")
+		return
+	}
+	if purged, err := result.RowsAffected(); err == nil && purged > 0 {
+		log.Info().Int64("purged", purged).Msg("Purged old message status")
+	}
+}
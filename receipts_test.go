@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestMessageStatusAdvance(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  MessageStatus
+		state   string
+		ts      int64
+		changed bool
+		want    MessageStatus
+	}{
+		{"sent to delivered", MessageStatus{State: "sent"}, "delivered", 10, true, MessageStatus{State: "delivered", DeliveredAt: 10}},
+		{"delivered to read", MessageStatus{State: "delivered", DeliveredAt: 10}, "read", 20, true, MessageStatus{State: "read", DeliveredAt: 10, ReadAt: 20}},
+		{"read to played", MessageStatus{State: "read", DeliveredAt: 10, ReadAt: 20}, "played", 30, true, MessageStatus{State: "played", DeliveredAt: 10, ReadAt: 20, PlayedAt: 30}},
+		// Skipped states get the time of the receipt
+		{"sent to read", MessageStatus{State: "sent"}, "read", 20, true, MessageStatus{State: "read", DeliveredAt: 20, ReadAt: 20}},
+		{"sent to played", MessageStatus{State: "sent"}, "played", 30, true, MessageStatus{State: "played", DeliveredAt: 30, ReadAt: 30, PlayedAt: 30}},
+		{"new participant", MessageStatus{}, "delivered", 10, true, MessageStatus{State: "delivered", DeliveredAt: 10}},
+		// States never go back
+		{"late delivery", MessageStatus{State: "read", DeliveredAt: 10, ReadAt: 20}, "delivered", 30, false, MessageStatus{State: "read", DeliveredAt: 10, ReadAt: 20}},
+		{"same state", MessageStatus{State: "read", DeliveredAt: 10, ReadAt: 20}, "read", 30, false, MessageStatus{State: "read", DeliveredAt: 10, ReadAt: 20}},
+		{"unknown state", MessageStatus{State: "sent"}, "typing", 30, false, MessageStatus{State: "sent"}},
+	}
+	for _, tt := range tests {
+		status := tt.status
+		if changed := status.advance(tt.state, tt.ts); changed != tt.changed || status != tt.want {
+			t.Errorf("%s: advance = %v %+v, want %v %+v", tt.name, changed, status, tt.changed, tt.want)
+		}
+	}
+}
+
+func TestReceiptState(t *testing.T) {
+	tests := map[types.ReceiptType]string{
+		types.ReceiptTypeDelivered: messageStateDelivered,
+		types.ReceiptTypeRead:      messageStateRead,
+		types.ReceiptTypePlayed:    messageStatePlayed,
+		types.ReceiptTypeReadSelf:  "",
+		types.ReceiptTypeSender:    "",
+		types.ReceiptTypeRetry:     "",
+	}
+	for receiptType, want := range tests {
+		if got := receiptState(receiptType); got != want {
+			t.Errorf("receiptState(%q) = %q, want %q", receiptType, got, want)
+		}
+	}
+}
+
+func TestTrackReceipt(t *testing.T) {
+	db := newTestDB(t)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	ana := types.NewJID("5491155550001", types.DefaultUserServer)
+	bob := types.JID{User: "5491155550002", Device: 2, Server: types.DefaultUserServer}
+	sentAt := time.Unix(1767225600, 0)
+	receipt := func(sender types.JID, receiptType types.ReceiptType, minutes int, ids ...string) {
+		trackReceipt(db, "u1", &events.Receipt{
+			MessageSource: types.MessageSource{Chat: group, Sender: sender, IsGroup: true},
+			MessageIDs:    ids,
+			Timestamp:     sentAt.Add(time.Duration(minutes) * time.Minute),
+			Type:          receiptType,
+		})
+	}
+
+	trackSentMessage(db, "u1", group, "MSG1", sentAt)
+	receipt(ana, types.ReceiptTypeDelivered, 1, "MSG1", "UNKNOWN")
+	receipt(bob, types.ReceiptTypeRead, 2, "MSG1")
+	receipt(ana, types.ReceiptTypeDelivered, 3, "MSG1")
+	// Receipts of the user's own devices are ignored
+	trackReceipt(db, "u1", &events.Receipt{
+		MessageSource: types.MessageSource{Chat: group, Sender: ana, IsFromMe: true},
+		MessageIDs:    []types.MessageID{"MSG1"},
+		Type:          types.ReceiptTypePlayed,
+	})
+
+	message, err := getMessageStatus(db, "u1", "MSG1")
+	if err != nil || message == nil {
+		t.Fatalf("getMessageStatus = %v, %v", message, err)
+	}
+	min := func(n int) int64 { return sentAt.Add(time.Duration(n) * time.Minute).Unix() }
+	if message.Chat != group.String() || !message.IsGroup || message.SentAt != sentAt.Unix() {
+		t.Errorf("message = %+v", message)
+	}
+	if want := (MessageStatus{State: "read", DeliveredAt: min(1), ReadAt: min(2)}); message.MessageStatus != want {
+		t.Errorf("message status = %+v, want %+v", message.MessageStatus, want)
+	}
+	want := []MessageReceipt{
+		{Participant: ana.String(), MessageStatus: MessageStatus{State: "delivered", DeliveredAt: min(1)}},
+		{Participant: bob.ToNonAD().String(), MessageStatus: MessageStatus{State: "read", DeliveredAt: min(2), ReadAt: min(2)}},
+	}
+	if len(message.Participants) != len(want) || message.Participants[0] != want[0] || message.Participants[1] != want[1] {
+		t.Errorf("participants = %+v, want %+v", message.Participants, want)
+	}
+
+	if unknown, err := getMessageStatus(db, "u1", "UNKNOWN"); unknown != nil || err != nil {
+		t.Errorf("status of a message not sent through the API = %+v, %v", unknown, err)
+	}
+	if other, err := getMessageStatus(db, "u2", "MSG1"); other != nil || err != nil {
+		t.Errorf("status for another user = %+v, %v", other, err)
+	}
+}
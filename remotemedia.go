@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The media send endpoints take an http(s) URL in place of a data URL. The
+// file is downloaded with a size limit and a timeout, and its type is
+// sniffed from the content, so an error page is not sent as an image.
+// Connections to loopback, private, link-local and other internal addresses
+// are refused, checked on the address actually dialed so a DNS name or a
+// redirect cannot point the download inside the network. Networks listed in
+// -remotemediaallow are let through.
+
+const maxRemoteMediaRedirects = 5
+
+var (
+	remoteMediaClient     *http.Client
+	remoteMediaClientOnce sync.Once
+	remoteMediaAllowed    []*net.IPNet
+)
+
+// Address ranges that are not reachable from the internet, on top of the
+// ones the net package knows
+var remoteMediaBlocked = mustParseCIDRs(
+	"0.0.0.0/8",     // this network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+	"64:ff9b::/96",  // NAT64
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// Parses the comma separated networks of -remotemediaallow, a single
+// address allows just that address
+func parseAllowedNetworks(value string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", item)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func ipInNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether media may be downloaded from an address
+func remoteMediaAddressAllowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ipInNetworks(ip, remoteMediaAllowed) {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	return !ipInNetworks(ip, remoteMediaBlocked)
+}
+
+// Refuses connections to addresses media may not be downloaded from
+func remoteMediaDialControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !remoteMediaAddressAllowed(ip) {
+		return fmt.Errorf("address %s is not allowed", host)
+	}
+	return nil
+}
+
+func getRemoteMediaClient() *http.Client {
+	remoteMediaClientOnce.Do(func() {
+		allowed, err := parseAllowedNetworks(*remoteMediaAllow)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid -remotemediaallow, no private networks are allowed")
+		}
+		remoteMediaAllowed = allowed
+
+		dialer := &net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: remoteMediaDialControl,
+		}
+		remoteMediaClient = &http.Client{
+			Timeout: *remoteMediaTimeout,
+			Transport: &http.Transport{
+				// A proxy would be dialed instead of the media server
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       90 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRemoteMediaRedirects {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("redirect to unsupported scheme %s", req.URL.Scheme)
+				}
+				return nil
+			},
+		}
+	})
+	return remoteMediaClient
+}
+
+// Returns whether a media field holds an http(s) URL instead of a data URL
+func isRemoteMedia(value string) bool {
+	lower := strings.ToLower(value)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// Downloads the media at an http(s) URL and returns its content and type.
+// The type is sniffed from the content, the Content-Type header is used
+// when the content is not recognized. With accept set, the type must start
+// with one of its prefixes.
+func fetchRemoteMedia(ctx context.Context, rawURL string, accept ...string) ([]byte, string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, "", errors.New("invalid URL")
+	}
+	maxSize := int64(*remoteMediaMaxSize) * 1024 * 1024
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "wuzapi")
+	resp, err := getRemoteMediaClient().Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", fmt.Errorf("server returned %s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, "", fmt.Errorf("file is larger than %d MB", *remoteMediaMaxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, "", fmt.Errorf("file is larger than %d MB", *remoteMediaMaxSize)
+	}
+	if len(data) == 0 {
+		return nil, "", errors.New("file is empty")
+	}
+
+	mimetype := http.DetectContentType(data)
+	if strings.HasPrefix(mimetype, "application/octet-stream") {
+		if header, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && header != "" {
+			mimetype = header
+		}
+	}
+	if len(accept) > 0 {
+		accepted := false
+		for _, prefix := range accept {
+			if strings.HasPrefix(mimetype, prefix) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return nil, "", fmt.Errorf("unexpected content type %s", mimetype)
+		}
+	}
+	return data, mimetype, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseAllowedNetworks(t *testing.T) {
+	nets, err := parseAllowedNetworks(" 10.0.0.0/8, 192.168.1.20,,fd00::/8 ,::1")
+	if err != nil {
+		t.Fatalf("parseAllowedNetworks error = %v", err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.20/32", "fd00::/8", "::1/128"}
+	if len(nets) != len(want) {
+		t.Fatalf("parseAllowedNetworks = %v, want %v", nets, want)
+	}
+	for i := range want {
+		if nets[i].String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, nets[i], want[i])
+		}
+	}
+
+	for _, value := range []string{"nope", "10.0.0.0/33", "10.0.0.1/x", "300.1.1.1"} {
+		if _, err := parseAllowedNetworks(value); err == nil {
+			t.Errorf("parseAllowedNetworks(%q) should fail", value)
+		}
+	}
+}
+
+func TestRemoteMediaAddressAllowed(t *testing.T) {
+	allowed := remoteMediaAllowed
+	defer func() { remoteMediaAllowed = allowed }()
+	remoteMediaAllowed = mustParseCIDRs("192.168.1.20/32", "fd12::/16")
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+
+		{"127.0.0.1", false},
+		{"127.8.9.10", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"172.32.0.1", true},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"64:ff9b::7f00:1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+
+		// Allow-listed
+		{"192.168.1.20", true},
+		{"::ffff:192.168.1.20", true},
+		{"192.168.1.21", false},
+		{"fd12::5", true},
+		{"fd13::5", false},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("invalid test address %s", tt.ip)
+		}
+		if got := remoteMediaAddressAllowed(ip); got != tt.want {
+			t.Errorf("remoteMediaAddressAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestIsRemoteMedia(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"https://example.com/a.png", true},
+		{"HTTP://example.com/a.png", true},
+		{"data:image/png;base64,AAAA", false},
+		{"ftp://example.com/a.png", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isRemoteMedia(tt.value); got != tt.want {
+			t.Errorf("isRemoteMedia(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFetchRemoteMediaLoopback(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.png":
+			w.Write(img.Bytes())
+		case "/redirect":
+			http.Redirect(w, r, "/img.png", http.StatusFound)
+		default:
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		}
+	}))
+	defer srv.Close()
+
+	// Built once from the flag, the allowed networks are swapped below
+	getRemoteMediaClient()
+	allowed := remoteMediaAllowed
+	defer func() { remoteMediaAllowed = allowed }()
+
+	remoteMediaAllowed = nil
+	for _, path := range []string{"/img.png", "/redirect"} {
+		_, _, err := fetchRemoteMedia(context.Background(), srv.URL+path, "image/")
+		if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+			t.Errorf("fetch %s from loopback error = %v, want refused", path, err)
+		}
+	}
+
+	remoteMediaAllowed = mustParseCIDRs("127.0.0.1/32")
+	for _, path := range []string{"/img.png", "/redirect"} {
+		data, mimetype, err := fetchRemoteMedia(context.Background(), srv.URL+path, "image/")
+		if err != nil {
+			t.Fatalf("fetch %s from allowed loopback error = %v", path, err)
+		}
+		if mimetype != "image/png" || !bytes.Equal(data, img.Bytes()) {
+			t.Errorf("fetch %s = %d bytes of %s, want the image", path, len(data), mimetype)
+		}
+	}
+
+	_, _, err := fetchRemoteMedia(context.Background(), srv.URL+"/page", "image/")
+	if err == nil || !strings.Contains(err.Error(), "unexpected content type") {
+		t.Errorf("fetch of a page as an image error = %v", err)
+	}
+}
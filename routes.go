@@ -50,6 +50,12 @@ func (s *server) routes() {
 	adminRoutes.Handle("/users", s.AddUser()).Methods("POST")
 	adminRoutes.Handle("/users/{id}", s.DeleteUser()).Methods("DELETE")
 	adminRoutes.Handle("/users/{id}/full", s.DeleteUserComplete()).Methods("DELETE")
+	adminRoutes.Handle("/firehose", s.GetFirehose()).Methods("GET")
+	adminRoutes.Handle("/firehose", s.SetFirehose()).Methods("PUT")
+	adminRoutes.Handle("/firehose", s.DeleteFirehose()).Methods("DELETE")
+	adminRoutes.Handle("/firehose/failed", s.ListFailedFirehose()).Methods("GET")
+	adminRoutes.Handle("/firehose/failed/replay", s.ReplayFailedFirehose()).Methods("POST")
+	adminRoutes.Handle("/firehose/failed/{id}/replay", s.ReplayFailedFirehose()).Methods("POST")
 
 	c := alice.New()
 	c = c.Append(s.authalice)
@@ -82,24 +88,87 @@ func (s *server) routes() {
 	s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
 	s.router.Handle("/webhook", c.Then(s.DeleteWebhook())).Methods("DELETE")
 	s.router.Handle("/webhook", c.Then(s.UpdateWebhook())).Methods("PUT")
+	s.router.Handle("/webhook/endpoints", c.Then(s.ListWebhooks())).Methods("GET")
+	s.router.Handle("/webhook/endpoints", c.Then(s.AddWebhookEndpoint())).Methods("POST")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.GetWebhookEndpoint())).Methods("GET")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.UpdateWebhookEndpoint())).Methods("PUT")
+	s.router.Handle("/webhook/endpoints/{id}", c.Then(s.DeleteWebhookEndpoint())).Methods("DELETE")
+	s.router.Handle("/webhook/failed", c.Then(s.ListFailedWebhooks())).Methods("GET")
+	s.router.Handle("/webhook/failed/replay", c.Then(s.ReplayFailedWebhooks())).Methods("POST")
+	s.router.Handle("/webhook/failed/{id}/replay", c.Then(s.ReplayFailedWebhook())).Methods("POST")
+	s.router.Handle("/webhook/deliveries", c.Then(s.ListWebhookDeliveries())).Methods("GET")
+	s.router.Handle("/webhook/test", c.Then(s.TestWebhook())).Methods("POST")
+	// The schema is public so receivers and code generators can fetch it
+	s.router.Handle("/webhook/schema/v2", s.GetWebhookSchema()).Methods("GET")
+
+	s.router.Handle("/sinks", c.Then(s.ListSinks())).Methods("GET")
+	s.router.Handle("/sinks", c.Then(s.AddSink())).Methods("POST")
+	s.router.Handle("/sinks/{id}", c.Then(s.GetSink())).Methods("GET")
+	s.router.Handle("/sinks/{id}", c.Then(s.UpdateSink())).Methods("PUT")
+	s.router.Handle("/sinks/{id}", c.Then(s.DeleteSink())).Methods("DELETE")
+	s.router.Handle("/sinks/{id}/test", c.Then(s.TestSink())).Methods("POST")
+
+	s.router.Handle("/events/stream", c.Then(s.StreamEvents())).Methods("GET")
+	s.router.Handle("/ws", c.Then(s.WebSocket())).Methods("GET")
 
 	s.router.Handle("/session/proxy", c.Then(s.SetProxy())).Methods("POST")
-
-	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
+	s.router.Handle("/session/s3/config", c.Then(s.GetS3Config())).Methods("GET")
+	s.router.Handle("/session/s3/config", c.Then(s.SetS3Config())).Methods("POST")
+	s.router.Handle("/session/s3/config", c.Then(s.DeleteS3Config())).Methods("DELETE")
+	s.router.Handle("/session/s3/test", c.Then(s.TestS3Config())).Methods("POST")
+	s.router.Handle("/session/queue", c.Then(s.GetCommandQueue())).Methods("GET")
+	s.router.Handle("/session/queue", c.Then(s.SetCommandQueue())).Methods("POST")
+	s.router.Handle("/session/queue", c.Then(s.DeleteCommandQueue())).Methods("DELETE")
+	s.router.Handle("/session/history", c.Then(s.GetMessageStore())).Methods("GET")
+	s.router.Handle("/session/history", c.Then(s.SetMessageStore())).Methods("POST")
+	s.router.Handle("/session/sendqueue", c.Then(s.GetSendQueueConfig())).Methods("GET")
+	s.router.Handle("/session/sendqueue", c.Then(s.SetSendQueueConfig())).Methods("POST")
+
+	s.router.Handle("/call/policy", c.Then(s.GetCallPolicy())).Methods("GET")
+	s.router.Handle("/call/policy", c.Then(s.SetCallPolicy())).Methods("POST")
+	s.router.Handle("/call/log", c.Then(s.ListCallLog())).Methods("GET")
+
+	// Send endpoints with an Idempotency-Key, or the Id of the new message,
+	// run once per key
+	send := c.Append(s.idempotent(true))
+	keyed := c.Append(s.idempotent(false))
+	// Media can be uploaded as multipart/form-data, with more time to read it
+	media := c.Append(multipartUploads, s.idempotent(true))
+
+	s.router.Handle("/chat/send/text", send.Then(s.queueable("send_text", s.SendMessage()))).Methods("POST")
 	s.router.Handle("/chat/delete", c.Then(s.DeleteMessage())).Methods("POST")
-	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
-	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
-	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
+	s.router.Handle("/chat/send/image", media.Then(s.queueable("send_image", s.SendImage()))).Methods("POST")
+	s.router.Handle("/chat/send/audio", media.Then(s.queueable("send_audio", s.SendAudio()))).Methods("POST")
+	s.router.Handle("/chat/send/document", media.Then(s.queueable("send_document", s.SendDocument()))).Methods("POST")
 	//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
-	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
-	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
-	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
-	s.router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
-	s.router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
-	s.router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
-	s.router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
-	s.router.Handle("/chat/send/poll", c.Then(s.SendPoll())).Methods("POST")
-	s.router.Handle("/chat/send/edit", c.Then(s.SendEditMessage())).Methods("POST")
+	s.router.Handle("/chat/send/video", media.Then(s.queueable("send_video", s.SendVideo()))).Methods("POST")
+	s.router.Handle("/chat/send/sticker", media.Then(s.queueable("send_sticker", s.SendSticker()))).Methods("POST")
+	s.router.Handle("/chat/send/location", send.Then(s.queueable("send_location", s.SendLocation()))).Methods("POST")
+	s.router.Handle("/chat/send/contact", send.Then(s.queueable("send_contact", s.SendContact()))).Methods("POST")
+	s.router.Handle("/chat/react", keyed.Then(s.React())).Methods("POST")
+	s.router.Handle("/chat/send/buttons", send.Then(s.queueable("send_buttons", s.SendButtons()))).Methods("POST")
+	s.router.Handle("/chat/send/list", send.Then(s.queueable("send_list", s.SendList()))).Methods("POST")
+	s.router.Handle("/chat/send/poll", send.Then(s.queueable("send_poll", s.SendPoll()))).Methods("POST")
+	s.router.Handle("/chat/send/edit", keyed.Then(s.SendEditMessage())).Methods("POST")
+	s.router.Handle("/chat/send/jobs", c.Then(s.ListSendJobs())).Methods("GET")
+	s.router.Handle("/chat/send/jobs/{id}", c.Then(s.GetSendJob())).Methods("GET")
+	s.router.Handle("/chat/send/jobs/{id}", c.Then(s.CancelSendJob())).Methods("DELETE")
+	s.router.Handle("/chat/schedule", send.Then(s.ScheduleMessage())).Methods("POST")
+	s.router.Handle("/chat/schedule", c.Then(s.ListScheduledMessages())).Methods("GET")
+	s.router.Handle("/chat/schedule/{id}", c.Then(s.RescheduleMessage())).Methods("PUT")
+	s.router.Handle("/chat/schedule/{id}", c.Then(s.CancelSendJob())).Methods("DELETE")
+	s.router.Handle("/campaigns", keyed.Then(s.CreateCampaign())).Methods("POST")
+	s.router.Handle("/campaigns", c.Then(s.ListCampaigns())).Methods("GET")
+	s.router.Handle("/campaigns/{id}", c.Then(s.GetCampaign())).Methods("GET")
+	s.router.Handle("/campaigns/{id}/pause", c.Then(s.UpdateCampaignStatus("pause"))).Methods("POST")
+	s.router.Handle("/campaigns/{id}/resume", c.Then(s.UpdateCampaignStatus("resume"))).Methods("POST")
+	s.router.Handle("/campaigns/{id}/cancel", c.Then(s.UpdateCampaignStatus("cancel"))).Methods("POST")
+	s.router.Handle("/campaigns/{id}/export", c.Then(s.ExportCampaign())).Methods("GET")
+	s.router.Handle("/chat/list", c.Then(s.ListChats())).Methods("GET")
+	s.router.Handle("/chat/history", c.Then(s.GetChatHistory())).Methods("GET")
+	s.router.Handle("/chat/search", c.Then(s.SearchMessages())).Methods("GET")
+	s.router.Handle("/chat/message/{id}", c.Then(s.GetStoredMessage())).Methods("GET")
+	s.router.Handle("/chat/message/{id}/status", c.Then(s.GetMessageStatus())).Methods("GET")
 
 	s.router.Handle("/user/presence", c.Then(s.SendPresence())).Methods("POST")
 	s.router.Handle("/user/info", c.Then(s.GetUser())).Methods("POST")
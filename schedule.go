@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// POST /chat/schedule takes the payload of a send endpoint with the type of
+// message and the send_at time, and stores it as a send job that the send
+// queue leaves alone until it is due. From then on it is sent like any
+// queued message, within the send queue limits, and its outcome is sent as
+// a SendJob event. Times without a zone are in the timezone set with TZ.
+
+const (
+	scheduleCheckInterval = time.Minute
+	maxScheduleAhead      = 365 * 24 * time.Hour
+)
+
+// Message types that can be scheduled, each sent with the send_<type> command
+var scheduleTypes = []string{"text", "image", "audio", "document", "video", "sticker", "location", "contact", "buttons", "list", "poll"}
+
+// Layouts accepted for send_at times without a zone
+var scheduleTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// Parses a send_at value: unix seconds, an RFC 3339 time, or a local time
+// without a zone
+func parseSendAt(value json.RawMessage) (time.Time, error) {
+	var seconds int64
+	if err := json.Unmarshal(value, &seconds); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	var text string
+	if err := json.Unmarshal(value, &text); err != nil {
+		return time.Time{}, errors.New("send_at must be a unix timestamp or a date and time")
+	}
+	text = strings.TrimSpace(text)
+	if seconds, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return t, nil
+	}
+	for _, layout := range scheduleTimeLayouts {
+		if t, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Could not parse send_at: %s", text)
+}
+
+// Checks that a scheduled time is in the future and not too far ahead
+func validateSendAt(sendAt time.Time) error {
+	now := time.Now()
+	if !sendAt.After(now) {
+		return errors.New("send_at must be in the future")
+	}
+	if sendAt.Sub(now) > maxScheduleAhead {
+		return fmt.Errorf("send_at must be within %d days", int(maxScheduleAhead.Hours()/24))
+	}
+	return nil
+}
+
+// Builds a scheduled send job from the body of a schedule request, the
+// type and send_at fields are removed from the payload
+func newScheduledJob(userID string, body []byte) (*SendJob, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, errors.New("Could not decode Payload")
+	}
+
+	msgtype := ""
+	var sendAtValue json.RawMessage
+	for key, value := range fields {
+		switch strings.ToLower(key) {
+		case "type":
+			json.Unmarshal(value, &msgtype)
+			delete(fields, key)
+		case "send_at":
+			sendAtValue = value
+			delete(fields, key)
+		}
+	}
+	msgtype = strings.ToLower(msgtype)
+	if msgtype == "" {
+		return nil, errors.New("Missing type in Payload")
+	}
+	if !Find(scheduleTypes, msgtype) {
+		return nil, fmt.Errorf("Invalid type: %s (allowed: %s)", msgtype, strings.Join(scheduleTypes, ", "))
+	}
+	if sendAtValue == nil {
+		return nil, errors.New("Missing send_at in Payload")
+	}
+	sendAt, err := parseSendAt(sendAtValue)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSendAt(sendAt); err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	job, err := newSendJob(userID, "send_"+msgtype, payload)
+	if err != nil {
+		return nil, err
+	}
+	job.SendAt = sendAt.Unix()
+	// Due jobs are sent in the order of their time
+	job.Seq = sendAt.UnixNano()
+	return job, nil
+}
+
+// Moves a scheduled job that is still queued to a new time, returns false
+// when there is no such job
+func rescheduleSendJob(db *sqlx.DB, userID string, id string, sendAt time.Time) (bool, error) {
+	result, err := db.Exec("UPDATE send_jobs SET send_at=$1, seq=$2 WHERE user_id=$3 AND id=$4 AND status=$5 AND send_at > 0",
+		sendAt.Unix(), sendAt.UnixNano(), userID, id, sendJobQueued)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
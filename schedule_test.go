@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSendAt(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC-3", -3*60*60)
+	defer func() { time.Local = local }()
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{`1767225600`, time.Unix(1767225600, 0)},
+		{`"1767225600"`, time.Unix(1767225600, 0)},
+		{`" 1767225600 "`, time.Unix(1767225600, 0)},
+		{`"2026-01-01T00:00:00Z"`, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{`"2026-01-01T09:30:00+05:30"`, time.Date(2026, 1, 1, 4, 0, 0, 0, time.UTC)},
+		// Times without a zone are in the local timezone
+		{`"2026-01-01T10:15:30"`, time.Date(2026, 1, 1, 13, 15, 30, 0, time.UTC)},
+		{`"2026-01-01T10:15"`, time.Date(2026, 1, 1, 13, 15, 0, 0, time.UTC)},
+		{`"2026-01-01 10:15:30"`, time.Date(2026, 1, 1, 13, 15, 30, 0, time.UTC)},
+		{`"2026-01-01 10:15"`, time.Date(2026, 1, 1, 13, 15, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseSendAt(json.RawMessage(tt.value))
+		if err != nil {
+			t.Errorf("parseSendAt(%s) error = %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseSendAt(%s) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	invalid := []struct {
+		value string
+		err   string
+	}{
+		{`true`, "must be a unix timestamp or a date and time"},
+		{`{"at":1}`, "must be a unix timestamp or a date and time"},
+		{`1.5`, "must be a unix timestamp or a date and time"},
+		{`"tomorrow"`, "Could not parse send_at: tomorrow"},
+		{`"2026-13-01 10:00"`, "Could not parse send_at"},
+		{`"01/02/2026 10:00"`, "Could not parse send_at"},
+		{`""`, "Could not parse send_at"},
+	}
+	for _, tt := range invalid {
+		_, err := parseSendAt(json.RawMessage(tt.value))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseSendAt(%s) error = %v, want %q", tt.value, err, tt.err)
+		}
+	}
+}
+
+func TestValidateSendAt(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		sendAt time.Time
+		err    string
+	}{
+		{"past", now.Add(-time.Hour), "must be in the future"},
+		{"now", now, "must be in the future"},
+		{"soon", now.Add(time.Minute), ""},
+		{"within a year", now.Add(364 * 24 * time.Hour), ""},
+		{"at the limit", now.Add(maxScheduleAhead - time.Minute), ""},
+		{"past the limit", now.Add(maxScheduleAhead + time.Minute), "must be within 365 days"},
+		{"years ahead", now.AddDate(5, 0, 0), "must be within 365 days"},
+	}
+	for _, tt := range tests {
+		err := validateSendAt(tt.sendAt)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: validateSendAt error = %v", tt.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: validateSendAt error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestNewScheduledJob(t *testing.T) {
+	sendAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	body := fmt.Sprintf(`{"Type":"text","send_at":%q,"Phone":"5491155554444","Body":"hi"}`, sendAt.Format(time.RFC3339))
+	job, err := newScheduledJob("u1", []byte(body))
+	if err != nil {
+		t.Fatalf("newScheduledJob error = %v", err)
+	}
+	if job.Action != "send_text" || job.SendAt != sendAt.Unix() || job.Seq != sendAt.UnixNano() {
+		t.Errorf("job = %s at %d seq %d, want send_text at %d", job.Action, job.SendAt, job.Seq, sendAt.Unix())
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(job.Payload), &payload)
+	if _, ok := payload["Type"]; ok {
+		t.Errorf("payload %s still has the type", job.Payload)
+	}
+	if _, ok := payload["send_at"]; ok {
+		t.Errorf("payload %s still has send_at", job.Payload)
+	}
+
+	invalid := []struct {
+		body string
+		err  string
+	}{
+		{`nope`, "Could not decode Payload"},
+		{`{"send_at":"2099-01-01T00:00:00Z","Phone":"1"}`, "Missing type"},
+		{`{"type":"fax","send_at":"2099-01-01T00:00:00Z","Phone":"1"}`, "Invalid type: fax"},
+		{`{"type":"text","Phone":"1","Body":"hi"}`, "Missing send_at"},
+		{`{"type":"text","send_at":1,"Phone":"1","Body":"hi"}`, "must be in the future"},
+	}
+	for _, tt := range invalid {
+		_, err := newScheduledJob("u1", []byte(tt.body))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("newScheduledJob(%s) error = %v, want %q", tt.body, err, tt.err)
+		}
+	}
+}
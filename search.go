@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Stored messages are searched with the full-text index of the database:
+// an FTS5 table kept in sync by triggers on SQLite and a generated tsvector
+// column on Postgres. The text or caption and the file name of documents
+// are indexed. Every word of the query must match, words are prefixes, so
+// "invo" finds "invoice.pdf". Results are ordered from the newest and paged
+// with an opaque cursor.
+//
+// Snippets are HTML: the database marks the matching words with private use
+// characters, then the text is escaped and the marked words that match the
+// query are put between <b> tags.
+
+const (
+	searchSnippetStart = "<b>"
+	searchSnippetEnd   = "</b>"
+	searchMarkStart    = "\uE000"
+	searchMarkEnd      = "\uE001"
+	maxSearchTerms     = 16
+)
+
+var searchTermPattern = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+// Filters of a message search, empty fields match everything
+type MessageSearch struct {
+	Query  string
+	Chat   string
+	Sender string
+	Kind   string
+	From   int64
+	To     int64
+	Limit  int
+	Cursor *searchCursor
+}
+
+// Position after the last result of a page
+type searchCursor struct {
+	SentAt int64  `json:"t"`
+	Chat   string `json:"c"`
+	Id     string `json:"i"`
+}
+
+// One search result, the snippet is escaped HTML with the matching words
+// between <b> tags
+type SearchResult struct {
+	StoredMessage
+	Snippet string `db:"snippet" json:"snippet"`
+}
+
+func (c searchCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(value string) (*searchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cursor searchCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Chat == "" || cursor.Id == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// Returns the lowercased words of a search query
+func searchTerms(query string) []string {
+	return searchTermPattern.FindAllString(strings.ToLower(query), maxSearchTerms)
+}
+
+// Builds the full-text query for the database driver, every term is a prefix
+func fullTextQuery(driver string, terms []string) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		if driver == "sqlite" {
+			parts[i] = `"` + term + `"*`
+		} else {
+			parts[i] = term + ":*"
+		}
+	}
+	if driver == "sqlite" {
+		return strings.Join(parts, " ")
+	}
+	return strings.Join(parts, " & ")
+}
+
+// Searches the stored messages of a user. Returns the results and the
+// cursor of the next page, empty on the last page.
+func searchMessages(db *sqlx.DB, userID string, search MessageSearch) ([]SearchResult, string, error) {
+	terms := searchTerms(search.Query)
+	if len(terms) == 0 {
+		return nil, "", errors.New("query has no words to search for")
+	}
+
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	columns := "m." + strings.ReplaceAll(storedMessageColumns, ", ", ", m.")
+	var query string
+	if db.DriverName() == "sqlite" {
+		query = fmt.Sprintf("SELECT %s, snippet(messages_fts, -1, '%s', '%s', '…', 16) AS snippet FROM messages_fts JOIN messages m ON m.rowid = messages_fts.rowid WHERE messages_fts MATCH %s",
+			columns, searchMarkStart, searchMarkEnd, arg(fullTextQuery("sqlite", terms)))
+	} else {
+		tsquery := "to_tsquery('simple', " + arg(fullTextQuery("postgres", terms)) + ")"
+		query = fmt.Sprintf("SELECT %s, ts_headline('simple', m.text || ' ' || m.file_name, %s, 'StartSel=%s, StopSel=%s, MaxWords=32, MinWords=8') AS snippet FROM messages m WHERE m.search_vector @@ %s",
+			columns, tsquery, searchMarkStart, searchMarkEnd, tsquery)
+	}
+
+	query += " AND m.user_id=" + arg(userID)
+	if search.Chat != "" {
+		query += " AND m.chat=" + arg(search.Chat)
+	}
+	if search.Sender != "" {
+		query += " AND m.sender=" + arg(search.Sender)
+	}
+	if search.Kind != "" {
+		query += " AND m.kind=" + arg(search.Kind)
+	}
+	if search.From > 0 {
+		query += " AND m.sent_at >= " + arg(search.From)
+	}
+	if search.To > 0 {
+		query += " AND m.sent_at <= " + arg(search.To)
+	}
+	if search.Cursor != nil {
+		query += fmt.Sprintf(" AND (m.sent_at, m.chat, m.id) < (%s, %s, %s)",
+			arg(search.Cursor.SentAt), arg(search.Cursor.Chat), arg(search.Cursor.Id))
+	}
+	// One more row than asked tells if there is a next page
+	query += " ORDER BY m.sent_at DESC, m.chat DESC, m.id DESC LIMIT " + arg(search.Limit+1)
+
+	results := []SearchResult{}
+	if err := db.Select(&results, query, args...); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(results) > search.Limit {
+		results = results[:search.Limit]
+		last := results[len(results)-1]
+		next = searchCursor{SentAt: last.SentAt, Chat: last.Chat, Id: last.Id}.encode()
+	}
+	for i := range results {
+		results[i].decodePayload()
+		results[i].Snippet = highlightSnippet(results[i].Snippet, terms)
+	}
+	return results, next, nil
+}
+
+// Escapes a snippet marked by the database and highlights the marked words
+// that start with a search term. Marks sent in messages are dropped.
+func highlightSnippet(marked string, terms []string) string {
+	unmark := strings.NewReplacer(searchMarkStart, "", searchMarkEnd, "")
+	var b strings.Builder
+	rest := marked
+	for {
+		start := strings.Index(rest, searchMarkStart)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], searchMarkEnd)
+		if end < 0 {
+			break
+		}
+		end += start
+		b.WriteString(html.EscapeString(unmark.Replace(rest[:start])))
+		word := unmark.Replace(rest[start:end])
+		if matchesSearchTerm(word, terms) {
+			b.WriteString(searchSnippetStart + html.EscapeString(word) + searchSnippetEnd)
+		} else {
+			b.WriteString(html.EscapeString(word))
+		}
+		rest = rest[end+len(searchMarkEnd):]
+	}
+	b.WriteString(html.EscapeString(unmark.Replace(rest)))
+	return b.String()
+}
+
+func matchesSearchTerm(word string, terms []string) bool {
+	word = strings.ToLower(word)
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"Invoice #42", []string{"invoice", "42"}},
+		{`"drop" OR table*; --`, []string{"drop", "or", "table"}},
+		{"  año  Ñandú ", []string{"año", "ñandú"}},
+		{"*** ---", nil},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if got := searchTerms(strings.Repeat("word ", maxSearchTerms+5)); len(got) != maxSearchTerms {
+		t.Errorf("searchTerms kept %d terms, want %d", len(got), maxSearchTerms)
+	}
+}
+
+func TestFullTextQuery(t *testing.T) {
+	terms := []string{"invoice", "42"}
+	if got := fullTextQuery("sqlite", terms); got != `"invoice"* "42"*` {
+		t.Errorf("sqlite query = %s", got)
+	}
+	if got := fullTextQuery("postgres", terms); got != "invoice:* & 42:*" {
+		t.Errorf("postgres query = %s", got)
+	}
+	if got := fullTextQuery("sqlite", []string{"one"}); got != `"one"*` {
+		t.Errorf("sqlite query of one term = %s", got)
+	}
+}
+
+func TestDecodeSearchCursor(t *testing.T) {
+	cursor := searchCursor{SentAt: 1767225600, Chat: "5491155554444@s.whatsapp.net", Id: "MSG1"}
+	decoded, err := decodeSearchCursor(cursor.encode())
+	if err != nil || *decoded != cursor {
+		t.Errorf("decoded cursor = %+v, %v, want %+v", decoded, err, cursor)
+	}
+
+	encode := func(value string) string { return base64.RawURLEncoding.EncodeToString([]byte(value)) }
+	for _, value := range []string{
+		"not base64!",
+		encode("not json"),
+		encode(`{"t":1,"c":"chat"}`),
+		encode(`{"t":1,"i":"MSG1"}`),
+		encode(`{"t":"x","c":"chat","i":"MSG1"}`),
+		"",
+	} {
+		if _, err := decodeSearchCursor(value); err == nil || err.Error() != "invalid cursor" {
+			t.Errorf("decodeSearchCursor(%q) error = %v", value, err)
+		}
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	terms := []string{"invo", "pay"}
+	mark := func(word string) string { return searchMarkStart + word + searchMarkEnd }
+	tests := []struct {
+		marked string
+		want   string
+	}{
+		{"Your " + mark("invoice") + " is here", "Your <b>invoice</b> is here"},
+		{mark("Invoices") + " to " + mark("PAY") + "…", "<b>Invoices</b> to <b>PAY</b>…"},
+		{"no marks", "no marks"},
+		// The text is escaped, tags are only added around matching words
+		{`<img src=x onerror="alert(1)"> ` + mark("invoice"), `&lt;img src=x onerror=&#34;alert(1)&#34;&gt; <b>invoice</b>`},
+		{mark("<i>invoice</i>"), "&lt;i&gt;invoice&lt;/i&gt;"},
+		{mark("other") + " " + mark("invoice & co"), "other <b>invoice &amp; co</b>"},
+		// Marks in the message itself can not open or close tags
+		{"a " + searchMarkStart + "invoice", "a invoice"},
+		{"a" + searchMarkEnd + " " + mark("pay") + searchMarkEnd, "a <b>pay</b>"},
+		{mark(searchMarkStart + "invoice"), "<b>invoice</b>"},
+	}
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.marked, terms); got != tt.want {
+			t.Errorf("highlightSnippet(%q) = %q, want %q", tt.marked, got, tt.want)
+		}
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	db := newTestDB(t)
+	contact := types.NewJID("5491155554444", types.DefaultUserServer)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	sentAt := time.Unix(1767225600, 0)
+	save := func(userID string, chat types.JID, id string, minutes int, msg *waE2E.Message) {
+		evt := storeTestMessage(chat, contact, id, sentAt.Add(time.Duration(minutes)*time.Minute), msg)
+		if err := saveMessage(db, userID, evt, messageSourceLive, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text := func(body string) *waE2E.Message { return &waE2E.Message{Conversation: proto.String(body)} }
+	save("u1", contact, "MSG1", 1, text("Your invoice is attached"))
+	save("u1", contact, "MSG2", 2, text("Second invoice, please pay"))
+	save("u1", group, "MSG3", 3, text("Invoices for the group"))
+	save("u1", contact, "MSG4", 4, &waE2E.Message{DocumentMessage: &waE2E.DocumentMessage{FileName: proto.String("invoice-march.pdf"), Mimetype: proto.String("application/pdf")}})
+	save("u1", contact, "MSG5", 5, text("Nothing to see"))
+	save("u2", contact, "MSG6", 6, text("Invoice of another user"))
+	save("u3", contact, "MSG7", 7, text(`<script>alert("invoice")</script>`))
+
+	ids := func(results []SearchResult) []string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.Id)
+		}
+		return ids
+	}
+
+	results, next, err := searchMessages(db, "u1", MessageSearch{Query: "invo", Limit: 10})
+	if err != nil {
+		t.Fatalf("searchMessages error = %v", err)
+	}
+	if got := ids(results); !reflect.DeepEqual(got, []string{"MSG4", "MSG3", "MSG2", "MSG1"}) || next != "" {
+		t.Errorf("search for invo = %v, next %q", got, next)
+	}
+	if snippet := results[2].Snippet; !strings.Contains(snippet, searchSnippetStart+"invoice"+searchSnippetEnd) {
+		t.Errorf("snippet = %q", snippet)
+	}
+	if results[2].Message == nil {
+		t.Error("result has no message")
+	}
+	results, _, err = searchMessages(db, "u3", MessageSearch{Query: "invoice", Limit: 10})
+	if err != nil || len(results) != 1 || strings.Contains(results[0].Snippet, "<script>") || !strings.Contains(results[0].Snippet, "&lt;script&gt;") {
+		t.Errorf("snippet of a message with HTML = %v, %v", results, err)
+	}
+
+	// Every term must match, filters narrow the results
+	filtered := []struct {
+		search MessageSearch
+		want   []string
+	}{
+		{MessageSearch{Query: "invoice pay", Limit: 10}, []string{"MSG2"}},
+		{MessageSearch{Query: "invoice", Chat: group.String(), Limit: 10}, []string{"MSG3"}},
+		{MessageSearch{Query: "invoice", Kind: "document", Limit: 10}, []string{"MSG4"}},
+		{MessageSearch{Query: "invoice", From: sentAt.Add(2 * time.Minute).Unix(), To: sentAt.Add(3 * time.Minute).Unix(), Limit: 10}, []string{"MSG3", "MSG2"}},
+		{MessageSearch{Query: "missing", Limit: 10}, nil},
+	}
+	for _, tt := range filtered {
+		results, _, err := searchMessages(db, "u1", tt.search)
+		if got := ids(results); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("search %+v = %v, %v, want %v", tt.search, got, err, tt.want)
+		}
+	}
+
+	// Pages follow the cursor
+	var pages [][]string
+	search := MessageSearch{Query: "invoice", Limit: 3}
+	for {
+		results, next, err := searchMessages(db, "u1", search)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, ids(results))
+		if next == "" {
+			break
+		}
+		if search.Cursor, err = decodeSearchCursor(next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(pages, [][]string{{"MSG4", "MSG3", "MSG2"}, {"MSG1"}}) {
+		t.Errorf("pages = %v", pages)
+	}
+
+	if _, _, err := searchMessages(db, "u1", MessageSearch{Query: "?!", Limit: 10}); err == nil {
+		t.Error("search without words should fail")
+	}
+}
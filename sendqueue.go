@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+)
+
+// Send endpoints called with ?queue=true store the request as a send job and
+// return at once with the job id and the message id the message will have.
+// Each user has a worker that sends the queued jobs through the same
+// handlers, spacing them to the configured messages per minute plus a random
+// jitter, and waiting the recipient interval between two messages to the
+// same chat. Jobs for one chat are sent in the order they were queued, a
+// chat that has to wait does not hold back the others. Jobs wait while the
+// user is not connected. The outcome of each job is sent as a SendJob event.
+//
+// Messages sent without the queue, through the REST API, WebSocket or
+// broker commands, wait for their turn under the same limits, so everything
+// the session sends counts. REST and WebSocket sends that would wait more
+// than directSendMaxWait are refused instead.
+//
+// Jobs are kept in the database, so they survive restarts. A job that was
+// being sent when wuzapi stopped is marked as failed instead of being sent
+// twice.
+//
+// Scheduled messages are send jobs with a send_at time, the worker leaves
+// them in the queue until they are due.
+
+const (
+	defaultSendRate              = 20
+	defaultSendRecipientInterval = 5
+	defaultSendJitter            = 3
+	maxSendRate                  = 600
+	maxSendRecipientInterval     = 3600
+	maxSendJitter                = 600
+
+	sendJobQueued    = "queued"
+	sendJobSending   = "sending"
+	sendJobSent      = "sent"
+	sendJobFailed    = "failed"
+	sendJobCancelled = "cancelled"
+
+	sendQueueBatchSize  = 100
+	sendQueueRetryDelay = 5 * time.Second
+	directSendMaxWait   = time.Minute
+)
+
+var (
+	sendQueue          = NewSendQueue()
+	sendqueueconfcache = cache.New(5*time.Minute, 10*time.Minute)
+	sendJobStatuses    = []string{sendJobQueued, sendJobSending, sendJobSent, sendJobFailed, sendJobCancelled}
+)
+
+type SendQueueConfig struct {
+	UserId            string `db:"user_id"`
+	MessagesPerMinute int    `db:"messages_per_minute"`
+	RecipientInterval int    `db:"recipient_interval"`
+	Jitter            int    `db:"jitter"`
+	UpdatedAt         int64  `db:"updated_at"`
+}
+
+const sendQueueConfigColumns = "user_id, messages_per_minute, recipient_interval, jitter, updated_at"
+
+func (c SendQueueConfig) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"messages_per_minute": c.MessagesPerMinute,
+		"recipient_interval":  c.RecipientInterval,
+		"jitter":              c.Jitter,
+		"updated_at":          c.UpdatedAt,
+	}
+}
+
+func (c SendQueueConfig) validate() error {
+	if c.MessagesPerMinute < 1 || c.MessagesPerMinute > maxSendRate {
+		return fmt.Errorf("messages_per_minute must be between 1 and %d", maxSendRate)
+	}
+	if c.RecipientInterval < 0 || c.RecipientInterval > maxSendRecipientInterval {
+		return fmt.Errorf("recipient_interval must be between 0 and %d seconds", maxSendRecipientInterval)
+	}
+	if c.Jitter < 0 || c.Jitter > maxSendJitter {
+		return fmt.Errorf("jitter must be between 0 and %d seconds", maxSendJitter)
+	}
+	return nil
+}
+
+// Time to wait after a message before sending the next one
+func (c SendQueueConfig) delay() time.Duration {
+	delay := time.Minute / time.Duration(c.MessagesPerMinute)
+	if c.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.Jitter) * int64(time.Second)))
+	}
+	return delay
+}
+
+// Returns the send queue settings of a user, the defaults when none are set
+func getSendQueueConfig(db *sqlx.DB, userID string) SendQueueConfig {
+	if cached, found := sendqueueconfcache.Get(userID); found {
+		return cached.(SendQueueConfig)
+	}
+	config := SendQueueConfig{
+		UserId:            userID,
+		MessagesPerMinute: defaultSendRate,
+		RecipientInterval: defaultSendRecipientInterval,
+		Jitter:            defaultSendJitter,
+	}
+	err := db.Get(&config, "SELECT "+sendQueueConfigColumns+" FROM send_queue_config WHERE user_id=$1", userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load send queue settings")
+		return config
+	}
+	sendqueueconfcache.Set(userID, config, cache.DefaultExpiration)
+	return config
+}
+
+// A send request waiting in the queue, or its outcome
+type SendJob struct {
+	Id         string          `db:"id" json:"id"`
+	UserId     string          `db:"user_id" json:"-"`
+	Action     string          `db:"action" json:"action"`
+	Chat       string          `db:"chat" json:"chat"`
+	MessageId  string          `db:"message_id" json:"message_id"`
+	Payload    string          `db:"payload" json:"-"`
+	Status     string          `db:"status" json:"status"`
+	Code       int             `db:"code" json:"code"`
+	Response   string          `db:"response" json:"-"`
+	Data       json.RawMessage `db:"-" json:"data,omitempty"`
+	Error      string          `db:"error" json:"error"`
+	Seq        int64           `db:"seq" json:"-"`
+	SendAt     int64           `db:"send_at" json:"send_at"`
+	CampaignId string          `db:"campaign_id" json:"campaign_id,omitempty"`
+	CreatedAt  int64           `db:"created_at" json:"created_at"`
+	FinishedAt int64           `db:"finished_at" json:"finished_at"`
+}
+
+const sendJobColumns = "id, user_id, action, chat, message_id, payload, status, code, response, error, seq, send_at, campaign_id, created_at, finished_at"
+
+// Queued jobs of a user that are not held by a paused campaign
+const sendJobWaiting = "user_id=$1 AND status=$2 AND campaign_id NOT IN (SELECT id FROM campaigns WHERE user_id=$1 AND status='" + campaignPaused + "')"
+
+// Fills in the data field of the API responses from the stored response
+func (j *SendJob) decodeResponse() {
+	if j.Response != "" && json.Valid([]byte(j.Response)) {
+		j.Data = json.RawMessage(j.Response)
+	}
+}
+
+// Builds a send job from the body of a send request. The recipient is taken
+// from the Phone (or group) field, and the message id is set in the payload
+// when the request has none, so it is known before the message is sent.
+func newSendJob(userID string, action string, body []byte) (*SendJob, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, errors.New("Could not decode Payload")
+	}
+
+	recipient := ""
+	msgid := ""
+	for key, value := range fields {
+		var text string
+		if json.Unmarshal(value, &text) != nil {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "phone", "group":
+			recipient = text
+		case "id":
+			msgid = text
+			delete(fields, key)
+		}
+	}
+	if recipient == "" {
+		return nil, errors.New("Missing Phone in Payload")
+	}
+	chat, ok := parseJID(recipient)
+	if !ok {
+		return nil, errors.New("Could not parse Phone")
+	}
+	if msgid == "" {
+		msgid = whatsmeow.GenerateMessageID()
+	}
+	fields["Id"], _ = json.Marshal(msgid)
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := GenerateRandomID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &SendJob{
+		Id:        id,
+		UserId:    userID,
+		Action:    action,
+		Chat:      chat.ToNonAD().String(),
+		MessageId: msgid,
+		Payload:   string(payload),
+		Status:    sendJobQueued,
+		Seq:       now.UnixNano(),
+		CreatedAt: now.Unix(),
+	}, nil
+}
+
+// Wraps a send handler so the request is queued when called with
+// ?queue=true, the action is the command that sends it later
+func (s *server) queueable(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		if queue, _ := strconv.ParseBool(r.URL.Query().Get("queue")); !queue {
+			// Uploads only count against the rate, the recipient is in the form
+			chat := ""
+			if !isMultipartRequest(r) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					s.Respond(w, r, http.StatusBadRequest, errors.New("Could not read Payload"))
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				chat = payloadChat(body)
+			}
+			if err := sendQueue.waitTurn(r.Context(), s, txtid, chat, directSendMaxWait); err != nil {
+				s.Respond(w, r, http.StatusTooManyRequests, err)
+				return
+			}
+			next(w, r)
+			return
+		}
+		if isMultipartRequest(r) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Uploaded files cannot be queued, send the media as an http(s) URL or base64 data"))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not read Payload"))
+			return
+		}
+		job, err := newSendJob(txtid, action, body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if err := sendQueue.Enqueue(s, job); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not queue message: %v", err)))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Str("job", job.Id).Str("id", job.MessageId).Msg("Message queued")
+		response := map[string]interface{}{"Details": "Queued", "JobId": job.Id, "Id": job.MessageId}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusAccepted, string(responseJson))
+		}
+	}
+}
+
+// Returns the chat a send payload is for, from its Phone (or group) field,
+// or an empty string
+func payloadChat(body []byte) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return ""
+	}
+	for key, value := range fields {
+		var text string
+		if json.Unmarshal(value, &text) != nil {
+			continue
+		}
+		if key := strings.ToLower(key); text != "" && (key == "phone" || key == "group") {
+			if chat, ok := parseJID(text); ok {
+				return chat.ToNonAD().String()
+			}
+		}
+	}
+	return ""
+}
+
+// Runs a command received outside of the queue, sends wait for their turn
+// like direct REST sends. Commands without a maxWait wait as long as needed.
+func (s *server) runDirectCommand(ctx context.Context, userinfo Values, cmd Command, maxWait time.Duration) CommandResult {
+	if strings.HasPrefix(cmd.Action, "send_") {
+		if err := sendQueue.waitTurn(ctx, s, userinfo.Get("Id"), payloadChat(cmd.Payload), maxWait); err != nil {
+			return commandError(cmd, http.StatusTooManyRequests, err)
+		}
+	}
+	return s.runCommand(ctx, userinfo, cmd)
+}
+
+// The worker of a user, which also holds its rate limits. It is kept after
+// it stops while they still apply, so they hold for the next message.
+// The limits are guarded by the lock of the SendQueue.
+type sendWorker struct {
+	wake     chan struct{}
+	running  bool
+	next     time.Time
+	lastChat map[string]time.Time
+	// When the rate limits of a stopped worker have passed
+	until time.Time
+}
+
+// SendQueue keeps the worker of each user with queued jobs or a pending
+// rate limit
+type SendQueue struct {
+	sync.Mutex
+	workers map[string]*sendWorker
+}
+
+func NewSendQueue() *SendQueue {
+	return &SendQueue{workers: make(map[string]*sendWorker)}
+}
+
+// Stores a job and wakes the worker of its user
+func (q *SendQueue) Enqueue(s *server, job *SendJob) error {
+	_, err := s.db.Exec("INSERT INTO send_jobs ("+sendJobColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, 0, '', '', $8, $9, $10, $11, 0)",
+		job.Id, job.UserId, job.Action, job.Chat, job.MessageId, job.Payload, job.Status, job.Seq, job.SendAt, job.CampaignId, job.CreatedAt)
+	if err != nil {
+		return err
+	}
+	q.wake(s, job.UserId)
+	return nil
+}
+
+// Returns the worker of a user, adding a stopped one when it has none.
+// Called with the lock held.
+func (q *SendQueue) worker(userID string) *sendWorker {
+	w, ok := q.workers[userID]
+	if !ok {
+		w = &sendWorker{wake: make(chan struct{}, 1), lastChat: make(map[string]time.Time)}
+		q.workers[userID] = w
+	}
+	return w
+}
+
+// Takes the next send slot of a user for a message to chat, after the rate
+// and the recipient interval of the messages before it, and returns when it
+// is. No slot is taken when it is more than maxWait away, if maxWait is set.
+func (q *SendQueue) reserve(s *server, userID string, chat string, maxWait time.Duration) (time.Time, bool) {
+	config := getSendQueueConfig(s.db, userID)
+	interval := time.Duration(config.RecipientInterval) * time.Second
+	q.Lock()
+	defer q.Unlock()
+	w := q.worker(userID)
+	now := time.Now()
+	slot := now
+	if w.next.After(slot) {
+		slot = w.next
+	}
+	if last, ok := w.lastChat[chat]; ok && chat != "" && last.Add(interval).After(slot) {
+		slot = last.Add(interval)
+	}
+	if maxWait > 0 && slot.Sub(now) > maxWait {
+		return slot, false
+	}
+	w.next = slot.Add(config.delay())
+	until := w.next
+	if chat != "" {
+		w.lastChat[chat] = slot
+		if slot.Add(interval).After(until) {
+			until = slot.Add(interval)
+		}
+	}
+	if !w.running && until.After(w.until) {
+		w.until = until
+	}
+	return slot, true
+}
+
+// Waits for a send slot of the user before sending a message outside of
+// the queue
+func (q *SendQueue) waitTurn(ctx context.Context, s *server, userID string, chat string, maxWait time.Duration) error {
+	slot, ok := q.reserve(s, userID, chat, maxWait)
+	if !ok {
+		return fmt.Errorf("Rate limit reached, the message could be sent in %d seconds, queue it with ?queue=true", int(time.Until(slot).Seconds()+1))
+	}
+	if wait := time.Until(slot); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// Starts the worker of a user, or wakes it when it is running
+func (q *SendQueue) wake(s *server, userID string) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	for id, idle := range q.workers {
+		if !idle.running && !now.Before(idle.until) {
+			delete(q.workers, id)
+		}
+	}
+	w := q.worker(userID)
+	if w.running {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	w.running = true
+	go q.run(s, userID, w)
+}
+
+// Fails the jobs interrupted by a restart and starts the workers of the
+// users with queued jobs
+func (q *SendQueue) Resume(s *server) {
+	campaigns := []string{}
+	if err := s.db.Select(&campaigns, "SELECT DISTINCT campaign_id FROM send_jobs WHERE status=$1 AND campaign_id != ''", sendJobSending); err != nil {
+		log.Error().Err(err).Msg("Could not load interrupted send jobs")
+	}
+	_, err := s.db.Exec("UPDATE send_jobs SET status=$1, error=$2, finished_at=$3 WHERE status=$4",
+		sendJobFailed, "interrupted by a restart, the message may have been sent", time.Now().Unix(), sendJobSending)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not update interrupted send jobs")
+	}
+	// The interrupted job may have been the last one of its campaign
+	for _, id := range campaigns {
+		finishCampaign(s.db, id)
+	}
+	users := []string{}
+	if err := s.db.Select(&users, "SELECT DISTINCT user_id FROM send_jobs WHERE status=$1", sendJobQueued); err != nil {
+		log.Error().Err(err).Msg("Could not load send queue")
+		return
+	}
+	for _, userID := range users {
+		q.wake(s, userID)
+	}
+}
+
+// Sends the queued jobs of a user as they become due, returns when there
+// are none left
+func (q *SendQueue) run(s *server, userID string, w *sendWorker) {
+	for {
+		jobs := []SendJob{}
+		err := s.db.Select(&jobs, "SELECT "+sendJobColumns+" FROM send_jobs WHERE "+sendJobWaiting+" AND send_at <= $3 ORDER BY seq LIMIT $4",
+			userID, sendJobQueued, time.Now().Unix(), sendQueueBatchSize)
+		if err != nil {
+			log.Error().Err(err).Str("userid", userID).Msg("Could not load send queue")
+			w.sleep(sendQueueRetryDelay)
+			continue
+		}
+		if len(jobs) == 0 {
+			// Wait for the next scheduled job, if any
+			var sendAt int64
+			err := s.db.Get(&sendAt, "SELECT COALESCE(MIN(send_at), 0) FROM send_jobs WHERE "+sendJobWaiting, userID, sendJobQueued)
+			if err != nil {
+				log.Error().Err(err).Str("userid", userID).Msg("Could not load send queue")
+				w.sleep(sendQueueRetryDelay)
+				continue
+			}
+			if sendAt > 0 {
+				wait := time.Until(time.Unix(sendAt, 0))
+				if wait > scheduleCheckInterval {
+					wait = scheduleCheckInterval
+				}
+				w.sleep(wait)
+				continue
+			}
+			config := getSendQueueConfig(s.db, userID)
+			// Jobs queued after the select have woken the worker
+			q.Lock()
+			select {
+			case <-w.wake:
+				q.Unlock()
+				continue
+			default:
+			}
+			w.running = false
+			w.until = w.next
+			for _, last := range w.lastChat {
+				if until := last.Add(time.Duration(config.RecipientInterval) * time.Second); until.After(w.until) {
+					w.until = until
+				}
+			}
+			if !time.Now().Before(w.until) {
+				delete(q.workers, userID)
+			}
+			q.Unlock()
+			return
+		}
+
+		config := getSendQueueConfig(s.db, userID)
+		client := clientManager.GetWhatsmeowClient(userID)
+		now := time.Now()
+		if client == nil || !client.IsConnected() || !client.IsLoggedIn() {
+			w.sleep(sendQueueRetryDelay)
+			continue
+		}
+		// Direct sends take slots too, so the limits are checked and the
+		// slot taken at once
+		q.Lock()
+		var job *SendJob
+		wait := w.next.Sub(now)
+		if wait <= 0 {
+			job, wait = w.pick(jobs, time.Duration(config.RecipientInterval)*time.Second, now)
+		}
+		if job != nil {
+			w.lastChat[job.Chat] = now
+			w.next = now.Add(config.delay())
+		}
+		q.Unlock()
+		if job == nil {
+			w.sleep(wait)
+			continue
+		}
+		q.send(s, userID, job)
+	}
+}
+
+// Returns the oldest job whose chat is not waiting for the recipient
+// interval, or how long to wait for one
+func (w *sendWorker) pick(jobs []SendJob, interval time.Duration, now time.Time) (*SendJob, time.Duration) {
+	for chat, last := range w.lastChat {
+		if now.Sub(last) >= interval {
+			delete(w.lastChat, chat)
+		}
+	}
+	wait := sendQueueRetryDelay
+	seen := make(map[string]bool)
+	for i := range jobs {
+		if seen[jobs[i].Chat] {
+			continue
+		}
+		seen[jobs[i].Chat] = true
+		last, ok := w.lastChat[jobs[i].Chat]
+		if !ok {
+			return &jobs[i], 0
+		}
+		if ready := last.Add(interval).Sub(now); ready < wait {
+			wait = ready
+		}
+	}
+	return nil, wait
+}
+
+func (w *sendWorker) sleep(d time.Duration) {
+	select {
+	case <-w.wake:
+	case <-time.After(d):
+	}
+}
+
+// Sends a job through its handler and records the outcome
+func (q *SendQueue) send(s *server, userID string, job *SendJob) {
+	result, err := s.db.Exec("UPDATE send_jobs SET status=$1 WHERE id=$2 AND status=$3 AND send_at <= $4", sendJobSending, job.Id, sendJobQueued, time.Now().Unix())
+	if err != nil {
+		log.Error().Err(err).Str("job", job.Id).Msg("Could not update send job")
+		return
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		// Cancelled or rescheduled after it was loaded
+		return
+	}
+
+	var token string
+	if err := s.db.Get(&token, "SELECT token FROM users WHERE id=$1", userID); err != nil {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load user for send job")
+	}
+	userinfo := Values{map[string]string{"Id": userID, "Token": token}}
+	if cached, found := userinfocache.Get(token); found {
+		userinfo = cached.(Values)
+	}
+	cmd := Command{Id: job.Id, Action: job.Action, Payload: json.RawMessage(job.Payload)}
+	res := s.runCommand(context.Background(), userinfo, cmd)
+
+	job.Status = sendJobSent
+	if !res.Success {
+		job.Status = sendJobFailed
+		log.Warn().Str("userid", userID).Str("job", job.Id).Str("error", res.Error).Msg("Queued message failed")
+	}
+	job.Code = res.Code
+	job.Data = res.Data
+	job.Response = string(res.Data)
+	job.Error = res.Error
+	job.FinishedAt = time.Now().Unix()
+	_, err = s.db.Exec("UPDATE send_jobs SET status=$1, code=$2, response=$3, error=$4, finished_at=$5 WHERE id=$6",
+		job.Status, job.Code, job.Response, job.Error, job.FinishedAt, job.Id)
+	if err != nil {
+		log.Error().Err(err).Str("job", job.Id).Msg("Could not update send job")
+	}
+
+	if job.CampaignId != "" {
+		finishCampaign(s.db, job.CampaignId)
+	}
+	if mycli := clientManager.GetMyClient(userID); mycli != nil {
+		mycli.myEventHandler(job)
+	}
+}
+
+// Cancels a queued job, returns false when the job is not queued
+func cancelSendJob(db *sqlx.DB, userID string, id string) (bool, error) {
+	result, err := db.Exec("UPDATE send_jobs SET status=$1, finished_at=$2 WHERE user_id=$3 AND id=$4 AND status=$5",
+		sendJobCancelled, time.Now().Unix(), userID, id, sendJobQueued)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func deleteUserSendJobs(db sqlx.Ext, userID string) error {
+	if _, err := db.Exec("DELETE FROM send_jobs WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM send_queue_config WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	sendqueueconfcache.Delete(userID)
+	return nil
+}
+
+// Removes the jobs that finished before -statusretention, the jobs of a
+// campaign are removed with the campaign
+func purgeSendJobs(db *sqlx.DB) {
+	if *statusRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-*statusRetention).Unix()
+	result, err := db.Exec("DELETE FROM send_jobs WHERE status IN ($1, $2, $3) AND finished_at < $4 AND campaign_id = ''", sendJobSent, sendJobFailed, sendJobCancelled, cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to purge send jobs")
+		return
+	}
+	if purged, err := result.RowsAffected(); err == nil && purged > 0 {
+		log.Info().Int64("purged", purged).Msg("Purged old send jobs")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func insertSendJob(t *testing.T, db *sqlx.DB, job SendJob) {
+	t.Helper()
+	named := ":" + strings.ReplaceAll(sendJobColumns, ", ", ", :")
+	if _, err := db.NamedExec("INSERT INTO send_jobs ("+sendJobColumns+") VALUES ("+named+")", job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendQueueConfig(t *testing.T) {
+	config := SendQueueConfig{MessagesPerMinute: 60}
+	if d := config.delay(); d != time.Second {
+		t.Errorf("delay without jitter = %v, want 1s", d)
+	}
+
+	// The jitter is added to the delay of the rate
+	config.Jitter = 2
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 200; i++ {
+		d := config.delay()
+		if d < time.Second || d >= 3*time.Second {
+			t.Fatalf("delay with 2s of jitter = %v, want between 1s and 3s", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("delay with jitter is always the same")
+	}
+
+	valid := []SendQueueConfig{
+		{MessagesPerMinute: 1},
+		{MessagesPerMinute: maxSendRate, RecipientInterval: maxSendRecipientInterval, Jitter: maxSendJitter},
+	}
+	for _, c := range valid {
+		if err := c.validate(); err != nil {
+			t.Errorf("validate(%+v) error = %v", c, err)
+		}
+	}
+	invalid := []SendQueueConfig{
+		{MessagesPerMinute: 0},
+		{MessagesPerMinute: maxSendRate + 1},
+		{MessagesPerMinute: 1, RecipientInterval: -1},
+		{MessagesPerMinute: 1, RecipientInterval: maxSendRecipientInterval + 1},
+		{MessagesPerMinute: 1, Jitter: -1},
+		{MessagesPerMinute: 1, Jitter: maxSendJitter + 1},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("validate(%+v) should fail", c)
+		}
+	}
+}
+
+func TestNewSendJob(t *testing.T) {
+	job, err := newSendJob("u1", "send_text", []byte(`{"Phone":"+5491155554444","Body":"hi"}`))
+	if err != nil {
+		t.Fatalf("newSendJob error = %v", err)
+	}
+	var payload map[string]string
+	json.Unmarshal([]byte(job.Payload), &payload)
+	if job.Chat != "5491155554444@s.whatsapp.net" || job.Status != sendJobQueued || job.MessageId == "" || payload["Id"] != job.MessageId {
+		t.Errorf("job = %+v", job)
+	}
+
+	// The message id of the request is kept, under a single key
+	job, err = newSendJob("u1", "send_image", []byte(`{"group":"120363000000000000@g.us","id":"MSG1"}`))
+	if err != nil || job.Chat != "120363000000000000@g.us" || job.MessageId != "MSG1" {
+		t.Fatalf("job with id = %+v, %v", job, err)
+	}
+	if strings.Contains(job.Payload, `"id"`) || !strings.Contains(job.Payload, `"Id":"MSG1"`) {
+		t.Errorf("payload = %s", job.Payload)
+	}
+
+	invalid := map[string]string{
+		`nope`:                 "Could not decode Payload",
+		`{"Body":"hi"}`:        "Missing Phone",
+		`{"Phone":1}`:          "Missing Phone",
+		`{"Phone":"@g.us"}`:    "Could not parse Phone",
+		`{"Phone":"",  "x":1}`: "Missing Phone",
+	}
+	for body, want := range invalid {
+		if _, err := newSendJob("u1", "send_text", []byte(body)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("newSendJob(%s) error = %v, want %q", body, err, want)
+		}
+	}
+}
+
+func TestSendWorkerPick(t *testing.T) {
+	now := time.Now()
+	interval := 10 * time.Second
+	jobs := []SendJob{
+		{Id: "a1", Chat: "a"},
+		{Id: "a2", Chat: "a"},
+		{Id: "b1", Chat: "b"},
+		{Id: "c1", Chat: "c"},
+		{Id: "b2", Chat: "b"},
+	}
+	w := &sendWorker{lastChat: map[string]time.Time{
+		"a": now.Add(-3 * time.Second),
+		"b": now.Add(-8 * time.Second),
+		"d": now.Add(-time.Minute),
+	}}
+
+	// Chats waiting for the interval do not hold back the others, and each
+	// chat gets its oldest job
+	job, wait := w.pick(jobs, interval, now)
+	if job == nil || job.Id != "c1" || wait != 0 {
+		t.Fatalf("pick = %v, %v, want c1", job, wait)
+	}
+	if _, ok := w.lastChat["d"]; ok {
+		t.Error("chat past the interval is still tracked")
+	}
+
+	w.lastChat["c"] = now
+	job, wait = w.pick(jobs, interval, now)
+	if job != nil || wait != 2*time.Second {
+		t.Errorf("pick with every chat waiting = %v, %v, want a wait of 2s", job, wait)
+	}
+
+	job, _ = w.pick(jobs, interval, now.Add(2*time.Second))
+	if job == nil || job.Id != "b1" {
+		t.Errorf("pick once b is ready = %v, want b1", job)
+	}
+	job, _ = w.pick(jobs, interval, now.Add(7*time.Second))
+	if job == nil || job.Id != "a1" {
+		t.Errorf("pick once a and b are ready = %v, want a1", job)
+	}
+
+	// The wait is capped, so new jobs are seen
+	w = &sendWorker{lastChat: map[string]time.Time{"a": now}}
+	job, wait = w.pick(jobs[:2], time.Hour, now)
+	if job != nil || wait != sendQueueRetryDelay {
+		t.Errorf("pick with a long interval = %v, %v, want a wait of %v", job, wait, sendQueueRetryDelay)
+	}
+	if job, _ := (&sendWorker{lastChat: map[string]time.Time{}}).pick(nil, interval, now); job != nil {
+		t.Errorf("pick without jobs = %v", job)
+	}
+}
+
+func TestSendWorkerKeepsRateLimits(t *testing.T) {
+	db := newTestDB(t)
+	s := &server{db: db}
+	q := NewSendQueue()
+	now := time.Now()
+	newWorker := func(userID string, next time.Time, lastChat time.Time) *sendWorker {
+		w := &sendWorker{wake: make(chan struct{}, 1), running: true, next: next, lastChat: map[string]time.Time{"a": lastChat}}
+		q.workers[userID] = w
+		return w
+	}
+
+	// Stopped workers are kept while the rate or the recipient interval
+	// still apply
+	waitingRate := newWorker("rate", now.Add(time.Hour), now.Add(-time.Hour))
+	q.run(s, "rate", waitingRate)
+	if waitingRate.running || !waitingRate.until.Equal(now.Add(time.Hour)) || q.workers["rate"] != waitingRate {
+		t.Errorf("worker waiting for the rate = running %v until %v", waitingRate.running, waitingRate.until)
+	}
+	waitingChat := newWorker("chat", now.Add(-time.Second), now)
+	q.run(s, "chat", waitingChat)
+	if want := now.Add(defaultSendRecipientInterval * time.Second); !waitingChat.until.Equal(want) || q.workers["chat"] != waitingChat {
+		t.Errorf("worker waiting for a chat = until %v, want %v", waitingChat.until, want)
+	}
+	done := newWorker("done", now.Add(-time.Second), now.Add(-time.Hour))
+	q.run(s, "done", done)
+	if _, ok := q.workers["done"]; ok {
+		t.Error("worker without pending limits is kept")
+	}
+
+	// Waking a user prunes the workers whose limits have passed
+	q.Lock()
+	waitingChat.until = now.Add(-time.Second)
+	q.Unlock()
+	q.wake(s, "rate")
+	waitForSendWorkers(t, q, "rate")
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.workers["chat"]; ok {
+		t.Error("worker whose limits passed is kept")
+	}
+	if w := q.workers["rate"]; w != waitingRate || !w.next.Equal(now.Add(time.Hour)) {
+		t.Error("restarted worker lost its rate limit")
+	}
+}
+
+// Waits until the workers of the users are stopped
+func waitForSendWorkers(t *testing.T, q *SendQueue, users ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		running := false
+		q.Lock()
+		for _, userID := range users {
+			if w, ok := q.workers[userID]; ok && w.running {
+				running = true
+			}
+		}
+		q.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workers of %v are still running", users)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendQueueResume(t *testing.T) {
+	db := newTestDB(t)
+	s := &server{db: db}
+	q := NewSendQueue()
+	for _, job := range []SendJob{
+		{Id: "j1", UserId: "u1", Action: "send_text", Chat: "a", Status: sendJobQueued, Seq: 1},
+		{Id: "j2", UserId: "u1", Action: "send_text", Chat: "a", Status: sendJobSending, Seq: 2},
+		{Id: "j3", UserId: "u2", Action: "send_text", Chat: "a", Status: sendJobSent, Seq: 3},
+		{Id: "j4", UserId: "u3", Action: "send_text", Chat: "a", Status: sendJobSending, Seq: 4},
+	} {
+		insertSendJob(t, db, job)
+	}
+
+	q.Resume(s)
+	statuses := make(map[string]SendJob)
+	jobs := []SendJob{}
+	if err := db.Select(&jobs, "SELECT "+sendJobColumns+" FROM send_jobs"); err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		statuses[job.Id] = job
+	}
+	// Jobs being sent when wuzapi stopped are not sent twice
+	for _, id := range []string{"j2", "j4"} {
+		if job := statuses[id]; job.Status != sendJobFailed || !strings.Contains(job.Error, "interrupted by a restart") || job.FinishedAt == 0 {
+			t.Errorf("interrupted job %s = %s %q", id, job.Status, job.Error)
+		}
+	}
+	if statuses["j1"].Status != sendJobQueued || statuses["j3"].Status != sendJobSent {
+		t.Errorf("other jobs = %s, %s", statuses["j1"].Status, statuses["j3"].Status)
+	}
+
+	// Only users with queued jobs get a worker
+	q.Lock()
+	_, u1 := q.workers["u1"]
+	others := len(q.workers)
+	q.Unlock()
+	if !u1 || others != 1 {
+		t.Errorf("Resume started %d workers, want the one of u1", others)
+	}
+
+	// Without a WhatsApp session the job waits in the queue
+	db.Exec("UPDATE send_jobs SET status=$1 WHERE id=$2", sendJobCancelled, "j1")
+	q.wake(s, "u1")
+	waitForSendWorkers(t, q, "u1")
+}
+
+func TestPayloadChat(t *testing.T) {
+	tests := map[string]string{
+		`{"Phone":"+5491155554444","Body":"hi"}`:     "5491155554444@s.whatsapp.net",
+		`{"phone":"5491155554444:3@s.whatsapp.net"}`: "5491155554444@s.whatsapp.net",
+		`{"Group":"120363000000000000@g.us"}`:        "120363000000000000@g.us",
+		`{"Phone":""}`:                               "",
+		`{"Phone":1}`:                                "",
+		`{"Body":"hi"}`:                              "",
+		`nope`:                                       "",
+	}
+	for body, want := range tests {
+		if got := payloadChat([]byte(body)); got != want {
+			t.Errorf("payloadChat(%s) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+func setSendQueueConfig(t *testing.T, config SendQueueConfig) {
+	sendqueueconfcache.Set(config.UserId, config, 0)
+	t.Cleanup(func() { sendqueueconfcache.Delete(config.UserId) })
+}
+
+func TestSendQueueReserve(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	q := NewSendQueue()
+	setSendQueueConfig(t, SendQueueConfig{UserId: "u1", MessagesPerMinute: 60, RecipientInterval: 10})
+	start := time.Now()
+	near := func(got time.Time, want time.Time) bool {
+		return !got.Before(want) && got.Sub(want) < 100*time.Millisecond
+	}
+
+	first, ok := q.reserve(s, "u1", "a", 0)
+	if !ok || !near(first, start) {
+		t.Fatalf("first slot = %v, %v, want now", first.Sub(start), ok)
+	}
+	// Every message waits for the rate, messages to the same chat for the
+	// recipient interval
+	if slot, _ := q.reserve(s, "u1", "b", 0); !near(slot, first.Add(time.Second)) {
+		t.Errorf("slot for another chat = %v, want 1s", slot.Sub(first))
+	}
+	third, _ := q.reserve(s, "u1", "a", 0)
+	if !near(third, first.Add(10*time.Second)) {
+		t.Errorf("slot for the same chat = %v, want 10s", third.Sub(first))
+	}
+
+	// Slots too far away are not taken
+	if slot, ok := q.reserve(s, "u1", "a", 5*time.Second); ok || !near(slot, third.Add(10*time.Second)) {
+		t.Errorf("slot past the wait = %v, %v, want 20s and refused", slot.Sub(first), ok)
+	}
+	// Messages without a known chat only wait for the rate
+	if slot, _ := q.reserve(s, "u1", "", 0); !slot.Equal(third.Add(time.Second)) {
+		t.Errorf("slot without chat = %v, want 11s", slot.Sub(first))
+	}
+
+	q.Lock()
+	w := q.workers["u1"]
+	if w.running || !w.next.Equal(third.Add(2*time.Second)) || len(w.lastChat) != 2 {
+		t.Errorf("worker = running %v, next %v, %d chats", w.running, w.next.Sub(first), len(w.lastChat))
+	}
+	// The stopped worker is kept until its limits pass
+	if !w.until.Equal(third.Add(10 * time.Second)) {
+		t.Errorf("worker kept until %v, want 20s", w.until.Sub(first))
+	}
+	q.Unlock()
+}
+
+func TestSendQueueWaitTurn(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	q := NewSendQueue()
+	setSendQueueConfig(t, SendQueueConfig{UserId: "u1", MessagesPerMinute: 600})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := q.waitTurn(context.Background(), s, "u1", "a", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("three sends at 600 per minute took %v, want 200ms", elapsed)
+	}
+
+	q.reserve(s, "u1", "", time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.waitTurn(ctx, s, "u1", "a", time.Second); err != context.DeadlineExceeded {
+		t.Errorf("waitTurn with a cancelled request = %v", err)
+	}
+	if err := q.waitTurn(context.Background(), s, "u1", "a", 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "Rate limit reached") {
+		t.Errorf("waitTurn past the maximum wait = %v", err)
+	}
+}
+
+func TestRunDirectCommand(t *testing.T) {
+	s := &server{db: newTestDB(t)}
+	setSendQueueConfig(t, SendQueueConfig{UserId: "u1", MessagesPerMinute: 1})
+	userinfo := Values{map[string]string{"Id": "u1"}}
+	queue := sendQueue
+	sendQueue = NewSendQueue()
+	defer func() { sendQueue = queue }()
+
+	// The first send takes the slot of the minute
+	send := Command{Id: "1", Action: "send_text", Payload: json.RawMessage(`{"Phone":"5491155554444","Body":"hi"}`)}
+	if res := s.runDirectCommand(context.Background(), userinfo, send, time.Second); res.Code == http.StatusTooManyRequests {
+		t.Fatalf("first send = %d %s", res.Code, res.Error)
+	}
+	if res := s.runDirectCommand(context.Background(), userinfo, send, time.Second); res.Code != http.StatusTooManyRequests || res.Id != "1" {
+		t.Errorf("second send = %d %s, want 429", res.Code, res.Error)
+	}
+	// Other commands are not limited
+	presence := Command{Id: "2", Action: "presence", Payload: json.RawMessage(`{"type":"available"}`)}
+	if res := s.runDirectCommand(context.Background(), userinfo, presence, time.Second); res.Code == http.StatusTooManyRequests {
+		t.Errorf("presence = %d %s", res.Code, res.Error)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nats-io/nats.go"
+	"github.com/patrickmn/go-cache"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Event sinks publish the events built by myEventHandler to a message bus
+// (NATS, Redis Streams or AMQP 0.9.1) instead of posting them over HTTP.
+// Users register their own sinks in the event_sinks table, and global sinks
+// configured from the environment receive the events of every user, like
+// the firehose. The subject, stream or routing key of each event comes from
+// a template where {user} is replaced with the user id and {type} with the
+// event type.
+//
+// Every sink has its own queue and worker, which keeps the connection to the
+// broker open and retries failed publishes. Events are dropped when the
+// queue is full, so a slow broker never blocks the WhatsApp event loop.
+
+const (
+	sinkTypeNATS  = "nats"
+	sinkTypeRedis = "redis"
+	sinkTypeAMQP  = "amqp"
+
+	defaultNATSSubject     = "wuzapi.{user}.{type}"
+	defaultRedisStream     = "wuzapi:{user}:{type}"
+	defaultAMQPRoutingKey  = "{user}.{type}"
+	defaultAMQPExchange    = "wuzapi"
+	globalSinkPrefix       = "global-"
+	sinkQueueSize          = 1024
+	sinkPublishTimeout     = 10 * time.Second
+	sinkMaxAttempts        = 5
+	redisSinkStreamMaxLen  = 100000
+	sinkReconnectBaseDelay = time.Second
+)
+
+var (
+	sinkcache      = cache.New(5*time.Minute, 10*time.Minute)
+	globalSinks    []SinkConfig
+	sinkDispatcher = NewSinkDispatcher()
+)
+
+type SinkConfig struct {
+	Id          string `db:"id"`
+	UserId      string `db:"user_id"`
+	Type        string `db:"type"`
+	URL         string `db:"url"`
+	Subject     string `db:"subject"`
+	Exchange    string `db:"exchange"`
+	Events      string `db:"events"`
+	Enabled     bool   `db:"enabled"`
+	Description string `db:"description"`
+	Schema      string `db:"schema"`
+	Filter      string `db:"filter"`
+	CreatedAt   int64  `db:"created_at"`
+}
+
+const sinkColumns = "id, user_id, type, url, subject, exchange, events, enabled, description, schema, filter, created_at"
+
+// Checks if the sink is subscribed to the given event type
+func (sc SinkConfig) Subscribed(eventType string) bool {
+	events := strings.Split(sc.Events, ",")
+	return Find(events, eventType) || Find(events, "All")
+}
+
+// Returns the subject, stream or routing key for an event
+func (sc SinkConfig) SubjectFor(userID string, eventType string) string {
+	return strings.NewReplacer("{user}", userID, "{type}", eventType).Replace(sc.Subject)
+}
+
+// The url is returned without its password, sink settings are shown to the
+// user but the broker credentials are not
+func (sc SinkConfig) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          sc.Id,
+		"type":        sc.Type,
+		"url":         redactURL(sc.URL),
+		"subject":     sc.Subject,
+		"exchange":    sc.Exchange,
+		"events":      strings.Split(sc.Events, ","),
+		"enabled":     sc.Enabled,
+		"description": sc.Description,
+		"schema":      sc.Schema,
+		"filter":      eventFilterJSON(sc.Filter),
+		"created_at":  sc.CreatedAt,
+	}
+}
+
+// Checks the type and url of a sink and fills in the default subject and
+// exchange
+func (sc *SinkConfig) validate() error {
+	switch sc.Type {
+	case sinkTypeNATS:
+		if sc.Subject == "" {
+			sc.Subject = defaultNATSSubject
+		}
+		sc.Exchange = ""
+	case sinkTypeRedis:
+		if sc.Subject == "" {
+			sc.Subject = defaultRedisStream
+		}
+		sc.Exchange = ""
+	case sinkTypeAMQP:
+		if sc.Subject == "" {
+			sc.Subject = defaultAMQPRoutingKey
+		}
+		if sc.Exchange == "" {
+			sc.Exchange = defaultAMQPExchange
+		}
+	default:
+		return fmt.Errorf("invalid sink type: %s (allowed: nats, redis, amqp)", sc.Type)
+	}
+
+	if err := validateBrokerURL(sc.Type, sc.URL); err != nil {
+		return err
+	}
+	if strings.ContainsAny(sc.Subject, " \t\r\n") {
+		return errors.New("sink subject cannot contain whitespace")
+	}
+	if strings.ContainsAny(sc.Exchange, " \t\r\n") {
+		return errors.New("sink exchange cannot contain whitespace")
+	}
+	return nil
+}
+
+// Checks that a broker url is valid and uses a scheme of its broker type
+func validateBrokerURL(brokerType string, rawURL string) error {
+	schemes := map[string][]string{
+		sinkTypeNATS:  {"nats", "tls", "ws", "wss"},
+		sinkTypeRedis: {"redis", "rediss"},
+		sinkTypeAMQP:  {"amqp", "amqps"},
+	}[brokerType]
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return errors.New("invalid broker url")
+	}
+	if !Find(schemes, u.Scheme) {
+		return fmt.Errorf("%s url must use %s", brokerType, strings.Join(schemes, ", "))
+	}
+	return nil
+}
+
+// Returns a url with its password replaced, for display and logging
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// Returns the enabled sinks of a user
+func getUserSinks(db *sqlx.DB, userID string) []SinkConfig {
+	if cached, found := sinkcache.Get(userID); found {
+		return cached.([]SinkConfig)
+	}
+	var sinks []SinkConfig
+	err := db.Select(&sinks, "SELECT "+sinkColumns+" FROM event_sinks WHERE user_id=$1 AND enabled=1 ORDER BY created_at", userID)
+	if err != nil {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load event sinks")
+		return nil
+	}
+	sinkcache.Set(userID, sinks, cache.DefaultExpiration)
+	return sinks
+}
+
+// Removes all the sinks of a user and stops their workers
+func deleteUserSinks(db sqlx.Ext, userID string) error {
+	var ids []string
+	err := sqlx.Select(db, &ids, "SELECT id FROM event_sinks WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM event_sinks WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		sinkDispatcher.Remove(id)
+	}
+	sinkcache.Delete(userID)
+	return nil
+}
+
+// Reads the global sinks from the environment, one per broker type
+func loadGlobalSinks() ([]SinkConfig, error) {
+	events, err := validateWebhookEvents(splitEnvList(os.Getenv("SINK_EVENTS")))
+	if err != nil {
+		return nil, err
+	}
+	schema, err := validateWebhookSchema(os.Getenv("SINK_SCHEMA"))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []SinkConfig{
+		{Type: sinkTypeNATS, URL: os.Getenv("SINK_NATS_URL"), Subject: os.Getenv("SINK_NATS_SUBJECT")},
+		{Type: sinkTypeRedis, URL: os.Getenv("SINK_REDIS_URL"), Subject: os.Getenv("SINK_REDIS_STREAM")},
+		{Type: sinkTypeAMQP, URL: os.Getenv("SINK_AMQP_URL"), Subject: os.Getenv("SINK_AMQP_ROUTING_KEY"), Exchange: os.Getenv("SINK_AMQP_EXCHANGE")},
+	}
+	var sinks []SinkConfig
+	for _, sc := range candidates {
+		if sc.URL == "" {
+			continue
+		}
+		sc.Id = globalSinkPrefix + sc.Type
+		sc.Events = events
+		sc.Enabled = true
+		sc.Schema = schema
+		if err := sc.validate(); err != nil {
+			return nil, fmt.Errorf("global %s sink: %w", sc.Type, err)
+		}
+		sinks = append(sinks, sc)
+	}
+	return sinks, nil
+}
+
+// Splits a comma separated environment variable, empty gives no items
+func splitEnvList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// A message published to a sink. Data is the event encoded in the schema of
+// the sink, the other fields are sent as message headers or stream fields.
+type SinkMessage struct {
+	EventID      string
+	EventType    string
+	InstanceID   string
+	InstanceName string
+	Data         []byte
+}
+
+// EventSink is a connection to a message broker
+type EventSink interface {
+	Publish(ctx context.Context, subject string, msg SinkMessage) error
+	Close() error
+}
+
+// Connects to the broker of a sink
+func newEventSink(ctx context.Context, sc SinkConfig) (EventSink, error) {
+	var sink EventSink
+	var err error
+	switch sc.Type {
+	case sinkTypeNATS:
+		sink, err = newNATSSink(ctx, sc.URL)
+	case sinkTypeRedis:
+		sink, err = newRedisSink(ctx, sc.URL)
+	case sinkTypeAMQP:
+		sink, err = newAMQPSink(ctx, sc.URL, sc.Exchange)
+	default:
+		err = fmt.Errorf("invalid sink type: %s", sc.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+type natsSink struct {
+	conn *nats.Conn
+}
+
+func newNATSSink(ctx context.Context, rawURL string) (*natsSink, error) {
+	timeout := sinkPublishTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	conn, err := nats.Connect(rawURL, nats.Name("wuzapi"), nats.Timeout(timeout))
+	if err != nil {
+		return nil, err
+	}
+	return &natsSink{conn: conn}, nil
+}
+
+// Publishes with the event id as Nats-Msg-Id, so JetStream streams drop
+// the duplicates of a retried publish. The flush waits for the server to
+// have received the message.
+func (s *natsSink) Publish(ctx context.Context, subject string, msg SinkMessage) error {
+	m := nats.NewMsg(subject)
+	m.Data = msg.Data
+	m.Header.Set(nats.MsgIdHdr, msg.EventID)
+	m.Header.Set("Wuzapi-Event-Type", msg.EventType)
+	m.Header.Set("Wuzapi-Instance-Id", msg.InstanceID)
+	m.Header.Set("Wuzapi-Instance-Name", msg.InstanceName)
+	if err := s.conn.PublishMsg(m); err != nil {
+		return err
+	}
+	return s.conn.FlushWithContext(ctx)
+}
+
+func (s *natsSink) Close() error {
+	s.conn.Close()
+	return nil
+}
+
+type redisSink struct {
+	client *redis.Client
+}
+
+func newRedisSink(ctx context.Context, rawURL string) (*redisSink, error) {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisSink{client: client}, nil
+}
+
+// Adds the event to the stream, trimmed to about redisSinkStreamMaxLen
+// entries so streams nobody reads do not grow forever
+func (s *redisSink) Publish(ctx context.Context, stream string, msg SinkMessage) error {
+	return s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: redisSinkStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"id":            msg.EventID,
+			"type":          msg.EventType,
+			"instance_id":   msg.InstanceID,
+			"instance_name": msg.InstanceName,
+			"data":          string(msg.Data),
+		},
+	}).Err()
+}
+
+func (s *redisSink) Close() error {
+	return s.client.Close()
+}
+
+type amqpSink struct {
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	exchange string
+}
+
+// Opens a channel in confirm mode and declares the exchange as a durable
+// topic exchange. The predefined amq.* exchanges cannot be declared, they
+// are used as they are.
+func newAMQPSink(ctx context.Context, rawURL string, exchange string) (*amqpSink, error) {
+	config := amqp.Config{Properties: amqp.NewConnectionProperties()}
+	config.Properties.SetClientConnectionName("wuzapi")
+	if deadline, ok := ctx.Deadline(); ok {
+		config.Dial = amqp.DefaultDial(time.Until(deadline))
+	}
+	conn, err := amqp.DialConfig(rawURL, config)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err == nil && !strings.HasPrefix(exchange, "amq.") {
+		err = channel.ExchangeDeclare(exchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	}
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &amqpSink{conn: conn, channel: channel, exchange: exchange}, nil
+}
+
+// Publishes a persistent message and waits for the broker to confirm it
+func (s *amqpSink) Publish(ctx context.Context, routingKey string, msg SinkMessage) error {
+	confirmation, err := s.channel.PublishWithDeferredConfirmWithContext(ctx, s.exchange, routingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.EventID,
+		Type:         msg.EventType,
+		AppId:        "wuzapi",
+		Timestamp:    time.Now(),
+		Headers: amqp.Table{
+			"instance_id":   msg.InstanceID,
+			"instance_name": msg.InstanceName,
+		},
+		Body: msg.Data,
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message was rejected by the broker")
+	}
+	return nil
+}
+
+func (s *amqpSink) Close() error {
+	return s.conn.Close()
+}
+
+type sinkJob struct {
+	subject string
+	msg     SinkMessage
+}
+
+type sinkWorker struct {
+	config SinkConfig
+	queue  chan sinkJob
+}
+
+// SinkDispatcher keeps one worker per sink id. A worker is replaced when
+// the configuration of its sink changes, the old one delivers what it has
+// queued and closes its connection.
+type SinkDispatcher struct {
+	sync.Mutex
+	workers map[string]*sinkWorker
+}
+
+func NewSinkDispatcher() *SinkDispatcher {
+	return &SinkDispatcher{workers: make(map[string]*sinkWorker)}
+}
+
+// Queues an event for a sink, without waiting for it to be published
+func (d *SinkDispatcher) Publish(sc SinkConfig, userID string, msg SinkMessage) {
+	d.Lock()
+	defer d.Unlock()
+
+	worker, ok := d.workers[sc.Id]
+	if ok && worker.config != sc {
+		close(worker.queue)
+		ok = false
+	}
+	if !ok {
+		worker = &sinkWorker{config: sc, queue: make(chan sinkJob, sinkQueueSize)}
+		d.workers[sc.Id] = worker
+		go worker.run()
+	}
+
+	select {
+	case worker.queue <- sinkJob{subject: sc.SubjectFor(userID, msg.EventType), msg: msg}:
+	default:
+		log.Warn().Str("sink", sc.Id).Str("type", msg.EventType).Str("id", msg.EventID).Msg("Event sink queue is full, dropping event")
+	}
+}
+
+// Stops the worker of a removed sink
+func (d *SinkDispatcher) Remove(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if worker, ok := d.workers[id]; ok {
+		close(worker.queue)
+		delete(d.workers, id)
+	}
+}
+
+func (w *sinkWorker) run() {
+	var sink EventSink
+	defer func() {
+		if sink != nil {
+			sink.Close()
+		}
+	}()
+
+	for job := range w.queue {
+		for attempt := 1; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), sinkPublishTimeout)
+			var err error
+			if sink == nil {
+				sink, err = newEventSink(ctx, w.config)
+			}
+			if err == nil {
+				err = sink.Publish(ctx, job.subject, job.msg)
+			}
+			cancel()
+			if err == nil {
+				log.Debug().Str("sink", w.config.Id).Str("subject", job.subject).Str("id", job.msg.EventID).Msg("Event published to sink")
+				break
+			}
+
+			// Reconnect on the next attempt, the connection may be broken
+			if sink != nil {
+				sink.Close()
+				sink = nil
+			}
+			if attempt >= sinkMaxAttempts {
+				log.Error().Err(err).Str("sink", w.config.Id).Str("subject", job.subject).Str("id", job.msg.EventID).Msg("Could not publish event to sink, dropping it")
+				break
+			}
+			log.Warn().Err(err).Str("sink", w.config.Id).Int("attempt", attempt).Msg("Could not publish event to sink, retrying")
+			time.Sleep(sinkReconnectBaseDelay * time.Duration(1<<(attempt-1)))
+		}
+	}
+}
+
+// Publishes an event to the sinks of the user and to the global sinks that
+// are subscribed to it, returns how many sinks it was queued for
+func publishToSinks(db *sqlx.DB, userID string, eventType string, fields map[string]interface{}, encoder *eventEncoder) int {
+	userSinks := getUserSinks(db, userID)
+	sinks := make([]SinkConfig, 0, len(userSinks)+len(globalSinks))
+	sinks = append(append(sinks, userSinks...), globalSinks...)
+	queued := 0
+	for _, sc := range sinks {
+		if !sc.Subscribed(eventType) || !getEventFilter(sc.Filter).Match(fields) {
+			continue
+		}
+		data, err := encoder.Encode(sc.Schema)
+		if err != nil {
+			log.Error().Err(err).Str("sink", sc.Id).Msg("Failed to marshal postmap to JSON")
+			continue
+		}
+		sinkDispatcher.Publish(sc, userID, SinkMessage{
+			EventID:      encoder.eventID,
+			EventType:    eventType,
+			InstanceID:   encoder.instanceID,
+			InstanceName: encoder.instanceName,
+			Data:         data,
+		})
+		queued++
+	}
+	return queued
+}
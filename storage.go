@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Incoming media can be offloaded to S3 compatible storage instead of being
+// sent base64 encoded in the webhook payload. Each user can configure a
+// bucket, otherwise the global storage configured with the S3_* environment
+// variables is used when set. Objects are stored as
+// <prefix>/<user id>/<chat>/<yyyy>/<mm>/<dd>/<message id><ext> and can be
+// expired with a bucket lifecycle rule scoped to the prefix.
+
+const (
+	defaultS3Prefix    = "wuzapi"
+	defaultS3URLExpiry = 24 * 60 * 60
+	// Presigned URLs can not be valid for more than 7 days
+	maxS3URLExpiry = 7 * 24 * 60 * 60
+	// Uploads run in the event handler of the session, which receives no
+	// other events meanwhile, slower uploads fall back to base64
+	s3UploadTimeout = 20 * time.Second
+)
+
+var (
+	storagecache  = cache.New(5*time.Minute, 10*time.Minute)
+	globalStorage *mediaStorage
+
+	objectKeyPartPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	objectKeyExtPattern  = regexp.MustCompile(`^\.[A-Za-z0-9]{1,10}$`)
+)
+
+type S3Config struct {
+	Enabled       bool   `db:"enabled"`
+	Endpoint      string `db:"endpoint"`
+	Region        string `db:"region"`
+	Bucket        string `db:"bucket"`
+	AccessKey     string `db:"access_key"`
+	SecretKey     string `db:"secret_key"`
+	UseSSL        bool   `db:"use_ssl"`
+	PathStyle     bool   `db:"path_style"`
+	Prefix        string `db:"prefix"`
+	RetentionDays int    `db:"retention_days"`
+	URLExpiry     int    `db:"url_expiry"`
+	UpdatedAt     int64  `db:"updated_at"`
+}
+
+const s3ConfigColumns = "enabled, endpoint, region, bucket, access_key, secret_key, use_ssl, path_style, prefix, retention_days, url_expiry, updated_at"
+
+func (c S3Config) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":        c.Enabled,
+		"endpoint":       c.Endpoint,
+		"region":         c.Region,
+		"bucket":         c.Bucket,
+		"access_key":     c.AccessKey,
+		"secret_key_set": c.SecretKey != "",
+		"use_ssl":        c.UseSSL,
+		"path_style":     c.PathStyle,
+		"prefix":         c.Prefix,
+		"retention_days": c.RetentionDays,
+		"url_expiry":     c.URLExpiry,
+		"updated_at":     c.UpdatedAt,
+	}
+}
+
+// Checks the configuration and fills in the defaults
+func (c *S3Config) validate() error {
+	// The endpoint can also be given as an URL, its scheme selects TLS
+	if strings.Contains(c.Endpoint, "://") {
+		endpoint, err := url.Parse(c.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return errors.New("invalid endpoint, use host[:port] or an http(s) URL")
+		}
+		if endpoint.Path != "" && endpoint.Path != "/" {
+			return errors.New("endpoint must not have a path, set the bucket and prefix instead")
+		}
+		c.Endpoint = endpoint.Host
+		c.UseSSL = endpoint.Scheme == "https"
+	}
+	if c.Endpoint == "" {
+		return errors.New("missing endpoint")
+	}
+	if c.Bucket == "" {
+		return errors.New("missing bucket")
+	}
+	c.Prefix = strings.Trim(c.Prefix, "/")
+	if c.Prefix == "" {
+		c.Prefix = defaultS3Prefix
+	}
+	if c.RetentionDays < 0 {
+		return errors.New("retention_days can not be negative")
+	}
+	if c.URLExpiry == 0 {
+		c.URLExpiry = defaultS3URLExpiry
+	}
+	if c.URLExpiry < 1 || c.URLExpiry > maxS3URLExpiry {
+		return fmt.Errorf("url_expiry must be between 1 and %d seconds", maxS3URLExpiry)
+	}
+	return nil
+}
+
+type mediaStorage struct {
+	config S3Config
+	client *minio.Client
+	// Prefix of the objects covered by the lifecycle rule
+	scope string
+}
+
+func newMediaStorage(config S3Config, scope string) (*mediaStorage, error) {
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       config.UseSSL,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mediaStorage{config: config, client: client, scope: scope}, nil
+}
+
+// Loads the global storage from the environment, nil when S3_BUCKET is not set
+func loadGlobalStorage() (*mediaStorage, error) {
+	if os.Getenv("S3_BUCKET") == "" {
+		return nil, nil
+	}
+	config := S3Config{
+		Enabled:   true,
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+		PathStyle: os.Getenv("S3_PATH_STYLE") == "true",
+		Prefix:    os.Getenv("S3_PREFIX"),
+	}
+	var err error
+	if v := os.Getenv("S3_RETENTION_DAYS"); v != "" {
+		if config.RetentionDays, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid S3_RETENTION_DAYS: %w", err)
+		}
+	}
+	if v := os.Getenv("S3_URL_EXPIRY"); v != "" {
+		if config.URLExpiry, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid S3_URL_EXPIRY: %w", err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return newMediaStorage(config, config.Prefix+"/")
+}
+
+// Returns the storage used for the media of the user, the user's own
+// configuration when set or the global storage otherwise. Returns nil when
+// media is sent base64 encoded.
+func getMediaStorage(db *sqlx.DB, userID string) *mediaStorage {
+	if cached, found := storagecache.Get(userID); found {
+		return cached.(*mediaStorage)
+	}
+	storage := globalStorage
+	var config S3Config
+	err := db.Get(&config, "SELECT "+s3ConfigColumns+" FROM s3_config WHERE user_id=$1", userID)
+	if err == nil {
+		storage = nil
+		if config.Enabled {
+			storage, err = newMediaStorage(config, userStorageScope(config, userID))
+			if err != nil {
+				log.Error().Err(err).Str("userid", userID).Msg("Could not create S3 client, sending media base64 encoded")
+			}
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load S3 settings")
+		return globalStorage
+	}
+	storagecache.Set(userID, storage, cache.DefaultExpiration)
+	return storage
+}
+
+func userStorageScope(config S3Config, userID string) string {
+	return config.Prefix + "/" + userID + "/"
+}
+
+// Message ids and chats come from other clients, parts of the key that are
+// not plain ids are replaced by their hash so they can not leave the scope
+func objectKeyPart(value string) string {
+	if objectKeyPartPattern.MatchString(value) {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (m *mediaStorage) objectKey(userID string, info types.MessageInfo, ext string) string {
+	chat := "unknown"
+	if info.Chat.User != "" {
+		chat = objectKeyPart(info.Chat.User)
+	}
+	timestamp := info.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if !objectKeyExtPattern.MatchString(ext) {
+		ext = ""
+	}
+	return path.Join(m.config.Prefix, userID, chat, timestamp.UTC().Format("2006/01/02"), objectKeyPart(info.ID)+ext)
+}
+
+// Uploads a media file and returns the details added to the webhook payload
+func (m *mediaStorage) Upload(ctx context.Context, userID string, info types.MessageInfo, filePath string, mimeType string) (map[string]interface{}, error) {
+	key := m.objectKey(userID, info, filepath.Ext(filePath))
+	upload, err := m.client.FPutObject(ctx, m.config.Bucket, key, filePath, minio.PutObjectOptions{ContentType: mimeType})
+	if err != nil {
+		return nil, fmt.Errorf("upload failed: %w", err)
+	}
+	expiry := time.Duration(m.config.URLExpiry) * time.Second
+	presigned, err := m.client.PresignedGetObject(ctx, m.config.Bucket, key, expiry, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not presign URL: %w", err)
+	}
+	return map[string]interface{}{
+		"bucket":    m.config.Bucket,
+		"key":       key,
+		"url":       presigned.String(),
+		"expiresAt": time.Now().Add(expiry).Unix(),
+		"size":      upload.Size,
+	}, nil
+}
+
+// Checks that the bucket is reachable and writable
+func (m *mediaStorage) Check(ctx context.Context) error {
+	exists, err := m.client.BucketExists(ctx, m.config.Bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", m.config.Bucket)
+	}
+	key := strings.TrimSuffix(m.scope, "/") + "/.wuzapi-check"
+	if _, err := m.client.PutObject(ctx, m.config.Bucket, key, strings.NewReader("ok"), 2, minio.PutObjectOptions{ContentType: "text/plain"}); err != nil {
+		return fmt.Errorf("could not write to bucket: %w", err)
+	}
+	return m.client.RemoveObject(ctx, m.config.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+// Adds, updates or removes the lifecycle rule expiring the objects of the
+// storage scope. Rules of other scopes or not created by wuzapi are kept.
+func (m *mediaStorage) ApplyLifecycle(ctx context.Context) error {
+	sum := sha256.Sum256([]byte(m.scope))
+	ruleID := "wuzapi-expire-" + hex.EncodeToString(sum[:6])
+
+	config, err := m.client.GetBucketLifecycle(ctx, m.config.Bucket)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+			return err
+		}
+		config = lifecycle.NewConfiguration()
+	}
+	rules := config.Rules[:0]
+	found := false
+	for _, rule := range config.Rules {
+		if rule.ID != ruleID {
+			rules = append(rules, rule)
+			continue
+		}
+		found = true
+	}
+	if !found && m.config.RetentionDays == 0 {
+		return nil
+	}
+	if m.config.RetentionDays > 0 {
+		rules = append(rules, lifecycle.Rule{
+			ID:         ruleID,
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Prefix: m.scope},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(m.config.RetentionDays)},
+		})
+	}
+	config.Rules = rules
+	return m.client.SetBucketLifecycle(ctx, m.config.Bucket, config)
+}
+
+// Adds the downloaded media file to the webhook payload, as a presigned URL
+// of the uploaded object when the user has S3 storage and base64 encoded
+// otherwise, and removes the temporary file
+func (mycli *MyClient) attachMedia(postmap map[string]interface{}, info types.MessageInfo, tmpPath string, mimeType string) error {
+	defer func() {
+		err := os.Remove(tmpPath)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to delete temporary file")
+		} else {
+			log.Info().Str("path", tmpPath).Msg("Temporary file deleted")
+		}
+	}()
+
+	if storage := getMediaStorage(mycli.db, mycli.userID); storage != nil {
+		if mimeType == "" {
+			mimeType = detectFileType(tmpPath)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s3UploadTimeout)
+		defer cancel()
+		object, err := storage.Upload(ctx, mycli.userID, info, tmpPath, mimeType)
+		if err == nil {
+			postmap["s3"] = object
+			postmap["mimeType"] = mimeType
+			postmap["fileName"] = filepath.Base(tmpPath)
+			log.Info().Str("path", tmpPath).Str("key", object["key"].(string)).Msg("Media uploaded to S3")
+			return nil
+		}
+		// Better a big payload than losing the media
+		log.Error().Err(err).Str("userid", mycli.userID).Msg("Failed to upload media to S3, sending it base64 encoded")
+	}
+
+	base64String, mimeType, err := fileToBase64(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to convert media to base64: %w", err)
+	}
+	postmap["base64"] = base64String
+	postmap["mimeType"] = mimeType
+	postmap["fileName"] = filepath.Base(tmpPath)
+	log.Info().Str("path", tmpPath).Msg("Media converted to base64")
+	return nil
+}
+
+func detectFileType(filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := file.Read(head)
+	return http.DetectContentType(head[:n])
+}
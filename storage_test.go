@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestS3ConfigValidate(t *testing.T) {
+	config := S3Config{Endpoint: "https://s3.example.com/", Bucket: "media", Prefix: "/media/wuzapi/"}
+	if err := config.validate(); err != nil {
+		t.Fatalf("validate error = %v", err)
+	}
+	if config.Endpoint != "s3.example.com" || !config.UseSSL {
+		t.Errorf("endpoint = %s, ssl %v, want s3.example.com with ssl", config.Endpoint, config.UseSSL)
+	}
+	if config.Prefix != "media/wuzapi" || config.URLExpiry != defaultS3URLExpiry {
+		t.Errorf("prefix = %q, url expiry %d", config.Prefix, config.URLExpiry)
+	}
+
+	plain := S3Config{Endpoint: "http://minio:9000", Bucket: "media", UseSSL: true}
+	if err := plain.validate(); err != nil || plain.Endpoint != "minio:9000" || plain.UseSSL || plain.Prefix != defaultS3Prefix {
+		t.Errorf("http endpoint = %s, ssl %v, prefix %q, error %v", plain.Endpoint, plain.UseSSL, plain.Prefix, err)
+	}
+	hostOnly := S3Config{Endpoint: "minio:9000", Bucket: "media", UseSSL: true}
+	if err := hostOnly.validate(); err != nil || hostOnly.Endpoint != "minio:9000" || !hostOnly.UseSSL {
+		t.Errorf("host endpoint = %s, ssl %v, error %v", hostOnly.Endpoint, hostOnly.UseSSL, err)
+	}
+
+	tests := []struct {
+		name   string
+		config S3Config
+		err    string
+	}{
+		{"no endpoint", S3Config{Bucket: "media"}, "missing endpoint"},
+		{"no bucket", S3Config{Endpoint: "minio:9000"}, "missing bucket"},
+		{"bad scheme", S3Config{Endpoint: "ftp://minio", Bucket: "media"}, "invalid endpoint"},
+		{"path", S3Config{Endpoint: "https://minio/media", Bucket: "media"}, "must not have a path"},
+		{"negative retention", S3Config{Endpoint: "minio", Bucket: "media", RetentionDays: -1}, "retention_days"},
+		{"url expiry too long", S3Config{Endpoint: "minio", Bucket: "media", URLExpiry: maxS3URLExpiry + 1}, "url_expiry must be between"},
+		{"negative url expiry", S3Config{Endpoint: "minio", Bucket: "media", URLExpiry: -5}, "url_expiry must be between"},
+	}
+	for _, tt := range tests {
+		err := tt.config.validate()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: validate error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	storage := &mediaStorage{config: S3Config{Prefix: "wuzapi"}}
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: types.NewJID("5491155554444", types.DefaultUserServer)},
+		ID:            "3EB0C767D26A1D8E5A12",
+		Timestamp:     time.Date(2026, 3, 9, 23, 30, 0, 0, time.FixedZone("UTC-3", -3*60*60)),
+	}
+	// Dated in UTC
+	want := "wuzapi/u1/5491155554444/2026/03/10/3EB0C767D26A1D8E5A12.jpg"
+	if got := storage.objectKey("u1", info, ".jpg"); got != want {
+		t.Errorf("objectKey = %s, want %s", got, want)
+	}
+
+	info.Chat = types.EmptyJID
+	info.Timestamp = time.Time{}
+	got := storage.objectKey("u1", info, "")
+	if want := "wuzapi/u1/unknown/" + time.Now().UTC().Format("2006/01/02") + "/3EB0C767D26A1D8E5A12"; got != want {
+		t.Errorf("objectKey without chat and time = %s, want %s", got, want)
+	}
+
+	// Ids that are not plain are hashed, so the key stays in the scope
+	info.Chat = types.JID{User: "../../other", Server: types.DefaultUserServer}
+	info.ID = "../../../u2/x"
+	info.Timestamp = time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	got = storage.objectKey("u1", info, ".jpg/../../x")
+	parts := strings.Split(got, "/")
+	if len(parts) != 7 || !strings.HasPrefix(got, "wuzapi/u1/") || strings.Contains(got, "..") {
+		t.Errorf("objectKey of unsafe ids = %s", got)
+	}
+	if parts[2] != objectKeyPart("../../other") || parts[6] != objectKeyPart("../../../u2/x") || len(parts[6]) != 32 {
+		t.Errorf("objectKey of unsafe ids = %s, want hashed chat and id", got)
+	}
+
+	if scope := userStorageScope(S3Config{Prefix: "media"}, "u1"); scope != "media/u1/" {
+		t.Errorf("userStorageScope = %s, want media/u1/", scope)
+	}
+}
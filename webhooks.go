@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Besides the main webhook stored in the users table, each user can register
+// any number of extra endpoints in the webhooks table, each one with its own
+// subscribed event types. Enabled endpoints are cached per user id and the
+// cache entry is dropped whenever the user changes them.
+
+var webhookcache = cache.New(5*time.Minute, 10*time.Minute)
+
+// Body formats for webhook deliveries. Form posts the event JSON encoded in
+// the jsonData field (the original behaviour), JSON posts the event itself
+// as an application/json body with the token and instance id as headers.
+const (
+	webhookFormatForm = "form"
+	webhookFormatJSON = "json"
+)
+
+type Webhook struct {
+	Id          string `db:"id"`
+	UserId      string `db:"user_id"`
+	URL         string `db:"url"`
+	Events      string `db:"events"`
+	Enabled     bool   `db:"enabled"`
+	Description string `db:"description"`
+	Format      string `db:"format"`
+	CreatedAt   int64  `db:"created_at"`
+	Filter      string `db:"filter"`
+	Schema      string `db:"schema"`
+}
+
+const webhookColumns = "id, user_id, url, events, enabled, description, format, created_at, filter, schema"
+
+// Checks if the endpoint is subscribed to the given event type
+func (wh Webhook) Subscribed(eventType string) bool {
+	events := strings.Split(wh.Events, ",")
+	return Find(events, eventType) || Find(events, "All")
+}
+
+func (wh Webhook) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          wh.Id,
+		"url":         wh.URL,
+		"events":      strings.Split(wh.Events, ","),
+		"enabled":     wh.Enabled,
+		"description": wh.Description,
+		"format":      wh.Format,
+		"created_at":  wh.CreatedAt,
+		"filter":      eventFilterJSON(wh.Filter),
+		"schema":      wh.Schema,
+	}
+}
+
+// Returns the enabled webhook endpoints of a user
+func getUserWebhooks(db *sqlx.DB, userID string) []Webhook {
+	if cached, found := webhookcache.Get(userID); found {
+		return cached.([]Webhook)
+	}
+	var webhooks []Webhook
+	err := db.Select(&webhooks, "SELECT "+webhookColumns+" FROM webhooks WHERE user_id=$1 AND enabled=1 ORDER BY created_at", userID)
+	if err != nil {
+		log.Error().Err(err).Str("userid", userID).Msg("Could not load webhooks")
+		return nil
+	}
+	webhookcache.Set(userID, webhooks, cache.DefaultExpiration)
+	return webhooks
+}
+
+// Validates a webhook URL, only http and https are allowed
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return errors.New("invalid webhook url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("webhook url must use http or https")
+	}
+	return nil
+}
+
+// Validates a webhook body format, empty means the default form format
+func validateWebhookFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return webhookFormatForm, nil
+	case webhookFormatForm, webhookFormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid webhook format: %s (allowed: form, json)", format)
+}
+
+// Delivery settings of a webhook, resolved when it is sent so changes apply
+// to events that are still waiting in the outbox
+type webhookTarget struct {
+	Secret string
+	Format string
+}
+
+// Returns the delivery settings for the main webhook of a user (empty
+// webhookID), for one of its additional endpoints or for the firehose
+func getWebhookTarget(db *sqlx.DB, userID string, webhookID string) webhookTarget {
+	target := webhookTarget{Format: webhookFormatForm}
+	var err error
+	if webhookID == "" {
+		err = db.QueryRow("SELECT webhook_secret, webhook_format FROM users WHERE id=$1", userID).Scan(&target.Secret, &target.Format)
+	} else if webhookID == firehoseWebhookID {
+		err = db.QueryRow("SELECT secret, format FROM firehose WHERE id=$1", firehoseWebhookID).Scan(&target.Secret, &target.Format)
+	} else {
+		err = db.QueryRow("SELECT u.webhook_secret, w.format FROM webhooks w JOIN users u ON u.id = w.user_id WHERE w.id=$1", webhookID).Scan(&target.Secret, &target.Format)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error().Err(err).Str("userid", userID).Str("webhook", webhookID).Msg("Could not get webhook settings")
+	}
+	return target
+}
+
+// Validates subscribed event types and joins them as stored in the database
+func validateWebhookEvents(events []string) (string, error) {
+	if len(events) == 0 {
+		return "All", nil
+	}
+	var valid []string
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		if !Find(messageTypes, event) {
+			return "", fmt.Errorf("invalid event type: %s", event)
+		}
+		if !Find(valid, event) {
+			valid = append(valid, event)
+		}
+	}
+	return strings.Join(valid, ","), nil
+}
+
+// Builds a sample event of the given type, shaped like the ones sent by
+// myEventHandler, so receivers can be tested without real WhatsApp traffic
+func sampleWebhookEvent(eventType string) (map[string]interface{}, error) {
+	contact := types.NewJID("5491155551234", types.DefaultUserServer)
+	source := types.MessageSource{Chat: contact, Sender: contact, IsFromMe: false}
+	now := time.Now().Truncate(time.Second)
+	messageID := "3EB0C767D26A1D8E5A12"
+	group := types.NewJID("120363312246943103", types.GroupServer)
+	newsletter := types.NewJID("120363144038483540", types.NewsletterServer)
+	call := types.BasicCallMeta{From: contact, Timestamp: now, CallCreator: contact, CallID: "C3D2E1F0A9B8C7D6E5F4A3B2C1D0E9F8"}
+
+	postmap := map[string]interface{}{
+		"type": eventType,
+		"test": true,
+	}
+	switch eventType {
+	case "Message":
+		postmap["event"] = &events.Message{
+			Info: types.MessageInfo{
+				MessageSource: source,
+				ID:            messageID,
+				Type:          "text",
+				PushName:      "Sample Contact",
+				Timestamp:     now,
+			},
+			Message: &waE2E.Message{Conversation: proto.String("This is a test message sent by wuzapi")},
+		}
+	case "ReadReceipt":
+		postmap["state"] = "Read"
+		postmap["event"] = &events.Receipt{
+			MessageSource: types.MessageSource{Chat: contact, Sender: contact},
+			MessageIDs:    []types.MessageID{messageID},
+			Timestamp:     now,
+			Type:          types.ReceiptTypeRead,
+		}
+	case "Presence":
+		postmap["state"] = "online"
+		postmap["event"] = &events.Presence{From: contact}
+	case "ChatPresence":
+		postmap["event"] = &events.ChatPresence{
+			MessageSource: source,
+			State:         types.ChatPresenceComposing,
+			Media:         types.ChatPresenceMediaText,
+		}
+	case "HistorySync":
+		postmap["event"] = &events.HistorySync{
+			Data: &waHistorySync.HistorySync{
+				SyncType: waHistorySync.HistorySync_RECENT.Enum(),
+				Progress: proto.Uint32(100),
+			},
+		}
+	case "CallOffer":
+		postmap["media"] = "audio"
+		postmap["action"] = callActionNone
+		postmap["event"] = &events.CallOffer{BasicCallMeta: call, CallRemoteMeta: types.CallRemoteMeta{RemotePlatform: "android", RemoteVersion: "2.24.10.78"}}
+	case "CallOfferNotice":
+		postmap["media"] = "audio"
+		postmap["action"] = callActionNone
+		postmap["event"] = &events.CallOfferNotice{BasicCallMeta: call, Media: "audio", Type: "group"}
+	case "CallAccept":
+		postmap["event"] = &events.CallAccept{BasicCallMeta: call, CallRemoteMeta: types.CallRemoteMeta{RemotePlatform: "android", RemoteVersion: "2.24.10.78"}}
+	case "CallTerminate":
+		postmap["state"] = "missed"
+		postmap["media"] = "audio"
+		postmap["event"] = &events.CallTerminate{BasicCallMeta: call, Reason: "timeout"}
+	case "CallReject":
+		postmap["event"] = &events.CallReject{BasicCallMeta: call}
+	case "GroupInfo":
+		postmap["event"] = &events.GroupInfo{JID: group, Sender: &contact, Timestamp: now, Join: []types.JID{types.NewJID("5491155554321", types.DefaultUserServer)}}
+	case "JoinedGroup":
+		postmap["event"] = &events.JoinedGroup{Reason: "invite", Sender: &contact, GroupInfo: types.GroupInfo{
+			JID:          group,
+			GroupName:    types.GroupName{Name: "Sample Group"},
+			Participants: []types.GroupParticipant{{JID: contact}},
+		}}
+	case "Picture":
+		postmap["event"] = &events.Picture{JID: contact, Author: contact, Timestamp: now, PictureID: "1714560000"}
+	case "UndecryptableMessage":
+		postmap["event"] = &events.UndecryptableMessage{
+			Info: types.MessageInfo{MessageSource: source, ID: messageID, PushName: "Sample Contact", Timestamp: now},
+		}
+	case "IdentityChange":
+		postmap["event"] = &events.IdentityChange{JID: contact, Timestamp: now}
+	case "Blocklist":
+		postmap["event"] = &events.Blocklist{Changes: []events.BlocklistChange{{JID: contact, Action: events.BlocklistChangeActionBlock}}}
+	case "NewsletterJoin":
+		postmap["event"] = &events.NewsletterJoin{NewsletterMetadata: types.NewsletterMetadata{
+			ID:         newsletter,
+			ThreadMeta: types.NewsletterThreadMetadata{Name: types.NewsletterText{Text: "Sample Channel"}},
+			ViewerMeta: &types.NewsletterViewerMetadata{Mute: types.NewsletterMuteOff, Role: types.NewsletterRoleSubscriber},
+		}}
+	case "NewsletterLeave":
+		postmap["event"] = &events.NewsletterLeave{ID: newsletter, Role: types.NewsletterRoleSubscriber}
+	case "NewsletterMuteChange":
+		postmap["event"] = &events.NewsletterMuteChange{ID: newsletter, Mute: types.NewsletterMuteOn}
+	case "NewsletterLiveUpdate":
+		postmap["event"] = &events.NewsletterLiveUpdate{JID: newsletter, Time: now}
+	case "SendJob":
+		postmap["event"] = &SendJob{
+			Id:         "7a1c3e5f9b2d4a6c",
+			Action:     "send_text",
+			Chat:       contact.String(),
+			MessageId:  messageID,
+			Status:     sendJobSent,
+			Code:       200,
+			Data:       json.RawMessage(fmt.Sprintf(`{"Details":"Sent","Id":%q,"Timestamp":%q}`, messageID, now.Format(time.RFC3339))),
+			CreatedAt:  now.Unix() - 30,
+			FinishedAt: now.Unix(),
+		}
+	default:
+		return nil, fmt.Errorf("no sample available for event type: %s", eventType)
+	}
+	return postmap, nil
+}
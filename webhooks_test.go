@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url string
+		err string
+	}{
+		{"https://example.com/hook", ""},
+		{"http://10.0.0.5:8080/hook?token=x", ""},
+		{"ftp://example.com/hook", "must use http or https"},
+		{"example.com/hook", "invalid webhook url"},
+		{"https://", "invalid webhook url"},
+		{"", "invalid webhook url"},
+		{"http://exa mple.com", "invalid webhook url"},
+	}
+	for _, tt := range tests {
+		err := validateWebhookURL(tt.url)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("validateWebhookURL(%q) error = %v", tt.url, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("validateWebhookURL(%q) error = %v, want %q", tt.url, err, tt.err)
+		}
+	}
+}
+
+func TestValidateWebhookEvents(t *testing.T) {
+	tests := []struct {
+		events []string
+		want   string
+		err    string
+	}{
+		{nil, "All", ""},
+		{[]string{"Message"}, "Message", ""},
+		{[]string{" Message ", "ReadReceipt", "Message"}, "Message,ReadReceipt", ""},
+		{[]string{"All"}, "All", ""},
+		{[]string{"Message", "Unknown"}, "", "invalid event type: Unknown"},
+		{[]string{"message"}, "", "invalid event type: message"},
+		{[]string{""}, "", "invalid event type"},
+	}
+	for _, tt := range tests {
+		got, err := validateWebhookEvents(tt.events)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validateWebhookEvents(%q) error = %v, want %q", tt.events, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("validateWebhookEvents(%q) = %q, %v, want %q", tt.events, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateWebhookFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+		err    string
+	}{
+		{"", webhookFormatForm, ""},
+		{"form", webhookFormatForm, ""},
+		{"json", webhookFormatJSON, ""},
+		{"JSON", "", "invalid webhook format: JSON"},
+		{"xml", "", "invalid webhook format: xml"},
+	}
+	for _, tt := range tests {
+		got, err := validateWebhookFormat(tt.format)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validateWebhookFormat(%q) error = %v, want %q", tt.format, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("validateWebhookFormat(%q) = %q, %v, want %q", tt.format, got, err, tt.want)
+		}
+	}
+}
+
+func TestSampleWebhookEvent(t *testing.T) {
+	for _, eventType := range messageTypes {
+		if eventType == "All" {
+			continue
+		}
+		postmap, err := sampleWebhookEvent(eventType)
+		if err != nil {
+			t.Errorf("sampleWebhookEvent(%s) error = %v", eventType, err)
+			continue
+		}
+		if postmap["type"] != eventType || postmap["test"] != true || postmap["event"] == nil {
+			t.Errorf("sample %s = %v", eventType, postmap)
+		}
+		if _, err := json.Marshal(postmap); err != nil {
+			t.Errorf("sample %s cannot be encoded: %v", eventType, err)
+		}
+	}
+
+	if _, err := sampleWebhookEvent("All"); err == nil {
+		t.Error("sampleWebhookEvent(All) should fail")
+	}
+}
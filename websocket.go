@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// The /ws endpoint streams the session events like /events/stream and
+// accepts commands as JSON frames, answered with frames carrying the same
+// correlation id. Commands run concurrently, so responses may arrive in a
+// different order than the commands were sent.
+
+const (
+	wsMaxMessageSize = 64 << 20
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = 50 * time.Second
+	wsMaxPending     = 8
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Requests are authenticated by token, not by cookies
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type wsEvent struct {
+	Type  string          `json:"type"`
+	Id    uint64          `json:"id"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func (s *server) WebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userinfo := r.Context().Value("userinfo").(Values)
+		txtid := userinfo.Get("Id")
+
+		var lastID uint64
+		if lastEventID := r.URL.Query().Get("lastEventId"); lastEventID != "" {
+			var err error
+			lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("invalid lastEventId"))
+				return
+			}
+		}
+
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade already replied with an error
+			log.Warn().Err(err).Str("userid", txtid).Msg("WebSocket upgrade failed")
+			return
+		}
+		defer conn.Close()
+
+		backlog, events, cancel := eventHub.Subscribe(txtid, lastID)
+		defer cancel()
+
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		results := make(chan CommandResult)
+		readerDone := make(chan struct{})
+
+		conn.SetReadLimit(wsMaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+
+		go func() {
+			defer close(readerDone)
+			pending := make(chan struct{}, wsMaxPending)
+			for {
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+						log.Warn().Err(err).Str("userid", txtid).Msg("WebSocket closed")
+					}
+					return
+				}
+				var cmd Command
+				if err := json.Unmarshal(message, &cmd); err != nil {
+					select {
+					case results <- commandError(cmd, http.StatusBadRequest, errors.New("could not decode command")):
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				select {
+				case pending <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				go func(cmd Command) {
+					defer func() { <-pending }()
+					result := s.runDirectCommand(ctx, userinfo, cmd, directSendMaxWait)
+					select {
+					case results <- result:
+					case <-ctx.Done():
+					}
+				}(cmd)
+			}
+		}()
+
+		write := func(v interface{}) error {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			return conn.WriteJSON(v)
+		}
+		for _, event := range backlog {
+			if err := write(wsEvent{Type: "event", Id: event.Id, Event: event.Type, Data: event.Data}); err != nil {
+				return
+			}
+		}
+
+		ping := time.NewTicker(wsPingPeriod)
+		defer ping.Stop()
+		for {
+			var err error
+			select {
+			case <-readerDone:
+				return
+			case <-ping.C:
+				err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			case result := <-results:
+				err = write(result)
+			case event, ok := <-events:
+				if !ok {
+					// Fell behind or user removed, the client reconnects and resumes
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "event stream interrupted"), time.Now().Add(wsWriteWait))
+					return
+				}
+				err = write(wsEvent{Type: "event", Id: event.Id, Event: event.Type, Data: event.Data})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -43,7 +43,7 @@ type MyClient struct {
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
 func (s *server) connectOnStartup() {
-	rows, err := s.db.Queryx("SELECT id,name,token,jid,webhook,events,proxy_url FROM users WHERE connected=1")
+	rows, err := s.db.Queryx("SELECT id,name,token,jid,webhook,events,proxy_url,webhook_include_token,webhook_filter,webhook_schema FROM users WHERE connected=1")
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 		return
@@ -57,20 +57,26 @@ func (s *server) connectOnStartup() {
 		webhook := ""
 		events := ""
 		proxy_url := ""
-		err = rows.Scan(&txtid, &name, &token, &jid, &webhook, &events, &proxy_url)
+		includeToken := ""
+		webhookFilter := ""
+		webhookSchema := ""
+		err = rows.Scan(&txtid, &name, &token, &jid, &webhook, &events, &proxy_url, &includeToken, &webhookFilter, &webhookSchema)
 		if err != nil {
 			log.Error().Err(err).Msg("DB Problem")
 			return
 		} else {
 			log.Info().Str("token", token).Msg("Connect to Whatsapp on startup")
 			v := Values{map[string]string{
-				"Id":      txtid,
-				"Name":    name,
-				"Jid":     jid,
-				"Webhook": webhook,
-				"Token":   token,
-				"Proxy":   proxy_url,
-				"Events":  events,
+				"Id":            txtid,
+				"Name":          name,
+				"Jid":           jid,
+				"Webhook":       webhook,
+				"Token":         token,
+				"Proxy":         proxy_url,
+				"Events":        events,
+				"IncludeToken":  includeToken,
+				"WebhookFilter": webhookFilter,
+				"WebhookSchema": webhookSchema,
 			}}
 			userinfocache.Set(token, v, cache.NoExpiration)
 			// Gets and set subscription to webhook events
@@ -181,6 +187,7 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 	clientManager.SetWhatsmeowClient(userID, client)
 	mycli := MyClient{client, 1, userID, token, subscriptions, s.db}
 	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
+	clientManager.SetMyClient(userID, &mycli)
 
 	httpClient := resty.New()
 	httpClient.SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
@@ -288,11 +295,14 @@ func (s *server) startClient(userID string, textjid string, token string, subscr
 		}
 	}
 
+	commandQueues.Start(s, userID, token)
+
 	// Keep connected client live until disconnected/killed
 	for {
 		select {
 		case <-killchannel[userID]:
 			log.Info().Str("userid", userID).Msg("Received kill signal")
+			commandQueues.Stop(userID)
 			client.Disconnect()
 			clientManager.DeleteWhatsmeowClient(userID)
 			sqlStmt := `UPDATE users SET qrcode='', connected=0 WHERE id=$1`
@@ -393,6 +403,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
+		storeMessage(mycli.db, mycli.userID, evt, messageSourceLive)
 
 		if !*skipMedia {
 			// try to get Image if any
@@ -424,28 +435,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Convert the image to base64
-				base64String, mimeType, err := fileToBase64(tmpPath)
+				// Upload the image or convert it to base64, and delete the temporary file
+				err = mycli.attachMedia(postmap, evt.Info, tmpPath, img.GetMimetype())
 				if err != nil {
-					log.Error().Err(err).Msg("Failed to convert image to base64")
+					log.Error().Err(err).Msg("Failed to attach image")
 					return
 				}
-
-				// Add the base64 string and other details to the postmap
-				postmap["base64"] = base64String
-				postmap["mimeType"] = mimeType
-				postmap["fileName"] = filepath.Base(tmpPath)
-
-				// Log the successful conversion
-				log.Info().Str("path", tmpPath).Msg("Image converted to base64")
-
-				// Delete the temporary file
-				err = os.Remove(tmpPath)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to delete temporary file")
-				} else {
-					log.Info().Str("path", tmpPath).Msg("Temporary file deleted")
-				}
 			}
 
 			// try to get Audio if any
@@ -483,28 +478,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Convert the audio to base64
-				base64String, mimeType, err := fileToBase64(tmpPath)
+				// Upload the audio or convert it to base64, and delete the temporary file
+				err = mycli.attachMedia(postmap, evt.Info, tmpPath, audio.GetMimetype())
 				if err != nil {
-					log.Error().Err(err).Msg("Failed to convert audio to base64")
+					log.Error().Err(err).Msg("Failed to attach audio")
 					return
 				}
-
-				// Add the base64 string and other details to the postmap
-				postmap["base64"] = base64String
-				postmap["mimeType"] = mimeType
-				postmap["fileName"] = filepath.Base(tmpPath)
-
-				// Log the successful conversion
-				log.Info().Str("path", tmpPath).Msg("Audio converted to base64")
-
-				// Delete the temporary file
-				err = os.Remove(tmpPath)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to delete temporary file")
-				} else {
-					log.Info().Str("path", tmpPath).Msg("Temporary file deleted")
-				}
 			}
 
 			// try to get Document if any
@@ -547,28 +526,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Convert the document to base64
-				base64String, mimeType, err := fileToBase64(tmpPath)
+				// Upload the document or convert it to base64, and delete the temporary file
+				err = mycli.attachMedia(postmap, evt.Info, tmpPath, document.GetMimetype())
 				if err != nil {
-					log.Error().Err(err).Msg("Failed to convert document to base64")
+					log.Error().Err(err).Msg("Failed to attach document")
 					return
 				}
-
-				// Add the base64 string and other details to the postmap
-				postmap["base64"] = base64String
-				postmap["mimeType"] = mimeType
-				postmap["fileName"] = filepath.Base(tmpPath)
-
-				// Log the successful conversion
-				log.Info().Str("path", tmpPath).Msg("Document converted to base64")
-
-				// Delete the temporary file
-				err = os.Remove(tmpPath)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to delete temporary file")
-				} else {
-					log.Info().Str("path", tmpPath).Msg("Temporary file deleted")
-				}
 			}
 
 			// try to get Video if any
@@ -600,34 +563,19 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					return
 				}
 
-				// Convert the video to base64
-				base64String, mimeType, err := fileToBase64(tmpPath)
+				// Upload the video or convert it to base64, and delete the temporary file
+				err = mycli.attachMedia(postmap, evt.Info, tmpPath, video.GetMimetype())
 				if err != nil {
-					log.Error().Err(err).Msg("Failed to convert video to base64")
+					log.Error().Err(err).Msg("Failed to attach video")
 					return
 				}
-
-				// Add the base64 string and other details to the postmap
-				postmap["base64"] = base64String
-				postmap["mimeType"] = mimeType
-				postmap["fileName"] = filepath.Base(tmpPath)
-
-				// Log the successful conversion
-				log.Info().Str("path", tmpPath).Msg("Video converted to base64")
-
-				// Delete the temporary file
-				err = os.Remove(tmpPath)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to delete temporary file")
-				} else {
-					log.Info().Str("path", tmpPath).Msg("Temporary file deleted")
-				}
 			}
 		}
 
 	case *events.Receipt:
 		postmap["type"] = "ReadReceipt"
 		dowebhook = 1
+		trackReceipt(mycli.db, mycli.userID, evt)
 		//if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
 		if evt.Type == types.ReceiptTypeRead || evt.Type == types.ReceiptTypeReadSelf {
 			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%v", evt.Timestamp)).Msg("Message was read")
@@ -662,6 +610,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.HistorySync:
 		postmap["type"] = "HistorySync"
 		dowebhook = 1
+		storeHistorySync(mycli, evt)
 	case *events.AppState:
 		log.Info().Str("index", fmt.Sprintf("%+v", evt.Index)).Str("actionValue", fmt.Sprintf("%+v", evt.SyncActionValue)).Msg("App state event received")
 	case *events.LoggedOut:
@@ -678,66 +627,211 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		dowebhook = 1
 		log.Info().Str("state", fmt.Sprintf("%s", evt.State)).Str("media", fmt.Sprintf("%s", evt.Media)).Str("chat", evt.MessageSource.Chat.String()).Str("sender", evt.MessageSource.Sender.String()).Msg("Chat Presence received")
 	case *events.CallOffer:
+		postmap["type"] = "CallOffer"
+		dowebhook = 1
+		media, isGroup := callOfferDetails(evt.Data)
+		postmap["media"] = media
+		postmap["action"] = mycli.handleCallOffer(evt.BasicCallMeta, media, isGroup)
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer")
 	case *events.CallAccept:
+		postmap["type"] = "CallAccept"
+		dowebhook = 1
+		trackCallAccept(mycli.db, mycli.userID, evt.BasicCallMeta)
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call accept")
 	case *events.CallTerminate:
-		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call terminate")
+		postmap["type"] = "CallTerminate"
+		dowebhook = 1
+		call, state, duration := finishCall(mycli.db, mycli.userID, evt.BasicCallMeta, callStateMissed, evt.Reason)
+		postmap["state"] = state
+		if call != nil {
+			postmap["media"] = call.Media
+		}
+		if state == callStateAnswered {
+			postmap["duration"] = duration
+		}
+		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Str("state", state).Msg("Got call terminate")
+	case *events.CallReject:
+		postmap["type"] = "CallReject"
+		dowebhook = 1
+		finishCall(mycli.db, mycli.userID, evt.BasicCallMeta, callStateRejected, "")
+		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call reject")
 	case *events.CallOfferNotice:
+		postmap["type"] = "CallOfferNotice"
+		dowebhook = 1
+		postmap["media"] = evt.Media
+		postmap["action"] = mycli.handleCallOffer(evt.BasicCallMeta, evt.Media, evt.Type == "group")
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer notice")
 	case *events.CallRelayLatency:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call relay latency")
+	case *events.GroupInfo:
+		postmap["type"] = "GroupInfo"
+		dowebhook = 1
+		log.Info().Str("group", evt.JID.String()).Int("join", len(evt.Join)).Int("leave", len(evt.Leave)).Int("promote", len(evt.Promote)).Int("demote", len(evt.Demote)).Msg("Group info changed")
+	case *events.JoinedGroup:
+		postmap["type"] = "JoinedGroup"
+		dowebhook = 1
+		log.Info().Str("group", evt.JID.String()).Str("reason", evt.Reason).Str("type", evt.Type).Msg("Joined group")
+	case *SendJob:
+		postmap["type"] = "SendJob"
+		dowebhook = 1
+		log.Info().Str("job", evt.Id).Str("id", evt.MessageId).Str("status", evt.Status).Msg("Send job finished")
+	case *events.Picture:
+		postmap["type"] = "Picture"
+		dowebhook = 1
+		log.Info().Str("jid", evt.JID.String()).Bool("remove", evt.Remove).Msg("Picture changed")
+	case *events.UndecryptableMessage:
+		postmap["type"] = "UndecryptableMessage"
+		dowebhook = 1
+		log.Warn().Str("id", evt.Info.ID).Str("chat", evt.Info.Chat.String()).Str("sender", evt.Info.Sender.String()).Bool("unavailable", evt.IsUnavailable).Msg("Could not decrypt message")
+	case *events.IdentityChange:
+		postmap["type"] = "IdentityChange"
+		dowebhook = 1
+		log.Info().Str("jid", evt.JID.String()).Bool("implicit", evt.Implicit).Msg("Identity changed")
+	case *events.Blocklist:
+		postmap["type"] = "Blocklist"
+		dowebhook = 1
+		log.Info().Str("action", string(evt.Action)).Int("changes", len(evt.Changes)).Msg("Blocklist changed")
+	case *events.NewsletterJoin:
+		postmap["type"] = "NewsletterJoin"
+		dowebhook = 1
+		log.Info().Str("newsletter", evt.ID.String()).Msg("Joined newsletter")
+	case *events.NewsletterLeave:
+		postmap["type"] = "NewsletterLeave"
+		dowebhook = 1
+		log.Info().Str("newsletter", evt.ID.String()).Msg("Left newsletter")
+	case *events.NewsletterMuteChange:
+		postmap["type"] = "NewsletterMuteChange"
+		dowebhook = 1
+		log.Info().Str("newsletter", evt.ID.String()).Str("mute", string(evt.Mute)).Msg("Newsletter mute changed")
+	case *events.NewsletterLiveUpdate:
+		postmap["type"] = "NewsletterLiveUpdate"
+		dowebhook = 1
+		log.Info().Str("newsletter", evt.JID.String()).Int("messages", len(evt.Messages)).Msg("Newsletter live update")
 	default:
 		log.Warn().Str("event", fmt.Sprintf("%+v", evt)).Msg("Unhandled event")
 	}
 
 	if dowebhook == 1 {
 		// call webhook
+		eventType := postmap["type"].(string)
 		webhookurl := ""
+		userName := ""
+		includeToken := true
+		webhookFilter := ""
+		webhookSchema := ""
 		myuserinfo, found := userinfocache.Get(mycli.token)
 		if !found {
 			log.Warn().Str("token", mycli.token).Msg("Could not call webhook as there is no user for this token")
 		} else {
 			webhookurl = myuserinfo.(Values).Get("Webhook")
+			userName = myuserinfo.(Values).Get("Name")
+			includeToken = myuserinfo.(Values).Get("IncludeToken") != "0"
+			webhookFilter = myuserinfo.(Values).Get("WebhookFilter")
+			webhookSchema = myuserinfo.(Values).Get("WebhookSchema")
 		}
+		fields := eventFilterFields(postmap)
 
-		if !Find(mycli.subscriptions, postmap["type"].(string)) && !Find(mycli.subscriptions, "All") {
-			log.Warn().Str("type", postmap["type"].(string)).Msg("Skipping webhook. Not subscribed for this type")
+		eventID, err := GenerateRandomID()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to generate event id")
+			return
+		}
+		encoder := newEventEncoder(postmap, eventID, mycli.userID, userName)
+		jsonData, err := encoder.Encode(webhookSchemaV1)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
 			return
 		}
 
-		if webhookurl != "" {
-			log.Info().Str("url", webhookurl).Msg("Calling webhook")
-			jsonData, err := json.Marshal(postmap)
+		subscribed := (Find(mycli.subscriptions, eventType) || Find(mycli.subscriptions, "All")) && getEventFilter(webhookFilter).Match(fields)
+		if subscribed {
+			eventHub.Publish(mycli.userID, eventType, jsonData)
+		}
+
+		webhooks := getUserWebhooks(mycli.db, mycli.userID)
+		firehose := getFirehose(mycli.db)
+		firehoseSubscribed := firehose.Subscribed(eventType) && getEventFilter(firehose.Filter).Match(fields)
+		sinks := publishToSinks(mycli.db, mycli.userID, eventType, fields, encoder)
+		if webhookurl == "" && len(webhooks) == 0 && !firehoseSubscribed {
+			if sinks == 0 {
+				log.Warn().Str("userid", mycli.userID).Msg("No webhook set for user")
+			}
+			return
+		}
+
+		// Form fields sent to the user's webhooks, with the event in the
+		// schema chosen for each of them
+		webhookData := func(schema string) (map[string]string, error) {
+			jsonData, err := encoder.Encode(schema)
 			if err != nil {
+				return nil, err
+			}
+			data := map[string]string{
+				"jsonData": string(jsonData),
+			}
+			if includeToken {
+				data["token"] = mycli.token
+			}
+			// Adicione este log
+			log.Debug().Interface("webhookData", data).Msg("Data being sent to webhook")
+			return data, nil
+		}
+
+		// Delivery and retries are handled by the outbox worker
+		if webhookurl != "" {
+			if !subscribed {
+				log.Warn().Str("type", eventType).Msg("Skipping webhook. Not subscribed for this type or filtered out")
+			} else if data, err := webhookData(webhookSchema); err != nil {
 				log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
 			} else {
-				data := map[string]string{
-					"jsonData": string(jsonData),
-					"token":    mycli.token,
+				log.Info().Str("url", webhookurl).Msg("Calling webhook")
+				err = outbox.Enqueue(mycli.userID, "", webhookurl, eventType, data, path)
+				if err != nil {
+					log.Error().Err(err).Msg("Failed to queue webhook")
 				}
+			}
+		}
 
-				// Adicione este log
-				log.Debug().Interface("webhookData", data).Msg("Data being sent to webhook")
+		for _, wh := range webhooks {
+			if !wh.Subscribed(eventType) || !getEventFilter(wh.Filter).Match(fields) {
+				continue
+			}
+			data, err := webhookData(wh.Schema)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
+				continue
+			}
+			log.Info().Str("url", wh.URL).Str("webhook", wh.Id).Msg("Calling webhook")
+			err = outbox.Enqueue(mycli.userID, wh.Id, wh.URL, eventType, data, path)
+			if err != nil {
+				log.Error().Err(err).Str("webhook", wh.Id).Msg("Failed to queue webhook")
+			}
+		}
 
-				if path == "" {
-					go callHook(webhookurl, data, mycli.userID)
-				} else {
-					// Create a channel to capture error from the goroutine
-					errChan := make(chan error, 1)
-					go func() {
-						err := callHookFile(webhookurl, data, mycli.userID, path)
-						errChan <- err
-					}()
-
-					// Optionally handle the error from the channel
-					if err := <-errChan; err != nil {
-						log.Error().Err(err).Msg("Error calling hook file")
-					}
-				}
+		if firehoseSubscribed {
+			// Tagged with the user, both in the event and as form fields. The
+			// v2 events already carry the instance id and name.
+			var firehoseJSON []byte
+			if firehose.Schema == webhookSchemaV2 {
+				firehoseJSON, err = encoder.Encode(webhookSchemaV2)
+			} else {
+				postmap["userID"] = mycli.userID
+				postmap["userName"] = userName
+				firehoseJSON, err = json.Marshal(postmap)
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
+				return
+			}
+			firehoseData := map[string]string{
+				"jsonData": string(firehoseJSON),
+				"userID":   mycli.userID,
+				"userName": userName,
+			}
+			err = outbox.Enqueue(mycli.userID, firehoseWebhookID, firehose.URL, eventType, firehoseData, path)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to queue firehose webhook")
 			}
-		} else {
-			log.Warn().Str("userid", mycli.userID).Msg("No webhook set for user")
 		}
 	}
 }